@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Roles of organization members, from most to least privileged.
+const (
+	roleOwner      = "owner"
+	roleAdmin      = "admin"
+	roleDispatcher = "dispatcher"
+	roleViewer     = "viewer"
+)
+
+type permission int
+
+const (
+	permViewDevices permission = iota
+	permEditOwnPreferences
+	// permManagePreferences covers reading and editing the preferences of
+	// other members of the organization.
+	permManagePreferences
+	permManageGeofences
+	permManageReports
+	permManageAPIKeys
+	permManageMembers
+	permManageOrganization
+	permViewAudit
+	// permManagePrivacyZones covers seeing privacy zones too, since they
+	// outline the places they hide.
+	permManagePrivacyZones
+	permManageDrivers
+)
+
+var rolePermissions = map[string][]permission{
+	roleViewer: {permViewDevices, permEditOwnPreferences},
+	roleDispatcher: {permViewDevices, permEditOwnPreferences,
+		permManageGeofences, permManageReports, permManageDrivers},
+	roleAdmin: {permViewDevices, permEditOwnPreferences,
+		permManageGeofences, permManageReports, permManageDrivers,
+		permManagePreferences, permManageAPIKeys, permManageMembers,
+		permViewAudit, permManagePrivacyZones},
+	roleOwner: {permViewDevices, permEditOwnPreferences,
+		permManageGeofences, permManageReports, permManageDrivers,
+		permManagePreferences, permManageAPIKeys, permManageMembers,
+		permViewAudit, permManagePrivacyZones, permManageOrganization},
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+var (
+	errUnauthenticated = errors.New("authentication required")
+	errForbidden       = errors.New("permission denied")
+)
+
+// accessConfig decides whether access control applies and who administers
+// the deployment as a whole.
+type accessConfig struct {
+	// Enforce makes every route require an identity allowed by its access
+	// policy. Without it requests are let through so single-tenant
+	// deployments keep working unchanged, except that API tokens are always
+	// checked and held to their scope.
+	Enforce bool
+
+	// AdminUsernames may create organizations, add users to them and
+	// change settings that apply to every tenant, such as retention and
+	// preference templates.
+	AdminUsernames []string
+}
+
+// accessConfigFromEnv reads ACCESS_CONTROL ("enforce" or "off", the
+// default) and ADMIN_USERNAMES (comma-separated).
+func accessConfigFromEnv() (accessConfig, error) {
+	var cfg accessConfig
+	switch v := os.Getenv("ACCESS_CONTROL"); v {
+	case "", "off":
+	case "enforce":
+		cfg.Enforce = true
+	default:
+		return cfg, fmt.Errorf("Invalid ACCESS_CONTROL: %q", v)
+	}
+	for _, username := range strings.Split(os.Getenv("ADMIN_USERNAMES"), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			cfg.AdminUsernames = append(cfg.AdminUsernames, username)
+		}
+	}
+	return cfg, nil
+}
+
+func (c accessConfig) isAdmin(username string) bool {
+	for _, admin := range c.AdminUsernames {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is the caller a request was authenticated as.
+type Principal struct {
+	Username     string
+	PreferenceID int
+
+	// OrganizationID is 0 and Role empty when the user is not a member of
+	// any organization.
+	OrganizationID int
+	Role           string
+
+	// DeploymentAdmin is set for users listed in ADMIN_USERNAMES, and
+	// never for API tokens.
+	DeploymentAdmin bool
+
+	// TokenID is set when the caller authenticated with an API token;
+	// ReadOnly tokens may only make GET requests. Service tokens have no
+	// preference of their own.
+	TokenID  int
+	ReadOnly bool
+}
+
+func (p *Principal) can(perm permission) bool {
+	for _, granted := range rolePermissions[p.Role] {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// principalFromContext returns the caller stored by authorize, or nil for
+// unauthenticated requests.
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// authenticate identifies the caller from an "Authorization: Bearer" API
+// token, a login session cookie, or else the X-Username header, which the
+// proxy in front of the backend is trusted to set unless single sign-on is
+// configured. It returns nil when the request carries no identity.
+func (deps *HandlerDependencies) authenticate(r *http.Request) (*Principal, error) {
+	if token, ok := bearerToken(r); ok {
+		return deps.principalForToken(token)
+	}
+	if p, err := deps.principalForSession(r); p != nil || err != nil {
+		return p, err
+	}
+	if deps.OIDC != nil && !deps.OIDC.cfg.TrustUsernameHeader {
+		return nil, nil
+	}
+	username := strings.TrimSpace(r.Header.Get("X-Username"))
+	if username == "" {
+		return nil, nil
+	}
+	return deps.principalForUsername(username)
+}
+
+// principalForUsername builds the principal of an existing user, including
+// their organization role.
+func (deps *HandlerDependencies) principalForUsername(username string) (*Principal, error) {
+	pref, err := deps.Store.GetPreferenceByUsername(username)
+	if err != nil {
+		if errors.Is(err, errPreferenceNotFound) {
+			return nil, errUnauthenticated
+		}
+		return nil, err
+	}
+
+	p := &Principal{Username: pref.Username, PreferenceID: pref.ID, DeploymentAdmin: deps.Access.isAdmin(pref.Username)}
+	member, err := deps.Organizations.Membership(pref.Username)
+	switch {
+	case err == nil:
+		p.OrganizationID, p.Role = member.OrganizationID, member.Role
+	case !errors.Is(err, errMemberNotFound):
+		return nil, err
+	}
+	return p, nil
+}
+
+// accessPolicy decides whether p may make request r. It is only consulted
+// while access control is enforced, and p is never nil then.
+type accessPolicy func(deps *HandlerDependencies, r *http.Request, p *Principal) error
+
+// authorize wraps a handler with authentication and, when access control is
+// enforced, the route's policy. See accessConfig.
+func (deps *HandlerDependencies) authorize(policy accessPolicy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			next(w, r)
+			return
+		}
+
+		p, err := deps.authenticate(r)
+		if err != nil {
+			writeAccessError(w, err)
+			return
+		}
+		if p != nil {
+			if p.ReadOnly && r.Method != "GET" && r.Method != "HEAD" {
+				writeAccessError(w, errForbidden)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+		}
+
+		if deps.Access.Enforce {
+			if p == nil {
+				writeAccessError(w, errUnauthenticated)
+				return
+			}
+			if err := policy(deps, r, p); err != nil {
+				writeAccessError(w, err)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func writeAccessError(w http.ResponseWriter, err error) {
+	setCORSHeaders(w)
+	switch {
+	case errors.Is(err, errUnauthenticated):
+		w.Header().Set("WWW-Authenticate", `Bearer realm="myGoApp"`)
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	case errors.Is(err, errForbidden):
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	case errors.Is(err, errPreferenceNotFound):
+		http.Error(w, "Preferences not found", http.StatusNotFound)
+	case errors.Is(err, errReportScheduleNotFound):
+		http.Error(w, "Report schedule not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Failed to check permissions: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// checkPreferenceAccess allows p to read (or, with write, change) pref:
+// their own with permEditOwnPreferences for writes, and those of other
+// members of their organization with permManagePreferences.
+func (deps *HandlerDependencies) checkPreferenceAccess(p *Principal, pref UserPreference, write bool) error {
+	if pref.ID == p.PreferenceID {
+		if write && !p.can(permEditOwnPreferences) {
+			return errForbidden
+		}
+		return nil
+	}
+	return deps.checkManagesUser(p, pref.Username)
+}
+
+// checkManagesUser allows p to act on behalf of another member of their
+// organization.
+func (deps *HandlerDependencies) checkManagesUser(p *Principal, username string) error {
+	if username == p.Username {
+		return nil
+	}
+	if !p.can(permManagePreferences) {
+		return errForbidden
+	}
+	member, err := deps.Organizations.Membership(username)
+	if err != nil {
+		if errors.Is(err, errMemberNotFound) {
+			return errForbidden
+		}
+		return err
+	}
+	if member.OrganizationID != p.OrganizationID {
+		return errForbidden
+	}
+	return nil
+}
+
+// authorizeRequest runs checks from inside a handler for decisions the
+// route policy cannot make, such as those depending on the request body. It
+// succeeds trivially while access control is not enforced.
+func (deps *HandlerDependencies) authorizeRequest(w http.ResponseWriter, r *http.Request, check func(p *Principal) error) bool {
+	if !deps.Access.Enforce {
+		return true
+	}
+	p := principalFromContext(r.Context())
+	if p == nil {
+		writeAccessError(w, errUnauthenticated)
+		return false
+	}
+	if err := check(p); err != nil {
+		writeAccessError(w, err)
+		return false
+	}
+	return true
+}
+
+// checkQueryPreference applies checkPreferenceAccess to the preference
+// device endpoints filter by, ?id= or the caller's own.
+func (deps *HandlerDependencies) checkQueryPreference(r *http.Request, p *Principal) error {
+	idParam := r.URL.Query().Get("id")
+	if idParam == "" {
+		return nil
+	}
+	id, err := strconv.Atoi(idParam)
+	if err != nil {
+		// Left for the handler to reject.
+		return nil
+	}
+	pref, err := deps.Store.GetPreference(id)
+	if err != nil {
+		return err
+	}
+	return deps.checkPreferenceAccess(p, pref, false)
+}
+
+// policyDevices guards the device list, device details and history, and
+// distance statistics.
+func policyDevices(deps *HandlerDependencies, r *http.Request, p *Principal) error {
+	if !p.can(permViewDevices) {
+		return errForbidden
+	}
+	return deps.checkQueryPreference(r, p)
+}
+
+// policyPreferences guards /preferences/{id}/..., /preferences/update/{id}
+// and /preferences/by-username/{username}.
+func policyPreferences(deps *HandlerDependencies, r *http.Request, p *Principal) error {
+	var pref UserPreference
+	var err error
+	if strings.HasPrefix(r.URL.Path, "/preferences/by-username/") {
+		username, parseErr := getUsernameFromURL(r.URL.Path)
+		if parseErr != nil {
+			return nil
+		}
+		pref, err = deps.Store.GetPreferenceByUsername(username)
+	} else {
+		rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/preferences/"), "update/")
+		id, parseErr := strconv.Atoi(strings.Split(strings.Trim(rest, "/"), "/")[0])
+		if parseErr != nil {
+			return nil
+		}
+		pref, err = deps.Store.GetPreference(id)
+	}
+	if err != nil {
+		if errors.Is(err, errPreferenceNotFound) && !p.can(permManagePreferences) {
+			// Don't reveal which preferences exist.
+			return errForbidden
+		}
+		return err
+	}
+	return deps.checkPreferenceAccess(p, pref, r.Method != "GET")
+}
+
+// policyGeofences lets every member list geofences; changing them needs
+// permManageGeofences.
+func policyGeofences(deps *HandlerDependencies, r *http.Request, p *Principal) error {
+	if r.Method == "GET" {
+		if !p.can(permViewDevices) {
+			return errForbidden
+		}
+		return nil
+	}
+	if !p.can(permManageGeofences) {
+		return errForbidden
+	}
+	return nil
+}
+
+// policyReports guards the ad hoc reports like the device endpoints, and
+// report schedules by the user they belong to.
+func policyReports(deps *HandlerDependencies, r *http.Request, p *Principal) error {
+	if err := policyDevices(deps, r, p); err != nil {
+		return err
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/reports/"), "/"), "/")
+	if parts[0] != "schedules" {
+		return nil
+	}
+	if r.Method != "GET" && !p.can(permManageReports) {
+		return errForbidden
+	}
+	if len(parts) == 1 {
+		// Listing defaults to the caller's schedules; creating checks the
+		// username in the body.
+		if username := r.URL.Query().Get("username"); username != "" {
+			return deps.checkManagesUser(p, username)
+		}
+		return nil
+	}
+
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil
+	}
+	schedule, err := deps.Reports.Get(id)
+	if err != nil {
+		return err
+	}
+	return deps.checkManagesUser(p, schedule.Username)
+}
+
+// policyAudit restricts the audit log to members who may view it.
+func policyAudit(deps *HandlerDependencies, r *http.Request, p *Principal) error {
+	if !p.can(permViewAudit) {
+		return errForbidden
+	}
+	return nil
+}
+
+// policyRetention leaves how long position history is kept to owners, for
+// their organization's devices, and to deployment admins, for every device.
+func policyRetention(deps *HandlerDependencies, r *http.Request, p *Principal) error {
+	if !p.DeploymentAdmin && !p.can(permManageOrganization) {
+		return errForbidden
+	}
+	return nil
+}
+
+// policyDrivers lets every member see drivers; changing them or their
+// assignments needs permManageDrivers.
+func policyDrivers(deps *HandlerDependencies, r *http.Request, p *Principal) error {
+	if r.Method == "GET" {
+		if !p.can(permViewDevices) {
+			return errForbidden
+		}
+		return nil
+	}
+	if !p.can(permManageDrivers) {
+		return errForbidden
+	}
+	return nil
+}
+
+// policyPrivacyZones restricts privacy zones to members who manage them.
+func policyPrivacyZones(deps *HandlerDependencies, r *http.Request, p *Principal) error {
+	if !p.can(permManagePrivacyZones) {
+		return errForbidden
+	}
+	return nil
+}
+
+// policyTeams lets every member see teams; changing a team's preferences
+// needs permManagePreferences and changing the team permManageMembers.
+func policyTeams(deps *HandlerDependencies, r *http.Request, p *Principal) error {
+	switch {
+	case r.Method == "GET":
+		if !p.can(permViewDevices) {
+			return errForbidden
+		}
+	case strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/preferences"):
+		if !p.can(permManagePreferences) {
+			return errForbidden
+		}
+	case !p.can(permManageMembers):
+		return errForbidden
+	}
+	return nil
+}
+
+// policyPreferenceTemplates lets members with permManagePreferences see
+// templates, but leaves changing them to deployment admins: templates are
+// shared by every organization and decide what every new user sees.
+func policyPreferenceTemplates(deps *HandlerDependencies, r *http.Request, p *Principal) error {
+	if p.DeploymentAdmin {
+		return nil
+	}
+	if r.Method != "GET" || !p.can(permManagePreferences) {
+		return errForbidden
+	}
+	return nil
+}
+
+// policyIdentified only requires an identity. The organization and token
+// handlers check roles themselves, since for example deployment admins may
+// create an organization without belonging to one.
+func policyIdentified(deps *HandlerDependencies, r *http.Request, p *Principal) error {
+	return nil
+}
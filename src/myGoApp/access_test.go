@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testRoles = []string{roleOwner, roleAdmin, roleDispatcher, roleViewer}
+
+// accessFixture has two organizations. The caller is the member of the
+// first with each role in turn, "own" targets are another member of it and
+// "other" targets a member of the second.
+type accessFixture struct {
+	db          *sql.DB
+	deps        *HandlerDependencies
+	replacer    *strings.Replacer
+	ownOrg      int
+	otherOrg    int
+	preferences map[string]int
+	geofences   map[int]int
+}
+
+func newAccessFixture(t *testing.T) *accessFixture {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "access.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	deps := &HandlerDependencies{Store: newMemoryStore(), Access: accessConfig{Enforce: true}}
+	if deps.Organizations, err = newOrganizationStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Audit, err = newAuditLog(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Geofences, err = newGeofenceStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Teams, err = newTeamStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.PreferenceLayers, err = newPreferenceLayerStore(db); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &accessFixture{db: db, deps: deps, preferences: map[string]int{}, geofences: map[int]int{}}
+	usernames := append([]string{"own-target", "other-target"}, testRoles...)
+	for _, username := range usernames {
+		pref, err := deps.Store.CreatePreference(UserPreference{Username: username}, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.preferences[username] = pref.ID
+	}
+
+	own, err := deps.Organizations.Create("Own", roleOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := deps.Organizations.Create("Other", "other-target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ownOrg, f.otherOrg = own.ID, other.ID
+	for _, m := range []struct{ username, role string }{
+		{roleAdmin, roleAdmin}, {roleDispatcher, roleDispatcher}, {roleViewer, roleViewer}, {"own-target", roleViewer},
+	} {
+		if _, err := deps.Organizations.SetMember(own.ID, m.username, m.role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, organizationID := range []int{f.ownOrg, f.otherOrg} {
+		g, err := deps.Geofences.Create(Geofence{OrganizationID: organizationID, Name: "Depot", RadiusMeters: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.geofences[organizationID] = g.ID
+	}
+
+	f.replacer = strings.NewReplacer(
+		"{own}", strconv.Itoa(f.preferences["own-target"]),
+		"{other}", strconv.Itoa(f.preferences["other-target"]),
+		"{ownUser}", "own-target",
+		"{otherUser}", "other-target",
+		"{ownOrg}", strconv.Itoa(f.ownOrg),
+		"{otherOrg}", strconv.Itoa(f.otherOrg),
+		"{ownGeofence}", strconv.Itoa(f.geofences[f.ownOrg]),
+		"{otherGeofence}", strconv.Itoa(f.geofences[f.otherOrg]),
+	)
+	return f
+}
+
+// request sends method and path, with its placeholders filled in, as
+// username ("" for nobody) through authorize and policy to handler.
+func (f *accessFixture) request(policy accessPolicy, handler http.HandlerFunc, username, method, path string) int {
+	r := httptest.NewRequest(method, f.replacer.Replace(path), strings.NewReader("{}"))
+	if username != "" {
+		r.Header.Set("X-Username", username)
+	}
+	w := httptest.NewRecorder()
+	f.deps.authorize(policy, handler)(w, r)
+	return w.Code
+}
+
+// reached stands in for the handler of routes whose access is decided by
+// their policy alone.
+func reached(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// routeAccessCase is a request to a route and the roles allowed to make it.
+// Allowed callers get 200, others denied, by default the 403 of authorize.
+type routeAccessCase struct {
+	method, path string
+	policy       accessPolicy
+	allowed      []string
+	handler      func(deps *HandlerDependencies) http.HandlerFunc
+	denied       int
+}
+
+var (
+	everyone     = testRoles
+	managers     = []string{roleOwner, roleAdmin}
+	dispatchers  = []string{roleOwner, roleAdmin, roleDispatcher}
+	organization = func(deps *HandlerDependencies) http.HandlerFunc { return deps.HandleOrganizations }
+	geofences    = func(deps *HandlerDependencies) http.HandlerFunc { return deps.HandleGeofences }
+)
+
+var routeAccessCases = []routeAccessCase{
+	{method: "GET", path: "/", policy: policyDevices, allowed: everyone},
+	{method: "GET", path: "/?id={own}", policy: policyDevices, allowed: managers},
+	{method: "GET", path: "/?id={other}", policy: policyDevices},
+	{method: "GET", path: "/devices/dev-1/points?id={own}", policy: policyDevices, allowed: managers},
+	{method: "GET", path: "/devices/dev-1/points?id={other}", policy: policyDevices},
+	{method: "GET", path: "/devices/nearest?lat=1&lng=1", policy: policyDevices, allowed: everyone},
+	{method: "GET", path: "/stats/distance?id={own}", policy: policyDevices, allowed: managers},
+	{method: "GET", path: "/stats/distance?id={other}", policy: policyDevices},
+
+	{method: "GET", path: "/preferences/{own}", policy: policyPreferences, allowed: managers},
+	{method: "GET", path: "/preferences/{other}", policy: policyPreferences},
+	{method: "POST", path: "/preferences/update/{own}", policy: policyPreferences, allowed: managers},
+	{method: "POST", path: "/preferences/update/{other}", policy: policyPreferences},
+	{method: "GET", path: "/preferences/by-username/{ownUser}", policy: policyPreferences, allowed: managers},
+	{method: "GET", path: "/preferences/by-username/{otherUser}", policy: policyPreferences},
+
+	{method: "GET", path: "/reports/trips?id={own}", policy: policyReports, allowed: managers},
+	{method: "GET", path: "/reports/trips?id={other}", policy: policyReports},
+	{method: "GET", path: "/reports/schedules", policy: policyReports, allowed: everyone},
+	{method: "POST", path: "/reports/schedules", policy: policyReports, allowed: dispatchers},
+	{method: "GET", path: "/reports/schedules?username={ownUser}", policy: policyReports, allowed: managers},
+	{method: "GET", path: "/reports/schedules?username={otherUser}", policy: policyReports},
+
+	{method: "GET", path: "/geofences", policy: policyGeofences, allowed: everyone},
+	{method: "POST", path: "/geofences", policy: policyGeofences, allowed: dispatchers},
+	{method: "GET", path: "/geofences/{ownGeofence}", policy: policyGeofences, allowed: everyone, handler: geofences},
+	{method: "GET", path: "/geofences/{otherGeofence}", policy: policyGeofences, handler: geofences, denied: http.StatusNotFound},
+	{method: "GET", path: "/audit", policy: policyAudit, allowed: managers},
+	{method: "GET", path: "/retention", policy: policyRetention, allowed: []string{roleOwner}},
+	{method: "POST", path: "/retention", policy: policyRetention, allowed: []string{roleOwner}},
+	{method: "GET", path: "/privacy-zones", policy: policyPrivacyZones, allowed: managers},
+	{method: "POST", path: "/privacy-zones", policy: policyPrivacyZones, allowed: managers},
+	{method: "GET", path: "/drivers", policy: policyDrivers, allowed: everyone},
+	{method: "POST", path: "/drivers", policy: policyDrivers, allowed: dispatchers},
+	{method: "GET", path: "/teams", policy: policyTeams, allowed: everyone},
+	{method: "POST", path: "/teams", policy: policyTeams, allowed: managers},
+	{method: "PUT", path: "/teams/1/preferences", policy: policyTeams, allowed: managers},
+	{method: "GET", path: "/preference-templates", policy: policyPreferenceTemplates, allowed: managers},
+	{method: "POST", path: "/preference-templates", policy: policyPreferenceTemplates},
+
+	// Organization routes leave the checks to their handler; other
+	// organizations look missing.
+	{method: "GET", path: "/orgs/{ownOrg}", policy: policyIdentified, allowed: everyone, handler: organization},
+	{method: "GET", path: "/orgs/{otherOrg}", policy: policyIdentified, handler: organization, denied: http.StatusNotFound},
+	{method: "GET", path: "/orgs/{ownOrg}/members", policy: policyIdentified, allowed: everyone, handler: organization},
+	{method: "GET", path: "/orgs/{otherOrg}/members", policy: policyIdentified, handler: organization, denied: http.StatusNotFound},
+	{method: "DELETE", path: "/orgs/{otherOrg}", policy: policyIdentified, handler: organization, denied: http.StatusNotFound},
+	{method: "POST", path: "/orgs", policy: policyIdentified, handler: organization, denied: http.StatusForbidden},
+}
+
+func (c routeAccessCase) handlerFor(deps *HandlerDependencies) http.HandlerFunc {
+	if c.handler == nil {
+		return reached
+	}
+	return c.handler(deps)
+}
+
+func TestRouteAccessByRole(t *testing.T) {
+	f := newAccessFixture(t)
+	for _, c := range routeAccessCases {
+		for _, role := range testRoles {
+			want := http.StatusForbidden
+			if c.denied != 0 {
+				want = c.denied
+			}
+			if contains(c.allowed, role) {
+				want = http.StatusOK
+			}
+			if got := f.request(c.policy, c.handlerFor(f.deps), role, c.method, c.path); got != want {
+				t.Errorf("%s %s as %s: %d, want %d", c.method, c.path, role, got, want)
+			}
+		}
+	}
+}
+
+func TestRouteAccessNeedsAuthentication(t *testing.T) {
+	f := newAccessFixture(t)
+	for _, c := range routeAccessCases {
+		if got := f.request(c.policy, c.handlerFor(f.deps), "", c.method, c.path); got != http.StatusUnauthorized {
+			t.Errorf("%s %s anonymously: %d, want 401", c.method, c.path, got)
+		}
+		if got := f.request(c.policy, c.handlerFor(f.deps), "nobody", c.method, c.path); got != http.StatusUnauthorized {
+			t.Errorf("%s %s as an unknown user: %d, want 401", c.method, c.path, got)
+		}
+	}
+}
+
+// Without ACCESS_CONTROL=enforce policies are skipped, for anonymous
+// callers and members alike. Organization endpoints still need to know who
+// the caller is.
+func TestRouteAccessNotEnforced(t *testing.T) {
+	f := newAccessFixture(t)
+	f.deps.Access.Enforce = false
+	for _, c := range routeAccessCases {
+		if c.handler != nil {
+			continue
+		}
+		for _, username := range []string{"", roleViewer} {
+			if got := f.request(c.policy, reached, username, c.method, c.path); got != http.StatusOK {
+				t.Errorf("%s %s as %q: %d, want 200", c.method, c.path, username, got)
+			}
+		}
+	}
+	if got := f.request(policyIdentified, f.deps.HandleOrganizations, "", "GET", "/orgs/{ownOrg}"); got != http.StatusUnauthorized {
+		t.Errorf("GET /orgs/{ownOrg} anonymously: %d, want 401", got)
+	}
+	if got := f.request(policyIdentified, f.deps.HandleOrganizations, roleViewer, "GET", "/orgs/{otherOrg}"); got != http.StatusNotFound {
+		t.Errorf("GET /orgs/{otherOrg} as a viewer: %d, want 404", got)
+	}
+}
+
+// Geofences of other organizations look missing to every member, even to
+// those who may delete their own.
+func TestGeofencesOfOtherOrganizations(t *testing.T) {
+	f := newAccessFixture(t)
+	for _, role := range dispatchers {
+		if got := f.request(policyGeofences, f.deps.HandleGeofences, role, "DELETE", "/geofences/{otherGeofence}"); got != http.StatusNotFound {
+			t.Errorf("DELETE /geofences/{otherGeofence} as %s: %d, want 404", role, got)
+		}
+	}
+	if _, err := f.deps.Geofences.Get(f.geofences[f.otherOrg]); err != nil {
+		t.Fatalf("other organization's geofence: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/geofences", nil)
+	r.Header.Set("X-Username", roleViewer)
+	w := httptest.NewRecorder()
+	f.deps.authorize(policyGeofences, f.deps.HandleGeofences)(w, r)
+	var listed []Geofence
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != f.geofences[f.ownOrg] {
+		t.Errorf("listed %+v, want only the own organization's geofence", listed)
+	}
+
+	if got := f.request(policyGeofences, f.deps.HandleGeofences, roleDispatcher, "DELETE", "/geofences/{ownGeofence}"); got != http.StatusNoContent {
+		t.Errorf("DELETE /geofences/{ownGeofence} as dispatcher: %d, want 204", got)
+	}
+}
+
+// Organization admins change the roles of their members but cannot add
+// users who belong to no organization; deployment admins can, to any
+// organization.
+func TestAddingUnaffiliatedUsersIsLeftToDeploymentAdmins(t *testing.T) {
+	f := newAccessFixture(t)
+	f.deps.Access.AdminUsernames = []string{"root"}
+	for _, username := range []string{"root", "newcomer"} {
+		if _, err := f.deps.Store.CreatePreference(UserPreference{Username: username}, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setMember := func(caller, path, role string) int {
+		r := httptest.NewRequest("PUT", f.replacer.Replace(path), strings.NewReader(`{"role": "`+role+`"}`))
+		r.Header.Set("X-Username", caller)
+		w := httptest.NewRecorder()
+		f.deps.authorize(policyIdentified, f.deps.HandleOrganizations)(w, r)
+		return w.Code
+	}
+
+	for _, c := range []struct {
+		caller, path, role string
+		want               int
+	}{
+		{roleOwner, "/orgs/{ownOrg}/members/newcomer", roleViewer, http.StatusForbidden},
+		{roleAdmin, "/orgs/{ownOrg}/members/root", roleAdmin, http.StatusForbidden},
+		{roleOwner, "/orgs/{ownOrg}/members/{otherUser}", roleViewer, http.StatusForbidden},
+		{roleAdmin, "/orgs/{ownOrg}/members/{ownUser}", roleDispatcher, http.StatusOK},
+		{"root", "/orgs/999/members/newcomer", roleViewer, http.StatusNotFound},
+		{"root", "/orgs/{otherOrg}/members/newcomer", roleViewer, http.StatusOK},
+		{"root", "/orgs/{ownOrg}/members/{otherUser}", roleViewer, http.StatusConflict},
+	} {
+		if got := setMember(c.caller, c.path, c.role); got != c.want {
+			t.Errorf("PUT %s as %s: %d, want %d", c.path, c.caller, got, c.want)
+		}
+	}
+
+	if _, err := f.deps.Organizations.Membership("root"); !errors.Is(err, errMemberNotFound) {
+		t.Errorf("root membership: %v, want none", err)
+	}
+	if m, err := f.deps.Organizations.Membership("newcomer"); err != nil || m.OrganizationID != f.otherOrg {
+		t.Errorf("newcomer membership %+v, %v, want the other organization", m, err)
+	}
+	owner := &Principal{Username: roleOwner, OrganizationID: f.ownOrg, Role: roleOwner}
+	if err := f.deps.checkManagesUser(owner, "newcomer"); !errors.Is(err, errForbidden) {
+		t.Errorf("owner managing newcomer: %v, want forbidden", err)
+	}
+}
+
+func TestPolicyPreferenceTemplates(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal Principal
+		method    string
+		allowed   bool
+	}{
+		{"deployment admin changes", Principal{DeploymentAdmin: true}, "POST", true},
+		{"deployment admin in no organization reads", Principal{DeploymentAdmin: true}, "GET", true},
+		{"organization owner reads", Principal{OrganizationID: 1, Role: roleOwner}, "GET", true},
+		{"organization owner changes", Principal{OrganizationID: 1, Role: roleOwner}, "PUT", false},
+		{"organization admin deletes", Principal{OrganizationID: 1, Role: roleAdmin}, "DELETE", false},
+		{"dispatcher reads", Principal{OrganizationID: 1, Role: roleDispatcher}, "GET", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/preference-templates", nil)
+			err := policyPreferenceTemplates(&HandlerDependencies{}, r, &tt.principal)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("allowed %v, want %v", allowed, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiTokenPrefix = "mga_"
+
+	// Token kinds. Personal tokens act as the user who created them;
+	// service tokens belong to an organization and carry their own role.
+	tokenPersonal = "personal"
+	tokenService  = "service"
+
+	scopeRead  = "read"
+	scopeWrite = "write"
+
+	// tokenUseResolution limits how often last_used_at is written for a
+	// busy token.
+	tokenUseResolution = time.Minute
+)
+
+var errAPITokenNotFound = errors.New("API token not found")
+
+// APIToken is the stored description of a token. The secret itself is only
+// returned once, when the token is created; the database keeps its SHA-256.
+type APIToken struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Kind   string `json:"type"`
+	Prefix string `json:"prefix"`
+	Scope  string `json:"scope"`
+
+	// Username created the token, and is who a personal token acts as.
+	Username string `json:"username"`
+	// OrganizationID and Role are set for service tokens.
+	OrganizationID int    `json:"organization_id,omitempty"`
+	Role           string `json:"role,omitempty"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (t APIToken) active(now time.Time) bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || now.Before(*t.ExpiresAt))
+}
+
+type apiTokenStore struct {
+	db *sql.DB
+}
+
+func newAPITokenStore(db *sql.DB) (*apiTokenStore, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS api_tokens (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL,
+            kind TEXT NOT NULL,
+            prefix TEXT NOT NULL,
+            hash TEXT UNIQUE NOT NULL,
+            scope TEXT NOT NULL,
+            username TEXT NOT NULL,
+            organization_id INTEGER,
+            role TEXT,
+            created_at DATETIME NOT NULL,
+            expires_at DATETIME,
+            last_used_at DATETIME,
+            revoked_at DATETIME
+        );
+        CREATE INDEX IF NOT EXISTS idx_api_tokens_username ON api_tokens(username);
+        CREATE INDEX IF NOT EXISTS idx_api_tokens_organization ON api_tokens(organization_id);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	return &apiTokenStore{db: db}, nil
+}
+
+const apiTokenColumns = "id, name, kind, prefix, scope, username, organization_id, role, created_at, expires_at, last_used_at, revoked_at"
+
+func scanAPIToken(row interface{ Scan(...any) error }) (APIToken, error) {
+	var t APIToken
+	var organizationID sql.NullInt64
+	var role sql.NullString
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.Name, &t.Kind, &t.Prefix, &t.Scope, &t.Username, &organizationID, &role,
+		&t.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t, err
+		}
+		return t, fmt.Errorf("Database error: %v", err)
+	}
+	t.OrganizationID = int(organizationID.Int64)
+	t.Role = role.String
+	t.CreatedAt = t.CreatedAt.UTC()
+	for _, c := range []struct {
+		value sql.NullTime
+		field **time.Time
+	}{{expiresAt, &t.ExpiresAt}, {lastUsedAt, &t.LastUsedAt}, {revokedAt, &t.RevokedAt}} {
+		if c.value.Valid {
+			v := c.value.Time.UTC()
+			*c.field = &v
+		}
+	}
+	return t, nil
+}
+
+// hashSecret returns the form an API token or session secret is stored in.
+// The secrets are random, so a fast unsalted hash is enough.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create stores t under a new random secret and returns both.
+func (s *apiTokenStore) Create(t APIToken) (APIToken, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return t, "", err
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	t.Prefix = secret[:len(apiTokenPrefix)+6]
+	t.CreatedAt = time.Now().UTC()
+
+	var organizationID, role, expiresAt any
+	if t.Kind == tokenService {
+		organizationID, role = t.OrganizationID, t.Role
+	}
+	if t.ExpiresAt != nil {
+		expiresAt = t.ExpiresAt.UTC()
+	}
+	result, err := s.db.Exec(`
+        INSERT INTO api_tokens(name, kind, prefix, hash, scope, username, organization_id, role, created_at, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.Name, t.Kind, t.Prefix, hashSecret(secret), t.Scope, t.Username, organizationID, role, t.CreatedAt, expiresAt)
+	if err != nil {
+		return t, "", err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return t, "", err
+	}
+	t.ID = int(id)
+	return t, secret, nil
+}
+
+func (s *apiTokenStore) Get(id int) (APIToken, error) {
+	t, err := scanAPIToken(s.db.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return t, fmt.Errorf("No API token found for ID %d: %w", id, errAPITokenNotFound)
+	}
+	return t, err
+}
+
+// Authenticate looks up the active token with the given secret and records
+// that it was used.
+func (s *apiTokenStore) Authenticate(secret string) (APIToken, error) {
+	t, err := scanAPIToken(s.db.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE hash = ?", hashSecret(secret)))
+	if err == sql.ErrNoRows {
+		return t, errAPITokenNotFound
+	}
+	if err != nil {
+		return t, err
+	}
+
+	now := time.Now().UTC()
+	if !t.active(now) {
+		return t, errAPITokenNotFound
+	}
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= tokenUseResolution {
+		if _, err := s.db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now, t.ID); err != nil {
+			return t, fmt.Errorf("Database error: %v", err)
+		}
+		t.LastUsedAt = &now
+	}
+	return t, nil
+}
+
+// List returns the personal tokens of username and, when organizationID is
+// non-zero, the service tokens of that organization, newest first.
+func (s *apiTokenStore) List(username string, organizationID int) ([]APIToken, error) {
+	rows, err := s.db.Query(
+		"SELECT "+apiTokenColumns+" FROM api_tokens WHERE (kind = ? AND username = ?) OR (kind = ? AND organization_id = ?) ORDER BY id DESC",
+		tokenPersonal, username, tokenService, organizationID)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return tokens, nil
+}
+
+// Revoke disables a token for good. Revoked tokens stay listed for
+// reference.
+func (s *apiTokenStore) Revoke(id int) error {
+	result, err := s.db.Exec("UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No active API token found for ID %d: %w", id, errAPITokenNotFound)
+	}
+	return nil
+}
+
+// principalForToken authenticates a bearer token. Personal tokens act as
+// their user with the user's current role; service tokens act with their
+// own role in their organization.
+func (deps *HandlerDependencies) principalForToken(secret string) (*Principal, error) {
+	t, err := deps.Tokens.Authenticate(secret)
+	if err != nil {
+		if errors.Is(err, errAPITokenNotFound) {
+			return nil, errUnauthenticated
+		}
+		return nil, err
+	}
+
+	var p *Principal
+	if t.Kind == tokenService {
+		if _, err := deps.Organizations.Get(t.OrganizationID); err != nil {
+			if errors.Is(err, errOrganizationNotFound) {
+				return nil, errUnauthenticated
+			}
+			return nil, err
+		}
+		p = &Principal{Username: "service:" + t.Name, OrganizationID: t.OrganizationID, Role: t.Role}
+	} else {
+		if p, err = deps.principalForUsername(t.Username); err != nil {
+			return nil, err
+		}
+	}
+	p.TokenID = t.ID
+	p.ReadOnly = t.Scope == scopeRead
+	// Deployment administration needs the admin themselves, not a token.
+	p.DeploymentAdmin = false
+	return p, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(r.Header.Get("Authorization")), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// HandleAPITokens routes GET/POST /tokens and DELETE /tokens/{id}. Tokens
+// can't be managed with a token, so a leaked one can't mint or extend
+// others.
+func (deps *HandlerDependencies) HandleAPITokens(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	p := principalFromContext(r.Context())
+	if p == nil {
+		writeAccessError(w, errUnauthenticated)
+		return
+	}
+	if p.TokenID != 0 && r.Method != "GET" {
+		writeAccessError(w, errForbidden)
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tokens"), "/")
+	if rest == "" {
+		switch r.Method {
+		case "GET":
+			organizationID := 0
+			if p.can(permManageAPIKeys) {
+				organizationID = p.OrganizationID
+			}
+			tokens, err := deps.Tokens.List(p.Username, organizationID)
+			if err != nil {
+				http.Error(w, "Failed to fetch API tokens: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, tokens)
+		case "POST":
+			deps.HandleCreateAPIToken(w, r, p)
+		default:
+			writeMethodNotAllowed(w)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(rest)
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != "DELETE" {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	t, err := deps.Tokens.Get(id)
+	if err != nil {
+		writeAPITokenError(w, err)
+		return
+	}
+	// Users revoke their own personal tokens; API key managers also revoke
+	// their organization's service tokens and its members' personal ones.
+	if t.Kind == tokenService {
+		if t.OrganizationID != p.OrganizationID || !p.can(permManageAPIKeys) {
+			writeAPITokenError(w, errAPITokenNotFound)
+			return
+		}
+	} else if t.Username != p.Username {
+		member, err := deps.Organizations.Membership(t.Username)
+		if err != nil || member.OrganizationID != p.OrganizationID || !p.can(permManageAPIKeys) {
+			writeAPITokenError(w, errAPITokenNotFound)
+			return
+		}
+	}
+
+	if err := deps.Tokens.Revoke(id); err != nil {
+		writeAPITokenError(w, err)
+		return
+	}
+	deps.Audit.Record(r, "token.revoke", "token", id, t, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleCreateAPIToken creates a token from {"name", "type", "scope",
+// "role", "expires_at" or "expires_in"}. Service tokens need
+// permManageAPIKeys and can't be given the owner role.
+func (deps *HandlerDependencies) HandleCreateAPIToken(w http.ResponseWriter, r *http.Request, p *Principal) {
+	var body struct {
+		Name      string     `json:"name"`
+		Kind      string     `json:"type"`
+		Scope     string     `json:"scope"`
+		Role      string     `json:"role"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		ExpiresIn string     `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t := APIToken{Name: strings.TrimSpace(body.Name), Kind: body.Kind, Scope: body.Scope, Username: p.Username}
+	if t.Kind == "" {
+		t.Kind = tokenPersonal
+	}
+	if t.Scope == "" {
+		t.Scope = scopeRead
+	}
+	switch {
+	case t.Name == "":
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	case t.Kind != tokenPersonal && t.Kind != tokenService:
+		http.Error(w, "type must be personal or service", http.StatusBadRequest)
+		return
+	case t.Scope != scopeRead && t.Scope != scopeWrite:
+		http.Error(w, "scope must be read or write", http.StatusBadRequest)
+		return
+	case body.ExpiresAt != nil && body.ExpiresIn != "":
+		http.Error(w, "Specify expires_at or expires_in, not both", http.StatusBadRequest)
+		return
+	}
+
+	t.ExpiresAt = body.ExpiresAt
+	if body.ExpiresIn != "" {
+		d, err := time.ParseDuration(body.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid expires_in: %q", body.ExpiresIn), http.StatusBadRequest)
+			return
+		}
+		expires := time.Now().UTC().Add(d)
+		t.ExpiresAt = &expires
+	}
+	if t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	if t.Kind == tokenService {
+		if !p.can(permManageAPIKeys) {
+			writeAccessError(w, errForbidden)
+			return
+		}
+		t.OrganizationID = p.OrganizationID
+		t.Role = body.Role
+		if t.Role == "" {
+			t.Role = roleViewer
+		}
+		if !validRole(t.Role) || t.Role == roleOwner {
+			http.Error(w, "role must be admin, dispatcher or viewer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	t, secret, err := deps.Tokens.Create(t)
+	if err != nil {
+		http.Error(w, "Failed to create API token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deps.Audit.Record(r, "token.create", "token", t.ID, nil, t)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		APIToken
+		Token string `json:"token"`
+	}{t, secret})
+}
+
+func writeAPITokenError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errAPITokenNotFound) {
+		http.Error(w, "API token not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, "Failed to access API token: "+err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTokenFixture adds an API token store to the access fixture.
+func newTokenFixture(t *testing.T) *accessFixture {
+	f := newAccessFixture(t)
+	var err error
+	if f.deps.Tokens, err = newAPITokenStore(f.db); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// tokenRequest sends a request to handler through authorize and policy,
+// authenticated as username or, if it starts with the token prefix, with
+// that bearer token.
+func (f *accessFixture) tokenRequest(policy accessPolicy, handler http.HandlerFunc, caller, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if strings.HasPrefix(caller, apiTokenPrefix) {
+		r.Header.Set("Authorization", "Bearer "+caller)
+	} else {
+		r.Header.Set("X-Username", caller)
+	}
+	w := httptest.NewRecorder()
+	f.deps.authorize(policy, handler)(w, r)
+	return w
+}
+
+// createToken creates a token through POST /tokens and returns it with its
+// secret.
+func (f *accessFixture) createToken(t *testing.T, username, body string) (APIToken, string) {
+	t.Helper()
+	w := f.tokenRequest(policyIdentified, f.deps.HandleAPITokens, username, "POST", "/tokens", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating token %s as %s: %d %s", body, username, w.Code, w.Body)
+	}
+	var created struct {
+		APIToken
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created.APIToken, created.Token
+}
+
+func TestAPITokensAreStoredHashed(t *testing.T) {
+	f := newTokenFixture(t)
+	token, secret := f.createToken(t, roleViewer, `{"name": "ci"}`)
+
+	if !strings.HasPrefix(secret, apiTokenPrefix) || !strings.HasPrefix(secret, token.Prefix) || len(token.Prefix) >= len(secret) {
+		t.Errorf("secret %q with prefix %q", secret, token.Prefix)
+	}
+	if token.Kind != tokenPersonal || token.Scope != scopeRead || token.Username != roleViewer {
+		t.Errorf("token %+v, want a read-only personal token of the viewer", token)
+	}
+	var hash string
+	if err := f.db.QueryRow("SELECT hash FROM api_tokens WHERE id = ?", token.ID).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if hash != hashSecret(secret) || strings.Contains(hash, secret) {
+		t.Errorf("stored %q, want the SHA-256 of the secret", hash)
+	}
+
+	// The secret is only shown once.
+	w := f.tokenRequest(policyIdentified, f.deps.HandleAPITokens, roleViewer, "GET", "/tokens", "")
+	if strings.Contains(w.Body.String(), secret) || !strings.Contains(w.Body.String(), token.Prefix) {
+		t.Errorf("token list %s, want the prefix but not the secret", w.Body)
+	}
+}
+
+func TestAPITokenScopesAndLifetime(t *testing.T) {
+	f := newTokenFixture(t)
+	_, readOnly := f.createToken(t, roleDispatcher, `{"name": "dashboard"}`)
+	writeToken, write := f.createToken(t, roleDispatcher, `{"name": "sync", "scope": "write", "expires_in": "1h"}`)
+
+	if writeToken.ExpiresAt == nil || time.Until(*writeToken.ExpiresAt) > time.Hour || time.Until(*writeToken.ExpiresAt) < 59*time.Minute {
+		t.Errorf("token expires at %v, want in an hour", writeToken.ExpiresAt)
+	}
+	tests := []struct {
+		caller, method string
+		status         int
+	}{
+		{readOnly, "GET", http.StatusOK},
+		{readOnly, "POST", http.StatusForbidden},
+		{write, "GET", http.StatusOK},
+		{write, "POST", http.StatusOK},
+		{"mga_unknown", "GET", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if w := f.tokenRequest(policyGeofences, reached, tt.caller, tt.method, "/geofences", "{}"); w.Code != tt.status {
+			t.Errorf("%s /geofences with %.12s: %d, want %d", tt.method, tt.caller, w.Code, tt.status)
+		}
+	}
+
+	// Use is recorded.
+	stored, err := f.deps.Tokens.Get(writeToken.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LastUsedAt == nil || time.Since(*stored.LastUsedAt) > time.Minute {
+		t.Errorf("last used at %v, want just now", stored.LastUsedAt)
+	}
+
+	// Expired tokens no longer authenticate, and can't be created.
+	if _, err := f.db.Exec("UPDATE api_tokens SET expires_at = ? WHERE id = ?", time.Now().UTC().Add(-time.Second), writeToken.ID); err != nil {
+		t.Fatal(err)
+	}
+	if w := f.tokenRequest(policyGeofences, reached, write, "GET", "/geofences", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired token answered %d, want 401", w.Code)
+	}
+	past := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	if w := f.tokenRequest(policyIdentified, f.deps.HandleAPITokens, roleDispatcher, "POST", "/tokens", `{"name": "old", "expires_at": "`+past+`"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("creating an expired token answered %d, want 400", w.Code)
+	}
+}
+
+func TestRevokedAPITokens(t *testing.T) {
+	f := newTokenFixture(t)
+	token, secret := f.createToken(t, roleViewer, `{"name": "laptop"}`)
+	path := "/tokens/" + strconv.Itoa(token.ID)
+
+	// Only its user or their organization's API key managers revoke it.
+	if w := f.tokenRequest(policyIdentified, f.deps.HandleAPITokens, roleDispatcher, "DELETE", path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("dispatcher revoking another member's token: %d, want 404", w.Code)
+	}
+	if w := f.tokenRequest(policyIdentified, f.deps.HandleAPITokens, "other-target", "DELETE", path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("owner of another organization revoking the token: %d, want 404", w.Code)
+	}
+	if w := f.tokenRequest(policyIdentified, f.deps.HandleAPITokens, roleAdmin, "DELETE", path, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("admin revoking a member's token: %d %s, want 204", w.Code, w.Body)
+	}
+	if w := f.tokenRequest(policyGeofences, reached, secret, "GET", "/geofences", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token answered %d, want 401", w.Code)
+	}
+	if w := f.tokenRequest(policyIdentified, f.deps.HandleAPITokens, roleViewer, "DELETE", path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("revoking twice answered %d, want 404", w.Code)
+	}
+
+	// Revoked tokens stay listed.
+	var tokens []APIToken
+	w := f.tokenRequest(policyIdentified, f.deps.HandleAPITokens, roleViewer, "GET", "/tokens", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].RevokedAt == nil {
+		t.Errorf("tokens %+v, want the revoked one", tokens)
+	}
+}
+
+func TestAPITokensCantManageTokens(t *testing.T) {
+	f := newTokenFixture(t)
+	other, _ := f.createToken(t, roleOwner, `{"name": "other"}`)
+	_, write := f.createToken(t, roleOwner, `{"name": "automation", "scope": "write"}`)
+
+	tests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/tokens", "", http.StatusOK},
+		{"POST", "/tokens", `{"name": "minted", "scope": "write"}`, http.StatusForbidden},
+		{"DELETE", "/tokens/" + strconv.Itoa(other.ID), "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if w := f.tokenRequest(policyIdentified, f.deps.HandleAPITokens, write, tt.method, tt.path, tt.body); w.Code != tt.status {
+			t.Errorf("%s %s with a token: %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+	}
+	if stored, err := f.deps.Tokens.Get(other.ID); err != nil || stored.RevokedAt != nil {
+		t.Errorf("token revoked (%v) through another token", err)
+	}
+}
+
+func TestServiceTokens(t *testing.T) {
+	f := newTokenFixture(t)
+
+	tests := []struct {
+		caller, body string
+		status       int
+	}{
+		{roleOwner, `{"name": "root", "type": "service", "role": "owner"}`, http.StatusBadRequest},
+		{roleOwner, `{"name": "bad", "type": "service", "role": "superuser"}`, http.StatusBadRequest},
+		{roleDispatcher, `{"name": "mine", "type": "service"}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if w := f.tokenRequest(policyIdentified, f.deps.HandleAPITokens, tt.caller, "POST", "/tokens", tt.body); w.Code != tt.status {
+			t.Errorf("creating %s as %s: %d, want %d", tt.body, tt.caller, w.Code, tt.status)
+		}
+	}
+
+	token, secret := f.createToken(t, roleOwner, `{"name": "exporter", "type": "service", "role": "admin"}`)
+	if token.OrganizationID != f.ownOrg || token.Role != roleAdmin {
+		t.Errorf("service token %+v, want an admin of the owner's organization", token)
+	}
+	// It acts with its own role, not its creator's.
+	if w := f.tokenRequest(policyAudit, reached, secret, "GET", "/audit", ""); w.Code != http.StatusOK {
+		t.Errorf("admin service token reading the audit log: %d, want 200", w.Code)
+	}
+	if w := f.tokenRequest(policyRetention, reached, secret, "GET", "/retention", ""); w.Code != http.StatusForbidden {
+		t.Errorf("admin service token reading retention policies: %d, want 403", w.Code)
+	}
+
+	// The organization's other API key managers see it, its members don't.
+	for caller, want := range map[string]bool{roleAdmin: true, roleViewer: false} {
+		w := f.tokenRequest(policyIdentified, f.deps.HandleAPITokens, caller, "GET", "/tokens", "")
+		if got := strings.Contains(w.Body.String(), `"exporter"`); got != want {
+			t.Errorf("%s sees the service token: %v, want %v", caller, got, want)
+		}
+	}
+}
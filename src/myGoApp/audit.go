@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditEvent records who changed what. Before and After are JSON snapshots
+// of the target, absent for creations and deletions respectively.
+type AuditEvent struct {
+	ID             int             `json:"id"`
+	OccurredAt     time.Time       `json:"occurred_at"`
+	Actor          string          `json:"actor"`
+	TokenID        int             `json:"token_id,omitempty"`
+	OrganizationID int             `json:"organization_id,omitempty"`
+	Action         string          `json:"action"`
+	TargetType     string          `json:"target_type"`
+	TargetID       string          `json:"target_id"`
+	Before         json.RawMessage `json:"before,omitempty"`
+	After          json.RawMessage `json:"after,omitempty"`
+	Request        AuditRequest    `json:"request"`
+}
+
+// AuditRequest is the metadata of the request that caused an event.
+type AuditRequest struct {
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	RemoteAddr string `json:"remote_addr"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+}
+
+// auditFilter selects events for the query API. Zero fields match all.
+type auditFilter struct {
+	OrganizationID int
+	Actor          string
+	Action         string // exact, or a prefix ending in "." such as "geofence."
+	TargetType     string
+	TargetID       string
+	From, To       time.Time
+	BeforeID       int // for paging backwards from the newest
+	Limit          int
+}
+
+// auditLog is the append-only audit_events table. Triggers reject updates
+// and deletes, so rows can only be added.
+type auditLog struct {
+	db *sql.DB
+}
+
+func newAuditLog(db *sql.DB) (*auditLog, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS audit_events (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            occurred_at DATETIME NOT NULL,
+            actor TEXT NOT NULL,
+            token_id INTEGER,
+            organization_id INTEGER,
+            action TEXT NOT NULL,
+            target_type TEXT NOT NULL,
+            target_id TEXT NOT NULL,
+            before TEXT,
+            after TEXT,
+            method TEXT NOT NULL,
+            path TEXT NOT NULL,
+            remote_addr TEXT NOT NULL,
+            user_agent TEXT,
+            request_id TEXT
+        );
+        CREATE INDEX IF NOT EXISTS idx_audit_events_occurred_at ON audit_events(occurred_at);
+        CREATE INDEX IF NOT EXISTS idx_audit_events_target ON audit_events(target_type, target_id);
+        CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+        BEGIN
+            SELECT RAISE(ABORT, 'audit_events is append-only');
+        END;
+        CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+        BEGIN
+            SELECT RAISE(ABORT, 'audit_events is append-only');
+        END;
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	return &auditLog{db: db}, nil
+}
+
+// Record appends an event for a change r made to a target. before and
+// after are marshalled to JSON; pass nil for a side that doesn't exist. The
+// change has already happened, so a failure to record it is logged rather
+// than failing the request.
+func (a *auditLog) Record(r *http.Request, action, targetType string, targetID any, before, after any) {
+	e := AuditEvent{
+		OccurredAt: time.Now().UTC(),
+		Actor:      actorFromRequest(r),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   fmt.Sprint(targetID),
+		Request: AuditRequest{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+			RequestID:  r.Header.Get("X-Request-ID"),
+		},
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.Request.RemoteAddr = host
+	}
+	if p := principalFromContext(r.Context()); p != nil {
+		e.TokenID, e.OrganizationID = p.TokenID, p.OrganizationID
+	}
+
+	var err error
+	if e.Before, err = marshalAuditSnapshot(before); err == nil {
+		e.After, err = marshalAuditSnapshot(after)
+	}
+	if err == nil {
+		err = a.insert(e)
+	}
+	if err != nil {
+		log.Printf("Failed to record audit event %s on %s %s: %v", action, targetType, e.TargetID, err)
+	}
+}
+
+func marshalAuditSnapshot(v any) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+func (a *auditLog) insert(e AuditEvent) error {
+	var tokenID, organizationID, before, after any
+	if e.TokenID != 0 {
+		tokenID = e.TokenID
+	}
+	if e.OrganizationID != 0 {
+		organizationID = e.OrganizationID
+	}
+	if e.Before != nil {
+		before = string(e.Before)
+	}
+	if e.After != nil {
+		after = string(e.After)
+	}
+	_, err := a.db.Exec(`
+        INSERT INTO audit_events(occurred_at, actor, token_id, organization_id, action, target_type, target_id,
+            before, after, method, path, remote_addr, user_agent, request_id)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.OccurredAt, e.Actor, tokenID, organizationID, e.Action, e.TargetType, e.TargetID,
+		before, after, e.Request.Method, e.Request.Path, e.Request.RemoteAddr, e.Request.UserAgent, e.Request.RequestID)
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	return nil
+}
+
+// Query returns the events matching f, newest first. each is called for
+// every event, so exports can stream without holding them all.
+func (a *auditLog) Query(f auditFilter, each func(AuditEvent) error) error {
+	query := `SELECT id, occurred_at, actor, token_id, organization_id, action, target_type, target_id,
+            before, after, method, path, remote_addr, user_agent, request_id
+        FROM audit_events WHERE 1 = 1`
+	var args []any
+	add := func(clause string, arg any) {
+		query += " AND " + clause
+		args = append(args, arg)
+	}
+	if f.OrganizationID != 0 {
+		add("organization_id = ?", f.OrganizationID)
+	}
+	if f.Actor != "" {
+		add("actor = ?", f.Actor)
+	}
+	if strings.HasSuffix(f.Action, ".") {
+		add("substr(action, 1, ?) = ?", len(f.Action))
+		args = append(args, f.Action)
+	} else if f.Action != "" {
+		add("action = ?", f.Action)
+	}
+	if f.TargetType != "" {
+		add("target_type = ?", f.TargetType)
+	}
+	if f.TargetID != "" {
+		add("target_id = ?", f.TargetID)
+	}
+	if !f.From.IsZero() {
+		add("occurred_at >= ?", f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		add("occurred_at < ?", f.To.UTC())
+	}
+	if f.BeforeID != 0 {
+		add("id < ?", f.BeforeID)
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEvent
+		var tokenID, organizationID sql.NullInt64
+		var before, after, userAgent, requestID sql.NullString
+		err := rows.Scan(&e.ID, &e.OccurredAt, &e.Actor, &tokenID, &organizationID, &e.Action, &e.TargetType, &e.TargetID,
+			&before, &after, &e.Request.Method, &e.Request.Path, &e.Request.RemoteAddr, &userAgent, &requestID)
+		if err != nil {
+			return fmt.Errorf("Database error: %v", err)
+		}
+		e.OccurredAt = e.OccurredAt.UTC()
+		e.TokenID, e.OrganizationID = int(tokenID.Int64), int(organizationID.Int64)
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		e.Request.UserAgent, e.Request.RequestID = userAgent.String, requestID.String
+		if err := each(e); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	return nil
+}
+
+// auditPreferenceChange records a change that produced pref, taking the
+// before state from the preference's previous revision.
+func (deps *HandlerDependencies) auditPreferenceChange(r *http.Request, action string, pref UserPreference) {
+	var before any
+	if pref.Version > 1 {
+		if rev, err := deps.Store.GetRevision(pref.ID, pref.Version-1); err == nil {
+			before = rev.Snapshot
+		}
+	}
+	deps.Audit.Record(r, action, "preference", pref.ID, before, pref)
+}
+
+// parseAuditFilter reads ?actor=, ?action=, ?target_type=, ?target_id=,
+// ?from=, ?to= (RFC 3339), ?before_id= and ?limit=.
+func parseAuditFilter(values url.Values) (auditFilter, error) {
+	f := auditFilter{
+		Actor:      values.Get("actor"),
+		Action:     values.Get("action"),
+		TargetType: values.Get("target_type"),
+		TargetID:   values.Get("target_id"),
+	}
+	for name, t := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if v := values.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, fmt.Errorf("Invalid %s: %v", name, err)
+			}
+			*t = parsed
+		}
+	}
+	for name, n := range map[string]*int{"before_id": &f.BeforeID, "limit": &f.Limit} {
+		if v := values.Get(name); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed <= 0 {
+				return f, fmt.Errorf("Invalid %s: %q", name, v)
+			}
+			*n = parsed
+		}
+	}
+	return f, nil
+}
+
+// HandleAudit serves GET /audit, a page of events matching the filters
+// (default 100, at most 1000; page with ?before_id= set to the last ID),
+// and GET /audit/export, every matching event as JSON Lines. Members of an
+// organization only see events caused by its members.
+func (deps *HandlerDependencies) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	f, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p := principalFromContext(r.Context()); p != nil && p.OrganizationID != 0 {
+		f.OrganizationID = p.OrganizationID
+	}
+
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/audit"), "/") {
+	case "":
+		if f.Limit == 0 {
+			f.Limit = defaultAuditLimit
+		}
+		if f.Limit > maxAuditLimit {
+			f.Limit = maxAuditLimit
+		}
+		events := []AuditEvent{}
+		err := deps.Audit.Query(f, func(e AuditEvent) error {
+			events = append(events, e)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, "Failed to fetch audit events: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, events)
+	case "export":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit-`+time.Now().UTC().Format("2006-01-02")+`.jsonl"`)
+		out := bufio.NewWriter(w)
+		enc := json.NewEncoder(out)
+		err := deps.Audit.Query(f, func(e AuditEvent) error {
+			return enc.Encode(e)
+		})
+		if err != nil {
+			// Headers are gone; all that's left is to cut the export short.
+			log.Printf("Failed to export audit events: %v", err)
+		}
+		out.Flush()
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// auditRequest sends a request as username through authorize and policy to
+// handler.
+func (f *accessFixture) auditRequest(policy accessPolicy, handler http.HandlerFunc, username, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("X-Username", username)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	f.deps.authorize(policy, handler)(w, r)
+	return w
+}
+
+// auditEvents queries GET /audit as username.
+func (f *accessFixture) auditEvents(t *testing.T, username, query string) []AuditEvent {
+	t.Helper()
+	w := f.auditRequest(policyAudit, f.deps.HandleAudit, username, "GET", "/audit"+query, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /audit%s as %s: %d %s", query, username, w.Code, w.Body)
+	}
+	var events []AuditEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+// newAuditFixture makes changes in both organizations of the access
+// fixture: the dispatcher creates and deletes a geofence and the viewer
+// edits their preference in the first, and the owner of the second creates
+// a geofence there.
+func newAuditFixture(t *testing.T) *accessFixture {
+	f := newAccessFixture(t)
+	geofence := `{"name": "Yard", "center": {"lat": 1, "lng": 2}, "radius_meters": 150}`
+
+	w := f.auditRequest(policyGeofences, f.deps.HandleGeofences, roleDispatcher, "POST", "/geofences", geofence, "X-Request-ID", "req-1")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating a geofence: %d %s", w.Code, w.Body)
+	}
+	var g Geofence
+	if err := json.Unmarshal(w.Body.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+	if w := f.auditRequest(policyGeofences, f.deps.HandleGeofences, roleDispatcher, "DELETE", "/geofences/"+strconv.Itoa(g.ID), ""); w.Code != http.StatusNoContent {
+		t.Fatalf("deleting a geofence: %d %s", w.Code, w.Body)
+	}
+	id := strconv.Itoa(f.preferences[roleViewer])
+	if w := f.auditRequest(policyPreferences, f.deps.HandleUpdateUserPreference, roleViewer, "POST", "/preferences/update/"+id,
+		`{"username": "viewer", "sortOrder": "status"}`, "If-Match", `"1"`); w.Code != http.StatusOK {
+		t.Fatalf("updating a preference: %d %s", w.Code, w.Body)
+	}
+	if w := f.auditRequest(policyGeofences, f.deps.HandleGeofences, "other-target", "POST", "/geofences", geofence); w.Code != http.StatusCreated {
+		t.Fatalf("creating a geofence in the other organization: %d %s", w.Code, w.Body)
+	}
+	return f
+}
+
+func TestMutationsAreAudited(t *testing.T) {
+	f := newAuditFixture(t)
+	events := f.auditEvents(t, roleOwner, "")
+	if len(events) != 3 {
+		t.Fatalf("owner sees %d events, want the 3 of their organization: %+v", len(events), events)
+	}
+
+	// Newest first.
+	update, deletion, creation := events[0], events[1], events[2]
+	if creation.Action != "geofence.create" || creation.Actor != roleDispatcher || creation.OrganizationID != f.ownOrg {
+		t.Errorf("creation event %+v", creation)
+	}
+	if creation.Before != nil || !strings.Contains(string(creation.After), `"Yard"`) {
+		t.Errorf("creation recorded before %s and after %s, want only after", creation.Before, creation.After)
+	}
+	if creation.Request.Method != "POST" || creation.Request.Path != "/geofences" || creation.Request.RequestID != "req-1" {
+		t.Errorf("creation request %+v", creation.Request)
+	}
+	if deletion.Action != "geofence.delete" || deletion.TargetID != creation.TargetID {
+		t.Errorf("deletion event %+v, want it to target the created geofence", deletion)
+	}
+	if !strings.Contains(string(deletion.Before), `"Yard"`) || deletion.After != nil {
+		t.Errorf("deletion recorded before %s and after %s, want only before", deletion.Before, deletion.After)
+	}
+
+	var before, after UserPreference
+	if update.Action != "preference.update" || json.Unmarshal(update.Before, &before) != nil || json.Unmarshal(update.After, &after) != nil {
+		t.Fatalf("update event %+v", update)
+	}
+	if before.Version != 1 || before.SortOrder != "" || after.Version != 2 || after.SortOrder != "status" {
+		t.Errorf("update recorded version %d %q before and %d %q after", before.Version, before.SortOrder, after.Version, after.SortOrder)
+	}
+
+	// The log is append-only.
+	if _, err := f.db.Exec("UPDATE audit_events SET actor = 'someone-else'"); err == nil {
+		t.Error("updating audit events succeeded")
+	}
+	if _, err := f.db.Exec("DELETE FROM audit_events"); err == nil {
+		t.Error("deleting audit events succeeded")
+	}
+}
+
+func TestAuditOnlyShowsTheReadersOrganization(t *testing.T) {
+	f := newAuditFixture(t)
+	events := f.auditEvents(t, "other-target", "")
+	if len(events) != 1 || events[0].Actor != "other-target" || events[0].OrganizationID != f.otherOrg {
+		t.Errorf("other organization's owner sees %+v, want only their own geofence", events)
+	}
+	if w := f.auditRequest(policyAudit, f.deps.HandleAudit, roleDispatcher, "GET", "/audit", ""); w.Code != http.StatusForbidden {
+		t.Errorf("dispatcher reading the audit log: %d, want 403", w.Code)
+	}
+}
+
+func TestAuditFilters(t *testing.T) {
+	f := newAuditFixture(t)
+	actions := func(events []AuditEvent) string {
+		var names []string
+		for _, e := range events {
+			names = append(names, e.Action)
+		}
+		return strings.Join(names, ",")
+	}
+
+	tests := []struct {
+		query, want string
+	}{
+		{"?action=geofence.", "geofence.delete,geofence.create"},
+		{"?action=geofence.create", "geofence.create"},
+		{"?action=geofence", ""},
+		{"?actor=viewer", "preference.update"},
+		{"?target_type=preference&target_id=" + strconv.Itoa(f.preferences[roleViewer]), "preference.update"},
+		{"?from=2000-01-01T00:00:00Z&to=2100-01-01T00:00:00Z", "preference.update,geofence.delete,geofence.create"},
+		{"?to=2000-01-01T00:00:00Z", ""},
+	}
+	for _, tt := range tests {
+		if got := actions(f.auditEvents(t, roleOwner, tt.query)); got != tt.want {
+			t.Errorf("GET /audit%s: %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	for _, query := range []string{"?from=yesterday", "?limit=0", "?before_id=x"} {
+		if w := f.auditRequest(policyAudit, f.deps.HandleAudit, roleOwner, "GET", "/audit"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /audit%s: %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestAuditPaging(t *testing.T) {
+	f := newAuditFixture(t)
+	var seen []int
+	query := "?limit=2"
+	for page := 0; page < 3; page++ {
+		events := f.auditEvents(t, roleOwner, query)
+		for _, e := range events {
+			seen = append(seen, e.ID)
+		}
+		if len(events) < 2 {
+			break
+		}
+		query = "?limit=2&before_id=" + strconv.Itoa(events[len(events)-1].ID)
+	}
+	if len(seen) != 3 {
+		t.Fatalf("paged through %v, want 3 events", seen)
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i] >= seen[i-1] {
+			t.Errorf("paged through %v, want newest first without repeats", seen)
+		}
+	}
+}
+
+func TestAuditExport(t *testing.T) {
+	f := newAuditFixture(t)
+	w := f.auditRequest(policyAudit, f.deps.HandleAudit, roleOwner, "GET", "/audit/export?action=geofence.", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("export answered %d with %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), ".jsonl") {
+		t.Errorf("export named %q", w.Header().Get("Content-Disposition"))
+	}
+
+	var actions []string
+	lines := bufio.NewScanner(w.Body)
+	for lines.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", lines.Text(), err)
+		}
+		if e.OrganizationID != f.ownOrg {
+			t.Errorf("exported an event of organization %d", e.OrganizationID)
+		}
+		actions = append(actions, e.Action)
+	}
+	if strings.Join(actions, ",") != "geofence.delete,geofence.create" {
+		t.Errorf("exported %v, want the filtered geofence events", actions)
+	}
+}
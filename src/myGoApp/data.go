@@ -1,33 +1,104 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"net/url"
+	"time"
 )
 
-func FetchData(apiKey string) (ApiResponse, error) {
-	resp, err := http.Get("https://track.onestepgps.com/v3/api/public/device?latest_point=true&api-key=" + apiKey)
+// maxUpstreamPages bounds how many pages a single paginated call follows, so
+// a misbehaving cursor cannot loop forever.
+const maxUpstreamPages = 100
+
+// errTooManyPages is returned by paginated calls with more than
+// maxUpstreamPages pages, rather than a silently truncated list.
+var errTooManyPages = errors.New("OneStepGPS returned too many pages")
+
+// upstreamPage is the envelope of paginated OneStepGPS list responses.
+type upstreamPage[T any] struct {
+	Results    []T    `json:"result_list"`
+	NextCursor string `json:"next_cursor"`
+}
+
+// DeviceSource supplies the current device list. UpstreamClient reads it from
+// OneStepGPS; simulatedFleet generates it.
+type DeviceSource interface {
+	FetchData(ctx context.Context) (ApiResponse, error)
+}
+
+func (c *UpstreamClient) FetchData(ctx context.Context) (ApiResponse, error) {
+	var apiResponse ApiResponse
+	err := c.getJSON(ctx, "/v3/api/public/device", url.Values{"latest_point": {"true"}}, &apiResponse)
 	if err != nil {
-		return ApiResponse{}, fmt.Errorf("error making http request: %v", err)
+		return ApiResponse{}, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return ApiResponse{}, fmt.Errorf("received non-200 response code: %d", resp.StatusCode)
+	return apiResponse, nil
+}
+
+func (c *UpstreamClient) FetchDevice(ctx context.Context, deviceID string) (DeviceDetail, error) {
+	var device DeviceDetail
+	err := c.getJSON(ctx, "/v3/api/public/device/"+url.PathEscape(deviceID), url.Values{"latest_point": {"true"}}, &device)
+	if err == nil && c.privacy != nil {
+		c.privacy.maskDevice(&device.Device)
 	}
+	return device, err
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return ApiResponse{}, fmt.Errorf("error reading response body: %v", err)
+// FetchDevicePoints returns the location history of a device between from
+// and to, following pagination.
+func (c *UpstreamClient) FetchDevicePoints(ctx context.Context, deviceID string, from, to time.Time) ([]DevicePoint, error) {
+	points, err := getAllPages[DevicePoint](ctx, c, "/v3/api/public/device-point", url.Values{
+		"device_id":       {deviceID},
+		"dt_tracker_from": {from.UTC().Format(time.RFC3339)},
+		"dt_tracker_to":   {to.UTC().Format(time.RFC3339)},
+	})
+	if err == nil && c.privacy != nil {
+		points = c.privacy.maskPoints(deviceID, points)
 	}
+	return points, err
+}
 
-	var apiResponse ApiResponse
-	err = json.Unmarshal(body, &apiResponse)
-	if err != nil {
-		return ApiResponse{}, fmt.Errorf("error unmarshalling json: %v", err)
+func (c *UpstreamClient) FetchDrivers(ctx context.Context) ([]Driver, error) {
+	return getAllPages[Driver](ctx, c, "/v3/api/public/driver", url.Values{})
+}
+
+// FetchTrips returns the trip report for the given devices (all devices when
+// empty) between from and to.
+func (c *UpstreamClient) FetchTrips(ctx context.Context, deviceIDs []string, from, to time.Time) ([]Trip, error) {
+	query := url.Values{
+		"dt_from": {from.UTC().Format(time.RFC3339)},
+		"dt_to":   {to.UTC().Format(time.RFC3339)},
 	}
+	for _, id := range deviceIDs {
+		query.Add("device_id", id)
+	}
+	trips, err := getAllPages[Trip](ctx, c, "/v3/api/public/report/trip", query)
+	if err == nil && c.privacy != nil {
+		for i := range trips {
+			c.privacy.maskTrip(&trips[i])
+		}
+	}
+	return trips, err
+}
 
-	return apiResponse, nil
+// getAllPages follows the cursors of a paginated call and returns every
+// page's results, or errTooManyPages if there are still more after
+// maxUpstreamPages.
+func getAllPages[T any](ctx context.Context, c *UpstreamClient, path string, query url.Values) ([]T, error) {
+	results := []T{}
+	for page := 0; page < maxUpstreamPages; page++ {
+		var resp upstreamPage[T]
+		if err := c.getJSON(ctx, path, query, &resp); err != nil {
+			return nil, err
+		}
+		results = append(results, resp.Results...)
+		if resp.NextCursor == "" {
+			return results, nil
+		}
+		query.Set("cursor", resp.NextCursor)
+	}
+	return nil, fmt.Errorf("%s has more than %d pages: %w", path, maxUpstreamPages, errTooManyPages)
 }
@@ -3,100 +3,430 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
-func createTables(db *sql.DB) {
+// sqliteStore is the PreferenceStore backed by the local SQLite database.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(db *sql.DB) (*sqliteStore, error) {
+	if err := createTables(db); err != nil {
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// Close is a no-op: the database is owned by main and shared with other
+// subsystems.
+func (s *sqliteStore) Close() error {
+	return nil
+}
+
+func createTables(db *sql.DB) error {
 	_, err := db.Exec(`
         CREATE TABLE IF NOT EXISTS user_preferences (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
             username TEXT UNIQUE NOT NULL,
             sort_order TEXT,
-            hidden_devices TEXT,
-            icon BLOB
+            hidden_devices TEXT, -- legacy JSON array, see migrateHiddenDevicesColumn
+            icon BLOB,
+            version INTEGER NOT NULL DEFAULT 1,
+            created_at DATETIME,
+            updated_at DATETIME
+        );
+    `)
+	if err != nil {
+		return fmt.Errorf("Failed to create tables: %v", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS preference_revisions (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            preference_id INTEGER NOT NULL REFERENCES user_preferences(id),
+            revision INTEGER NOT NULL,
+            actor TEXT NOT NULL,
+            snapshot TEXT NOT NULL,
+            diff TEXT NOT NULL,
+            created_at DATETIME NOT NULL,
+            UNIQUE (preference_id, revision)
         );
     `)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to create tables: %v", err))
+		return fmt.Errorf("Failed to create tables: %v", err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS hidden_devices (
+            preference_id INTEGER NOT NULL REFERENCES user_preferences(id),
+            device_id TEXT NOT NULL,
+            PRIMARY KEY (preference_id, device_id)
+        );
+    `)
+	if err != nil {
+		return fmt.Errorf("Failed to create tables: %v", err)
+	}
+
+	if err := migrateUserPreferences(db); err != nil {
+		return fmt.Errorf("Failed to migrate tables: %v", err)
+	}
+	return nil
+}
+
+// migrateUserPreferences brings databases created by older versions of the
+// backend up to the current user_preferences schema.
+func migrateUserPreferences(db *sql.DB) error {
+	columns := []struct{ name, definition string }{
+		{"username", "TEXT"},
+		{"version", "INTEGER NOT NULL DEFAULT 1"},
+		{"created_at", "DATETIME"},
+		{"updated_at", "DATETIME"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(db, "user_preferences", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+
+	statements := []string{
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_user_preferences_username ON user_preferences(username)`,
+		`UPDATE user_preferences SET created_at = CURRENT_TIMESTAMP WHERE created_at IS NULL`,
+		`UPDATE user_preferences SET updated_at = created_at WHERE updated_at IS NULL`,
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %v", stmt, err)
+		}
+	}
+	return migrateHiddenDevicesColumn(db)
+}
+
+// migrateHiddenDevicesColumn moves hidden devices stored in the legacy JSON
+// hidden_devices column into the hidden_devices table. Migrated rows have the
+// column cleared so the migration runs only once per row.
+func migrateHiddenDevicesColumn(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, hidden_devices FROM user_preferences WHERE hidden_devices IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	legacy := map[int][]string{}
+	for rows.Next() {
+		var id int
+		var hiddenDevices string
+		if err := rows.Scan(&id, &hiddenDevices); err != nil {
+			rows.Close()
+			return err
+		}
+		var ids []string
+		if hiddenDevices != "" {
+			if err := json.Unmarshal([]byte(hiddenDevices), &ids); err != nil {
+				rows.Close()
+				return fmt.Errorf("Failed to unmarshal hidden devices of preference %d: %v", id, err)
+			}
+		}
+		legacy[id] = ids
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, ids := range legacy {
+		for _, deviceID := range ids {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO hidden_devices(preference_id, device_id) VALUES (?, ?)", id, deviceID); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("UPDATE user_preferences SET hidden_devices = NULL WHERE id = ?", id); err != nil {
+			return err
+		}
 	}
+	return tx.Commit()
 }
 
-func getUserPreference(db *sql.DB, id int) (UserPreference, error) {
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// queryer is the subset of *sql.DB and *sql.Tx used to read preferences, so
+// the same code serves plain reads and reads inside an update transaction.
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func (s *sqliteStore) GetPreference(id int) (UserPreference, error) {
+	return getSQLitePreference(s.db, id)
+}
+
+func getSQLitePreference(q queryer, id int) (UserPreference, error) {
 	var pref UserPreference
-	var hiddenDevices string
 
-	err := db.QueryRow("SELECT id, sort_order, hidden_devices, icon FROM user_preferences WHERE id=?", id).Scan(&pref.ID, &pref.SortOrder, &hiddenDevices, &pref.Icon)
+	err := q.QueryRow(`
+        SELECT id, COALESCE(username, ''), sort_order, icon, version, created_at, updated_at
+        FROM user_preferences
+        WHERE id=?`, id).Scan(&pref.ID, &pref.Username, &pref.SortOrder, &pref.Icon, &pref.Version, &pref.CreatedAt, &pref.UpdatedAt)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return pref, fmt.Errorf("No user preference found for ID %d", id)
+			return pref, fmt.Errorf("No user preference found for ID %d: %w", id, errPreferenceNotFound)
 		}
 		return pref, fmt.Errorf("Database error: %v", err)
 	}
 
-	if err := json.Unmarshal([]byte(hiddenDevices), &pref.HiddenDevices); err != nil {
-		return pref, fmt.Errorf("Failed to unmarshal hidden devices: %v", err)
+	pref.HiddenDevices, err = getSQLiteHiddenDevices(q, pref.ID)
+	return pref, err
+}
+
+func getSQLiteHiddenDevices(q queryer, preferenceID int) ([]string, error) {
+	rows, err := q.Query("SELECT device_id FROM hidden_devices WHERE preference_id = ? ORDER BY device_id", preferenceID)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
 	}
+	defer rows.Close()
 
-	return pref, nil
+	hiddenDevices := []string{}
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			return nil, fmt.Errorf("Database error: %v", err)
+		}
+		hiddenDevices = append(hiddenDevices, deviceID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return hiddenDevices, nil
 }
 
-func updateUserPreference(db *sql.DB, pref UserPreference) error {
-	hiddenDevicesJSON, err := json.Marshal(pref.HiddenDevices)
-	if err != nil {
+func replaceSQLiteHiddenDevices(tx *sql.Tx, preferenceID int, hiddenDevices []string) error {
+	if _, err := tx.Exec("DELETE FROM hidden_devices WHERE preference_id = ?", preferenceID); err != nil {
 		return err
 	}
+	for _, deviceID := range hiddenDevices {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO hidden_devices(preference_id, device_id) VALUES (?, ?)", preferenceID, deviceID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) UpdatePreference(pref UserPreference, actor string) (UserPreference, error) {
+	return s.update(pref.ID, pref.Version, actor, func(previous UserPreference) UserPreference {
+		return pref
+	})
+}
+
+func (s *sqliteStore) UpdateHiddenDevices(id int, change HiddenDevicesChange, expectedVersion int, actor string) (UserPreference, error) {
+	return s.update(id, expectedVersion, actor, func(previous UserPreference) UserPreference {
+		next := previous
+		next.HiddenDevices = applyHiddenDevicesChange(previous.HiddenDevices, change)
+		return next
+	})
+}
+
+// update applies mutate to the stored preference inside one transaction,
+// checking expectedVersion (when non-zero) and recording the revision.
+func (s *sqliteStore) update(id, expectedVersion int, actor string, mutate func(previous UserPreference) UserPreference) (UserPreference, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return UserPreference{}, err
+	}
+	defer tx.Rollback()
 
-	result, err := db.Exec(
-		"UPDATE user_preferences SET sort_order = ?, hidden_devices = ?, icon = ? WHERE id = ?",
-		pref.SortOrder, string(hiddenDevicesJSON), pref.Icon, pref.ID,
+	previous, err := getSQLitePreference(tx, id)
+	if err != nil {
+		return previous, err
+	}
+	if expectedVersion != 0 && expectedVersion != previous.Version {
+		return previous, errVersionConflict
+	}
+
+	pref := mutate(copyPreference(previous))
+	pref.ID = previous.ID
+	pref.HiddenDevices = normalizeHiddenDevices(pref.HiddenDevices)
+
+	now := time.Now().UTC()
+	result, err := tx.Exec(
+		"UPDATE user_preferences SET sort_order = ?, icon = ?, version = version + 1, updated_at = ? WHERE id = ? AND version = ?",
+		pref.SortOrder, pref.Icon, now, pref.ID, previous.Version,
 	)
 	if err != nil {
-		return err
+		return pref, err
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return pref, err
 	}
-	
-	return nil
+	if rowsAffected == 0 {
+		return pref, errVersionConflict
+	}
+
+	if err := replaceSQLiteHiddenDevices(tx, pref.ID, pref.HiddenDevices); err != nil {
+		return pref, err
+	}
+
+	pref.Username = previous.Username
+	pref.Version = previous.Version + 1
+	pref.CreatedAt = previous.CreatedAt
+	pref.UpdatedAt = now
+
+	if err := insertPreferenceRevision(tx, previous, pref, actor); err != nil {
+		return pref, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return pref, err
+	}
+	return pref, nil
 }
 
-func createUserPreference(db *sql.DB, pref UserPreference) error {
-	hiddenDevicesJSON, err := json.Marshal(pref.HiddenDevices)
+func (s *sqliteStore) CreatePreference(pref UserPreference, actor string) (UserPreference, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return pref, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	result, err := tx.Exec("INSERT INTO user_preferences(username, sort_order, icon, version, created_at, updated_at) VALUES (?, ?, ?, 1, ?, ?)",
+		pref.Username, pref.SortOrder, pref.Icon, now, now)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return pref, fmt.Errorf("username %s: %w", pref.Username, errUsernameTaken)
+		}
+		return pref, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return pref, err
+	}
+
+	pref.ID = int(id)
+	pref.HiddenDevices = normalizeHiddenDevices(pref.HiddenDevices)
+	pref.Version = 1
+	pref.CreatedAt = now
+	pref.UpdatedAt = now
+
+	if err := replaceSQLiteHiddenDevices(tx, pref.ID, pref.HiddenDevices); err != nil {
+		return pref, err
+	}
+	if err := insertPreferenceRevision(tx, UserPreference{}, pref, actor); err != nil {
+		return pref, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return pref, err
+	}
+	return pref, nil
+}
+
+func (s *sqliteStore) GetPreferenceByUsername(username string) (UserPreference, error) {
+	var pref UserPreference
+
+	err := s.db.QueryRow(`
+        SELECT id, username, sort_order, icon, version, created_at, updated_at
+        FROM user_preferences
+        WHERE username=?`, username).Scan(&pref.ID, &pref.Username, &pref.SortOrder, &pref.Icon, &pref.Version, &pref.CreatedAt, &pref.UpdatedAt)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return pref, fmt.Errorf("No user preference found for username %s: %w", username, errPreferenceNotFound)
+		}
+		return pref, fmt.Errorf("Database error: %v", err)
+	}
+
+	pref.HiddenDevices, err = getSQLiteHiddenDevices(s.db, pref.ID)
+	return pref, err
+}
+
+func insertPreferenceRevision(tx *sql.Tx, before, after UserPreference, actor string) error {
+	snapshot, diff, err := encodeRevision(before, after)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec("INSERT INTO user_preferences(username,sort_order, hidden_devices, icon) VALUES (?, ?, ?)",
-		pref.SortOrder, string(hiddenDevicesJSON), pref.Icon)
+	_, err = tx.Exec("INSERT INTO preference_revisions(preference_id, revision, actor, snapshot, diff, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		after.ID, after.Version, actor, snapshot, diff, after.UpdatedAt)
 	return err
 }
 
-func getUserPreferenceByUsername(db *sql.DB, username string) (UserPreference, error) {
-    var pref UserPreference
-    var hiddenDevices string
-
-    err := db.QueryRow(`
-        SELECT id, username, sort_order, hidden_devices, icon 
-        FROM user_preferences 
-        WHERE username=?`, username).Scan(&pref.ID, &pref.Username, &pref.SortOrder, &hiddenDevices, &pref.Icon)
+func (s *sqliteStore) ListRevisions(preferenceID int) ([]PreferenceRevision, error) {
+	rows, err := s.db.Query(`
+        SELECT preference_id, revision, actor, snapshot, diff, created_at
+        FROM preference_revisions
+        WHERE preference_id = ?
+        ORDER BY revision DESC`, preferenceID)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
 
-    if err != nil {
-        if err == sql.ErrNoRows {
-            return pref, fmt.Errorf("No user preference found for username %s", username)
-        }
-        return pref, fmt.Errorf("Database error: %v", err)
-    }
+	revisions := []PreferenceRevision{}
+	for rows.Next() {
+		rev, err := scanPreferenceRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return revisions, nil
+}
 
-    if hiddenDevices != "" {
-        if err := json.Unmarshal([]byte(hiddenDevices), &pref.HiddenDevices); err != nil {
-            return pref, fmt.Errorf("Failed to unmarshal hidden devices: %v", err)
-        }
-    }
+func (s *sqliteStore) GetRevision(preferenceID, revision int) (PreferenceRevision, error) {
+	row := s.db.QueryRow(`
+        SELECT preference_id, revision, actor, snapshot, diff, created_at
+        FROM preference_revisions
+        WHERE preference_id = ? AND revision = ?`, preferenceID, revision)
 
-    return pref, nil
+	rev, err := scanPreferenceRevision(row)
+	if err == sql.ErrNoRows {
+		return rev, fmt.Errorf("No revision %d found for preference %d: %w", revision, preferenceID, errRevisionNotFound)
+	}
+	return rev, err
 }
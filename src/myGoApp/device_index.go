@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDeviceIndexMaxAge = 15 * time.Second
+	defaultNearestDevices    = 5
+	maxNearestDevices        = 100
+)
+
+// deviceIndex keeps a spatial index over the latest device list. It is
+// rebuilt whenever the device list is fetched, and refetched by spatial
+// queries once it is older than maxAge.
+type deviceIndex struct {
+	source DeviceSource
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	index   *spatialIndex[Device]
+	builtAt time.Time
+}
+
+// newDeviceIndexFromEnv wraps source; DEVICE_INDEX_MAX_AGE overrides how
+// long spatial queries may use a device list (default 15s).
+func newDeviceIndexFromEnv(source DeviceSource) (*deviceIndex, error) {
+	maxAge := defaultDeviceIndexMaxAge
+	if v := os.Getenv("DEVICE_INDEX_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DEVICE_INDEX_MAX_AGE: %v", err)
+		}
+		maxAge = d
+	}
+	return &deviceIndex{source: source, maxAge: maxAge}, nil
+}
+
+// FetchData fetches the device list and rebuilds the index from it, so
+// handlers can use the index in place of the source.
+func (di *deviceIndex) FetchData(ctx context.Context) (ApiResponse, error) {
+	data, err := di.source.FetchData(ctx)
+	if err != nil {
+		return data, err
+	}
+
+	// Hidden devices have no position to search by.
+	var located []Device
+	for _, d := range data.Devices {
+		if d.Privacy != privacyHidden {
+			located = append(located, d)
+		}
+	}
+	index := newSpatialIndex(located, func(d Device) Position { return d.Position })
+	di.mu.Lock()
+	di.index = index
+	di.builtAt = time.Now()
+	di.mu.Unlock()
+	return data, nil
+}
+
+// current returns the index, refreshing it first when it is stale.
+func (di *deviceIndex) current(ctx context.Context) (*spatialIndex[Device], error) {
+	di.mu.Lock()
+	index, builtAt := di.index, di.builtAt
+	di.mu.Unlock()
+
+	if index != nil && time.Since(builtAt) < di.maxAge {
+		return index, nil
+	}
+	if _, err := di.FetchData(ctx); err != nil {
+		return nil, err
+	}
+
+	di.mu.Lock()
+	defer di.mu.Unlock()
+	return di.index, nil
+}
+
+// NearbyDevice is a device with its distance from the queried point.
+type NearbyDevice struct {
+	Device
+	DistanceMeters float64 `json:"distance_meters"`
+}
+
+// HandleNearestDevices returns the k devices nearest to ?lat=&lng=, leaving
+// out the ones the user has hidden or cannot see.
+func (deps *HandlerDependencies) HandleNearestDevices(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	lat, err1 := strconv.ParseFloat(values.Get("lat"), 64)
+	lng, err2 := strconv.ParseFloat(values.Get("lng"), 64)
+	if err1 != nil || err2 != nil || !validLatitude(lat) || !validLongitude(lng) {
+		http.Error(w, "lat and lng must be valid coordinates", http.StatusBadRequest)
+		return
+	}
+	k := defaultNearestDevices
+	if v := values.Get("k"); v != "" {
+		k, err1 = strconv.Atoi(v)
+		if err1 != nil || k < 1 || k > maxNearestDevices {
+			http.Error(w, fmt.Sprintf("k must be between 1 and %d", maxNearestDevices), http.StatusBadRequest)
+			return
+		}
+	}
+
+	pref, ok := deps.preferenceForDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+	index, err := deps.DeviceIndex.current(r.Context())
+	if err != nil {
+		deps.Upstream.writeUpstreamError(w, err)
+		return
+	}
+	visible := deps.visibleToCaller(r, pref)
+
+	matches := index.KNearest(Position{Latitude: lat, Longitude: lng}, k, visible)
+	devices := make([]NearbyDevice, len(matches))
+	for i, m := range matches {
+		m.Item.Address = deps.Geocoder.Address(m.Item.Position)
+		devices[i] = NearbyDevice{Device: m.Item, DistanceMeters: m.DistanceMeters}
+	}
+	writeJSON(w, devices)
+}
+
+// HandleDevicesWithin returns the devices inside ?bbox=minLng,minLat,maxLng,maxLat,
+// leaving out the ones the user has hidden or cannot see.
+func (deps *HandlerDependencies) HandleDevicesWithin(w http.ResponseWriter, r *http.Request) {
+	box, err := parseBoundingBox(r.URL.Query().Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pref, ok := deps.preferenceForDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+	index, err := deps.DeviceIndex.current(r.Context())
+	if err != nil {
+		deps.Upstream.writeUpstreamError(w, err)
+		return
+	}
+	visible := deps.visibleToCaller(r, pref)
+
+	devices := index.Within(box, visible)
+	sort.Slice(devices, func(i, j int) bool { return deviceBefore(devices[i], devices[j]) })
+	deps.Geocoder.addAddresses(devices)
+	writeJSON(w, ApiResponse{Devices: devices, Total: len(devices)})
+}
+
+func visibleDevice(pref UserPreference) func(Device) bool {
+	hidden := make(map[string]bool, len(pref.HiddenDevices))
+	for _, id := range pref.HiddenDevices {
+		hidden[id] = true
+	}
+	return func(d Device) bool { return !hidden[d.ID] }
+}
+
+// visibleToCaller is visibleDevice, also leaving out the devices outside the
+// organization of the caller of r.
+func (deps *HandlerDependencies) visibleToCaller(r *http.Request, pref UserPreference) func(Device) bool {
+	visible := visibleDevice(pref)
+	return func(d Device) bool { return visible(d) && deps.DeviceOrganizations.visible(r.Context(), d.ID) }
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var errOrganizationDeviceNotFound = errors.New("device not assigned to organization")
+
+// OrganizationDevice assigns a device to the organization whose members may
+// see it. A device belongs to at most one organization.
+type OrganizationDevice struct {
+	OrganizationID int       `json:"organization_id"`
+	DeviceID       string    `json:"device_id"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// deviceOrganizations keeps the device_organizations table and decides who
+// sees which device. Members of an organization only see the devices
+// assigned to it; callers outside any organization, such as deployment
+// admins or anyone while access control is off, see every device.
+type deviceOrganizations struct {
+	db *sql.DB
+
+	mu       sync.RWMutex
+	byDevice map[string]int
+}
+
+func newDeviceOrganizations(db *sql.DB) (*deviceOrganizations, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS device_organizations (
+            device_id TEXT PRIMARY KEY,
+            organization_id INTEGER NOT NULL REFERENCES organizations(id),
+            created_at DATETIME NOT NULL
+        );
+        CREATE INDEX IF NOT EXISTS idx_device_organizations_organization
+            ON device_organizations(organization_id);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	s := &deviceOrganizations{db: db}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *deviceOrganizations) reload() error {
+	rows, err := s.db.Query("SELECT device_id, organization_id FROM device_organizations")
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	byDevice := map[string]int{}
+	for rows.Next() {
+		var deviceID string
+		var organizationID int
+		if err := rows.Scan(&deviceID, &organizationID); err != nil {
+			return fmt.Errorf("Database error: %v", err)
+		}
+		byDevice[deviceID] = organizationID
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+
+	s.mu.Lock()
+	s.byDevice = byDevice
+	s.mu.Unlock()
+	return nil
+}
+
+// List returns the devices of an organization.
+func (s *deviceOrganizations) List(organizationID int) ([]OrganizationDevice, error) {
+	rows, err := s.db.Query(
+		"SELECT organization_id, device_id, created_at FROM device_organizations WHERE organization_id = ? ORDER BY device_id",
+		organizationID)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	devices := []OrganizationDevice{}
+	for rows.Next() {
+		var d OrganizationDevice
+		if err := rows.Scan(&d.OrganizationID, &d.DeviceID, &d.CreatedAt); err != nil {
+			return nil, fmt.Errorf("Database error: %v", err)
+		}
+		d.CreatedAt = d.CreatedAt.UTC()
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return devices, nil
+}
+
+// Assign assigns a device to an organization, moving it from the one it
+// belonged to before, if any.
+func (s *deviceOrganizations) Assign(organizationID int, deviceID string) (OrganizationDevice, error) {
+	d := OrganizationDevice{OrganizationID: organizationID, DeviceID: deviceID, CreatedAt: time.Now().UTC()}
+	_, err := s.db.Exec(`
+        INSERT INTO device_organizations(device_id, organization_id, created_at) VALUES (?, ?, ?)
+        ON CONFLICT(device_id) DO UPDATE SET
+            organization_id = excluded.organization_id,
+            created_at = excluded.created_at`,
+		d.DeviceID, d.OrganizationID, d.CreatedAt)
+	if err != nil {
+		return d, fmt.Errorf("Database error: %v", err)
+	}
+	return d, s.reload()
+}
+
+// Unassign takes a device away from an organization.
+func (s *deviceOrganizations) Unassign(organizationID int, deviceID string) error {
+	result, err := s.db.Exec("DELETE FROM device_organizations WHERE organization_id = ? AND device_id = ?", organizationID, deviceID)
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No device %q in organization %d: %w", deviceID, organizationID, errOrganizationDeviceNotFound)
+	}
+	return s.reload()
+}
+
+// allows reports whether members of organizationID may see a device. Every
+// device is allowed for 0.
+func (s *deviceOrganizations) allows(organizationID int, deviceID string) bool {
+	if s == nil || organizationID == 0 {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byDevice[deviceID] == organizationID
+}
+
+// allowsAll reports whether members of organizationID may see every one of
+// deviceIDs.
+func (s *deviceOrganizations) allowsAll(organizationID int, deviceIDs []string) bool {
+	for _, id := range deviceIDs {
+		if !s.allows(organizationID, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// owner returns the organization a device is assigned to, or 0 if none.
+func (s *deviceOrganizations) owner(deviceID string) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byDevice[deviceID]
+}
+
+// visible reports whether the caller in ctx may see a device.
+func (s *deviceOrganizations) visible(ctx context.Context, deviceID string) bool {
+	organizationID := 0
+	if p := principalFromContext(ctx); p != nil {
+		organizationID = p.OrganizationID
+	}
+	return s.allows(organizationID, deviceID)
+}
+
+// scoped wraps a device source so that the device list fetched for a
+// request only has the devices its caller may see.
+func (s *deviceOrganizations) scoped(source DeviceSource) DeviceSource {
+	return &organizationScopedSource{source: source, devices: s}
+}
+
+type organizationScopedSource struct {
+	source  DeviceSource
+	devices *deviceOrganizations
+}
+
+func (s *organizationScopedSource) FetchData(ctx context.Context) (ApiResponse, error) {
+	data, err := s.source.FetchData(ctx)
+	if err != nil {
+		return data, err
+	}
+	visible := make([]Device, 0, len(data.Devices))
+	for _, d := range data.Devices {
+		if s.devices.visible(ctx, d.ID) {
+			visible = append(visible, d)
+		}
+	}
+	data.Devices, data.Total = visible, len(visible)
+	return data, nil
+}
+
+// HandleOrganizationDevices routes GET /orgs/{id}/devices, which members
+// may use, and PUT/DELETE /orgs/{id}/devices/{device_id}, which only
+// deployment admins may.
+func (deps *HandlerDependencies) HandleOrganizationDevices(w http.ResponseWriter, r *http.Request, p *Principal, id int, parts []string) {
+	if len(parts) == 0 {
+		if r.Method != "GET" {
+			writeMethodNotAllowed(w)
+			return
+		}
+		devices, err := deps.DeviceOrganizations.List(id)
+		if err != nil {
+			http.Error(w, "Failed to fetch devices: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, devices)
+		return
+	}
+	if len(parts) > 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	deviceID, err := url.PathUnescape(parts[0])
+	if err != nil || deviceID == "" {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if !p.DeploymentAdmin {
+		writeAccessError(w, errForbidden)
+		return
+	}
+	if _, err := deps.Organizations.Get(id); err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		d, err := deps.DeviceOrganizations.Assign(id, deviceID)
+		if err != nil {
+			http.Error(w, "Failed to assign device: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deps.Audit.Record(r, "organization.device.assign", "device", deviceID, nil, d)
+		writeJSON(w, d)
+	case "DELETE":
+		if err := deps.DeviceOrganizations.Unassign(id, deviceID); err != nil {
+			if errors.Is(err, errOrganizationDeviceNotFound) {
+				http.Error(w, "Device not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Failed to unassign device: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		deps.Audit.Record(r, "organization.device.unassign", "device", deviceID, OrganizationDevice{OrganizationID: id, DeviceID: deviceID}, nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
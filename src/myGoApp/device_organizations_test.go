@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newDeviceScopeFixture adds three devices to the access fixture: one of
+// each organization and one of neither.
+func newDeviceScopeFixture(t *testing.T) *accessFixture {
+	f := newAccessFixture(t)
+	deps := f.deps
+	var err error
+	if deps.DeviceOrganizations, err = newDeviceOrganizations(f.db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Drivers, err = newDriverStore(f.db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Privacy, err = newPrivacyZones(f.db, deps.Drivers); err != nil {
+		t.Fatal(err)
+	}
+	devices := staticDevices{
+		{ID: "own-dev", Name: "Own", Position: Position{Latitude: 1, Longitude: 1}},
+		{ID: "other-dev", Name: "Other", Position: Position{Latitude: 1.001, Longitude: 1.001}},
+		{ID: "loose-dev", Name: "Loose", Position: Position{Latitude: 1.002, Longitude: 1.002}},
+	}
+	if deps.Positions, err = newPositionLogFromEnv(f.db, devices, deps.Privacy); err != nil {
+		t.Fatal(err)
+	}
+	if deps.States, err = newStateTracker(f.db, deps.Positions, defaultDeviceStateConfig(), deps.Privacy); err != nil {
+		t.Fatal(err)
+	}
+	if deps.DeviceIndex, err = newDeviceIndexFromEnv(deps.States); err != nil {
+		t.Fatal(err)
+	}
+	deps.Devices = deps.DeviceOrganizations.scoped(deps.DeviceIndex)
+	if deps.Stats, err = newStatsRollupFromEnv(f.db, deps.Positions); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := deps.DeviceOrganizations.Assign(f.ownOrg, "own-dev"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deps.DeviceOrganizations.Assign(f.otherOrg, "other-dev"); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// deviceIDsIn collects the device IDs of a JSON response, wherever its
+// objects keep them.
+func deviceIDsIn(t *testing.T, body []byte) []string {
+	var ids []string
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for key, value := range v {
+				if id, ok := value.(string); ok && (key == "id" || key == "device_id") && strings.HasSuffix(id, "-dev") {
+					ids = append(ids, id)
+				}
+				walk(value)
+			}
+		case []any:
+			for _, value := range v {
+				walk(value)
+			}
+		}
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	walk(v)
+	sort.Strings(ids)
+	return ids
+}
+
+func TestDevicesOfOtherOrganizations(t *testing.T) {
+	f := newDeviceScopeFixture(t)
+	day := time.Now().UTC().Format(statsDayLayout)
+	for _, id := range []string{"own-dev", "other-dev", "loose-dev"} {
+		if _, err := f.db.Exec("INSERT INTO device_daily_stats(device_id, day, distance_meters, positions, updated_at) VALUES (?, ?, 1000, 2, ?)",
+			id, day, time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Record where the devices are, for their state timelines.
+	if _, err := f.deps.Devices.FetchData(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	deviceRoutes := f.deps.HandleDevices
+	tests := []struct {
+		path    string
+		handler http.HandlerFunc
+		status  int
+		devices []string
+	}{
+		{"/", f.deps.Handler, http.StatusOK, []string{"own-dev"}},
+		{"/devices/nearest?lat=1&lng=1&k=3", deviceRoutes, http.StatusOK, []string{"own-dev"}},
+		{"/devices/within?bbox=0,0,2,2", deviceRoutes, http.StatusOK, []string{"own-dev"}},
+		{"/devices/other-dev", deviceRoutes, http.StatusNotFound, nil},
+		{"/devices/loose-dev", deviceRoutes, http.StatusNotFound, nil},
+		{"/devices/other-dev/points", deviceRoutes, http.StatusNotFound, nil},
+		{"/devices/other-dev/states", deviceRoutes, http.StatusNotFound, nil},
+		{"/devices/own-dev/states", deviceRoutes, http.StatusOK, []string{"own-dev"}},
+		{"/stats/distance", f.deps.HandleStats, http.StatusOK, []string{"own-dev"}},
+		{"/reports/trips?device_id=other-dev", f.deps.HandleReports, http.StatusOK, nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("X-Username", roleViewer)
+		w := httptest.NewRecorder()
+		f.deps.authorize(policyDevices, tt.handler)(w, r)
+		if w.Code != tt.status {
+			t.Errorf("GET %s: %d %s, want %d", tt.path, w.Code, w.Body, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if ids := deviceIDsIn(t, w.Body.Bytes()); strings.Join(ids, ",") != strings.Join(tt.devices, ",") {
+			t.Errorf("GET %s returned devices %v, want %v", tt.path, ids, tt.devices)
+		}
+	}
+
+	// Deployment admins outside any organization see every device.
+	f.deps.Access.AdminUsernames = []string{"root"}
+	if _, err := f.deps.Store.CreatePreference(UserPreference{Username: "root"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Username", "root")
+	w := httptest.NewRecorder()
+	f.deps.authorize(policyIdentified, f.deps.Handler)(w, r)
+	if ids := deviceIDsIn(t, w.Body.Bytes()); len(ids) != 3 {
+		t.Errorf("deployment admin sees %v, want every device", ids)
+	}
+}
+
+// Members may only point drivers and privacy zones at their own devices:
+// a zone on another organization's device would mask it for everyone.
+func TestChangesToDevicesOfOtherOrganizations(t *testing.T) {
+	f := newDeviceScopeFixture(t)
+	driver, err := f.deps.Drivers.Create(DriverProfile{OrganizationID: f.ownOrg, Name: "Dana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	polygon := `[{"lat": 0, "lng": 0}, {"lat": 0, "lng": 2}, {"lat": 2, "lng": 2}]`
+
+	tests := []struct {
+		path   string
+		policy accessPolicy
+		body   string
+		status int
+	}{
+		{"/drivers/" + strconv.Itoa(driver.ID) + "/assignments", policyDrivers, `{"device_id": "other-dev"}`, http.StatusBadRequest},
+		{"/drivers/" + strconv.Itoa(driver.ID) + "/assignments", policyDrivers, `{"device_id": "own-dev"}`, http.StatusCreated},
+		{"/privacy-zones", policyPrivacyZones, `{"name": "Home", "device_id": "other-dev", "mode": "hidden", "polygon": ` + polygon + `}`, http.StatusBadRequest},
+		{"/privacy-zones", policyPrivacyZones, `{"name": "Home", "device_id": "own-dev", "mode": "hidden", "polygon": ` + polygon + `}`, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		handler := f.deps.HandleDrivers
+		if strings.HasPrefix(tt.path, "/privacy-zones") {
+			handler = f.deps.HandlePrivacyZones
+		}
+		r := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+		r.Header.Set("X-Username", roleOwner)
+		w := httptest.NewRecorder()
+		f.deps.authorize(tt.policy, handler)(w, r)
+		if w.Code != tt.status {
+			t.Errorf("POST %s %s: %d %s, want %d", tt.path, tt.body, w.Code, w.Body, tt.status)
+		}
+	}
+}
+
+func TestFleetReportOnlyCoversTheOwnersOrganization(t *testing.T) {
+	f := newDeviceScopeFixture(t)
+	if _, err := f.deps.Devices.FetchData(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pref, err := f.deps.Store.GetPreferenceByUsername(roleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	report, err := f.deps.buildFleetReport(context.Background(), "Fleet", pref, now.Add(-time.Hour), now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Devices) != 1 || report.Devices[0].DeviceID != "own-dev" {
+		t.Errorf("report covers %+v, want only own-dev", report.Devices)
+	}
+}
+
+func TestOrganizationDevicesAreAssignedByDeploymentAdmins(t *testing.T) {
+	f := newDeviceScopeFixture(t)
+	f.deps.Access.AdminUsernames = []string{"root"}
+	if _, err := f.deps.Store.CreatePreference(UserPreference{Username: "root"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		caller, method, path string
+		status               int
+	}{
+		{roleOwner, "PUT", "/orgs/{ownOrg}/devices/loose-dev", http.StatusForbidden},
+		{roleOwner, "DELETE", "/orgs/{ownOrg}/devices/own-dev", http.StatusForbidden},
+		{roleOwner, "PUT", "/orgs/{otherOrg}/devices/other-dev", http.StatusNotFound},
+		{roleViewer, "GET", "/orgs/{otherOrg}/devices", http.StatusNotFound},
+		{"root", "PUT", "/orgs/999/devices/loose-dev", http.StatusNotFound},
+		{"root", "PUT", "/orgs/{ownOrg}/devices/loose-dev", http.StatusOK},
+		{"root", "DELETE", "/orgs/{otherOrg}/devices/own-dev", http.StatusNotFound},
+		{"root", "PUT", "/orgs/{ownOrg}/devices/other-dev", http.StatusOK},
+		{"root", "DELETE", "/orgs/{ownOrg}/devices/own-dev", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if got := f.request(policyIdentified, f.deps.HandleOrganizations, tt.caller, tt.method, tt.path); got != tt.status {
+			t.Errorf("%s %s as %s: %d, want %d", tt.method, tt.path, tt.caller, got, tt.status)
+		}
+	}
+
+	r := httptest.NewRequest("GET", f.replacer.Replace("/orgs/{ownOrg}/devices"), nil)
+	r.Header.Set("X-Username", roleViewer)
+	w := httptest.NewRecorder()
+	f.deps.authorize(policyIdentified, f.deps.HandleOrganizations)(w, r)
+	if ids := deviceIDsIn(t, w.Body.Bytes()); strings.Join(ids, ",") != "loose-dev,other-dev" {
+		t.Errorf("own organization has devices %v, want loose-dev and other-dev", ids)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxDevicePageSize = 1000
+
+// deviceQuery holds the filtering and pagination parameters accepted by the
+// device list endpoint:
+//
+//	q=text                   case-insensitive substring of the device name
+//	active=true|false        only active or only inactive devices
+//	bbox=minLng,minLat,maxLng,maxLat
+//	lat=..&lng=..&radius=..  within radius meters of a point
+//	include_hidden=true      keep hidden devices, flagged with "hidden"
+//	limit=n&cursor=..        page through the result, ordered by name
+type deviceQuery struct {
+	Text          string
+	Active        *bool
+	BBox          *BoundingBox
+	Center        *Position
+	RadiusMeters  float64
+	IncludeHidden bool
+	Limit         int
+	Cursor        *deviceCursor
+}
+
+// deviceCursor marks the last device of a page; the next page starts with
+// the first device ordered after it.
+type deviceCursor struct {
+	Name string `json:"n"`
+	ID   string `json:"i"`
+}
+
+func parseDeviceQuery(values url.Values) (deviceQuery, error) {
+	var query deviceQuery
+
+	query.Text = strings.ToLower(strings.TrimSpace(values.Get("q")))
+
+	if v := values.Get("active"); v != "" {
+		active, err := strconv.ParseBool(v)
+		if err != nil {
+			return query, fmt.Errorf("Invalid active value %q", v)
+		}
+		query.Active = &active
+	}
+
+	if v := values.Get("bbox"); v != "" {
+		box, err := parseBoundingBox(v)
+		if err != nil {
+			return query, err
+		}
+		query.BBox = &box
+	}
+
+	if values.Get("lat") != "" || values.Get("lng") != "" || values.Get("radius") != "" {
+		lat, errLat := strconv.ParseFloat(values.Get("lat"), 64)
+		lng, errLng := strconv.ParseFloat(values.Get("lng"), 64)
+		radius, errRadius := strconv.ParseFloat(values.Get("radius"), 64)
+		if errLat != nil || errLng != nil || errRadius != nil {
+			return query, fmt.Errorf("lat, lng and radius must all be numbers")
+		}
+		if !validLatitude(lat) || !validLongitude(lng) || math.IsNaN(radius) || math.IsInf(radius, 0) || radius <= 0 {
+			return query, fmt.Errorf("lat, lng or radius out of range")
+		}
+		query.Center = &Position{Latitude: lat, Longitude: lng}
+		query.RadiusMeters = radius
+	}
+
+	if v := values.Get("include_hidden"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			return query, fmt.Errorf("Invalid include_hidden value %q", v)
+		}
+		query.IncludeHidden = include
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return query, fmt.Errorf("Invalid limit %q", v)
+		}
+		if limit > maxDevicePageSize {
+			limit = maxDevicePageSize
+		}
+		query.Limit = limit
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return query, fmt.Errorf("Invalid cursor")
+		}
+		var cursor deviceCursor
+		if err := json.Unmarshal(raw, &cursor); err != nil {
+			return query, fmt.Errorf("Invalid cursor")
+		}
+		query.Cursor = &cursor
+	}
+
+	return query, nil
+}
+
+func (query deviceQuery) matches(device Device) bool {
+	if query.Text != "" && !strings.Contains(strings.ToLower(device.Name), query.Text) {
+		return false
+	}
+	if query.Active != nil && isDeviceActive(device) != *query.Active {
+		return false
+	}
+	if query.BBox != nil && !query.BBox.Contains(device.Position) {
+		return false
+	}
+	if query.Center != nil && haversineMeters(*query.Center, device.Position) > query.RadiusMeters {
+		return false
+	}
+	return true
+}
+
+// apply filters devices for a user with the given hidden devices and returns
+// the requested page, the total number of matches and the cursor of the next
+// page, if any. Without limit or cursor the upstream order is preserved.
+func (query deviceQuery) apply(devices []Device, hiddenDevices []string) ([]Device, int, string) {
+	var matched []Device
+	for _, device := range devices {
+		hidden := contains(hiddenDevices, device.ID)
+		if hidden && !query.IncludeHidden {
+			continue
+		}
+		if !query.matches(device) {
+			continue
+		}
+		device.Hidden = hidden
+		matched = append(matched, device)
+	}
+
+	total := len(matched)
+	if query.Limit == 0 && query.Cursor == nil {
+		return matched, total, ""
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return deviceBefore(matched[i], matched[j])
+	})
+
+	start := 0
+	if query.Cursor != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return deviceBefore(Device{Name: query.Cursor.Name, ID: query.Cursor.ID}, matched[i])
+		})
+	}
+
+	end := len(matched)
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+	}
+	page := matched[start:end]
+
+	next := ""
+	if end < len(matched) {
+		last := page[len(page)-1]
+		raw, _ := json.Marshal(deviceCursor{Name: last.Name, ID: last.ID})
+		next = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	return page, total, next
+}
+
+// deviceBefore orders devices case-insensitively by name, then by ID.
+func deviceBefore(a, b Device) bool {
+	if an, bn := strings.ToLower(a.Name), strings.ToLower(b.Name); an != bn {
+		return an < bn
+	}
+	return a.ID < b.ID
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newDeviceQueryTestDeps serves a fixed device list to a user who hides
+// the delta van.
+func newDeviceQueryTestDeps(t *testing.T) (*HandlerDependencies, string) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "devices.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	deps := &HandlerDependencies{
+		Store: newMemoryStore(),
+		Devices: staticDevices{
+			{ID: "c", Name: "charlie van", IsActive: "active", Position: Position{Latitude: 10, Longitude: 10}},
+			{ID: "a", Name: "Alpha Van", IsActive: "active", Position: Position{Latitude: 0, Longitude: 0}},
+			{ID: "b", Name: "Bravo Truck", IsActive: "inactive", Position: Position{Latitude: 1, Longitude: 1}},
+			{ID: "d", Name: "Delta Van", IsActive: "active", Position: Position{Latitude: 0.001, Longitude: 0}},
+			{ID: "a2", Name: "alpha van", IsActive: "inactive", Position: Position{Latitude: 0, Longitude: 0.001}},
+		},
+	}
+	if deps.Organizations, err = newOrganizationStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.PreferenceLayers, err = newPreferenceLayerStore(db); err != nil {
+		t.Fatal(err)
+	}
+	pref, err := deps.Store.CreatePreference(UserPreference{Username: "alice", HiddenDevices: []string{"d"}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deps, strconv.Itoa(pref.ID)
+}
+
+// listDevices GETs the device list with query and returns the response.
+func listDevices(t *testing.T, deps *HandlerDependencies, id, query string) (*httptest.ResponseRecorder, ApiResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	deps.Handler(w, httptest.NewRequest("GET", "/?id="+id+"&"+query, nil))
+	var resp ApiResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, resp
+}
+
+func deviceIDs(devices []Device) string {
+	ids := make([]string, len(devices))
+	for i, d := range devices {
+		ids[i] = d.ID
+		if d.Hidden {
+			ids[i] += "(hidden)"
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestDeviceQueryFilters(t *testing.T) {
+	deps, id := newDeviceQueryTestDeps(t)
+
+	tests := []struct {
+		query, want string
+	}{
+		{"", "c,a,b,a2"},
+		{"q=VAN", "c,a,a2"},
+		{"q=+alpha+", "a,a2"},
+		{"q=bus", ""},
+		{"active=true", "c,a"},
+		{"active=false", "b,a2"},
+		{"bbox=-1,-1,2,2", "a,b,a2"},
+		{"bbox=-1,-1,2,2&active=true&q=van", "a"},
+		// 0.001° is about 111m from the origin.
+		{"lat=0&lng=0&radius=50", "a"},
+		{"lat=0&lng=0&radius=200", "a,a2"},
+		{"include_hidden=true", "c,a,b,d(hidden),a2"},
+		{"include_hidden=true&lat=0&lng=0&radius=200", "a,d(hidden),a2"},
+		{"include_hidden=false", "c,a,b,a2"},
+		// Pages are ordered by name, then ID.
+		{"limit=10", "a,a2,b,c"},
+	}
+	for _, tt := range tests {
+		w, resp := listDevices(t, deps, id, tt.query)
+		if w.Code != http.StatusOK {
+			t.Errorf("?%s: %d %s", tt.query, w.Code, w.Body)
+			continue
+		}
+		if got := deviceIDs(resp.Devices); got != tt.want {
+			t.Errorf("?%s: %q, want %q", tt.query, got, tt.want)
+		}
+		if resp.Total != len(resp.Devices) || resp.NextCursor != "" {
+			t.Errorf("?%s: total %d and cursor %q for a single page of %d", tt.query, resp.Total, resp.NextCursor, len(resp.Devices))
+		}
+	}
+}
+
+func TestDeviceQueryRejectsInvalidParameters(t *testing.T) {
+	deps, id := newDeviceQueryTestDeps(t)
+
+	for _, query := range []string{
+		"active=maybe",
+		"bbox=1,2,3",
+		"bbox=0,0,200,1",
+		"lat=0&lng=0",
+		"lat=0&lng=0&radius=0",
+		"lat=0&lng=0&radius=-5",
+		"lat=0&lng=0&radius=NaN",
+		"lat=0&lng=0&radius=Inf",
+		"lat=0&lng=0&radius=-Inf",
+		"lat=91&lng=0&radius=10",
+		"lat=NaN&lng=0&radius=10",
+		"include_hidden=sometimes",
+		"limit=0",
+		"limit=ten",
+		"cursor=!!!",
+		"cursor=" + url.QueryEscape("bm90IGpzb24"),
+	} {
+		if w, _ := listDevices(t, deps, id, query); w.Code != http.StatusBadRequest {
+			t.Errorf("?%s: %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestDeviceQueryPagination(t *testing.T) {
+	deps, id := newDeviceQueryTestDeps(t)
+
+	tests := []struct {
+		query string
+		pages []string
+		total int
+	}{
+		{"limit=2", []string{"a,a2", "b,c"}, 4},
+		{"limit=3", []string{"a,a2,b", "c"}, 4},
+		{"limit=2&include_hidden=true", []string{"a,a2", "b,c", "d(hidden)"}, 5},
+		{"limit=1&active=true", []string{"a", "c"}, 2},
+	}
+	for _, tt := range tests {
+		var pages []string
+		query := tt.query
+		for len(pages) <= len(tt.pages) {
+			w, resp := listDevices(t, deps, id, query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("?%s: %d %s", query, w.Code, w.Body)
+			}
+			if resp.Total != tt.total {
+				t.Errorf("?%s: total %d, want %d", query, resp.Total, tt.total)
+			}
+			pages = append(pages, deviceIDs(resp.Devices))
+			if resp.NextCursor == "" {
+				break
+			}
+			query = tt.query + "&cursor=" + url.QueryEscape(resp.NextCursor)
+		}
+		if strings.Join(pages, " | ") != strings.Join(tt.pages, " | ") {
+			t.Errorf("?%s: pages %q, want %q", tt.query, pages, tt.pages)
+		}
+	}
+
+	// A cursor keeps its place when the device it names is gone.
+	cursor, _ := json.Marshal(deviceCursor{Name: "Bravo Bus", ID: "gone"})
+	_, resp := listDevices(t, deps, id, "limit=10&cursor="+base64.RawURLEncoding.EncodeToString(cursor))
+	if got := deviceIDs(resp.Devices); got != "b,c" {
+		t.Errorf("page after a removed device: %q, want %q", got, "b,c")
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Normalized device states derived from successive samples.
+const (
+	stateMoving  = "moving"
+	stateIdling  = "idling"
+	stateParked  = "parked"
+	stateOffline = "offline"
+)
+
+// DeviceStateTransition is a device entering a state. EndedAt is set on
+// timelines once the device has left the state again.
+type DeviceStateTransition struct {
+	DeviceID      string     `json:"device_id"`
+	State         string     `json:"state"`
+	PreviousState string     `json:"previous_state,omitempty"`
+	StartedAt     time.Time  `json:"started_at"`
+	EndedAt       *time.Time `json:"ended_at,omitempty"`
+	Position      Position   `json:"position"`
+	Privacy       string     `json:"privacy,omitempty"`
+}
+
+// DeviceStateConfig holds the thresholds of the state machine.
+type DeviceStateConfig struct {
+	// A device is moving while it keeps getting MoveMeters away from where
+	// it last moved to, and stopped once it has stayed within MoveMeters of
+	// that spot for StopAfter. Stopped devices are idling until they have
+	// been stationary for ParkedAfter, then parked.
+	MoveMeters  float64
+	StopAfter   time.Duration
+	ParkedAfter time.Duration
+	// PollInterval is how often the device list is fetched in the
+	// background so states keep updating without traffic; 0 disables it.
+	PollInterval time.Duration
+}
+
+func defaultDeviceStateConfig() DeviceStateConfig {
+	return DeviceStateConfig{
+		MoveMeters:   50,
+		StopAfter:    30 * time.Second,
+		ParkedAfter:  5 * time.Minute,
+		PollInterval: 30 * time.Second,
+	}
+}
+
+// deviceStateConfigFromEnv overrides the defaults with
+// DEVICE_STATE_MOVE_METERS, DEVICE_STATE_STOP_AFTER,
+// DEVICE_STATE_PARKED_AFTER and DEVICE_STATE_POLL_INTERVAL.
+func deviceStateConfigFromEnv() (DeviceStateConfig, error) {
+	cfg := defaultDeviceStateConfig()
+
+	durations := map[string]*time.Duration{
+		"DEVICE_STATE_STOP_AFTER":    &cfg.StopAfter,
+		"DEVICE_STATE_PARKED_AFTER":  &cfg.ParkedAfter,
+		"DEVICE_STATE_POLL_INTERVAL": &cfg.PollInterval,
+	}
+	for name, target := range durations {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return cfg, fmt.Errorf("Invalid %s: %v", name, err)
+			}
+			*target = d
+		}
+	}
+	if v := os.Getenv("DEVICE_STATE_MOVE_METERS"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return cfg, fmt.Errorf("Invalid DEVICE_STATE_MOVE_METERS: %q", v)
+		}
+		cfg.MoveMeters = f
+	}
+	return cfg, nil
+}
+
+// stateTracker derives device states from every device list fetched
+// through it, records transitions in device_state_transitions and annotates
+// the devices with their current state.
+type stateTracker struct {
+	source  DeviceSource
+	db      *sql.DB
+	cfg     DeviceStateConfig
+	privacy *privacyZones
+	now     func() time.Time
+
+	mu      sync.Mutex
+	devices map[string]*trackedDevice
+}
+
+type trackedDevice struct {
+	state string
+	since time.Time
+
+	// anchor is where the device last moved to, at anchoredAt; a zero
+	// anchoredAt means the device has not been sampled while online yet.
+	anchor     Position
+	anchoredAt time.Time
+}
+
+func newStateTracker(db *sql.DB, source DeviceSource, cfg DeviceStateConfig, privacy *privacyZones) (*stateTracker, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS device_state_transitions (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            device_id TEXT NOT NULL,
+            state TEXT NOT NULL,
+            previous_state TEXT NOT NULL DEFAULT '',
+            started_at DATETIME NOT NULL,
+            lat REAL NOT NULL,
+            lng REAL NOT NULL
+        );
+        CREATE INDEX IF NOT EXISTS idx_device_state_transitions_device
+            ON device_state_transitions(device_id, started_at);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+
+	t := &stateTracker{
+		source:  source,
+		db:      db,
+		cfg:     cfg,
+		privacy: privacy,
+		now:     time.Now,
+		devices: map[string]*trackedDevice{},
+	}
+	if err := t.loadCurrentStates(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// loadCurrentStates restores the latest state of each device so a restart
+// does not record spurious transitions.
+func (t *stateTracker) loadCurrentStates() error {
+	rows, err := t.db.Query(`
+        SELECT device_id, state, started_at
+        FROM device_state_transitions t
+        WHERE id = (SELECT MAX(id) FROM device_state_transitions WHERE device_id = t.device_id)`)
+	if err != nil {
+		return fmt.Errorf("Failed to load device states: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := &trackedDevice{}
+		var deviceID string
+		if err := rows.Scan(&deviceID, &d.state, &d.since); err != nil {
+			return fmt.Errorf("Failed to load device states: %v", err)
+		}
+		d.since = d.since.UTC()
+		t.devices[deviceID] = d
+	}
+	return rows.Err()
+}
+
+// FetchData fetches the device list from the source and tracks it.
+func (t *stateTracker) FetchData(ctx context.Context) (ApiResponse, error) {
+	data, err := t.source.FetchData(ctx)
+	if err != nil {
+		return data, err
+	}
+	if err := t.observe(data.Devices); err != nil {
+		// State tracking must not take the device list down with it.
+		log.Printf("Failed to record device states: %v", err)
+	}
+	return data, nil
+}
+
+// observe feeds one sample of every device through the state machine and
+// annotates the devices with their resulting state.
+func (t *stateTracker) observe(devices []Device) error {
+	now := t.now().UTC()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var transitions []DeviceStateTransition
+	for i := range devices {
+		device := &devices[i]
+		d, ok := t.devices[device.ID]
+		if !ok {
+			d = &trackedDevice{}
+			t.devices[device.ID] = d
+		}
+
+		if next := t.nextState(d, *device, now); next != d.state {
+			transitions = append(transitions, DeviceStateTransition{
+				DeviceID:      device.ID,
+				State:         next,
+				PreviousState: d.state,
+				StartedAt:     now,
+				Position:      device.Position,
+			})
+			d.state = next
+			d.since = now
+		}
+
+		if d.state != "" {
+			since := d.since
+			device.State = d.state
+			device.StateSince = &since
+			device.TimeInStateSeconds = int64(now.Sub(d.since) / time.Second)
+		}
+	}
+	return t.insertTransitions(transitions)
+}
+
+// nextState returns the state of d given a new sample. Until there are
+// enough samples to tell, a device keeps its current (possibly unknown)
+// state.
+func (t *stateTracker) nextState(d *trackedDevice, device Device, now time.Time) string {
+	if !isDeviceActive(device) {
+		d.anchoredAt = time.Time{}
+		return stateOffline
+	}
+
+	if d.anchoredAt.IsZero() {
+		d.anchor, d.anchoredAt = device.Position, now
+		if d.state == stateOffline {
+			// Back online but not known to be moving yet.
+			return stateIdling
+		}
+		return d.state
+	}
+
+	if haversineMeters(d.anchor, device.Position) >= t.cfg.MoveMeters {
+		d.anchor, d.anchoredAt = device.Position, now
+		return stateMoving
+	}
+	switch stationary := now.Sub(d.anchoredAt); {
+	case stationary >= t.cfg.ParkedAfter:
+		return stateParked
+	case stationary >= t.cfg.StopAfter:
+		return stateIdling
+	default:
+		return d.state
+	}
+}
+
+func (t *stateTracker) insertTransitions(transitions []DeviceStateTransition) error {
+	if len(transitions) == 0 {
+		return nil
+	}
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, tr := range transitions {
+		_, err := tx.Exec(`
+            INSERT INTO device_state_transitions(device_id, state, previous_state, started_at, lat, lng)
+            VALUES (?, ?, ?, ?, ?, ?)`,
+			tr.DeviceID, tr.State, tr.PreviousState, tr.StartedAt, tr.Position.Latitude, tr.Position.Longitude)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Timeline returns the states a device was in between from and to, oldest
+// first, starting with the state it was already in at from. Positions are
+// masked by privacy zones.
+func (t *stateTracker) Timeline(deviceID string, from, to time.Time) ([]DeviceStateTransition, error) {
+	rows, err := t.db.Query(`
+        SELECT device_id, state, previous_state, started_at, lat, lng
+        FROM device_state_transitions
+        WHERE device_id = ?
+          AND started_at <= ?
+          AND started_at >= COALESCE((
+              SELECT MAX(started_at) FROM device_state_transitions
+              WHERE device_id = ? AND started_at <= ?), ?)
+        ORDER BY started_at, id`, deviceID, to.UTC(), deviceID, from.UTC(), from.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	timeline := []DeviceStateTransition{}
+	for rows.Next() {
+		var tr DeviceStateTransition
+		err := rows.Scan(&tr.DeviceID, &tr.State, &tr.PreviousState, &tr.StartedAt, &tr.Position.Latitude, &tr.Position.Longitude)
+		if err != nil {
+			return nil, fmt.Errorf("Database error: %v", err)
+		}
+		tr.StartedAt = tr.StartedAt.UTC()
+		if n := len(timeline); n > 0 {
+			ended := tr.StartedAt
+			timeline[n-1].EndedAt = &ended
+		}
+		timeline = append(timeline, tr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	t.privacy.maskTransitions(deviceID, timeline)
+	return timeline, nil
+}
+
+// poll fetches the device list every PollInterval until ctx is done.
+func (t *stateTracker) poll(ctx context.Context, source DeviceSource) {
+	if t.cfg.PollInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(t.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := source.FetchData(ctx); err != nil {
+				log.Printf("Failed to poll devices: %v", err)
+			}
+		}
+	}
+}
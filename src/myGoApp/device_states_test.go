@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeviceStateTransitions(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "states.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cfg := DeviceStateConfig{MoveMeters: 50, StopAfter: 30 * time.Second, ParkedAfter: 5 * time.Minute}
+	tracker, err := newStateTracker(db, staticDevices{}, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	var now time.Time
+	tracker.now = func() time.Time { return now }
+
+	// 0.001° of latitude is about 111m, well past MoveMeters.
+	tests := []struct {
+		at          time.Duration
+		active      string
+		lat         float64
+		state       string
+		timeInState int64
+	}{
+		{0, "active", 0, "", 0}, // a first sample can't tell yet
+		{10 * time.Second, "active", 0.001, stateMoving, 0},
+		{20 * time.Second, "active", 0.002, stateMoving, 10},
+		{40 * time.Second, "active", 0.0021, stateMoving, 30}, // within MoveMeters, not stopped long enough
+		{60 * time.Second, "active", 0.0021, stateIdling, 0},
+		{2 * time.Minute, "active", 0.0021, stateIdling, 60},
+		{6 * time.Minute, "active", 0.0021, stateParked, 0},
+		{7 * time.Minute, "inactive", 0.0021, stateOffline, 0},
+		{8 * time.Minute, "active", 0.0021, stateIdling, 0}, // back online
+		{9 * time.Minute, "active", 0.005, stateMoving, 0},
+	}
+	for _, tt := range tests {
+		now = start.Add(tt.at)
+		devices := []Device{{ID: "truck", IsActive: tt.active, Position: Position{Latitude: tt.lat}}}
+		if err := tracker.observe(devices); err != nil {
+			t.Fatal(err)
+		}
+		got := devices[0]
+		if got.State != tt.state || got.TimeInStateSeconds != tt.timeInState {
+			t.Errorf("at %v: %q for %ds, want %q for %ds", tt.at, got.State, got.TimeInStateSeconds, tt.state, tt.timeInState)
+		}
+	}
+
+	// Every change of state is recorded once.
+	want := []struct {
+		state, previous string
+		at              time.Duration
+	}{
+		{stateMoving, "", 10 * time.Second},
+		{stateIdling, stateMoving, 60 * time.Second},
+		{stateParked, stateIdling, 6 * time.Minute},
+		{stateOffline, stateParked, 7 * time.Minute},
+		{stateIdling, stateOffline, 8 * time.Minute},
+		{stateMoving, stateIdling, 9 * time.Minute},
+	}
+	timeline, err := tracker.Timeline("truck", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeline) != len(want) {
+		t.Fatalf("timeline has %d transitions, want %d: %+v", len(timeline), len(want), timeline)
+	}
+	for i, tr := range timeline {
+		w := want[i]
+		if tr.State != w.state || tr.PreviousState != w.previous || !tr.StartedAt.Equal(start.Add(w.at)) {
+			t.Errorf("transition %d: %s from %q at %v, want %s from %q at %v",
+				i, tr.State, tr.PreviousState, tr.StartedAt, w.state, w.previous, start.Add(w.at))
+		}
+		switch {
+		case i < len(timeline)-1 && (tr.EndedAt == nil || !tr.EndedAt.Equal(timeline[i+1].StartedAt)):
+			t.Errorf("transition %d ends at %v, want when the next one starts", i, tr.EndedAt)
+		case i == len(timeline)-1 && tr.EndedAt != nil:
+			t.Errorf("current state ends at %v, want it open", tr.EndedAt)
+		}
+	}
+
+	// A timeline starts with the state the device was already in.
+	timeline, err = tracker.Timeline("truck", start.Add(3*time.Minute), start.Add(7*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeline) != 3 || timeline[0].State != stateIdling || timeline[1].State != stateParked || timeline[2].State != stateOffline {
+		t.Errorf("timeline from 08:03 to 08:07 is %+v, want idling, parked and offline", timeline)
+	}
+
+	// After a restart the current state is restored, without a spurious
+	// transition for the first sample.
+	restarted, err := newStateTracker(db, staticDevices{}, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = start.Add(10 * time.Minute)
+	restarted.now = func() time.Time { return now }
+	devices := []Device{{ID: "truck", IsActive: "active", Position: Position{Latitude: 0.005}}}
+	if err := restarted.observe(devices); err != nil {
+		t.Fatal(err)
+	}
+	if devices[0].State != stateMoving || devices[0].TimeInStateSeconds != 60 {
+		t.Errorf("after a restart: %q for %ds, want moving for 60s", devices[0].State, devices[0].TimeInStateSeconds)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM device_state_transitions").Scan(&n); err != nil || n != len(want) {
+		t.Errorf("%d transitions stored (%v) after a restart, want %d", n, err, len(want))
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHistoryWindow = 24 * time.Hour
+	maxHistoryWindow     = 31 * 24 * time.Hour
+)
+
+// HandleDevices routes /devices/nearest, /devices/within and the
+// /devices/{id}[/points|/states] endpoints.
+func (deps *HandlerDependencies) HandleDevices(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices/"), "/"), "/")
+	if len(parts) == 1 {
+		switch parts[0] {
+		case "nearest":
+			deps.HandleNearestDevices(w, r)
+			return
+		case "within":
+			deps.HandleDevicesWithin(w, r)
+			return
+		}
+	}
+
+	deviceID, err := url.PathUnescape(parts[0])
+	if err != nil || deviceID == "" {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		deps.HandleGetDevice(w, r, deviceID)
+	case len(parts) == 2 && parts[1] == "points":
+		deps.HandleGetDevicePoints(w, r, deviceID)
+	case len(parts) == 2 && parts[1] == "states":
+		deps.HandleGetDeviceStates(w, r, deviceID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// HandleGetDevice returns the detail of a device the user has not hidden.
+// Devices of other organizations look missing, here and in the device's
+// history.
+func (deps *HandlerDependencies) HandleGetDevice(w http.ResponseWriter, r *http.Request, deviceID string) {
+	pref, ok := deps.preferenceForDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+	if contains(pref.HiddenDevices, deviceID) || !deps.DeviceOrganizations.visible(r.Context(), deviceID) {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	device, err := deps.Upstream.FetchDevice(r.Context(), deviceID)
+	if err != nil {
+		deps.Upstream.writeUpstreamError(w, err)
+		return
+	}
+	device.Address = deps.Geocoder.Address(device.Position)
+
+	writeJSON(w, device)
+}
+
+// HandleGetDevicePoints returns the location history of a device between
+// ?from= and ?to= (RFC 3339), defaulting to the last 24 hours.
+func (deps *HandlerDependencies) HandleGetDevicePoints(w http.ResponseWriter, r *http.Request, deviceID string) {
+	from, to, err := parseTimeRange(r.URL.Query(), defaultHistoryWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pref, ok := deps.preferenceForDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+	if contains(pref.HiddenDevices, deviceID) || !deps.DeviceOrganizations.visible(r.Context(), deviceID) {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	points, err := deps.Upstream.FetchDevicePoints(r.Context(), deviceID, from, to)
+	if err != nil {
+		deps.Upstream.writeUpstreamError(w, err)
+		return
+	}
+	for i := range points {
+		points[i].Address = deps.Geocoder.Address(Position{Latitude: points[i].Latitude, Longitude: points[i].Longitude})
+	}
+
+	writeJSON(w, points)
+}
+
+// HandleGetDeviceStates returns the state timeline of a device between
+// ?from= and ?to= (RFC 3339), defaulting to the last 24 hours.
+func (deps *HandlerDependencies) HandleGetDeviceStates(w http.ResponseWriter, r *http.Request, deviceID string) {
+	from, to, err := parseTimeRange(r.URL.Query(), defaultHistoryWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pref, ok := deps.preferenceForDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+	if contains(pref.HiddenDevices, deviceID) || !deps.DeviceOrganizations.visible(r.Context(), deviceID) {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	timeline, err := deps.States.Timeline(deviceID, from, to)
+	if err != nil {
+		http.Error(w, "Failed to fetch device states: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, timeline)
+}
+
+// HandleReports routes /reports/drivers, /reports/trips, /reports/fleet and
+// /reports/schedules/...
+func (deps *HandlerDependencies) HandleReports(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/reports/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "drivers":
+		deps.HandleDriverReport(w, r)
+	case len(parts) == 1 && parts[0] == "trips":
+		deps.HandleTripReport(w, r)
+	case len(parts) == 1 && parts[0] == "fleet":
+		deps.HandleFleetReport(w, r)
+	case parts[0] == "schedules":
+		deps.HandleReportSchedules(w, r, parts[1:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// HandleDriverReport lists drivers, leaving out those currently assigned to
+// a device the user has hidden or cannot see.
+func (deps *HandlerDependencies) HandleDriverReport(w http.ResponseWriter, r *http.Request) {
+	pref, ok := deps.preferenceForDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+
+	drivers, err := deps.Upstream.FetchDrivers(r.Context())
+	if err != nil {
+		deps.Upstream.writeUpstreamError(w, err)
+		return
+	}
+
+	visible := []Driver{}
+	for _, driver := range drivers {
+		if driver.DeviceID == "" || (!contains(pref.HiddenDevices, driver.DeviceID) && deps.DeviceOrganizations.visible(r.Context(), driver.DeviceID)) {
+			visible = append(visible, driver)
+		}
+	}
+
+	writeJSON(w, visible)
+}
+
+// HandleTripReport returns trips between ?from= and ?to= for the devices
+// given as ?device_id= (repeatable), or all visible devices.
+func (deps *HandlerDependencies) HandleTripReport(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseTimeRange(r.URL.Query(), defaultHistoryWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pref, ok := deps.preferenceForDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+
+	visible := func(deviceID string) bool {
+		return !contains(pref.HiddenDevices, deviceID) && deps.DeviceOrganizations.visible(r.Context(), deviceID)
+	}
+	var deviceIDs []string
+	for _, id := range r.URL.Query()["device_id"] {
+		if visible(id) {
+			deviceIDs = append(deviceIDs, id)
+		}
+	}
+	if len(r.URL.Query()["device_id"]) > 0 && len(deviceIDs) == 0 {
+		writeJSON(w, []Trip{})
+		return
+	}
+
+	trips, err := deps.Upstream.FetchTrips(r.Context(), deviceIDs, from, to)
+	if err != nil {
+		deps.Upstream.writeUpstreamError(w, err)
+		return
+	}
+
+	visibleTrips := []Trip{}
+	for _, trip := range trips {
+		if visible(trip.DeviceID) {
+			visibleTrips = append(visibleTrips, trip)
+		}
+	}
+
+	writeJSON(w, visibleTrips)
+}
+
+// preferenceForDeviceRequest loads the preferences of the user named by ?id=
+// so their hidden devices can be filtered out. It writes the error response
+// itself and returns false on failure.
+func (deps *HandlerDependencies) preferenceForDeviceRequest(w http.ResponseWriter, r *http.Request) (UserPreference, bool) {
+	userID, err := getUserIDFromQuery(r)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return UserPreference{}, false
+	}
+
+	pref, err := deps.preferenceByID(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		return UserPreference{}, false
+	}
+	return pref, true
+}
+
+// parseTimeRange reads ?from= and ?to= as RFC 3339 timestamps. to defaults to
+// now and from to window before to.
+func parseTimeRange(values url.Values, window time.Duration) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+	if v := values.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid to: %v", err)
+		}
+		to = t
+	}
+
+	from := to.Add(-window)
+	if v := values.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid from: %v", err)
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	if to.Sub(from) > maxHistoryWindow {
+		return time.Time{}, time.Time{}, fmt.Errorf("Time range must not exceed %d days", int(maxHistoryWindow.Hours()/24))
+	}
+	return from, to, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to convert data to JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errDriverNotFound           = errors.New("driver not found")
+	errDriverAssignmentNotFound = errors.New("driver assignment not found")
+	errAssignmentOverlap        = errors.New("assignment overlaps another")
+	errAssignmentEnded          = errors.New("assignment has already ended")
+	errInvalidAssignmentEnd     = errors.New("ends_at must be after starts_at")
+)
+
+// DriverProfile is a driver kept by the backend, unlike Driver, which is
+// OneStepGPS's record. ExternalID optionally links the two.
+type DriverProfile struct {
+	ID             int       `json:"id"`
+	OrganizationID int       `json:"organization_id,omitempty"`
+	Name           string    `json:"name"`
+	Phone          string    `json:"phone,omitempty"`
+	Email          string    `json:"email,omitempty"`
+	ExternalID     string    `json:"external_id,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// DriverAssignment puts a driver in a device from StartsAt until EndsAt,
+// or until further notice when EndsAt is nil.
+type DriverAssignment struct {
+	ID        int        `json:"id"`
+	DriverID  int        `json:"driver_id"`
+	DeviceID  string     `json:"device_id"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// covers reports whether the assignment was in effect at t.
+func (a DriverAssignment) covers(t time.Time) bool {
+	return !t.Before(a.StartsAt) && (a.EndsAt == nil || t.Before(*a.EndsAt))
+}
+
+// driverStore keeps the drivers and driver_assignments tables. Assignments
+// are also kept in memory, since privacy zones look up who was driving for
+// every position they mask; byDevice indexes them for that.
+type driverStore struct {
+	db *sql.DB
+
+	mu          sync.RWMutex
+	assignments []DriverAssignment
+	byDevice    map[string][]DriverAssignment
+}
+
+func newDriverStore(db *sql.DB) (*driverStore, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS drivers (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            organization_id INTEGER,
+            name TEXT NOT NULL,
+            phone TEXT NOT NULL DEFAULT '',
+            email TEXT NOT NULL DEFAULT '',
+            external_id TEXT NOT NULL DEFAULT '',
+            created_at DATETIME NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS driver_assignments (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            driver_id INTEGER NOT NULL REFERENCES drivers(id),
+            device_id TEXT NOT NULL,
+            starts_at DATETIME NOT NULL,
+            ends_at DATETIME,
+            created_at DATETIME NOT NULL
+        );
+        CREATE INDEX IF NOT EXISTS idx_driver_assignments_driver ON driver_assignments(driver_id, starts_at);
+        CREATE INDEX IF NOT EXISTS idx_driver_assignments_device ON driver_assignments(device_id, starts_at);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	s := &driverStore{db: db}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+const driverColumns = "id, organization_id, name, phone, email, external_id, created_at"
+
+// List returns the drivers of an organization, or every driver for 0.
+func (s *driverStore) List(organizationID int) ([]DriverProfile, error) {
+	query := "SELECT " + driverColumns + " FROM drivers"
+	var args []any
+	if organizationID != 0 {
+		query += " WHERE organization_id = ?"
+		args = append(args, organizationID)
+	}
+	rows, err := s.db.Query(query+" ORDER BY name, id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	drivers := []DriverProfile{}
+	for rows.Next() {
+		d, err := scanDriver(rows)
+		if err != nil {
+			return nil, err
+		}
+		drivers = append(drivers, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return drivers, nil
+}
+
+func (s *driverStore) Get(id int) (DriverProfile, error) {
+	d, err := scanDriver(s.db.QueryRow("SELECT "+driverColumns+" FROM drivers WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return d, fmt.Errorf("No driver found for ID %d: %w", id, errDriverNotFound)
+	}
+	return d, err
+}
+
+func (s *driverStore) Create(d DriverProfile) (DriverProfile, error) {
+	d.CreatedAt = time.Now().UTC()
+	var organizationID any
+	if d.OrganizationID != 0 {
+		organizationID = d.OrganizationID
+	}
+	result, err := s.db.Exec(
+		"INSERT INTO drivers(organization_id, name, phone, email, external_id, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		organizationID, d.Name, d.Phone, d.Email, d.ExternalID, d.CreatedAt)
+	if err != nil {
+		return d, fmt.Errorf("Database error: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return d, err
+	}
+	d.ID = int(id)
+	return d, nil
+}
+
+// Delete removes a driver along with their assignment history.
+func (s *driverStore) Delete(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM driver_assignments WHERE driver_id = ?", id); err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	result, err := tx.Exec("DELETE FROM drivers WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No driver found for ID %d: %w", id, errDriverNotFound)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.reload()
+}
+
+func scanDriver(row interface{ Scan(...any) error }) (DriverProfile, error) {
+	var d DriverProfile
+	var organizationID sql.NullInt64
+	err := row.Scan(&d.ID, &organizationID, &d.Name, &d.Phone, &d.Email, &d.ExternalID, &d.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return d, err
+		}
+		return d, fmt.Errorf("Database error: %v", err)
+	}
+	d.OrganizationID = int(organizationID.Int64)
+	d.CreatedAt = d.CreatedAt.UTC()
+	return d, nil
+}
+
+func (s *driverStore) reload() error {
+	rows, err := s.db.Query("SELECT id, driver_id, device_id, starts_at, ends_at, created_at FROM driver_assignments ORDER BY starts_at, id")
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	assignments := []DriverAssignment{}
+	byDevice := map[string][]DriverAssignment{}
+	for rows.Next() {
+		a, err := scanDriverAssignment(rows)
+		if err != nil {
+			return err
+		}
+		assignments = append(assignments, a)
+		byDevice[a.DeviceID] = append(byDevice[a.DeviceID], a)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+
+	s.mu.Lock()
+	s.assignments, s.byDevice = assignments, byDevice
+	s.mu.Unlock()
+	return nil
+}
+
+func scanDriverAssignment(row interface{ Scan(...any) error }) (DriverAssignment, error) {
+	var a DriverAssignment
+	var endsAt sql.NullTime
+	err := row.Scan(&a.ID, &a.DriverID, &a.DeviceID, &a.StartsAt, &endsAt, &a.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return a, err
+		}
+		return a, fmt.Errorf("Database error: %v", err)
+	}
+	a.StartsAt, a.CreatedAt = a.StartsAt.UTC(), a.CreatedAt.UTC()
+	if endsAt.Valid {
+		t := endsAt.Time.UTC()
+		a.EndsAt = &t
+	}
+	return a, nil
+}
+
+// Assignments returns a driver's assignments that overlap [from, to),
+// oldest first. A zero to means no upper bound.
+func (s *driverStore) Assignments(driverID int, from, to time.Time) []DriverAssignment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	assignments := []DriverAssignment{}
+	for _, a := range s.assignments {
+		if a.DriverID != driverID || (!to.IsZero() && !a.StartsAt.Before(to)) || (a.EndsAt != nil && !a.EndsAt.After(from)) {
+			continue
+		}
+		assignments = append(assignments, a)
+	}
+	return assignments
+}
+
+// Current returns the assignment of every driver who is in a device at t.
+func (s *driverStore) Current(t time.Time) map[int]DriverAssignment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	current := map[int]DriverAssignment{}
+	for _, a := range s.assignments {
+		if a.covers(t) {
+			current[a.DriverID] = a
+		}
+	}
+	return current
+}
+
+// DriverAt returns who was driving a device at t. A device's assignments
+// don't overlap and are kept in start order, so only the last one starting
+// by t can cover it.
+func (s *driverStore) DriverAt(deviceID string, t time.Time) (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	assignments := s.byDevice[deviceID]
+	i := sort.Search(len(assignments), func(i int) bool { return assignments[i].StartsAt.After(t) })
+	if i > 0 && assignments[i-1].covers(t) {
+		return assignments[i-1].DriverID, true
+	}
+	return 0, false
+}
+
+// Assign records a new assignment. Neither the driver nor the device may
+// have another assignment overlapping it.
+func (s *driverStore) Assign(a DriverAssignment) (DriverAssignment, error) {
+	a.CreatedAt = time.Now().UTC()
+	a.StartsAt = a.StartsAt.UTC()
+	var endsAt any
+	if a.EndsAt != nil {
+		t := a.EndsAt.UTC()
+		a.EndsAt, endsAt = &t, t
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return a, err
+	}
+	defer tx.Rollback()
+
+	if err := checkAssignmentOverlap(tx, a, 0); err != nil {
+		return a, err
+	}
+	result, err := tx.Exec(
+		"INSERT INTO driver_assignments(driver_id, device_id, starts_at, ends_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		a.DriverID, a.DeviceID, a.StartsAt, endsAt, a.CreatedAt)
+	if err != nil {
+		return a, fmt.Errorf("Database error: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return a, err
+	}
+	a.ID = int(id)
+	if err := tx.Commit(); err != nil {
+		return a, err
+	}
+	return a, s.reload()
+}
+
+// End ends an open assignment at t.
+func (s *driverStore) End(driverID, id int, t time.Time) (DriverAssignment, error) {
+	a, err := scanDriverAssignment(s.db.QueryRow(
+		"SELECT id, driver_id, device_id, starts_at, ends_at, created_at FROM driver_assignments WHERE id = ? AND driver_id = ?",
+		id, driverID))
+	if err == sql.ErrNoRows {
+		return a, fmt.Errorf("No assignment %d found for driver %d: %w", id, driverID, errDriverAssignmentNotFound)
+	}
+	if err != nil {
+		return a, err
+	}
+	if a.EndsAt != nil {
+		return a, fmt.Errorf("Assignment %d ended at %s: %w", id, a.EndsAt.Format(time.RFC3339), errAssignmentEnded)
+	}
+	t = t.UTC()
+	if !t.After(a.StartsAt) {
+		return a, fmt.Errorf("Assignment %d starts at %s: %w", id, a.StartsAt.Format(time.RFC3339), errInvalidAssignmentEnd)
+	}
+
+	if _, err := s.db.Exec("UPDATE driver_assignments SET ends_at = ? WHERE id = ?", t, id); err != nil {
+		return a, fmt.Errorf("Database error: %v", err)
+	}
+	a.EndsAt = &t
+	return a, s.reload()
+}
+
+// checkAssignmentOverlap looks for assignments of the same driver or device
+// overlapping a, other than the one with ID except.
+func checkAssignmentOverlap(tx *sql.Tx, a DriverAssignment, except int) error {
+	query := `SELECT id FROM driver_assignments
+        WHERE (driver_id = ? OR device_id = ?) AND id != ?
+          AND (ends_at IS NULL OR ends_at > ?)`
+	args := []any{a.DriverID, a.DeviceID, except, a.StartsAt}
+	if a.EndsAt != nil {
+		query += " AND starts_at < ?"
+		args = append(args, *a.EndsAt)
+	}
+	var id int
+	err := tx.QueryRow(query+" LIMIT 1", args...).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return fmt.Errorf("Database error: %v", err)
+	default:
+		return fmt.Errorf("Conflicts with assignment %d: %w", id, errAssignmentOverlap)
+	}
+}
+
+// DriverLocation is where a driver is now: the device they are assigned to
+// with its latest position, or neither when they aren't driving.
+type DriverLocation struct {
+	Driver     DriverProfile     `json:"driver"`
+	Assignment *DriverAssignment `json:"assignment,omitempty"`
+	Device     *Device           `json:"device,omitempty"`
+}
+
+// DriverSegment is part of a shift spent in one device.
+type DriverSegment struct {
+	DeviceID   string           `json:"device_id"`
+	From       time.Time        `json:"from"`
+	To         time.Time        `json:"to"`
+	DistanceKm float64          `json:"distance_km"`
+	Positions  []StoredPosition `json:"positions"`
+}
+
+// DriverShift is where a driver was between From and To.
+type DriverShift struct {
+	DriverID   int             `json:"driver_id"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	DistanceKm float64         `json:"distance_km"`
+	Segments   []DriverSegment `json:"segments"`
+}
+
+// HandleDrivers routes GET/POST /drivers, GET /drivers/locations, GET/DELETE
+// /drivers/{id}, GET/POST /drivers/{id}/assignments, POST
+// /drivers/{id}/assignments/{assignmentID}/end and GET /drivers/{id}/shift.
+// Members of an organization only see its drivers.
+func (deps *HandlerDependencies) HandleDrivers(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	organizationID := 0
+	if p := principalFromContext(r.Context()); p != nil {
+		organizationID = p.OrganizationID
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/drivers"), "/"), "/")
+	switch {
+	case parts[0] == "" && r.Method == "GET":
+		drivers, err := deps.Drivers.List(organizationID)
+		if err != nil {
+			http.Error(w, "Failed to fetch drivers: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, drivers)
+		return
+	case parts[0] == "" && r.Method == "POST":
+		deps.HandleCreateDriver(w, r, organizationID)
+		return
+	case len(parts) == 1 && parts[0] == "locations" && r.Method == "GET":
+		deps.HandleDriverLocations(w, r, organizationID)
+		return
+	case len(parts) == 1 && (parts[0] == "" || parts[0] == "locations"):
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid driver ID", http.StatusBadRequest)
+		return
+	}
+	driver, err := deps.Drivers.Get(id)
+	if err == nil && organizationID != 0 && driver.OrganizationID != organizationID {
+		err = fmt.Errorf("No driver found for ID %d: %w", id, errDriverNotFound)
+	}
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		writeJSON(w, driver)
+	case len(parts) == 1 && r.Method == "DELETE":
+		if err := deps.Drivers.Delete(id); err != nil {
+			writeDriverError(w, err)
+			return
+		}
+		deps.Audit.Record(r, "driver.delete", "driver", id, driver, nil)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "assignments" && r.Method == "GET":
+		// ?from= and ?to= narrow the history, which is all of it by default.
+		var from, to time.Time
+		if r.URL.Query().Get("from") != "" || r.URL.Query().Get("to") != "" {
+			if from, to, err = parseTimeRange(r.URL.Query(), maxHistoryWindow); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, deps.Drivers.Assignments(id, from, to))
+	case len(parts) == 2 && parts[1] == "assignments" && r.Method == "POST":
+		deps.HandleAssignDriver(w, r, driver)
+	case len(parts) == 4 && parts[1] == "assignments" && parts[3] == "end" && r.Method == "POST":
+		assignmentID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.Error(w, "Invalid assignment ID", http.StatusBadRequest)
+			return
+		}
+		deps.HandleEndDriverAssignment(w, r, driver, assignmentID)
+	case len(parts) == 2 && parts[1] == "shift" && r.Method == "GET":
+		deps.HandleDriverShift(w, r, driver)
+	case len(parts) <= 2 || (len(parts) == 4 && parts[3] == "end"):
+		writeMethodNotAllowed(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// HandleCreateDriver creates a driver from {"name", "phone", "email",
+// "external_id"}.
+func (deps *HandlerDependencies) HandleCreateDriver(w http.ResponseWriter, r *http.Request, organizationID int) {
+	var d DriverProfile
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	d.Name = strings.TrimSpace(d.Name)
+	if d.Name == "" {
+		http.Error(w, "Invalid driver: name is required", http.StatusBadRequest)
+		return
+	}
+	d.OrganizationID = organizationID
+
+	d, err := deps.Drivers.Create(d)
+	if err != nil {
+		http.Error(w, "Failed to create driver: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deps.Audit.Record(r, "driver.create", "driver", d.ID, nil, d)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+// HandleAssignDriver assigns a driver to a device from {"device_id",
+// "starts_at", "ends_at"}. starts_at defaults to now and ends_at to open
+// ended.
+func (deps *HandlerDependencies) HandleAssignDriver(w http.ResponseWriter, r *http.Request, driver DriverProfile) {
+	var a DriverAssignment
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.DriverID = driver.ID
+	if a.StartsAt.IsZero() {
+		a.StartsAt = time.Now()
+	}
+	switch {
+	case strings.TrimSpace(a.DeviceID) == "":
+		http.Error(w, "Invalid assignment: device_id is required", http.StatusBadRequest)
+		return
+	case !deps.DeviceOrganizations.visible(r.Context(), a.DeviceID):
+		http.Error(w, "Invalid assignment: unknown device_id", http.StatusBadRequest)
+		return
+	case a.EndsAt != nil && !a.EndsAt.After(a.StartsAt):
+		http.Error(w, "Invalid assignment: ends_at must be after starts_at", http.StatusBadRequest)
+		return
+	}
+
+	a, err := deps.Drivers.Assign(a)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	deps.Audit.Record(r, "driver.assign", "driver_assignment", a.ID, nil, a)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// HandleEndDriverAssignment ends an open assignment at {"ends_at"}, by
+// default now.
+func (deps *HandlerDependencies) HandleEndDriverAssignment(w http.ResponseWriter, r *http.Request, driver DriverProfile, id int) {
+	var body struct {
+		EndsAt *time.Time `json:"ends_at"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	endsAt := time.Now()
+	if body.EndsAt != nil {
+		endsAt = *body.EndsAt
+	}
+
+	a, err := deps.Drivers.End(driver.ID, id, endsAt)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	before := a
+	before.EndsAt = nil
+	deps.Audit.Record(r, "driver.unassign", "driver_assignment", a.ID, before, a)
+	writeJSON(w, a)
+}
+
+// HandleDriverLocations lists every driver with the device they are in now
+// and its latest position, leaving out devices the user has hidden.
+func (deps *HandlerDependencies) HandleDriverLocations(w http.ResponseWriter, r *http.Request, organizationID int) {
+	pref, ok := deps.preferenceForDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+	drivers, err := deps.Drivers.List(organizationID)
+	if err != nil {
+		http.Error(w, "Failed to fetch drivers: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := deps.Devices.FetchData(r.Context())
+	if err != nil {
+		deps.Upstream.writeUpstreamError(w, err)
+		return
+	}
+	devices := map[string]Device{}
+	for _, d := range data.Devices {
+		devices[d.ID] = d
+	}
+
+	current := deps.Drivers.Current(time.Now().UTC())
+	locations := []DriverLocation{}
+	for _, driver := range drivers {
+		location := DriverLocation{Driver: driver}
+		if a, ok := current[driver.ID]; ok && !contains(pref.HiddenDevices, a.DeviceID) {
+			location.Assignment = &a
+			if device, ok := devices[a.DeviceID]; ok {
+				// A masked device had its address cleared; don't put it back.
+				if device.Privacy == "" {
+					device.Address = deps.Geocoder.Address(device.Position)
+				}
+				location.Device = &device
+			}
+		}
+		locations = append(locations, location)
+	}
+	writeJSON(w, locations)
+}
+
+// HandleDriverShift returns where a driver was between ?from= and ?to=
+// (RFC 3339, by default the last 24 hours): the stored positions of each
+// device they were assigned to, while they were.
+func (deps *HandlerDependencies) HandleDriverShift(w http.ResponseWriter, r *http.Request, driver DriverProfile) {
+	from, to, err := parseTimeRange(r.URL.Query(), defaultHistoryWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pref, ok := deps.preferenceForDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+
+	shift := DriverShift{DriverID: driver.ID, From: from, To: to, Segments: []DriverSegment{}}
+	for _, a := range deps.Drivers.Assignments(driver.ID, from, to) {
+		if contains(pref.HiddenDevices, a.DeviceID) || !deps.DeviceOrganizations.visible(r.Context(), a.DeviceID) {
+			continue
+		}
+		segment := DriverSegment{DeviceID: a.DeviceID, From: a.StartsAt, To: to}
+		if segment.From.Before(from) {
+			segment.From = from
+		}
+		if a.EndsAt != nil && a.EndsAt.Before(to) {
+			segment.To = *a.EndsAt
+		}
+		segment.Positions, err = deps.Positions.Track(a.DeviceID, segment.From, segment.To)
+		if err != nil {
+			http.Error(w, "Failed to fetch positions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		segment.DistanceKm = filteredDistanceMeters(segment.Positions) / 1000
+		shift.DistanceKm += segment.DistanceKm
+		shift.Segments = append(shift.Segments, segment)
+	}
+	sort.Slice(shift.Segments, func(i, j int) bool { return shift.Segments[i].From.Before(shift.Segments[j].From) })
+	writeJSON(w, shift)
+}
+
+func writeDriverError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errDriverNotFound):
+		http.Error(w, "Driver not found", http.StatusNotFound)
+	case errors.Is(err, errDriverAssignmentNotFound):
+		http.Error(w, "Assignment not found", http.StatusNotFound)
+	case errors.Is(err, errAssignmentOverlap), errors.Is(err, errAssignmentEnded):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errInvalidAssignmentEnd):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDriverAt(t *testing.T) {
+	deps := newPrivacyTestDeps(t)
+	start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	hours := func(n int) time.Time { return start.Add(time.Duration(n) * time.Hour) }
+	ends := func(n int) *time.Time { t := hours(n); return &t }
+
+	var drivers []int
+	for _, name := range []string{"Ann", "Ben", "Cat"} {
+		d, err := deps.Drivers.Create(DriverProfile{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		drivers = append(drivers, d.ID)
+	}
+	for _, a := range []DriverAssignment{
+		{DriverID: drivers[1], DeviceID: "truck", StartsAt: hours(4), EndsAt: ends(6)},
+		{DriverID: drivers[0], DeviceID: "truck", StartsAt: hours(0), EndsAt: ends(2)},
+		{DriverID: drivers[2], DeviceID: "truck", StartsAt: hours(8)},
+		{DriverID: drivers[0], DeviceID: "van", StartsAt: hours(2), EndsAt: ends(4)},
+	} {
+		if _, err := deps.Drivers.Assign(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		deviceID string
+		at       time.Time
+		driver   int
+		driving  bool
+	}{
+		{"truck", hours(-1), 0, false},
+		{"truck", hours(0), drivers[0], true},
+		{"truck", hours(1), drivers[0], true},
+		{"truck", hours(2), 0, false},
+		{"truck", hours(5), drivers[1], true},
+		{"truck", hours(7), 0, false},
+		{"truck", hours(100), drivers[2], true},
+		{"van", hours(3), drivers[0], true},
+		{"van", hours(1), 0, false},
+		{"bus", hours(1), 0, false},
+	}
+	for _, tt := range tests {
+		driver, driving := deps.Drivers.DriverAt(tt.deviceID, tt.at)
+		if driver != tt.driver || driving != tt.driving {
+			t.Errorf("DriverAt(%s, %v) = %d, %v; want %d, %v", tt.deviceID, tt.at, driver, driving, tt.driver, tt.driving)
+		}
+	}
+}
+
+func TestDriverLocationsDontGeocodeMaskedDevices(t *testing.T) {
+	home := Position{Latitude: 10.9, Longitude: 10.9}
+	deps := newPrivacyTestDeps(t, Device{ID: "a", Position: home}, Device{ID: "b", Position: home})
+	deps.Geocoder = newReverseGeocoder([]place{{Name: "Hometown", Region: "XX", Position: home}}, 500)
+	squareZone(t, deps, 0, "a", privacyCentroid)
+
+	for _, deviceID := range []string{"a", "b"} {
+		driver, err := deps.Drivers.Create(DriverProfile{Name: "Driver of " + deviceID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := deps.Drivers.Assign(DriverAssignment{DriverID: driver.ID, DeviceID: deviceID, StartsAt: time.Now().Add(-time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	deps.HandleDriverLocations(w, httptest.NewRequest("GET", "/drivers/locations?id=0", nil), 0)
+	var locations []DriverLocation
+	if err := json.Unmarshal(w.Body.Bytes(), &locations); err != nil {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	addresses := map[string]string{}
+	for _, l := range locations {
+		if l.Device != nil {
+			addresses[l.Device.ID] = l.Device.Address
+		}
+	}
+	if addresses["a"] != "" {
+		t.Errorf("masked device has address %q", addresses["a"])
+	}
+	if addresses["b"] == "" {
+		t.Error("unmasked device has no address")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// buildFleetReport summarizes the stored positions, device states and
+// geofence visits of the devices pref can see between from and to.
+func (deps *HandlerDependencies) buildFleetReport(ctx context.Context, title string, pref UserPreference, from, to time.Time) (FleetReport, error) {
+	report := FleetReport{
+		Title:       title,
+		From:        from,
+		To:          to,
+		GeneratedAt: time.Now().UTC(),
+		Devices:     []DeviceSummary{},
+		Visits:      []GeofenceVisit{},
+	}
+
+	organizationID := deps.organizationOf(pref.Username)
+	positions, err := deps.Positions.Between(from, to)
+	if err != nil {
+		return report, err
+	}
+	geofences, err := deps.Geofences.List(organizationID)
+	if err != nil {
+		return report, err
+	}
+
+	// Report on every visible device, using the current list for names;
+	// devices that have since disappeared are still reported by ID.
+	names := map[string]string{}
+	if data, err := deps.Devices.FetchData(ctx); err != nil {
+		log.Printf("Failed to fetch device names for report: %v", err)
+	} else {
+		for _, device := range data.Devices {
+			names[device.ID] = device.Name
+		}
+	}
+	for id := range positions {
+		if _, ok := names[id]; !ok {
+			names[id] = id
+		}
+	}
+
+	for id, name := range names {
+		if contains(pref.HiddenDevices, id) || !deps.DeviceOrganizations.allows(organizationID, id) {
+			continue
+		}
+		track := positions[id]
+		summary := DeviceSummary{
+			DeviceID:   id,
+			Name:       name,
+			DistanceKm: filteredDistanceMeters(track) / 1000,
+		}
+
+		active, err := deps.activeDuration(id, from, to)
+		if err != nil {
+			return report, err
+		}
+		summary.ActiveHours = active.Hours()
+
+		for _, g := range geofences {
+			visits := geofenceVisits(id, g, track)
+			summary.GeofenceVisits += len(visits)
+			report.Visits = append(report.Visits, visits...)
+		}
+		report.Devices = append(report.Devices, summary)
+	}
+
+	sortReport(&report)
+	return report, nil
+}
+
+// activeDuration is how long a device spent moving or idling between from
+// and to.
+func (deps *HandlerDependencies) activeDuration(deviceID string, from, to time.Time) (time.Duration, error) {
+	timeline, err := deps.States.Timeline(deviceID, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	var active time.Duration
+	for _, tr := range timeline {
+		if tr.State != stateMoving && tr.State != stateIdling {
+			continue
+		}
+		start, end := tr.StartedAt, now
+		if tr.EndedAt != nil {
+			end = *tr.EndedAt
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			active += end.Sub(start)
+		}
+	}
+	return active, nil
+}
+
+// geofenceVisits finds the stays of a device inside g along its track.
+func geofenceVisits(deviceID string, g Geofence, track []StoredPosition) []GeofenceVisit {
+	var visits []GeofenceVisit
+	inside := false
+	for _, p := range track {
+		contained := g.Contains(p.Position)
+		switch {
+		case contained && !inside:
+			visits = append(visits, GeofenceVisit{DeviceID: deviceID, Geofence: g.Name, EnteredAt: p.RecordedAt})
+		case !contained && inside:
+			exited := p.RecordedAt
+			visits[len(visits)-1].ExitedAt = &exited
+		}
+		inside = contained
+	}
+	return visits
+}
+
+// HandleFleetReport renders a report for the preference in ?id= between
+// ?from= and ?to= (default the last 24 hours) as ?format=csv|html|pdf
+// (default csv).
+func (deps *HandlerDependencies) HandleFleetReport(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseTimeRange(r.URL.Query(), defaultHistoryWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = reportCSV
+	}
+	if !validReportFormat(format) {
+		http.Error(w, "format must be csv, html or pdf", http.StatusBadRequest)
+		return
+	}
+
+	pref, ok := deps.preferenceForDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := deps.buildFleetReport(r.Context(), "Fleet report", pref, from, to)
+	if err != nil {
+		http.Error(w, "Failed to build report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, err := renderReport(report, format)
+	if err != nil {
+		http.Error(w, "Failed to render report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contentType, ext := reportContentType(format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="fleet-report-`+to.Format("2006-01-02")+"."+ext+`"`)
+	w.Write(body)
+}
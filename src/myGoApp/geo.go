@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const earthRadiusMeters = 6371000.0
+
+// haversineMeters returns the great-circle distance between two positions.
+func haversineMeters(a, b Position) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := (b.Latitude - a.Latitude) * math.Pi / 180
+	dLng := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// BoundingBox is an axis-aligned latitude/longitude rectangle. Boxes that
+// cross the antimeridian have MinLng greater than MaxLng.
+type BoundingBox struct {
+	MinLng, MinLat, MaxLng, MaxLat float64
+}
+
+// parseBoundingBox parses "minLng,minLat,maxLng,maxLat", the GeoJSON bbox
+// order.
+func parseBoundingBox(value string) (BoundingBox, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return BoundingBox{}, fmt.Errorf("bbox must be minLng,minLat,maxLng,maxLat")
+	}
+
+	var coords [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return BoundingBox{}, fmt.Errorf("Invalid bbox coordinate %q", part)
+		}
+		coords[i] = v
+	}
+
+	box := BoundingBox{MinLng: coords[0], MinLat: coords[1], MaxLng: coords[2], MaxLat: coords[3]}
+	if box.MinLat > box.MaxLat {
+		return BoundingBox{}, fmt.Errorf("bbox minLat must not exceed maxLat")
+	}
+	if !validLatitude(box.MinLat) || !validLatitude(box.MaxLat) || !validLongitude(box.MinLng) || !validLongitude(box.MaxLng) {
+		return BoundingBox{}, fmt.Errorf("bbox coordinates out of range")
+	}
+	return box, nil
+}
+
+func (b BoundingBox) Contains(p Position) bool {
+	if p.Latitude < b.MinLat || p.Latitude > b.MaxLat {
+		return false
+	}
+	if b.MinLng <= b.MaxLng {
+		return p.Longitude >= b.MinLng && p.Longitude <= b.MaxLng
+	}
+	return p.Longitude >= b.MinLng || p.Longitude <= b.MaxLng
+}
+
+func validLatitude(lat float64) bool {
+	return lat >= -90 && lat <= 90
+}
+
+func validLongitude(lng float64) bool {
+	return lng >= -180 && lng <= 180
+}
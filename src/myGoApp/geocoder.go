@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// geocodeCellDegrees is the size of the coordinate cells lookups are
+	// cached by, about 1 km.
+	geocodeCellDegrees = 0.01
+	geocodeCacheLimit  = 100000
+	defaultMaxPlaceKm  = 50
+)
+
+// place is one populated place from the gazetteer.
+type place struct {
+	Name     string
+	Region   string
+	Position Position
+}
+
+// ReverseGeocoder resolves positions to the nearest place in an offline
+// gazetteer. A nil *ReverseGeocoder resolves nothing, which is how the
+// backend runs when no gazetteer is configured.
+type ReverseGeocoder struct {
+	places         *spatialIndex[place]
+	maxDistanceKm  float64
+	cellsPerDegree float64
+
+	mu    sync.Mutex
+	cache map[[2]int32]string
+}
+
+// newReverseGeocoderFromEnv loads the gazetteer named by GAZETTEER_PATH.
+// Places further away than GEOCODER_MAX_DISTANCE_KM (default 50) are not
+// used. It returns nil when GAZETTEER_PATH is unset.
+func newReverseGeocoderFromEnv() (*ReverseGeocoder, error) {
+	path := os.Getenv("GAZETTEER_PATH")
+	if path == "" {
+		return nil, nil
+	}
+
+	maxDistanceKm := float64(defaultMaxPlaceKm)
+	if v := os.Getenv("GEOCODER_MAX_DISTANCE_KM"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return nil, fmt.Errorf("Invalid GEOCODER_MAX_DISTANCE_KM: %q", v)
+		}
+		maxDistanceKm = f
+	}
+
+	places, err := loadGazetteer(path)
+	if err != nil {
+		return nil, err
+	}
+	return newReverseGeocoder(places, maxDistanceKm), nil
+}
+
+func newReverseGeocoder(places []place, maxDistanceKm float64) *ReverseGeocoder {
+	return &ReverseGeocoder{
+		places:         newSpatialIndex(places, func(p place) Position { return p.Position }),
+		maxDistanceKm:  maxDistanceKm,
+		cellsPerDegree: 1 / geocodeCellDegrees,
+		cache:          map[[2]int32]string{},
+	}
+}
+
+// loadGazetteer reads a GeoNames dump (e.g. cities15000.txt): tab-separated
+// rows of which it keeps the populated places (feature class P). US places
+// are labelled with their state, others with their country code.
+func loadGazetteer(path string) ([]place, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open gazetteer: %v", err)
+	}
+	defer f.Close()
+
+	var places []place
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 11 {
+			return nil, fmt.Errorf("Invalid gazetteer line %d: expected GeoNames columns", line)
+		}
+		if fields[6] != "P" {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(fields[4], 64)
+		lng, err2 := strconv.ParseFloat(fields[5], 64)
+		if err1 != nil || err2 != nil || !validLatitude(lat) || !validLongitude(lng) {
+			return nil, fmt.Errorf("Invalid gazetteer line %d: bad coordinates", line)
+		}
+
+		region := fields[8]
+		if region == "US" && fields[10] != "" {
+			region = fields[10]
+		}
+		places = append(places, place{
+			Name:     fields[1],
+			Region:   region,
+			Position: Position{Latitude: lat, Longitude: lng},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read gazetteer: %v", err)
+	}
+	if len(places) == 0 {
+		return nil, fmt.Errorf("Gazetteer %s has no populated places", path)
+	}
+	return places, nil
+}
+
+// Address describes pos as "near <place>, <region>", or returns "" when no
+// place is close enough. Results are cached per coordinate cell.
+func (g *ReverseGeocoder) Address(pos Position) string {
+	if g == nil || (pos.Latitude == 0 && pos.Longitude == 0) {
+		return ""
+	}
+
+	cell := [2]int32{
+		int32(math.Floor(pos.Latitude * g.cellsPerDegree)),
+		int32(math.Floor(pos.Longitude * g.cellsPerDegree)),
+	}
+	g.mu.Lock()
+	address, ok := g.cache[cell]
+	g.mu.Unlock()
+	if ok {
+		return address
+	}
+
+	// Resolve the cell by its center so every position in it gets the
+	// same answer.
+	center := Position{
+		Latitude:  (float64(cell[0]) + 0.5) / g.cellsPerDegree,
+		Longitude: (float64(cell[1]) + 0.5) / g.cellsPerDegree,
+	}
+	if p, meters, found := g.places.Nearest(center); found && meters <= g.maxDistanceKm*1000 {
+		address = "near " + p.Name
+		if p.Region != "" {
+			address += ", " + p.Region
+		}
+	}
+
+	g.mu.Lock()
+	if len(g.cache) >= geocodeCacheLimit {
+		// Fleets stay within a limited area, so simply starting over
+		// is cheaper than tracking recency.
+		g.cache = map[[2]int32]string{}
+	}
+	g.cache[cell] = address
+	g.mu.Unlock()
+	return address
+}
+
+// addAddresses fills in the address of each device.
+func (g *ReverseGeocoder) addAddresses(devices []Device) {
+	for i := range devices {
+		devices[i].Address = g.Address(devices[i].Position)
+	}
+}
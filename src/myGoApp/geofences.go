@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errGeofenceNotFound = errors.New("geofence not found")
+
+// Geofence is a named circular area that reports count visits to.
+type Geofence struct {
+	ID             int       `json:"id"`
+	OrganizationID int       `json:"organization_id,omitempty"`
+	Name           string    `json:"name"`
+	Center         Position  `json:"center"`
+	RadiusMeters   float64   `json:"radius_meters"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (g Geofence) Contains(p Position) bool {
+	return haversineMeters(g.Center, p) <= g.RadiusMeters
+}
+
+func (g Geofence) validate() error {
+	switch {
+	case strings.TrimSpace(g.Name) == "":
+		return fmt.Errorf("name is required")
+	case !validLatitude(g.Center.Latitude) || !validLongitude(g.Center.Longitude):
+		return fmt.Errorf("center must be a valid position")
+	case g.RadiusMeters <= 0:
+		return fmt.Errorf("radius_meters must be positive")
+	}
+	return nil
+}
+
+type geofenceStore struct {
+	db *sql.DB
+}
+
+func newGeofenceStore(db *sql.DB) (*geofenceStore, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS geofences (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL,
+            lat REAL NOT NULL,
+            lng REAL NOT NULL,
+            radius_meters REAL NOT NULL,
+            created_at DATETIME NOT NULL
+        );
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	if err := addColumnIfMissing(db, "geofences", "organization_id", "INTEGER"); err != nil {
+		return nil, fmt.Errorf("Failed to migrate geofences: %v", err)
+	}
+	return &geofenceStore{db: db}, nil
+}
+
+const geofenceColumns = "id, organization_id, name, lat, lng, radius_meters, created_at"
+
+// List returns the geofences of an organization, or every geofence for 0.
+func (s *geofenceStore) List(organizationID int) ([]Geofence, error) {
+	query := "SELECT " + geofenceColumns + " FROM geofences"
+	var args []any
+	if organizationID != 0 {
+		query += " WHERE organization_id = ?"
+		args = append(args, organizationID)
+	}
+	rows, err := s.db.Query(query+" ORDER BY name, id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	geofences := []Geofence{}
+	for rows.Next() {
+		g, err := scanGeofence(rows)
+		if err != nil {
+			return nil, err
+		}
+		geofences = append(geofences, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return geofences, nil
+}
+
+func (s *geofenceStore) Get(id int) (Geofence, error) {
+	g, err := scanGeofence(s.db.QueryRow("SELECT "+geofenceColumns+" FROM geofences WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return g, fmt.Errorf("No geofence found for ID %d: %w", id, errGeofenceNotFound)
+	}
+	return g, err
+}
+
+func (s *geofenceStore) Create(g Geofence) (Geofence, error) {
+	g.CreatedAt = time.Now().UTC()
+	var organizationID any
+	if g.OrganizationID != 0 {
+		organizationID = g.OrganizationID
+	}
+	result, err := s.db.Exec(
+		"INSERT INTO geofences(organization_id, name, lat, lng, radius_meters, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		organizationID, g.Name, g.Center.Latitude, g.Center.Longitude, g.RadiusMeters, g.CreatedAt)
+	if err != nil {
+		return g, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return g, err
+	}
+	g.ID = int(id)
+	return g, nil
+}
+
+func (s *geofenceStore) Delete(id int) error {
+	result, err := s.db.Exec("DELETE FROM geofences WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No geofence found for ID %d: %w", id, errGeofenceNotFound)
+	}
+	return nil
+}
+
+func scanGeofence(row interface{ Scan(...any) error }) (Geofence, error) {
+	var g Geofence
+	var organizationID sql.NullInt64
+	err := row.Scan(&g.ID, &organizationID, &g.Name, &g.Center.Latitude, &g.Center.Longitude, &g.RadiusMeters, &g.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return g, err
+		}
+		return g, fmt.Errorf("Database error: %v", err)
+	}
+	g.OrganizationID = int(organizationID.Int64)
+	g.CreatedAt = g.CreatedAt.UTC()
+	return g, nil
+}
+
+// HandleGeofences routes GET/POST /geofences and GET/DELETE /geofences/{id}.
+// Members of an organization only see and change its geofences.
+func (deps *HandlerDependencies) HandleGeofences(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	organizationID := 0
+	if p := principalFromContext(r.Context()); p != nil {
+		organizationID = p.OrganizationID
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/geofences"), "/")
+	if rest == "" {
+		switch r.Method {
+		case "GET":
+			geofences, err := deps.Geofences.List(organizationID)
+			if err != nil {
+				http.Error(w, "Failed to fetch geofences: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, geofences)
+		case "POST":
+			deps.HandleCreateGeofence(w, r, organizationID)
+		default:
+			writeMethodNotAllowed(w)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(rest)
+	if err != nil {
+		http.Error(w, "Invalid geofence ID", http.StatusBadRequest)
+		return
+	}
+	g, err := deps.Geofences.Get(id)
+	if err == nil && organizationID != 0 && g.OrganizationID != organizationID {
+		err = fmt.Errorf("No geofence found for ID %d: %w", id, errGeofenceNotFound)
+	}
+	if err != nil {
+		writeGeofenceError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, g)
+	case "DELETE":
+		if err := deps.Geofences.Delete(id); err != nil {
+			writeGeofenceError(w, err)
+			return
+		}
+		deps.Audit.Record(r, "geofence.delete", "geofence", id, g, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// HandleCreateGeofence creates a geofence for the caller's organization
+// from {"name", "center", "radius_meters"}.
+func (deps *HandlerDependencies) HandleCreateGeofence(w http.ResponseWriter, r *http.Request, organizationID int) {
+	var g Geofence
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := g.validate(); err != nil {
+		http.Error(w, "Invalid geofence: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.OrganizationID = organizationID
+
+	g, err := deps.Geofences.Create(g)
+	if err != nil {
+		http.Error(w, "Failed to create geofence: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deps.Audit.Record(r, "geofence.create", "geofence", g.ID, nil, g)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+func writeGeofenceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errGeofenceNotFound) {
+		http.Error(w, "Geofence not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, "Failed to access geofence: "+err.Error(), http.StatusInternalServerError)
+}
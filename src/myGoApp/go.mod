@@ -2,4 +2,7 @@ module myGoApp
 
 go 1.21.3
 
-require github.com/mattn/go-sqlite3 v1.14.17 // indirect
+require (
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.17
+)
@@ -1,55 +1,78 @@
 package main
 
 import (
-	"database/sql" 
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
-	"fmt"
 )
 
 type HandlerDependencies struct {
-	DB     *sql.DB
-	ApiKey string
+	Store    PreferenceStore
+	Devices  DeviceSource
+	Upstream *UpstreamClient
+	Geocoder *ReverseGeocoder
+
+	// DeviceIndex is behind Devices, so every device list fetch rebuilds
+	// it. DeviceOrganizations scopes Devices to the caller's organization.
+	DeviceIndex         *deviceIndex
+	DeviceOrganizations *deviceOrganizations
+	States              *stateTracker
+	Positions           *positionLog
+	Geofences           *geofenceStore
+	Reports             *reportScheduler
+	Stats               *statsRollup
+
+	Access        accessConfig
+	Organizations *organizationStore
+	Tokens        *apiTokenStore
+	Sessions      *sessionStore
+	OIDC          *oidcProvider // nil unless single sign-on is configured
+	Audit         *auditLog
+	Retention     *retentionManager
+	Privacy       *privacyZones
+	Drivers       *driverStore
+
+	PreferenceTemplates *preferenceTemplateStore
+	Teams               *teamStore
+	PreferenceLayers    *preferenceLayerStore
 }
 
 func (deps *HandlerDependencies) Handler(w http.ResponseWriter, r *http.Request) {
 	setCORSHeaders(w)
 
-	data, err := FetchData(deps.ApiKey)
+	query, err := parseDeviceQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Failed to fetch data", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	userID := 1
-	if idParam, ok := r.URL.Query()["id"]; ok {
-		if len(idParam) > 0 {
-			userID, err = strconv.Atoi(idParam[0])
-			if err != nil {
-				http.Error(w, "Invalid user ID", http.StatusBadRequest)
-				return
-			}
-		}
+	data, err := deps.Devices.FetchData(r.Context())
+	if err != nil {
+		deps.Upstream.writeUpstreamError(w, err)
+		return
 	}
 
-	pref, err := getUserPreference(deps.DB, userID)
+	userID, err := getUserIDFromQuery(r)
 	if err != nil {
-		http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
-	var filteredDevices []Device
-	for _, device := range data.Devices {
-		if !contains(pref.HiddenDevices, device.ID) {
-			filteredDevices = append(filteredDevices, device)
-		}
+	pref, err := deps.preferenceByID(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		return
 	}
 
-	response, err := json.Marshal(ApiResponse{Devices: filteredDevices})
+	devices, total, next := query.apply(data.Devices, pref.HiddenDevices)
+	deps.Geocoder.addAddresses(devices)
+
+	response, err := json.Marshal(ApiResponse{Devices: devices, Total: total, NextCursor: next})
 	if err != nil {
 		http.Error(w, "Failed to convert data to JSON", http.StatusInternalServerError)
 		return
@@ -68,12 +91,18 @@ func (deps *HandlerDependencies) HandleGetUserPreference(w http.ResponseWriter,
 		return
 	}
 
-	pref, err := getUserPreference(deps.DB, userID)
+	pref, err := deps.Store.GetPreference(userID)
 	if err != nil {
-		http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		if errors.Is(err, errPreferenceNotFound) {
+			http.Error(w, "Preferences not found for the given ID", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		}
 		return
 	}
 
+	w.Header().Set("ETag", preferenceETag(pref))
+
 	base64Icon := base64.StdEncoding.EncodeToString(pref.Icon)
 	pref.Icon = []byte(base64Icon)
 
@@ -102,14 +131,12 @@ func (deps *HandlerDependencies) HandleUpdateUserPreference(w http.ResponseWrite
 		return
 	}
 
-	
 	userID, err := getUserIDFromURL(r.URL.Path)
 	if err != nil {
 		http.Error(w, "Invalid user ID: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	
 	var pref UserPreference
 	err = json.NewDecoder(r.Body).Decode(&pref)
 	if err != nil {
@@ -117,81 +144,120 @@ func (deps *HandlerDependencies) HandleUpdateUserPreference(w http.ResponseWrite
 		return
 	}
 
-	
 	pref.ID = userID
 
+	// The version in the body is whatever the client last read; the
+	// If-Match header says which version the update is meant for.
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		http.Error(w, "Preference has been modified", http.StatusPreconditionFailed)
+		return
+	}
+	pref.Version = version
 
-	err = updateUserPreference(deps.DB, pref)
+	pref, err = deps.Store.UpdatePreference(pref, actorFromRequest(r))
 	if err != nil {
-		http.Error(w, "Failed to update user preferences: "+err.Error(), http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, errPreferenceNotFound):
+			http.Error(w, "Preferences not found for the given ID", http.StatusNotFound)
+		case errors.Is(err, errVersionConflict):
+			http.Error(w, "Preference has been modified", http.StatusPreconditionFailed)
+		default:
+			http.Error(w, "Failed to update user preferences: "+err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
+	deps.auditPreferenceChange(r, "preference.update", pref)
 
+	w.Header().Set("ETag", preferenceETag(pref))
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"message": "Preference updated successfully"}`))
 }
 
 func (deps *HandlerDependencies) HandleGetUserPreferenceByUsername(w http.ResponseWriter, r *http.Request) {
-    setCORSHeaders(w)
-
-   
-    username, err := getUsernameFromURL(r.URL.Path)
-    if err != nil {
-        http.Error(w, "Invalid username: "+err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    
-    pref, err := getUserPreferenceByUsername(deps.DB, username)
-    if err != nil {
-        
-        if err == sql.ErrNoRows {
-            http.Error(w, "Preferences not found for the given username", http.StatusNotFound)
-        } else {
-            http.Error(w, "Server error: "+err.Error(), http.StatusInternalServerError)
-        }
-        return
-    }
-
-    
-    base64Icon := base64.StdEncoding.EncodeToString(pref.Icon)
-    pref.Icon = []byte(base64Icon) 
-
-   
-    response, err := json.Marshal(pref)
-    if err != nil {
-        http.Error(w, "Failed to convert user preferences to JSON: "+err.Error(), http.StatusInternalServerError)
-        return
-    }
-
-  
-    w.Header().Set("Content-Type", "application/json")
-    w.Write(response)
+	setCORSHeaders(w)
+
+	username, err := getUsernameFromURL(r.URL.Path)
+	if err != nil {
+		http.Error(w, "Invalid username: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pref, err := deps.Store.GetPreferenceByUsername(username)
+	if err != nil {
+
+		if errors.Is(err, errPreferenceNotFound) {
+			http.Error(w, "Preferences not found for the given username", http.StatusNotFound)
+		} else {
+			http.Error(w, "Server error: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("ETag", preferenceETag(pref))
+
+	base64Icon := base64.StdEncoding.EncodeToString(pref.Icon)
+	pref.Icon = []byte(base64Icon)
+
+	response, err := json.Marshal(pref)
+	if err != nil {
+		http.Error(w, "Failed to convert user preferences to JSON: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
 }
 
 func getUsernameFromURL(path string) (string, error) {
-    parts := strings.Split(strings.TrimPrefix(path, "/preferences/by-username/"), "/")
-    if len(parts) != 1 {
-        return "", fmt.Errorf("Invalid URL format")
-    }
-    username, err := url.QueryUnescape(parts[0])
-    if err != nil {
-        return "", fmt.Errorf("Invalid username format: %v", err)
-    }
-    return username, nil
+	parts := strings.Split(strings.TrimPrefix(path, "/preferences/by-username/"), "/")
+	if len(parts) != 1 {
+		return "", fmt.Errorf("Invalid URL format")
+	}
+	username, err := url.QueryUnescape(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("Invalid username format: %v", err)
+	}
+	return username, nil
+}
+
+// getUserIDFromQuery returns the preference ID passed as ?id=, defaulting to
+// the caller's own (0 for service tokens), or to the first user for clients
+// that predate multi-user support.
+func getUserIDFromQuery(r *http.Request) (int, error) {
+	idParam := r.URL.Query().Get("id")
+	if idParam == "" {
+		if p := principalFromContext(r.Context()); p != nil {
+			return p.PreferenceID, nil
+		}
+		return 1, nil
+	}
+	return strconv.Atoi(idParam)
+}
+
+// preferenceByID loads the effective preference of a user, resolved from
+// their organization, team and personal layers, or for ID 0 the empty
+// preference used by callers that have none, which hides nothing.
+func (deps *HandlerDependencies) preferenceByID(id int) (UserPreference, error) {
+	if id == 0 {
+		return UserPreference{}, nil
+	}
+	pref, err := deps.Store.GetPreference(id)
+	if err != nil {
+		return pref, err
+	}
+	return deps.effectivePreference(pref), nil
 }
 
 func getUserIDFromURL(path string) (int, error) {
-	
+
 	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
 	if len(parts) < 2 {
 		return 0, fmt.Errorf("Invalid URL format")
 	}
 
-	
 	idStr := parts[len(parts)-1]
 
-	
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		return 0, fmt.Errorf("Invalid user ID format: %v", err)
@@ -200,17 +266,63 @@ func getUserIDFromURL(path string) (int, error) {
 	return id, nil
 }
 
+// preferenceETag returns the strong entity tag for the stored version of pref.
+func preferenceETag(pref UserPreference) string {
+	return fmt.Sprintf("\"%d\"", pref.Version)
+}
+
+// ifMatchVersion returns the preference version named by the request's
+// If-Match header, or 0 for "*", which overwrites whatever is stored.
+// Without the header it answers 428, and for a tag that can never match a
+// stored version 412; ok is false then.
+func ifMatchVersion(w http.ResponseWriter, r *http.Request) (version int, ok bool) {
+	ifMatch := r.Header.Get("If-Match")
+	switch ifMatch {
+	case "":
+		http.Error(w, "If-Match is required; send the ETag of the preference, or * to overwrite it", http.StatusPreconditionRequired)
+		return 0, false
+	case "*":
+		return 0, true
+	}
+	if version, ok = parseETag(ifMatch); !ok {
+		http.Error(w, "Preference has been modified", http.StatusPreconditionFailed)
+	}
+	return version, ok
+}
+
+// parseETag extracts the preference version from an entity tag produced by
+// preferenceETag. Weak tags are accepted since the version is the same.
+func parseETag(tag string) (int, bool) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.Atoi(tag[1 : len(tag)-1])
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
 func contains(slice []string, val string) bool {
-    for _, item := range slice {
-        if item == val {
-            return true
-        }
-    }
-    return false
+	for _, item := range slice {
+		if item == val {
+			return true
+		}
+	}
+	return false
 }
 
 func setCORSHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Origin, Accept, X-Requested-With")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Origin, Accept, X-Requested-With, If-Match, X-Username, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	w.Write([]byte(`{"error": "Method not allowed"}`))
 }
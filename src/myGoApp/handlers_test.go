@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPreferenceUpdatesNeedIfMatch(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "handlers.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	deps := &HandlerDependencies{Store: newMemoryStore()}
+	if deps.Audit, err = newAuditLog(db); err != nil {
+		t.Fatal(err)
+	}
+	pref, err := deps.Store.CreatePreference(UserPreference{Username: "alice", SortOrder: "name"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strconv.Itoa(pref.ID)
+
+	for _, tt := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/preferences/" + id, deps.HandleGetUserPreference},
+		{"/preferences/by-username/alice", deps.HandleGetUserPreferenceByUsername},
+	} {
+		w := httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest("GET", tt.path, nil))
+		if got := w.Header().Get("ETag"); got != `"1"` {
+			t.Errorf("GET %s: ETag %q, want %q", tt.path, got, `"1"`)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		ifMatch string
+		status  int
+		etag    string
+	}{
+		{"without If-Match", "", http.StatusPreconditionRequired, ""},
+		{"with a malformed tag", "version-1", http.StatusPreconditionFailed, ""},
+		{"with the current tag", `"1"`, http.StatusOK, `"2"`},
+		{"with a stale tag", `"1"`, http.StatusPreconditionFailed, ""},
+		{"with a weak current tag", `W/"2"`, http.StatusOK, `"3"`},
+		{"with *", "*", http.StatusOK, `"4"`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/preferences/update/"+id, strings.NewReader(`{"username": "alice", "sortOrder": "status"}`))
+		if tt.ifMatch != "" {
+			r.Header.Set("If-Match", tt.ifMatch)
+		}
+		w := httptest.NewRecorder()
+		deps.HandleUpdateUserPreference(w, r)
+		if w.Code != tt.status {
+			t.Errorf("update %s: %d %s, want %d", tt.name, w.Code, w.Body, tt.status)
+		}
+		if got := w.Header().Get("ETag"); got != tt.etag {
+			t.Errorf("update %s: ETag %q, want %q", tt.name, got, tt.etag)
+		}
+	}
+
+	stored, err := deps.Store.GetPreference(pref.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != 4 || stored.SortOrder != "status" {
+		t.Errorf("stored version %d with sort order %q, want version 4 sorted by status", stored.Version, stored.SortOrder)
+	}
+}
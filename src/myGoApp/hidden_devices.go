@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// hiddenDevicesRequest is the body of POST /preferences/{id}/hidden-devices.
+// Besides explicit add/remove lists it accepts selectors that are resolved
+// against the current device list from OneStepGPS.
+type hiddenDevicesRequest struct {
+	HiddenDevicesChange
+	HidePrefix   string `json:"hidePrefix"`
+	HidePattern  string `json:"hidePattern"`
+	HideInactive bool   `json:"hideInactive"`
+}
+
+func (req hiddenDevicesRequest) needsDevices() bool {
+	return req.HidePrefix != "" || req.HidePattern != "" || req.HideInactive
+}
+
+// HandleUpdateHiddenDevices hides and shows sets of devices in one atomic
+// change, recorded as a single preference revision.
+func (deps *HandlerDependencies) HandleUpdateHiddenDevices(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"error": "Method not allowed"}`))
+		return
+	}
+
+	userID, err := getUserIDFromURL(strings.TrimSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/hidden-devices"))
+	if err != nil {
+		http.Error(w, "Invalid user ID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req hiddenDevicesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var pattern *regexp.Regexp
+	if req.HidePattern != "" {
+		pattern, err = regexp.Compile(req.HidePattern)
+		if err != nil {
+			http.Error(w, "Invalid hidePattern: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	change := req.HiddenDevicesChange
+	if req.needsDevices() {
+		data, err := deps.Devices.FetchData(r.Context())
+		if err != nil {
+			deps.Upstream.writeUpstreamError(w, err)
+			return
+		}
+		for _, device := range data.Devices {
+			switch {
+			case req.HidePrefix != "" && strings.HasPrefix(device.Name, req.HidePrefix),
+				pattern != nil && pattern.MatchString(device.Name),
+				req.HideInactive && !isDeviceActive(device):
+				change.Add = append(change.Add, device.ID)
+			}
+		}
+	}
+
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	pref, err := deps.Store.UpdateHiddenDevices(userID, change, version, actorFromRequest(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, errPreferenceNotFound):
+			http.Error(w, "Preferences not found for the given ID", http.StatusNotFound)
+		case errors.Is(err, errVersionConflict):
+			http.Error(w, "Preference has been modified", http.StatusPreconditionFailed)
+		default:
+			http.Error(w, "Failed to update hidden devices: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	deps.auditPreferenceChange(r, "preference.hidden_devices", pref)
+
+	w.Header().Set("ETag", preferenceETag(pref))
+
+	base64Icon := base64.StdEncoding.EncodeToString(pref.Icon)
+	pref.Icon = []byte(base64Icon)
+
+	response, err := json.Marshal(pref)
+	if err != nil {
+		http.Error(w, "Failed to convert user preferences to JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// isDeviceActive reports whether OneStepGPS considers the device active.
+func isDeviceActive(device Device) bool {
+	return strings.EqualFold(device.IsActive, "active")
+}
@@ -1,35 +1,242 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"log"
 	"net/http"
 	"os"
-	_ "github.com/mattn/go-sqlite3"
+	"os/signal"
+	"syscall"
+
+	"myGoApp/simulator"
 )
 
 func main() {
-	apiKey := os.Getenv("ONESTEPGPS_API_KEY")
-	if apiKey == "" {
-		panic("ONESTEPGPS_API_KEY environment variable not set!")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "simulate":
+			runSimulatorServer()
+			return
+		}
 	}
 
-	db, err := sql.Open("sqlite3", "./preferences.db")
+	upstreamMode := os.Getenv("UPSTREAM_MODE")
+	apiKeys, err := newAPIKeySourceFromEnv(upstreamMode == upstreamReplay || upstreamMode == upstreamSimulate)
+	if err != nil {
+		panic(err.Error())
+	}
+	log.SetOutput(&redactingWriter{w: os.Stderr, keys: apiKeys})
+
+	// SIGHUP forces the API key file to be re-read after a rotation.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := apiKeys.Reload(); err != nil {
+				log.Printf("Failed to reload API key: %v", err)
+			}
+		}
+	}()
+
+	dbPath := os.Getenv("SQLITE_PATH")
+	if dbPath == "" {
+		dbPath = "./preferences.db"
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		panic("Failed to open database: " + err.Error())
 	}
 	defer db.Close()
 
+	store, err := openPreferenceStore(db)
+	if err != nil {
+		panic("Failed to open preference store: " + err.Error())
+	}
+	defer store.Close()
+
+	upstreamConfig, err := upstreamConfigFromEnv()
+	if err != nil {
+		panic(err.Error())
+	}
+	upstreamConfig.Transport, err = newUpstreamTransport(upstreamMode)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	geocoder, err := newReverseGeocoderFromEnv()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	upstream := newUpstreamClient(apiKeys, upstreamConfig)
 	deps := &HandlerDependencies{
-		DB:     db,
-		ApiKey: apiKey,
+		Store:    store,
+		Devices:  upstream,
+		Upstream: upstream,
+		Geocoder: geocoder,
+	}
+	if upstreamMode == upstreamSimulate {
+		simConfig, err := simulator.ConfigFromEnv()
+		if err != nil {
+			panic(err.Error())
+		}
+		deps.Devices = simulatedFleet{sim: simulator.New(simConfig)}
 	}
 
-	
-	http.HandleFunc("/", deps.Handler)
-	http.HandleFunc("/preferences/", deps.HandleGetUserPreference) // GET request
-	http.HandleFunc("/preferences/update/", deps.HandleUpdateUserPreference) // POST request
-	http.HandleFunc("/preferences/by-username/", deps.HandleGetUserPreferenceByUsername) // New GET request by username
+	deps.Drivers, err = newDriverStore(db)
+	if err != nil {
+		panic(err.Error())
+	}
+	deps.Privacy, err = newPrivacyZones(db, deps.Drivers)
+	if err != nil {
+		panic(err.Error())
+	}
+	upstream.privacy = deps.Privacy
+	deps.DeviceOrganizations, err = newDeviceOrganizations(db)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	// Every device list fetch passes through the position log, the state
+	// tracker, privacy zones and the spatial index, in that order. Handlers
+	// then only get the devices of the caller's organization.
+	deps.Positions, err = newPositionLogFromEnv(db, deps.Devices, deps.Privacy)
+	if err != nil {
+		panic("Failed to start position logging: " + err.Error())
+	}
+	stateConfig, err := deviceStateConfigFromEnv()
+	if err != nil {
+		panic(err.Error())
+	}
+	deps.States, err = newStateTracker(db, deps.Positions, stateConfig, deps.Privacy)
+	if err != nil {
+		panic("Failed to start device state tracking: " + err.Error())
+	}
+	deps.DeviceIndex, err = newDeviceIndexFromEnv(deps.Privacy.mask(deps.States))
+	if err != nil {
+		panic(err.Error())
+	}
+	deps.Devices = deps.DeviceOrganizations.scoped(deps.DeviceIndex)
+	go deps.States.poll(context.Background(), deps.DeviceIndex)
 
+	deps.Audit, err = newAuditLog(db)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	deps.Geofences, err = newGeofenceStore(db)
+	if err != nil {
+		panic(err.Error())
+	}
+	deliveryConfig, err := reportDeliveryConfigFromEnv()
+	if err != nil {
+		panic(err.Error())
+	}
+	deps.Reports, err = newReportScheduler(db, deps, deliveryConfig)
+	if err != nil {
+		panic(err.Error())
+	}
+	go deps.Reports.loop(context.Background())
+
+	deps.Stats, err = newStatsRollupFromEnv(db, deps.Positions)
+	if err != nil {
+		panic(err.Error())
+	}
+	go deps.Stats.loop(context.Background())
+
+	deps.Retention, err = newRetentionManagerFromEnv(db, deps.DeviceOrganizations)
+	if err != nil {
+		panic(err.Error())
+	}
+	go deps.Retention.loop(context.Background())
+
+	deps.Access, err = accessConfigFromEnv()
+	if err != nil {
+		panic(err.Error())
+	}
+	deps.Organizations, err = newOrganizationStore(db)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	deps.Teams, err = newTeamStore(db)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	deps.PreferenceLayers, err = newPreferenceLayerStore(db)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	deps.PreferenceTemplates, err = newPreferenceTemplateStore(db)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	deps.Tokens, err = newAPITokenStore(db)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	oidcConfig, err := oidcConfigFromEnv()
+	if err != nil {
+		panic(err.Error())
+	}
+	if oidcConfig.Issuer != "" {
+		deps.OIDC = newOIDCProvider(oidcConfig)
+	}
+	deps.Sessions, err = newSessionStore(db, oidcConfig.SessionTTL)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	rateLimitConfig, err := rateLimitConfigFromEnv()
+	if err != nil {
+		panic(err.Error())
+	}
+	limiter, err := newRateLimiter(rateLimitConfig)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	// Each route applies the client address's rate limit, authenticates
+	// the caller and checks its access policy, and then applies the
+	// caller's own rate limit for the route.
+	route := func(pattern string, policy accessPolicy, handler http.HandlerFunc) {
+		http.HandleFunc(pattern, limiter.limitAddress(pattern, deps.authorize(policy, limiter.limitIdentity(pattern, handler))))
+	}
+	route("/", policyDevices, deps.Handler)
+	route("/preferences/", policyPreferences, deps.HandlePreferences)                             // GET request, revisions and restore
+	route("/preferences/update/", policyPreferences, deps.HandleUpdateUserPreference)             // POST request
+	route("/preferences/by-username/", policyPreferences, deps.HandleGetUserPreferenceByUsername) // New GET request by username
+	route("/devices/", policyDevices, deps.HandleDevices)                                         // Device detail, point history and spatial queries
+	route("/reports/", policyReports, deps.HandleReports)                                         // Driver, trip and fleet reports, report schedules
+	route("/geofences", policyGeofences, deps.HandleGeofences)
+	route("/geofences/", policyGeofences, deps.HandleGeofences)
+	route("/stats/", policyDevices, deps.HandleStats) // Distance rollups
+	route("/orgs", policyIdentified, deps.HandleOrganizations)
+	route("/orgs/", policyIdentified, deps.HandleOrganizations) // Organizations and member roles
+	route("/tokens", policyIdentified, deps.HandleAPITokens)
+	route("/tokens/", policyIdentified, deps.HandleAPITokens) // Personal and service API tokens
+	route("/audit", policyAudit, deps.HandleAudit)
+	route("/audit/", policyAudit, deps.HandleAudit) // Audit log query and JSON Lines export
+	route("/retention", policyRetention, deps.HandleRetention)
+	route("/retention/", policyRetention, deps.HandleRetention) // Position history retention policies and dry run
+	route("/privacy-zones", policyPrivacyZones, deps.HandlePrivacyZones)
+	route("/privacy-zones/", policyPrivacyZones, deps.HandlePrivacyZones) // Zones masking device positions
+	route("/drivers", policyDrivers, deps.HandleDrivers)
+	route("/drivers/", policyDrivers, deps.HandleDrivers) // Drivers, device assignments, locations and shifts
+	route("/teams", policyTeams, deps.HandleTeams)
+	route("/teams/", policyTeams, deps.HandleTeams) // Teams and their shared preferences
+	route("/preference-templates", policyPreferenceTemplates, deps.HandlePreferenceTemplates)
+	route("/preference-templates/", policyPreferenceTemplates, deps.HandlePreferenceTemplates) // Preferences new users start with
+	// Login happens before there is anyone to authorize, so it is only
+	// limited by client address.
+	http.HandleFunc("/auth/", limiter.limitAddress("/auth/", deps.HandleAuth))
 
 	panic(http.ListenAndServe(":8081", nil))
 }
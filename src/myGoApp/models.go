@@ -1,11 +1,23 @@
 package main
 
+import "time"
+
 type UserPreference struct {
 	Username      string   `json:"username"`
 	ID            int      `json:"id"`
 	SortOrder     string   `json:"sortOrder"`
 	HiddenDevices []string `json:"hiddenDevices"`
-	Icon          []byte   
+	Icon          []byte
+	Version       int       `json:"version"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// HiddenDevicesChange is a batch edit of a preference's hidden devices.
+type HiddenDevicesChange struct {
+	Add     []string `json:"add"`
+	Remove  []string `json:"remove"`
+	ShowAll bool     `json:"showAll"`
 }
 
 type Device struct {
@@ -13,6 +25,15 @@ type Device struct {
 	Name     string   `json:"display_name"`
 	Position Position `json:"latest_device_point"`
 	IsActive string   `json:"active_state"`
+	Hidden   bool     `json:"hidden,omitempty"`
+	Address  string   `json:"address,omitempty"`
+	// Privacy is "centroid" or "hidden" when a privacy zone masked Position.
+	Privacy string `json:"privacy,omitempty"`
+
+	// State is derived by the backend, see stateTracker.
+	State              string     `json:"state,omitempty"`
+	StateSince         *time.Time `json:"state_since,omitempty"`
+	TimeInStateSeconds int64      `json:"time_in_state_seconds,omitempty"`
 }
 
 type Position struct {
@@ -21,5 +42,71 @@ type Position struct {
 }
 
 type ApiResponse struct {
-	Devices []Device `json:"result_list"`
+	Devices    []Device `json:"result_list"`
+	Total      int      `json:"total"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+type PreferenceRevision struct {
+	PreferenceID int            `json:"preferenceId"`
+	Revision     int            `json:"revision"`
+	Actor        string         `json:"actor"`
+	Snapshot     UserPreference `json:"snapshot"`
+	Diff         PreferenceDiff `json:"diff"`
+	CreatedAt    time.Time      `json:"createdAt"`
+}
+
+type PreferenceDiff struct {
+	SortOrder            *StringChange `json:"sortOrder,omitempty"`
+	HiddenDevicesAdded   []string      `json:"hiddenDevicesAdded,omitempty"`
+	HiddenDevicesRemoved []string      `json:"hiddenDevicesRemoved,omitempty"`
+	IconChanged          bool          `json:"iconChanged,omitempty"`
+}
+
+type StringChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DeviceDetail is the full record of a single device.
+type DeviceDetail struct {
+	Device
+	Make         string    `json:"make"`
+	Model        string    `json:"model"`
+	VIN          string    `json:"vin"`
+	LicensePlate string    `json:"license_plate"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// DevicePoint is one sample of a device's location history.
+type DevicePoint struct {
+	DeviceID  string    `json:"device_id"`
+	Time      time.Time `json:"dt_tracker"`
+	Latitude  float64   `json:"lat"`
+	Longitude float64   `json:"lng"`
+	Altitude  float64   `json:"altitude"`
+	Heading   float64   `json:"angle"`
+	SpeedKph  float64   `json:"speed"`
+	Address   string    `json:"address,omitempty"`
+	Privacy   string    `json:"privacy,omitempty"`
+}
+
+type Driver struct {
+	ID       string `json:"driver_id"`
+	Name     string `json:"display_name"`
+	Phone    string `json:"phone"`
+	Email    string `json:"email"`
+	DeviceID string `json:"device_id"`
+}
+
+type Trip struct {
+	DeviceID       string    `json:"device_id"`
+	DriverID       string    `json:"driver_id"`
+	StartTime      time.Time `json:"start_time"`
+	EndTime        time.Time `json:"end_time"`
+	StartPosition  Position  `json:"start_point"`
+	EndPosition    Position  `json:"end_point"`
+	DistanceMeters float64   `json:"distance"`
+	MaxSpeedKph    float64   `json:"max_speed"`
+	Privacy        string    `json:"privacy,omitempty"`
 }
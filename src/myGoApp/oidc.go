@@ -0,0 +1,625 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcLoginTimeout     = 10 * time.Minute
+	oidcClockSkew        = time.Minute
+	oidcJWKSRefreshDelay = time.Minute
+
+	// oidcMaxPendingLogins bounds the logins awaiting their callback; when
+	// full, the oldest is dropped.
+	oidcMaxPendingLogins = 1000
+
+	// oidcStateCookie binds a login to the browser that started it.
+	oidcStateCookie = "login_state"
+)
+
+// OIDCConfig configures single sign-on with an OpenID Connect provider.
+// Login is disabled when Issuer is empty.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // optional; PKCE protects public clients
+	RedirectURL  string // this backend's /auth/callback as registered with the provider
+	Scopes       []string
+
+	// UsernameClaim names the ID token claim used as the preference
+	// username: "email" (the default), "preferred_username" or "sub".
+	UsernameClaim string
+
+	// PostLoginURL is where the browser goes after logging in, unless the
+	// login asked for another path on the same site.
+	PostLoginURL string
+	SessionTTL   time.Duration
+
+	// TrustUsernameHeader keeps accepting X-Username alongside logins,
+	// for deployments behind a proxy that sets it.
+	TrustUsernameHeader bool
+}
+
+func oidcConfigFromEnv() (OIDCConfig, error) {
+	cfg := OIDCConfig{
+		Issuer:        strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/"),
+		ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:        []string{"openid", "email", "profile"},
+		UsernameClaim: "email",
+		PostLoginURL:  "http://localhost:8080/",
+		SessionTTL:    defaultSessionTTL,
+	}
+	if v := os.Getenv("OIDC_SCOPES"); v != "" {
+		cfg.Scopes = strings.Fields(v)
+	}
+	if v := os.Getenv("OIDC_USERNAME_CLAIM"); v != "" {
+		cfg.UsernameClaim = v
+	}
+	if v := os.Getenv("OIDC_POST_LOGIN_URL"); v != "" {
+		cfg.PostLoginURL = v
+	}
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("Invalid SESSION_TTL: %q", v)
+		}
+		cfg.SessionTTL = d
+	}
+	cfg.TrustUsernameHeader = os.Getenv("TRUST_USERNAME_HEADER") == "true"
+
+	if cfg.Issuer == "" {
+		return cfg, nil
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return cfg, fmt.Errorf("OIDC_CLIENT_ID and OIDC_REDIRECT_URL must be set when OIDC_ISSUER is")
+	}
+	switch cfg.UsernameClaim {
+	case "email", "preferred_username", "sub":
+	default:
+		return cfg, fmt.Errorf("Invalid OIDC_USERNAME_CLAIM: %q", cfg.UsernameClaim)
+	}
+	return cfg, nil
+}
+
+// oidcMetadata is the part of the provider's discovery document we use.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is a login started by /auth/login and awaiting its callback.
+type oidcLogin struct {
+	verifier  string
+	nonce     string
+	redirect  string
+	startedAt time.Time
+}
+
+// oidcProvider runs the authorization code flow with PKCE. Discovery and
+// signing keys are fetched lazily and cached; keys are refetched when a
+// token is signed with one we don't know, so provider key rotation works.
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	metadata    *oidcMetadata
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+	pending     map[string]oidcLogin // by state
+}
+
+func newOIDCProvider(cfg OIDCConfig) *oidcProvider {
+	return &oidcProvider{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		pending: map[string]oidcLogin{},
+	}
+}
+
+func (o *oidcProvider) getJSON(rawURL string, v any) error {
+	resp, err := o.client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (o *oidcProvider) discover() (*oidcMetadata, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.metadata != nil {
+		return o.metadata, nil
+	}
+
+	var m oidcMetadata
+	if err := o.getJSON(o.cfg.Issuer+"/.well-known/openid-configuration", &m); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %v", err)
+	}
+	if strings.TrimSuffix(m.Issuer, "/") != o.cfg.Issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", m.Issuer, o.cfg.Issuer)
+	}
+	o.metadata = &m
+	return o.metadata, nil
+}
+
+// key returns the RSA signing key with the given ID.
+func (o *oidcProvider) key(metadata *oidcMetadata, kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(o.keysFetched) < oidcJWKSRefreshDelay {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(metadata.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("Failed to fetch signing keys: %v", err)
+	}
+	o.keysFetched = time.Now()
+	o.keys = map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		o.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	key, ok := o.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// idTokenClaims are the ID token claims we check or map to a username.
+type idTokenClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	Expiry            float64         `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     any             `json:"email_verified"`
+	PreferredUsername string          `json:"preferred_username"`
+}
+
+// verifyIDToken checks the RS256 signature, issuer, audience, expiry and
+// nonce of an ID token.
+func (o *oidcProvider) verifyIDToken(metadata *oidcMetadata, token, nonce string) (idTokenClaims, error) {
+	var claims idTokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return claims, fmt.Errorf("malformed ID token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return claims, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := o.key(metadata, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("malformed ID token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return claims, fmt.Errorf("invalid ID token signature")
+	}
+
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return claims, fmt.Errorf("malformed ID token claims: %v", err)
+	}
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != o.cfg.Issuer:
+		return claims, fmt.Errorf("ID token issued by %q", claims.Issuer)
+	case !audienceContains(claims.Audience, o.cfg.ClientID):
+		return claims, fmt.Errorf("ID token not issued for this client")
+	case time.Now().Add(-oidcClockSkew).After(time.Unix(int64(claims.Expiry), 0)):
+		return claims, fmt.Errorf("ID token has expired")
+	case claims.Nonce != nonce:
+		return claims, fmt.Errorf("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceContains accepts the aud claim as a string or a list.
+func audienceContains(aud json.RawMessage, clientID string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == clientID
+	}
+	var list []string
+	if json.Unmarshal(aud, &list) == nil {
+		return contains(list, clientID)
+	}
+	return false
+}
+
+// username maps verified claims to a preference username. Unverified
+// email addresses are refused, since anyone could claim them.
+func (o *oidcProvider) username(claims idTokenClaims) (string, error) {
+	switch o.cfg.UsernameClaim {
+	case "sub":
+		return claims.Subject, nil
+	case "preferred_username":
+		if claims.PreferredUsername == "" {
+			return "", fmt.Errorf("ID token has no preferred_username")
+		}
+		return claims.PreferredUsername, nil
+	default:
+		if claims.Email == "" {
+			return "", fmt.Errorf("ID token has no email")
+		}
+		if verified, ok := claims.EmailVerified.(bool); ok && !verified {
+			return "", fmt.Errorf("email %s is not verified", claims.Email)
+		}
+		if verified, ok := claims.EmailVerified.(string); ok && verified != "true" {
+			return "", fmt.Errorf("email %s is not verified", claims.Email)
+		}
+		return strings.ToLower(claims.Email), nil
+	}
+}
+
+func randomURLString(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// pkceChallenge is the S256 code challenge of a verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// startLogin records a pending login and returns the provider URL to send
+// the browser to, along with the state the browser must present again on
+// the callback.
+func (o *oidcProvider) startLogin(redirect string) (string, string, error) {
+	metadata, err := o.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	var state, nonce, verifier string
+	for _, s := range []*string{&state, &nonce, &verifier} {
+		if *s, err = randomURLString(32); err != nil {
+			return "", "", err
+		}
+	}
+
+	o.mu.Lock()
+	oldest := ""
+	for s, login := range o.pending {
+		if time.Since(login.startedAt) > oidcLoginTimeout {
+			delete(o.pending, s)
+		} else if oldest == "" || login.startedAt.Before(o.pending[oldest].startedAt) {
+			oldest = s
+		}
+	}
+	if len(o.pending) >= oidcMaxPendingLogins {
+		delete(o.pending, oldest)
+	}
+	o.pending[state] = oidcLogin{verifier: verifier, nonce: nonce, redirect: redirect, startedAt: time.Now()}
+	o.mu.Unlock()
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.cfg.ClientID},
+		"redirect_uri":          {o.cfg.RedirectURL},
+		"scope":                 {strings.Join(o.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + params.Encode(), state, nil
+}
+
+// finishLogin exchanges the authorization code of a callback and returns
+// the username it maps to and where to send the browser. browserState is
+// the state cookie of the browser making the callback, which must match so
+// a login started by someone else can't be completed in this browser.
+func (o *oidcProvider) finishLogin(state, browserState, code string) (string, string, error) {
+	o.mu.Lock()
+	login, ok := o.pending[state]
+	delete(o.pending, state)
+	o.mu.Unlock()
+	if !ok || time.Since(login.startedAt) > oidcLoginTimeout {
+		return "", "", fmt.Errorf("unknown or expired login, please try again")
+	}
+	if subtle.ConstantTimeCompare([]byte(state), []byte(browserState)) != 1 {
+		return "", "", fmt.Errorf("login was not started in this browser, please try again")
+	}
+
+	metadata, err := o.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"client_id":     {o.cfg.ClientID},
+		"code_verifier": {login.verifier},
+	}
+	if o.cfg.ClientSecret != "" {
+		form.Set("client_secret", o.cfg.ClientSecret)
+	}
+	resp, err := o.client.PostForm(metadata.TokenEndpoint, form)
+	if err != nil {
+		return "", "", fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", "", fmt.Errorf("token request failed: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return "", "", fmt.Errorf("token request failed: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+
+	claims, err := o.verifyIDToken(metadata, tokens.IDToken, login.nonce)
+	if err != nil {
+		return "", "", err
+	}
+	username, err := o.username(claims)
+	if err != nil {
+		return "", "", err
+	}
+	return username, login.redirect, nil
+}
+
+// loginRedirect returns the URL to send the browser to after login. Only
+// paths on the site of PostLoginURL are accepted, so the login can't be
+// used as an open redirect.
+func (o *oidcProvider) loginRedirect(requested string) string {
+	if requested == "" || !strings.HasPrefix(requested, "/") || strings.HasPrefix(requested, "//") {
+		return o.cfg.PostLoginURL
+	}
+	base, err := url.Parse(o.cfg.PostLoginURL)
+	if err != nil {
+		return o.cfg.PostLoginURL
+	}
+	target, err := base.Parse(requested)
+	if err != nil || target.Host != base.Host {
+		return o.cfg.PostLoginURL
+	}
+	return target.String()
+}
+
+// provisionUser returns the preference of username, creating it from the
+// default preference template on the user's first login.
+func (deps *HandlerDependencies) provisionUser(username string) (UserPreference, error) {
+	pref, err := deps.Store.GetPreferenceByUsername(username)
+	if err == nil || !errors.Is(err, errPreferenceNotFound) {
+		return pref, err
+	}
+
+	pref = UserPreference{Username: username, HiddenDevices: []string{}}
+	template, err := deps.PreferenceTemplates.Default()
+	switch {
+	case err == nil:
+		pref = template.Preferences.applyTo(pref, importReplace)
+	case !errors.Is(err, errPreferenceTemplateNotFound):
+		log.Printf("Failed to load preference template for %s: %v", username, err)
+	}
+
+	pref, err = deps.Store.CreatePreference(pref, "oidc")
+	if errors.Is(err, errUsernameTaken) {
+		// Provisioned by a concurrent login.
+		return deps.Store.GetPreferenceByUsername(username)
+	}
+	if err == nil && template.ID != 0 {
+		log.Printf("Provisioned preferences for %s on first login from template %q", username, template.Name)
+	} else if err == nil {
+		log.Printf("Provisioned preferences for %s on first login", username)
+	}
+	return pref, err
+}
+
+// HandleAuth routes /auth/login, /auth/callback, /auth/logout and /auth/me.
+func (deps *HandlerDependencies) HandleAuth(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/auth/"), "/") {
+	case "login":
+		deps.HandleLogin(w, r)
+	case "callback":
+		deps.HandleLoginCallback(w, r)
+	case "logout":
+		deps.HandleLogout(w, r)
+	case "me":
+		// /auth/me goes through authorize to resolve the caller.
+		deps.authorize(policyIdentified, deps.HandleWhoAmI)(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// HandleLogin starts a single sign-on login; ?redirect= optionally names the
+// frontend path to return to.
+func (deps *HandlerDependencies) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if deps.OIDC == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	target, state, err := deps.OIDC.startLogin(deps.OIDC.loginRedirect(r.URL.Query().Get("redirect")))
+	if err != nil {
+		http.Error(w, "Failed to start login: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	deps.OIDC.setStateCookie(w, state, oidcLoginTimeout)
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// HandleLoginCallback completes a login: it provisions the user's
+// preferences if needed, sets the session cookie and returns the browser
+// to the frontend.
+func (deps *HandlerDependencies) HandleLoginCallback(w http.ResponseWriter, r *http.Request) {
+	if deps.OIDC == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		http.Error(w, "Login failed: "+e+" "+query.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+
+	var browserState string
+	if cookie, err := r.Cookie(oidcStateCookie); err == nil {
+		browserState = cookie.Value
+	}
+	deps.OIDC.setStateCookie(w, "", -1)
+	username, redirect, err := deps.OIDC.finishLogin(query.Get("state"), browserState, query.Get("code"))
+	if err != nil {
+		http.Error(w, "Login failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if _, err := deps.provisionUser(username); err != nil {
+		http.Error(w, "Failed to provision user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	secret, expires, err := deps.Sessions.Create(username)
+	if err != nil {
+		http.Error(w, "Failed to create session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    secret,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(deps.OIDC.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// setStateCookie sets the login state cookie, or with a negative maxAge
+// clears it. It is Lax so it survives the top-level redirect back from the
+// provider.
+func (o *oidcProvider) setStateCookie(w http.ResponseWriter, state string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(o.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// HandleLogout ends the session of the request, if any.
+func (deps *HandlerDependencies) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil && deps.Sessions != nil {
+		if err := deps.Sessions.Delete(cookie.Value); err != nil {
+			http.Error(w, "Failed to end session: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleWhoAmI describes the authenticated caller.
+func (deps *HandlerDependencies) HandleWhoAmI(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+	if p == nil {
+		writeAccessError(w, errUnauthenticated)
+		return
+	}
+	writeJSON(w, struct {
+		Username       string `json:"username"`
+		PreferenceID   int    `json:"preference_id,omitempty"`
+		OrganizationID int    `json:"organization_id,omitempty"`
+		Role           string `json:"role,omitempty"`
+		TokenID        int    `json:"token_id,omitempty"`
+		ReadOnly       bool   `json:"read_only,omitempty"`
+	}{p.Username, p.PreferenceID, p.OrganizationID, p.Role, p.TokenID, p.ReadOnly})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// oidcStub is a minimal OpenID Connect provider on an httptest.Server. It
+// signs ID tokens with a key generated at start, approves the email address
+// in ?login_hint=, and enforces PKCE with S256.
+type oidcStub struct {
+	*httptest.Server
+	issuer string
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu    sync.Mutex
+	codes map[string]oidcStubCode
+
+	// tamper, when set, edits the claims of the next ID tokens, and
+	// badSignature corrupts their signature.
+	tamper       func(claims map[string]any)
+	badSignature bool
+}
+
+type oidcStubCode struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	email       string
+	issuedAt    time.Time
+}
+
+func newOIDCStub(t *testing.T) *oidcStub {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &oidcStub{key: key, kid: "stub-key", codes: map[string]oidcStubCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", stub.handleDiscovery)
+	mux.HandleFunc("/authorize", stub.handleAuthorize)
+	mux.HandleFunc("/token", stub.handleToken)
+	mux.HandleFunc("/jwks", stub.handleJWKS)
+	stub.Server = httptest.NewServer(mux)
+	stub.issuer = stub.URL
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// setTamper installs a claims editor for the ID tokens issued from now on.
+func (s *oidcStub) setTamper(tamper func(claims map[string]any), badSignature bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tamper, s.badSignature = tamper, badSignature
+}
+
+func (s *oidcStub) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"issuer":                                s.issuer,
+		"authorization_endpoint":                s.issuer + "/authorize",
+		"token_endpoint":                        s.issuer + "/token",
+		"jwks_uri":                              s.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (s *oidcStub) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": s.kid,
+		"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+	}}})
+}
+
+// handleAuthorize approves the email address in ?login_hint= and redirects
+// back with a code.
+func (s *oidcStub) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirectURI.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if query.Get("response_type") != "code" || query.Get("client_id") == "" {
+		http.Error(w, "response_type=code and client_id are required", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	email := strings.TrimSpace(query.Get("login_hint"))
+	if email == "" {
+		http.Error(w, "login_hint is required", http.StatusBadRequest)
+		return
+	}
+
+	code, err := randomURLString(24)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	s.codes[code] = oidcStubCode{
+		clientID:    query.Get("client_id"),
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		email:       email,
+		issuedAt:    time.Now(),
+	}
+	s.mu.Unlock()
+
+	params := redirectURI.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// handleToken redeems a code once, checking the redirect URI, client and
+// PKCE verifier it was issued for.
+func (s *oidcStub) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOIDCStubError(w, "invalid_request", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	code, ok := s.codes[r.PostForm.Get("code")]
+	delete(s.codes, r.PostForm.Get("code"))
+	s.mu.Unlock()
+
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code":
+		writeOIDCStubError(w, "unsupported_grant_type", "")
+		return
+	case !ok || time.Since(code.issuedAt) > time.Minute:
+		writeOIDCStubError(w, "invalid_grant", "unknown or expired code")
+		return
+	case code.clientID != r.PostForm.Get("client_id") || code.redirectURI != r.PostForm.Get("redirect_uri"):
+		writeOIDCStubError(w, "invalid_grant", "client_id or redirect_uri does not match")
+		return
+	case pkceChallenge(r.PostForm.Get("code_verifier")) != code.challenge:
+		writeOIDCStubError(w, "invalid_grant", "code_verifier does not match")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":            s.issuer,
+		"sub":            "stub|" + strings.ToLower(code.email),
+		"aud":            code.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          code.nonce,
+		"email":          code.email,
+		"email_verified": true,
+	}
+	s.mu.Lock()
+	tamper, badSignature := s.tamper, s.badSignature
+	s.mu.Unlock()
+	if tamper != nil {
+		tamper(claims)
+	}
+	idToken, err := s.sign(claims)
+	if badSignature {
+		idToken = idToken[:len(idToken)-4] + "AAAA"
+	}
+	if err != nil {
+		writeOIDCStubError(w, "server_error", err.Error())
+		return
+	}
+	accessToken, err := randomURLString(24)
+	if err != nil {
+		writeOIDCStubError(w, "server_error", err.Error())
+		return
+	}
+	writeJSON(w, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// sign encodes claims as an RS256 JWT.
+func (s *oidcStub) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func writeOIDCStubError(w http.ResponseWriter, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
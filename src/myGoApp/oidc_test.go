@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// oidcTestApp is the backend's /auth/ endpoints wired to an oidcStub, with
+// a browser-like client that keeps cookies but doesn't follow redirects.
+type oidcTestApp struct {
+	*httptest.Server
+	deps   *HandlerDependencies
+	stub   *oidcStub
+	client *http.Client
+}
+
+func newOIDCTestApp(t *testing.T) *oidcTestApp {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "oidc.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	deps := &HandlerDependencies{Store: newMemoryStore()}
+	if deps.Organizations, err = newOrganizationStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.PreferenceTemplates, err = newPreferenceTemplateStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Sessions, err = newSessionStore(db, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &oidcTestApp{deps: deps, stub: newOIDCStub(t)}
+	app.Server = httptest.NewServer(http.HandlerFunc(deps.HandleAuth))
+	t.Cleanup(app.Close)
+	deps.OIDC = newOIDCProvider(OIDCConfig{
+		Issuer:        app.stub.issuer,
+		ClientID:      "app",
+		RedirectURL:   app.URL + "/auth/callback",
+		Scopes:        []string{"openid", "email"},
+		UsernameClaim: "email",
+		PostLoginURL:  "http://frontend.test/",
+		SessionTTL:    time.Hour,
+	})
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.client = &http.Client{
+		Jar:           jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return app
+}
+
+// redirect GETs target and returns where it redirects to.
+func (app *oidcTestApp) redirect(t *testing.T, target string) string {
+	t.Helper()
+	resp, err := app.client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("GET %s: %d, want a redirect", target, resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+// startLogin begins a login and returns the provider's callback URL for
+// email, without visiting it.
+func (app *oidcTestApp) startLogin(t *testing.T, email string) string {
+	t.Helper()
+	authorize := app.redirect(t, app.URL+"/auth/login?redirect=/fleet")
+	return app.redirect(t, authorize+"&login_hint="+url.QueryEscape(email))
+}
+
+// login runs a whole login for email and returns the callback response.
+func (app *oidcTestApp) login(t *testing.T, email string) *http.Response {
+	t.Helper()
+	resp, err := app.client.Get(app.startLogin(t, email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	app := newOIDCTestApp(t)
+	template, err := app.deps.PreferenceTemplates.Save(PreferenceTemplate{
+		Name:        "Dispatch",
+		Default:     true,
+		Preferences: PreferenceDocument{Format: preferenceDocumentFormat, SortOrder: "status", HiddenDevices: []string{"dev-9"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := app.login(t, "Carol@Example.com")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "http://frontend.test/fleet" {
+		t.Fatalf("callback answered %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	pref, err := app.deps.Store.GetPreferenceByUsername("carol@example.com")
+	if err != nil {
+		t.Fatalf("user not provisioned: %v", err)
+	}
+	if pref.SortOrder != "status" || strings.Join(pref.HiddenDevices, ",") != "dev-9" {
+		t.Errorf("provisioned %+v, want template %q applied", pref, template.Name)
+	}
+
+	// The session cookie identifies the user from now on.
+	me, err := app.client.Get(app.URL + "/auth/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer me.Body.Close()
+	var whoami struct {
+		Username     string `json:"username"`
+		PreferenceID int    `json:"preference_id"`
+	}
+	json.NewDecoder(me.Body).Decode(&whoami)
+	if me.StatusCode != http.StatusOK || whoami.Username != "carol@example.com" || whoami.PreferenceID != pref.ID {
+		t.Errorf("/auth/me answered %d %+v", me.StatusCode, whoami)
+	}
+
+	// A second login reuses the preference instead of provisioning again.
+	if resp := app.login(t, "carol@example.com"); resp.StatusCode != http.StatusFound {
+		t.Fatalf("second login answered %d", resp.StatusCode)
+	}
+	again, err := app.deps.Store.GetPreferenceByUsername("carol@example.com")
+	if err != nil || again.ID != pref.ID || again.Version != pref.Version {
+		t.Errorf("second login changed the preference: %+v, %v", again, err)
+	}
+}
+
+func TestOIDCLoginUsesPKCE(t *testing.T) {
+	app := newOIDCTestApp(t)
+	authorize, err := url.Parse(app.redirect(t, app.URL+"/auth/login"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authorize.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("code_challenge_method %q, want S256", query.Get("code_challenge_method"))
+	}
+
+	app.deps.OIDC.mu.Lock()
+	login, ok := app.deps.OIDC.pending[query.Get("state")]
+	app.deps.OIDC.mu.Unlock()
+	if !ok {
+		t.Fatal("no pending login for the state sent to the provider")
+	}
+	if query.Get("code_challenge") != pkceChallenge(login.verifier) {
+		t.Error("code_challenge is not the S256 hash of the verifier")
+	}
+	if strings.Contains(authorize.RawQuery, login.verifier) {
+		t.Error("the verifier itself was sent to the authorization endpoint")
+	}
+}
+
+func TestOIDCRejectsBadIDTokens(t *testing.T) {
+	app := newOIDCTestApp(t)
+
+	tests := []struct {
+		name         string
+		tamper       func(claims map[string]any)
+		badSignature bool
+	}{
+		{name: "wrong nonce", tamper: func(c map[string]any) { c["nonce"] = "replayed" }},
+		{name: "wrong audience", tamper: func(c map[string]any) { c["aud"] = "another-client" }},
+		{name: "wrong audience list", tamper: func(c map[string]any) { c["aud"] = []string{"another-client"} }},
+		{name: "wrong issuer", tamper: func(c map[string]any) { c["iss"] = "https://evil.example.com" }},
+		{name: "expired", tamper: func(c map[string]any) { c["exp"] = time.Now().Add(-2 * oidcClockSkew).Unix() }},
+		{name: "unverified email", tamper: func(c map[string]any) { c["email_verified"] = false }},
+		{name: "unverified email as string", tamper: func(c map[string]any) { c["email_verified"] = "false" }},
+		{name: "no email", tamper: func(c map[string]any) { delete(c, "email") }},
+		{name: "bad signature", badSignature: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.stub.setTamper(tt.tamper, tt.badSignature)
+			email := "user" + string(rune('a'+i)) + "@example.com"
+
+			resp := app.login(t, email)
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("callback answered %d, want 401", resp.StatusCode)
+			}
+			if _, err := app.deps.Store.GetPreferenceByUsername(email); !errors.Is(err, errPreferenceNotFound) {
+				t.Errorf("user was provisioned despite the bad ID token: %v", err)
+			}
+		})
+	}
+
+	t.Run("audience list with this client", func(t *testing.T) {
+		app.stub.setTamper(func(c map[string]any) { c["aud"] = []string{"other", "app"} }, false)
+		if resp := app.login(t, "listed@example.com"); resp.StatusCode != http.StatusFound {
+			t.Errorf("callback answered %d, want a redirect", resp.StatusCode)
+		}
+	})
+}
+
+func TestOIDCCallbackNeedsTheBrowserThatStartedTheLogin(t *testing.T) {
+	app := newOIDCTestApp(t)
+	callback := app.startLogin(t, "attacker@example.com")
+
+	// A victim's browser has no state cookie for the attacker's login.
+	victim := &http.Client{CheckRedirect: app.client.CheckRedirect}
+	resp, err := victim.Get(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("callback without the state cookie answered %d, want 401", resp.StatusCode)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookie && c.Value != "" {
+			t.Error("a session was created for a browser that didn't start the login")
+		}
+	}
+
+	// The failed callback used up the state, so the login can't be
+	// finished anywhere else either.
+	resp, err = app.client.Get(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replayed callback answered %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestOIDCPendingLoginsAreCapped(t *testing.T) {
+	app := newOIDCTestApp(t)
+	_, first, err := app.deps.OIDC.startLogin("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < oidcMaxPendingLogins+10; i++ {
+		if _, _, err := app.deps.OIDC.startLogin("/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app.deps.OIDC.mu.Lock()
+	pending := len(app.deps.OIDC.pending)
+	app.deps.OIDC.mu.Unlock()
+	if pending != oidcMaxPendingLogins {
+		t.Errorf("%d pending logins, want the cap of %d", pending, oidcMaxPendingLogins)
+	}
+	app.deps.OIDC.mu.Lock()
+	_, kept := app.deps.OIDC.pending[first]
+	app.deps.OIDC.mu.Unlock()
+	if kept {
+		t.Error("the oldest pending login was kept")
+	}
+}
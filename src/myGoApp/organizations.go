@@ -0,0 +1,522 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errOrganizationNotFound = errors.New("organization not found")
+	errMemberNotFound       = errors.New("organization member not found")
+	errAlreadyMember        = errors.New("user already belongs to an organization")
+	errLastOwner            = errors.New("organization must keep an owner")
+)
+
+// Organization groups users, each of whom belongs to at most one.
+type Organization struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Member is a user's role in an organization. Users are identified by their
+// preference username.
+type Member struct {
+	OrganizationID int       `json:"organization_id"`
+	Username       string    `json:"username"`
+	Role           string    `json:"role"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type organizationStore struct {
+	db *sql.DB
+}
+
+func newOrganizationStore(db *sql.DB) (*organizationStore, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS organizations (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL,
+            created_at DATETIME NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS organization_members (
+            username TEXT PRIMARY KEY,
+            organization_id INTEGER NOT NULL REFERENCES organizations(id),
+            role TEXT NOT NULL,
+            created_at DATETIME NOT NULL
+        );
+        CREATE INDEX IF NOT EXISTS idx_organization_members_organization ON organization_members(organization_id);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	return &organizationStore{db: db}, nil
+}
+
+func (s *organizationStore) Get(id int) (Organization, error) {
+	var o Organization
+	err := s.db.QueryRow("SELECT id, name, created_at FROM organizations WHERE id = ?", id).Scan(&o.ID, &o.Name, &o.CreatedAt)
+	if err == sql.ErrNoRows {
+		return o, fmt.Errorf("No organization found for ID %d: %w", id, errOrganizationNotFound)
+	}
+	if err != nil {
+		return o, fmt.Errorf("Database error: %v", err)
+	}
+	o.CreatedAt = o.CreatedAt.UTC()
+	return o, nil
+}
+
+// Create inserts an organization with owner as its first member.
+func (s *organizationStore) Create(name, owner string) (Organization, error) {
+	o := Organization{Name: name, CreatedAt: time.Now().UTC()}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return o, err
+	}
+	defer tx.Rollback()
+
+	var existing int
+	err = tx.QueryRow("SELECT organization_id FROM organization_members WHERE username = ?", owner).Scan(&existing)
+	if err == nil {
+		return o, errAlreadyMember
+	}
+	if err != sql.ErrNoRows {
+		return o, fmt.Errorf("Database error: %v", err)
+	}
+
+	result, err := tx.Exec("INSERT INTO organizations(name, created_at) VALUES (?, ?)", o.Name, o.CreatedAt)
+	if err != nil {
+		return o, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return o, err
+	}
+	o.ID = int(id)
+
+	_, err = tx.Exec("INSERT INTO organization_members(username, organization_id, role, created_at) VALUES (?, ?, ?, ?)",
+		owner, o.ID, roleOwner, o.CreatedAt)
+	if err != nil {
+		return o, err
+	}
+	return o, tx.Commit()
+}
+
+// Delete removes an organization and its memberships.
+func (s *organizationStore) Delete(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM organization_members WHERE organization_id = ?", id); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM organizations WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No organization found for ID %d: %w", id, errOrganizationNotFound)
+	}
+	return tx.Commit()
+}
+
+// Membership returns the organization role of username.
+func (s *organizationStore) Membership(username string) (Member, error) {
+	m, err := scanMember(s.db.QueryRow(
+		"SELECT organization_id, username, role, created_at FROM organization_members WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return m, fmt.Errorf("%q is not a member of an organization: %w", username, errMemberNotFound)
+	}
+	return m, err
+}
+
+// organizationOf returns the organization of username, or 0 when they
+// belong to none, for work done on their behalf without a request.
+func (deps *HandlerDependencies) organizationOf(username string) int {
+	if deps.Organizations == nil {
+		return 0
+	}
+	member, err := deps.Organizations.Membership(username)
+	if err != nil {
+		return 0
+	}
+	return member.OrganizationID
+}
+
+func (s *organizationStore) Members(organizationID int) ([]Member, error) {
+	rows, err := s.db.Query(
+		"SELECT organization_id, username, role, created_at FROM organization_members WHERE organization_id = ? ORDER BY username",
+		organizationID)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		m, err := scanMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return members, nil
+}
+
+// SetMember adds username to an organization or changes their role. It
+// fails with errAlreadyMember when the user belongs to another organization
+// and with errLastOwner when it would demote the only owner.
+func (s *organizationStore) SetMember(organizationID int, username, role string) (Member, error) {
+	m := Member{OrganizationID: organizationID, Username: username, Role: role, CreatedAt: time.Now().UTC()}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return m, err
+	}
+	defer tx.Rollback()
+
+	current, err := scanMember(tx.QueryRow(
+		"SELECT organization_id, username, role, created_at FROM organization_members WHERE username = ?", username))
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec("INSERT INTO organization_members(username, organization_id, role, created_at) VALUES (?, ?, ?, ?)",
+			username, organizationID, role, m.CreatedAt)
+		if err != nil {
+			return m, err
+		}
+	case err != nil:
+		return m, err
+	case current.OrganizationID != organizationID:
+		return m, errAlreadyMember
+	default:
+		if current.Role == roleOwner && role != roleOwner {
+			if err := checkOtherOwner(tx, organizationID, username); err != nil {
+				return m, err
+			}
+		}
+		if _, err := tx.Exec("UPDATE organization_members SET role = ? WHERE username = ?", role, username); err != nil {
+			return m, err
+		}
+		m.CreatedAt = current.CreatedAt
+	}
+	return m, tx.Commit()
+}
+
+// RemoveMember takes username out of an organization, unless they are its
+// only owner.
+func (s *organizationStore) RemoveMember(organizationID int, username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := scanMember(tx.QueryRow(
+		"SELECT organization_id, username, role, created_at FROM organization_members WHERE username = ? AND organization_id = ?",
+		username, organizationID))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%q is not a member of organization %d: %w", username, organizationID, errMemberNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if current.Role == roleOwner {
+		if err := checkOtherOwner(tx, organizationID, username); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM organization_members WHERE username = ?", username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func checkOtherOwner(tx *sql.Tx, organizationID int, username string) error {
+	var owners int
+	err := tx.QueryRow("SELECT COUNT(*) FROM organization_members WHERE organization_id = ? AND role = ? AND username != ?",
+		organizationID, roleOwner, username).Scan(&owners)
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	if owners == 0 {
+		return errLastOwner
+	}
+	return nil
+}
+
+func scanMember(row interface{ Scan(...any) error }) (Member, error) {
+	var m Member
+	err := row.Scan(&m.OrganizationID, &m.Username, &m.Role, &m.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return m, err
+		}
+		return m, fmt.Errorf("Database error: %v", err)
+	}
+	m.CreatedAt = m.CreatedAt.UTC()
+	return m, nil
+}
+
+// HandleOrganizations routes /orgs, /orgs/{id},
+// /orgs/{id}/members[/{username}], /orgs/{id}/devices[/{device_id}] and
+// /orgs/{id}/preferences. Every
+// endpoint needs an authenticated caller, even while access control is not
+// enforced.
+func (deps *HandlerDependencies) HandleOrganizations(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	p := principalFromContext(r.Context())
+	if p == nil {
+		writeAccessError(w, errUnauthenticated)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/orgs"), "/"), "/")
+	if parts[0] == "" {
+		switch r.Method {
+		case "GET":
+			// A user sees the organization they belong to.
+			orgs := []Organization{}
+			if p.OrganizationID != 0 {
+				o, err := deps.Organizations.Get(p.OrganizationID)
+				if err != nil {
+					writeOrganizationError(w, err)
+					return
+				}
+				orgs = append(orgs, o)
+			}
+			writeJSON(w, orgs)
+		case "POST":
+			deps.HandleCreateOrganization(w, r, p)
+		default:
+			writeMethodNotAllowed(w)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+	// Other organizations are indistinguishable from missing ones, except
+	// to deployment admins adding members or devices to them.
+	addsMember := len(parts) == 3 && parts[1] == "members" && r.Method == "PUT"
+	managesDevices := len(parts) >= 2 && parts[1] == "devices"
+	if id != p.OrganizationID && !(p.DeploymentAdmin && (addsMember || managesDevices)) {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		o, err := deps.Organizations.Get(id)
+		if err != nil {
+			writeOrganizationError(w, err)
+			return
+		}
+		writeJSON(w, o)
+	case len(parts) == 1 && r.Method == "DELETE":
+		if !p.can(permManageOrganization) {
+			writeAccessError(w, errForbidden)
+			return
+		}
+		o, err := deps.Organizations.Get(id)
+		if err != nil {
+			writeOrganizationError(w, err)
+			return
+		}
+		if err := deps.Organizations.Delete(id); err != nil {
+			writeOrganizationError(w, err)
+			return
+		}
+		deps.Audit.Record(r, "organization.delete", "organization", id, o, nil)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "members" && r.Method == "GET":
+		members, err := deps.Organizations.Members(id)
+		if err != nil {
+			writeOrganizationError(w, err)
+			return
+		}
+		writeJSON(w, members)
+	case len(parts) == 3 && parts[1] == "members":
+		username, err := url.PathUnescape(parts[2])
+		if err != nil || username == "" {
+			http.Error(w, "Invalid username", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			deps.HandleSetOrganizationMember(w, r, p, id, username)
+		case "DELETE":
+			// Members may leave; removing others needs permManageMembers,
+			// and only owners can remove an owner.
+			if username != p.Username {
+				if !p.can(permManageMembers) {
+					writeAccessError(w, errForbidden)
+					return
+				}
+				if m, err := deps.Organizations.Membership(username); err == nil && m.Role == roleOwner && !p.can(permManageOrganization) {
+					writeAccessError(w, errForbidden)
+					return
+				}
+			}
+			before, _ := deps.Organizations.Membership(username)
+			if err := deps.Organizations.RemoveMember(id, username); err != nil {
+				writeOrganizationError(w, err)
+				return
+			}
+			deps.Audit.Record(r, "organization.member.remove", "member", username, before, nil)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeMethodNotAllowed(w)
+		}
+	case len(parts) >= 2 && parts[1] == "devices":
+		deps.HandleOrganizationDevices(w, r, p, id, parts[2:])
+	case len(parts) == 2 && parts[1] == "preferences":
+		deps.HandlePreferenceLayer(w, r, layerOrganization, id)
+	case len(parts) <= 2:
+		writeMethodNotAllowed(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// HandleCreateOrganization lets a deployment admin create an organization
+// from a {"name": ..., "owner": ...} body. The owner must be an existing
+// user and defaults to the caller.
+func (deps *HandlerDependencies) HandleCreateOrganization(w http.ResponseWriter, r *http.Request, p *Principal) {
+	if !p.DeploymentAdmin {
+		writeAccessError(w, errForbidden)
+		return
+	}
+
+	var body struct {
+		Name  string `json:"name"`
+		Owner string `json:"owner"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(body.Name) == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	owner := strings.TrimSpace(body.Owner)
+	if owner == "" {
+		owner = p.Username
+	}
+	if _, err := deps.Store.GetPreferenceByUsername(owner); err != nil {
+		if errors.Is(err, errPreferenceNotFound) {
+			http.Error(w, "Unknown username", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	o, err := deps.Organizations.Create(strings.TrimSpace(body.Name), owner)
+	if err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+	deps.Audit.Record(r, "organization.create", "organization", o.ID, nil, o)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(o)
+}
+
+// HandleSetOrganizationMember changes the role of a member of organization
+// id, from a {"role": ...} body. Granting or taking away the owner role is
+// reserved to owners. Only deployment admins add users who belong to no
+// organization, so that an organization admin cannot take over accounts,
+// such as those of deployment admins or newly signed in users, by adding
+// them.
+func (deps *HandlerDependencies) HandleSetOrganizationMember(w http.ResponseWriter, r *http.Request, p *Principal, id int, username string) {
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validRole(body.Role) {
+		http.Error(w, "role must be owner, admin, dispatcher or viewer", http.StatusBadRequest)
+		return
+	}
+
+	current, err := deps.Organizations.Membership(username)
+	if err != nil && !errors.Is(err, errMemberNotFound) {
+		writeOrganizationError(w, err)
+		return
+	}
+	if !p.DeploymentAdmin {
+		if !p.can(permManageMembers) || current.Username == "" || current.OrganizationID != id {
+			writeAccessError(w, errForbidden)
+			return
+		}
+		if (body.Role == roleOwner || current.Role == roleOwner) && !p.can(permManageOrganization) {
+			writeAccessError(w, errForbidden)
+			return
+		}
+	} else if _, err := deps.Organizations.Get(id); err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	if _, err := deps.Store.GetPreferenceByUsername(username); err != nil {
+		if errors.Is(err, errPreferenceNotFound) {
+			http.Error(w, "Unknown username", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	m, err := deps.Organizations.SetMember(id, username, body.Role)
+	if err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+	var before any
+	if current.Username != "" {
+		before = current
+	}
+	deps.Audit.Record(r, "organization.member.set", "member", username, before, m)
+	writeJSON(w, m)
+}
+
+func writeOrganizationError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errOrganizationNotFound):
+		http.Error(w, "Organization not found", http.StatusNotFound)
+	case errors.Is(err, errMemberNotFound):
+		http.Error(w, "Member not found", http.StatusNotFound)
+	case errors.Is(err, errAlreadyMember):
+		http.Error(w, "User already belongs to an organization", http.StatusConflict)
+	case errors.Is(err, errLastOwner):
+		http.Error(w, "Organization must keep an owner", http.StatusConflict)
+	default:
+		http.Error(w, "Failed to access organization: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultPositionSampleInterval = 30 * time.Second
+
+// StoredPosition is a device position recorded by the backend.
+type StoredPosition struct {
+	DeviceID   string    `json:"device_id"`
+	RecordedAt time.Time `json:"recorded_at"`
+	Position   Position  `json:"position"`
+}
+
+// positionLog records the positions of active devices from every device list
+// fetched through it into device_positions, at most once per device every
+// interval. Reports and statistics are computed from these rows.
+type positionLog struct {
+	source   DeviceSource
+	db       *sql.DB
+	privacy  *privacyZones
+	interval time.Duration
+	now      func() time.Time
+
+	mu         sync.Mutex
+	recordedAt map[string]time.Time
+}
+
+// newPositionLogFromEnv wraps source; POSITION_SAMPLE_INTERVAL overrides how
+// often a device's position is stored (default 30s). Positions are stored
+// as recorded and masked with privacy when read back, except by
+// BetweenUnmasked.
+func newPositionLogFromEnv(db *sql.DB, source DeviceSource, privacy *privacyZones) (*positionLog, error) {
+	interval := defaultPositionSampleInterval
+	if v := os.Getenv("POSITION_SAMPLE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid POSITION_SAMPLE_INTERVAL: %v", err)
+		}
+		interval = d
+	}
+
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS device_positions (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            device_id TEXT NOT NULL,
+            recorded_at DATETIME NOT NULL,
+            lat REAL NOT NULL,
+            lng REAL NOT NULL
+        );
+        CREATE INDEX IF NOT EXISTS idx_device_positions_device
+            ON device_positions(device_id, recorded_at);
+        CREATE INDEX IF NOT EXISTS idx_device_positions_recorded_at
+            ON device_positions(recorded_at);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+
+	return &positionLog{
+		source:     source,
+		db:         db,
+		privacy:    privacy,
+		interval:   interval,
+		now:        time.Now,
+		recordedAt: map[string]time.Time{},
+	}, nil
+}
+
+// FetchData fetches the device list from the source and records it.
+func (l *positionLog) FetchData(ctx context.Context) (ApiResponse, error) {
+	data, err := l.source.FetchData(ctx)
+	if err != nil {
+		return data, err
+	}
+	if err := l.record(data.Devices); err != nil {
+		log.Printf("Failed to record device positions: %v", err)
+	}
+	return data, nil
+}
+
+func (l *positionLog) record(devices []Device) error {
+	now := l.now().UTC()
+
+	l.mu.Lock()
+	var due []Device
+	for _, device := range devices {
+		if !isDeviceActive(device) || now.Sub(l.recordedAt[device.ID]) < l.interval {
+			continue
+		}
+		l.recordedAt[device.ID] = now
+		due = append(due, device)
+	}
+	l.mu.Unlock()
+
+	if len(due) == 0 {
+		return nil
+	}
+
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO device_positions(device_id, recorded_at, lat, lng) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, device := range due {
+		if _, err := stmt.Exec(device.ID, now, device.Position.Latitude, device.Position.Longitude); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Track returns the stored positions of one device recorded in [from, to),
+// in time order, with privacy zones applied.
+func (l *positionLog) Track(deviceID string, from, to time.Time) ([]StoredPosition, error) {
+	rows, err := l.db.Query(`
+        SELECT device_id, recorded_at, lat, lng
+        FROM device_positions
+        WHERE device_id = ? AND recorded_at >= ? AND recorded_at < ?
+        ORDER BY recorded_at`, deviceID, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	track := []StoredPosition{}
+	for rows.Next() {
+		var p StoredPosition
+		if err := rows.Scan(&p.DeviceID, &p.RecordedAt, &p.Position.Latitude, &p.Position.Longitude); err != nil {
+			return nil, fmt.Errorf("Database error: %v", err)
+		}
+		p.RecordedAt = p.RecordedAt.UTC()
+		track = append(track, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return l.privacy.maskTrack(deviceID, track), nil
+}
+
+// Between returns the stored positions recorded in [from, to), grouped by
+// device and in time order, with privacy zones applied.
+func (l *positionLog) Between(from, to time.Time) (map[string][]StoredPosition, error) {
+	positions, err := l.BetweenUnmasked(from, to)
+	if err != nil {
+		return nil, err
+	}
+	for id, track := range positions {
+		// Callers rely on every track having a position.
+		if track = l.privacy.maskTrack(id, track); len(track) > 0 {
+			positions[id] = track
+		} else {
+			delete(positions, id)
+		}
+	}
+	return positions, nil
+}
+
+// BetweenUnmasked is Between without privacy zones, for aggregates such as
+// the stats rollups that must not be skewed by them. Its positions must
+// never reach a response.
+func (l *positionLog) BetweenUnmasked(from, to time.Time) (map[string][]StoredPosition, error) {
+	rows, err := l.db.Query(`
+        SELECT device_id, recorded_at, lat, lng
+        FROM device_positions
+        WHERE recorded_at >= ? AND recorded_at < ?
+        ORDER BY device_id, recorded_at`, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	positions := map[string][]StoredPosition{}
+	for rows.Next() {
+		var p StoredPosition
+		if err := rows.Scan(&p.DeviceID, &p.RecordedAt, &p.Position.Latitude, &p.Position.Longitude); err != nil {
+			return nil, fmt.Errorf("Database error: %v", err)
+		}
+		p.RecordedAt = p.RecordedAt.UTC()
+		positions[p.DeviceID] = append(positions[p.DeviceID], p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return positions, nil
+}
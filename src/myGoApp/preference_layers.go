@@ -0,0 +1,356 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Preference layers, from the outermost to the one resolved last.
+const (
+	layerOrganization = "organization"
+	layerTeam         = "team"
+	layerPersonal     = "personal"
+	layerDefault      = "default"
+)
+
+// PreferenceLayer is one level of settings that a user's effective
+// preference is resolved from. A non-empty SortOrder overrides the outer
+// layers'; ShownDevices shows devices that outer layers hid, then
+// HiddenDevices hides more.
+type PreferenceLayer struct {
+	Layer         string    `json:"layer"`
+	ID            int       `json:"id,omitempty"`
+	SortOrder     string    `json:"sortOrder"`
+	HiddenDevices []string  `json:"hiddenDevices"`
+	ShownDevices  []string  `json:"shownDevices"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// PreferenceSources names the layer each effective setting came from.
+// HiddenDevices maps each hidden device to the layer that hid it and
+// ShownDevices each device hidden by an outer layer to the layer that showed
+// it again.
+type PreferenceSources struct {
+	SortOrder     string            `json:"sortOrder"`
+	HiddenDevices map[string]string `json:"hiddenDevices"`
+	ShownDevices  map[string]string `json:"shownDevices"`
+}
+
+// PreferenceResolution is the effective preference of a user together with
+// the layers it was resolved from.
+type PreferenceResolution struct {
+	Effective UserPreference    `json:"effective"`
+	Sources   PreferenceSources `json:"sources"`
+	Layers    []PreferenceLayer `json:"layers"`
+}
+
+// preferenceLayerStore keeps the organization and team layers. The
+// personal layer is the user's own preference, so for it only the devices
+// the user shows are stored here.
+type preferenceLayerStore struct {
+	db *sql.DB
+}
+
+func newPreferenceLayerStore(db *sql.DB) (*preferenceLayerStore, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS preference_layers (
+            layer TEXT NOT NULL,
+            layer_id INTEGER NOT NULL,
+            sort_order TEXT NOT NULL DEFAULT '',
+            hidden_devices TEXT NOT NULL DEFAULT '[]',
+            shown_devices TEXT NOT NULL DEFAULT '[]',
+            updated_at DATETIME NOT NULL,
+            PRIMARY KEY (layer, layer_id)
+        );
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	return &preferenceLayerStore{db: db}, nil
+}
+
+// Get returns a layer, which is empty until it is first saved.
+func (s *preferenceLayerStore) Get(layer string, id int) (PreferenceLayer, error) {
+	l := PreferenceLayer{Layer: layer, ID: id, HiddenDevices: []string{}, ShownDevices: []string{}}
+	var hidden, shown string
+	err := s.db.QueryRow(
+		"SELECT sort_order, hidden_devices, shown_devices, updated_at FROM preference_layers WHERE layer = ? AND layer_id = ?",
+		layer, id).Scan(&l.SortOrder, &hidden, &shown, &l.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return l, nil
+	}
+	if err != nil {
+		return l, fmt.Errorf("Database error: %v", err)
+	}
+	if err := json.Unmarshal([]byte(hidden), &l.HiddenDevices); err != nil {
+		return l, fmt.Errorf("Failed to unmarshal hidden devices: %v", err)
+	}
+	if err := json.Unmarshal([]byte(shown), &l.ShownDevices); err != nil {
+		return l, fmt.Errorf("Failed to unmarshal shown devices: %v", err)
+	}
+	l.UpdatedAt = l.UpdatedAt.UTC()
+	return l, nil
+}
+
+func (s *preferenceLayerStore) Put(l PreferenceLayer) (PreferenceLayer, error) {
+	l.HiddenDevices = normalizeHiddenDevices(l.HiddenDevices)
+	l.ShownDevices = normalizeHiddenDevices(l.ShownDevices)
+	l.UpdatedAt = time.Now().UTC()
+	hidden, err := json.Marshal(l.HiddenDevices)
+	if err != nil {
+		return l, err
+	}
+	shown, err := json.Marshal(l.ShownDevices)
+	if err != nil {
+		return l, err
+	}
+	_, err = s.db.Exec(`
+        INSERT INTO preference_layers(layer, layer_id, sort_order, hidden_devices, shown_devices, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT(layer, layer_id) DO UPDATE SET
+            sort_order = excluded.sort_order,
+            hidden_devices = excluded.hidden_devices,
+            shown_devices = excluded.shown_devices,
+            updated_at = excluded.updated_at`,
+		l.Layer, l.ID, l.SortOrder, string(hidden), string(shown), l.UpdatedAt)
+	if err != nil {
+		return l, fmt.Errorf("Database error: %v", err)
+	}
+	return l, nil
+}
+
+func (s *preferenceLayerStore) Delete(layer string, id int) error {
+	if _, err := s.db.Exec("DELETE FROM preference_layers WHERE layer = ? AND layer_id = ?", layer, id); err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	return nil
+}
+
+// resolvePreference resolves the effective preference of pref's user from
+// their organization's layer, their team's and their own. The team layer
+// only applies while the team belongs to the user's organization.
+func (deps *HandlerDependencies) resolvePreference(pref UserPreference) (PreferenceResolution, error) {
+	var layers []PreferenceLayer
+	if m, err := deps.Organizations.Membership(pref.Username); err == nil {
+		l, err := deps.PreferenceLayers.Get(layerOrganization, m.OrganizationID)
+		if err != nil {
+			return PreferenceResolution{}, err
+		}
+		layers = append(layers, l)
+
+		team, err := deps.Teams.TeamOf(pref.Username)
+		switch {
+		case err == nil && team.OrganizationID == m.OrganizationID:
+			l, err := deps.PreferenceLayers.Get(layerTeam, team.ID)
+			if err != nil {
+				return PreferenceResolution{}, err
+			}
+			layers = append(layers, l)
+		case err != nil && !errors.Is(err, errTeamMemberNotFound):
+			return PreferenceResolution{}, err
+		}
+	} else if !errors.Is(err, errMemberNotFound) {
+		return PreferenceResolution{}, err
+	}
+
+	personal, err := deps.PreferenceLayers.Get(layerPersonal, pref.ID)
+	if err != nil {
+		return PreferenceResolution{}, err
+	}
+	personal.SortOrder = pref.SortOrder
+	personal.HiddenDevices = pref.HiddenDevices
+	if personal.HiddenDevices == nil {
+		personal.HiddenDevices = []string{}
+	}
+	personal.UpdatedAt = pref.UpdatedAt
+	layers = append(layers, personal)
+
+	return resolvePreferenceLayers(pref, layers), nil
+}
+
+// resolvePreferenceLayers applies layers to pref in order. A device keeps
+// the first layer that hid it as its source.
+func resolvePreferenceLayers(pref UserPreference, layers []PreferenceLayer) PreferenceResolution {
+	sources := PreferenceSources{
+		SortOrder:     layerDefault,
+		HiddenDevices: map[string]string{},
+		ShownDevices:  map[string]string{},
+	}
+	effective := pref
+	effective.SortOrder = ""
+
+	for _, l := range layers {
+		if l.SortOrder != "" {
+			effective.SortOrder = l.SortOrder
+			sources.SortOrder = l.Layer
+		}
+		for _, id := range l.ShownDevices {
+			if _, ok := sources.HiddenDevices[id]; ok {
+				delete(sources.HiddenDevices, id)
+				sources.ShownDevices[id] = l.Layer
+			}
+		}
+		for _, id := range l.HiddenDevices {
+			if _, ok := sources.HiddenDevices[id]; !ok {
+				sources.HiddenDevices[id] = l.Layer
+				delete(sources.ShownDevices, id)
+			}
+		}
+	}
+
+	effective.HiddenDevices = make([]string, 0, len(sources.HiddenDevices))
+	for id := range sources.HiddenDevices {
+		effective.HiddenDevices = append(effective.HiddenDevices, id)
+	}
+	sort.Strings(effective.HiddenDevices)
+	return PreferenceResolution{Effective: effective, Sources: sources, Layers: layers}
+}
+
+// effectivePreference resolves pref's layers, falling back to pref alone if
+// they can't be loaded so that devices stay available.
+func (deps *HandlerDependencies) effectivePreference(pref UserPreference) UserPreference {
+	resolution, err := deps.resolvePreference(pref)
+	if err != nil {
+		log.Printf("Failed to resolve preference layers for %d: %v", pref.ID, err)
+		return pref
+	}
+	return resolution.Effective
+}
+
+// HandleEffectivePreference returns the effective preference of
+// /preferences/{id}/effective with the layers it was resolved from.
+func (deps *HandlerDependencies) HandleEffectivePreference(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	userID, err := getUserIDFromURL(strings.TrimSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/effective"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pref, ok := deps.preferenceForLayerRequest(w, userID)
+	if !ok {
+		return
+	}
+
+	resolution, err := deps.resolvePreference(pref)
+	if err != nil {
+		http.Error(w, "Failed to resolve preference layers: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resolution.Effective.Icon = []byte(base64.StdEncoding.EncodeToString(resolution.Effective.Icon))
+	writeJSON(w, resolution)
+}
+
+// HandleShownDevices reads or, with PUT {"shownDevices": [...]}, sets the
+// devices a user shows although their organization or team hides them.
+func (deps *HandlerDependencies) HandleShownDevices(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	userID, err := getUserIDFromURL(strings.TrimSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/shown-devices"))
+	if err != nil {
+		http.Error(w, "Invalid user ID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := deps.preferenceForLayerRequest(w, userID); !ok {
+		return
+	}
+
+	before, err := deps.PreferenceLayers.Get(layerPersonal, userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch shown devices: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, map[string][]string{"shownDevices": before.ShownDevices})
+	case "PUT":
+		var body struct {
+			ShownDevices []string `json:"shownDevices"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		after := before
+		after.ShownDevices = body.ShownDevices
+		after, err := deps.PreferenceLayers.Put(after)
+		if err != nil {
+			http.Error(w, "Failed to update shown devices: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deps.Audit.Record(r, "preference.shown_devices", "preference", userID, before.ShownDevices, after.ShownDevices)
+		writeJSON(w, map[string][]string{"shownDevices": after.ShownDevices})
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// HandlePreferenceLayer reads or, with PUT {"sortOrder", "hiddenDevices",
+// "shownDevices"}, replaces an organization or team layer. Changing one
+// needs permManagePreferences.
+func (deps *HandlerDependencies) HandlePreferenceLayer(w http.ResponseWriter, r *http.Request, layer string, id int) {
+	before, err := deps.PreferenceLayers.Get(layer, id)
+	if err != nil {
+		http.Error(w, "Failed to fetch preferences: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, before)
+	case "PUT":
+		if p := principalFromContext(r.Context()); p != nil && !p.can(permManagePreferences) {
+			writeAccessError(w, errForbidden)
+			return
+		}
+		var body PreferenceLayer
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		body.Layer, body.ID = layer, id
+		after, err := deps.PreferenceLayers.Put(body)
+		if err != nil {
+			http.Error(w, "Failed to update preferences: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deps.Audit.Record(r, "preference_layer.update", layer, id, before, after)
+		writeJSON(w, after)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// preferenceForLayerRequest loads the preference named in the URL, writing
+// the error response itself and returning false on failure.
+func (deps *HandlerDependencies) preferenceForLayerRequest(w http.ResponseWriter, id int) (UserPreference, bool) {
+	pref, err := deps.Store.GetPreference(id)
+	if err != nil {
+		if errors.Is(err, errPreferenceNotFound) {
+			http.Error(w, "Preferences not found for the given ID", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		}
+		return pref, false
+	}
+	return pref, true
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolvePreferenceLayers(t *testing.T) {
+	tests := []struct {
+		name         string
+		layers       []PreferenceLayer
+		sortOrder    string
+		sortSource   string
+		hidden       []string
+		hiddenSource map[string]string
+		shownSource  map[string]string
+	}{
+		{
+			name:         "no layers",
+			sortSource:   layerDefault,
+			hidden:       []string{},
+			hiddenSource: map[string]string{},
+			shownSource:  map[string]string{},
+		},
+		{
+			name: "inner layers override outer ones",
+			layers: []PreferenceLayer{
+				{Layer: layerOrganization, SortOrder: "name", HiddenDevices: []string{"a", "b", "d"}},
+				// "z" was never hidden, so showing it changes nothing.
+				{Layer: layerTeam, ShownDevices: []string{"a", "z"}, HiddenDevices: []string{"d", "e"}},
+				{Layer: layerPersonal, SortOrder: "status", ShownDevices: []string{"b"}, HiddenDevices: []string{"a"}},
+			},
+			sortOrder:    "status",
+			sortSource:   layerPersonal,
+			hidden:       []string{"a", "d", "e"},
+			hiddenSource: map[string]string{"a": layerPersonal, "d": layerOrganization, "e": layerTeam},
+			shownSource:  map[string]string{"b": layerPersonal},
+		},
+		{
+			name: "an empty sort order keeps the outer one",
+			layers: []PreferenceLayer{
+				{Layer: layerOrganization, SortOrder: "name"},
+				{Layer: layerTeam},
+				{Layer: layerPersonal},
+			},
+			sortOrder:    "name",
+			sortSource:   layerOrganization,
+			hidden:       []string{},
+			hiddenSource: map[string]string{},
+			shownSource:  map[string]string{},
+		},
+		{
+			name: "showing only undoes outer layers",
+			layers: []PreferenceLayer{
+				{Layer: layerOrganization, ShownDevices: []string{"a"}},
+				{Layer: layerTeam, HiddenDevices: []string{"a"}},
+			},
+			sortSource:   layerDefault,
+			hidden:       []string{"a"},
+			hiddenSource: map[string]string{"a": layerTeam},
+			shownSource:  map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		pref := UserPreference{ID: 1, Username: "alice", SortOrder: "ignored", HiddenDevices: []string{"ignored"}}
+		got := resolvePreferenceLayers(pref, tt.layers)
+		if got.Effective.SortOrder != tt.sortOrder || got.Sources.SortOrder != tt.sortSource {
+			t.Errorf("%s: sort order %q from %q, want %q from %q", tt.name,
+				got.Effective.SortOrder, got.Sources.SortOrder, tt.sortOrder, tt.sortSource)
+		}
+		if !reflect.DeepEqual(got.Effective.HiddenDevices, tt.hidden) {
+			t.Errorf("%s: hidden devices %v, want %v", tt.name, got.Effective.HiddenDevices, tt.hidden)
+		}
+		if !reflect.DeepEqual(got.Sources.HiddenDevices, tt.hiddenSource) {
+			t.Errorf("%s: hidden by %v, want %v", tt.name, got.Sources.HiddenDevices, tt.hiddenSource)
+		}
+		if !reflect.DeepEqual(got.Sources.ShownDevices, tt.shownSource) {
+			t.Errorf("%s: shown by %v, want %v", tt.name, got.Sources.ShownDevices, tt.shownSource)
+		}
+		if got.Effective.ID != pref.ID || got.Effective.Username != pref.Username {
+			t.Errorf("%s: effective preference is %d %q, want the user's", tt.name, got.Effective.ID, got.Effective.Username)
+		}
+	}
+}
+
+func TestResolvePreferenceIgnoresTeamsOfOtherOrganizations(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "layers.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	deps := &HandlerDependencies{Store: newMemoryStore()}
+	if deps.Organizations, err = newOrganizationStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Teams, err = newTeamStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.PreferenceLayers, err = newPreferenceLayerStore(db); err != nil {
+		t.Fatal(err)
+	}
+	pref, err := deps.Store.CreatePreference(UserPreference{Username: "alice"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, err := deps.Organizations.Create("Acme", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobco, err := deps.Organizations.Create("Bobco", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deps.PreferenceLayers.Put(PreferenceLayer{Layer: layerOrganization, ID: acme.ID, HiddenDevices: []string{"acme-hidden"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice is left on a team of Bobco, for instance after moving to Acme.
+	night, err := deps.Teams.Create(Team{OrganizationID: bobco.ID, Name: "Night"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deps.PreferenceLayers.Put(PreferenceLayer{Layer: layerTeam, ID: night.ID, HiddenDevices: []string{"bobco-hidden"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deps.Teams.SetMember(night.ID, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	resolution, err := deps.resolvePreference(pref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resolution.Effective.HiddenDevices; !reflect.DeepEqual(got, []string{"acme-hidden"}) {
+		t.Errorf("hidden devices %v, want only Acme's", got)
+	}
+	for _, l := range resolution.Layers {
+		if l.Layer == layerTeam {
+			t.Errorf("resolved from the team layer of another organization: %+v", l)
+		}
+	}
+
+	// On a team of her own organization, its layer applies.
+	day, err := deps.Teams.Create(Team{OrganizationID: acme.ID, Name: "Day"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deps.PreferenceLayers.Put(PreferenceLayer{Layer: layerTeam, ID: day.ID, HiddenDevices: []string{"team-hidden"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deps.Teams.SetMember(day.ID, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	resolution, err = deps.resolvePreference(pref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resolution.Effective.HiddenDevices; !reflect.DeepEqual(got, []string{"acme-hidden", "team-hidden"}) {
+		t.Errorf("hidden devices %v, want Acme's and its team's", got)
+	}
+	if got := resolution.Sources.HiddenDevices["team-hidden"]; got != layerTeam {
+		t.Errorf("team-hidden attributed to %q, want %q", got, layerTeam)
+	}
+}
+
+func TestScheduledReportsUseTheEffectivePreference(t *testing.T) {
+	f := newDeviceScopeFixture(t)
+	if _, err := f.deps.Devices.FetchData(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The organization hides its only device from its members.
+	if _, err := f.deps.PreferenceLayers.Put(PreferenceLayer{Layer: layerOrganization, ID: f.ownOrg, HiddenDevices: []string{"own-dev"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := &reportScheduler{deps: f.deps, cfg: ReportDeliveryConfig{Directory: t.TempDir()}}
+	schedule := ReportSchedule{ID: 1, Username: roleViewer, Name: "Fleet", Format: reportCSV, Delivery: deliverDirectory}
+	now := time.Now().UTC()
+	path, err := rs.generate(context.Background(), schedule, now.Add(-time.Hour), now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), "own-dev") {
+		t.Errorf("scheduled report includes a device the organization hides:\n%s", body)
+	}
+}
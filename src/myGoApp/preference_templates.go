@@ -0,0 +1,452 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// preferenceDocumentFormat identifies exported preferences, so imports can
+// tell them apart from other JSON.
+const preferenceDocumentFormat = "mygoapp.preferences.v1"
+
+const (
+	importMerge   = "merge"
+	importReplace = "replace"
+)
+
+var errPreferenceTemplateNotFound = errors.New("preference template not found")
+
+// PreferenceDocument is the portable form of a preference: its settings
+// without the ID, username and version that tie it to one user.
+type PreferenceDocument struct {
+	Format        string     `json:"format"`
+	ExportedAt    *time.Time `json:"exportedAt,omitempty"`
+	SortOrder     string     `json:"sortOrder"`
+	HiddenDevices []string   `json:"hiddenDevices"`
+	Icon          []byte     `json:"icon,omitempty"`
+}
+
+func preferenceDocument(pref UserPreference) PreferenceDocument {
+	hidden := pref.HiddenDevices
+	if hidden == nil {
+		hidden = []string{}
+	}
+	now := time.Now().UTC()
+	return PreferenceDocument{
+		Format:        preferenceDocumentFormat,
+		ExportedAt:    &now,
+		SortOrder:     pref.SortOrder,
+		HiddenDevices: hidden,
+		Icon:          pref.Icon,
+	}
+}
+
+// applyTo returns pref with the document's settings applied. Replace takes
+// every setting from the document; merge adds its hidden devices to the
+// ones already hidden and only takes the sort order and icon if set.
+func (doc PreferenceDocument) applyTo(pref UserPreference, mode string) UserPreference {
+	if mode == importReplace {
+		pref.SortOrder = doc.SortOrder
+		pref.HiddenDevices = normalizeHiddenDevices(doc.HiddenDevices)
+		pref.Icon = doc.Icon
+		return pref
+	}
+	if doc.SortOrder != "" {
+		pref.SortOrder = doc.SortOrder
+	}
+	pref.HiddenDevices = applyHiddenDevicesChange(pref.HiddenDevices, HiddenDevicesChange{Add: doc.HiddenDevices})
+	if len(doc.Icon) > 0 {
+		pref.Icon = doc.Icon
+	}
+	return pref
+}
+
+func (doc PreferenceDocument) validate() error {
+	if doc.Format != "" && doc.Format != preferenceDocumentFormat {
+		return fmt.Errorf("unsupported format %q", doc.Format)
+	}
+	return nil
+}
+
+// HandleExportPreference returns a preference as a PreferenceDocument,
+// served as a download.
+func (deps *HandlerDependencies) HandleExportPreference(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	userID, err := getUserIDFromURL(strings.TrimSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/export"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pref, err := deps.Store.GetPreference(userID)
+	if err != nil {
+		if errors.Is(err, errPreferenceNotFound) {
+			http.Error(w, "Preferences not found for the given ID", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="preferences-%d.json"`, userID))
+	writeJSON(w, preferenceDocument(pref))
+}
+
+// HandleImportPreference applies an exported PreferenceDocument to a
+// preference, merging it in or, with ?mode=replace, replacing the settings.
+// With If-Match: * the import fails if the preference changes while it is
+// applied, rather than overwriting the change.
+func (deps *HandlerDependencies) HandleImportPreference(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	userID, err := getUserIDFromURL(strings.TrimSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/import"))
+	if err != nil {
+		http.Error(w, "Invalid user ID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = importMerge
+	}
+	if mode != importMerge && mode != importReplace {
+		http.Error(w, "mode must be merge or replace", http.StatusBadRequest)
+		return
+	}
+
+	var doc PreferenceDocument
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := doc.validate(); err != nil {
+		http.Error(w, "Invalid preference document: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	current, err := deps.Store.GetPreference(userID)
+	if err != nil {
+		if errors.Is(err, errPreferenceNotFound) {
+			http.Error(w, "Preferences not found for the given ID", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		}
+		return
+	}
+	if version == 0 {
+		version = current.Version
+	}
+
+	pref := doc.applyTo(current, mode)
+	pref.Version = version
+
+	pref, err = deps.Store.UpdatePreference(pref, actorFromRequest(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, errPreferenceNotFound):
+			http.Error(w, "Preferences not found for the given ID", http.StatusNotFound)
+		case errors.Is(err, errVersionConflict):
+			http.Error(w, "Preference has been modified", http.StatusPreconditionFailed)
+		default:
+			http.Error(w, "Failed to import user preferences: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	deps.auditPreferenceChange(r, "preference.import", pref)
+
+	w.Header().Set("ETag", preferenceETag(pref))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf(`{"message": "Preferences imported (%s)", "revision": %d}`, mode, pref.Version)))
+}
+
+// PreferenceTemplate holds preferences users can start from. The default
+// template is applied to new users on their first login; users only join an
+// organization once they exist, so templates aren't per organization.
+type PreferenceTemplate struct {
+	ID          int                `json:"id"`
+	Name        string             `json:"name"`
+	Default     bool               `json:"default"`
+	Preferences PreferenceDocument `json:"preferences"`
+	CreatedAt   time.Time          `json:"created_at"`
+	UpdatedAt   time.Time          `json:"updated_at"`
+}
+
+type preferenceTemplateStore struct {
+	db *sql.DB
+}
+
+func newPreferenceTemplateStore(db *sql.DB) (*preferenceTemplateStore, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS preference_templates (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL,
+            is_default INTEGER NOT NULL DEFAULT 0,
+            preferences TEXT NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL
+        );
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	return &preferenceTemplateStore{db: db}, nil
+}
+
+const preferenceTemplateColumns = "id, name, is_default, preferences, created_at, updated_at"
+
+func (s *preferenceTemplateStore) List() ([]PreferenceTemplate, error) {
+	rows, err := s.db.Query("SELECT " + preferenceTemplateColumns + " FROM preference_templates ORDER BY name, id")
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	templates := []PreferenceTemplate{}
+	for rows.Next() {
+		t, err := scanPreferenceTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return templates, nil
+}
+
+func (s *preferenceTemplateStore) Get(id int) (PreferenceTemplate, error) {
+	t, err := scanPreferenceTemplate(s.db.QueryRow(
+		"SELECT "+preferenceTemplateColumns+" FROM preference_templates WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return t, fmt.Errorf("No preference template found for ID %d: %w", id, errPreferenceTemplateNotFound)
+	}
+	return t, err
+}
+
+// Default returns the template new users start with.
+func (s *preferenceTemplateStore) Default() (PreferenceTemplate, error) {
+	t, err := scanPreferenceTemplate(s.db.QueryRow(
+		"SELECT " + preferenceTemplateColumns + " FROM preference_templates WHERE is_default = 1 ORDER BY id DESC LIMIT 1"))
+	if err == sql.ErrNoRows {
+		return t, fmt.Errorf("No default preference template: %w", errPreferenceTemplateNotFound)
+	}
+	return t, err
+}
+
+// Save creates the template, or updates it when it has an ID. Making a
+// template the default unsets the previous default.
+func (s *preferenceTemplateStore) Save(t PreferenceTemplate) (PreferenceTemplate, error) {
+	now := time.Now().UTC()
+	t.UpdatedAt = now
+	if t.ID == 0 {
+		t.CreatedAt = now
+	}
+	t.Preferences.Format = preferenceDocumentFormat
+	t.Preferences.ExportedAt = nil
+	t.Preferences.HiddenDevices = normalizeHiddenDevices(t.Preferences.HiddenDevices)
+	preferences, err := json.Marshal(t.Preferences)
+	if err != nil {
+		return t, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return t, err
+	}
+	defer tx.Rollback()
+
+	if t.Default {
+		if _, err := tx.Exec("UPDATE preference_templates SET is_default = 0 WHERE id != ?", t.ID); err != nil {
+			return t, fmt.Errorf("Database error: %v", err)
+		}
+	}
+	if t.ID == 0 {
+		result, err := tx.Exec(
+			"INSERT INTO preference_templates(name, is_default, preferences, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+			t.Name, t.Default, string(preferences), t.CreatedAt, t.UpdatedAt)
+		if err != nil {
+			return t, fmt.Errorf("Database error: %v", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return t, err
+		}
+		t.ID = int(id)
+	} else {
+		result, err := tx.Exec(
+			"UPDATE preference_templates SET name = ?, is_default = ?, preferences = ?, updated_at = ? WHERE id = ?",
+			t.Name, t.Default, string(preferences), t.UpdatedAt, t.ID)
+		if err != nil {
+			return t, fmt.Errorf("Database error: %v", err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			return t, fmt.Errorf("No preference template found for ID %d: %w", t.ID, errPreferenceTemplateNotFound)
+		}
+	}
+	return t, tx.Commit()
+}
+
+func (s *preferenceTemplateStore) Delete(id int) error {
+	result, err := s.db.Exec("DELETE FROM preference_templates WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No preference template found for ID %d: %w", id, errPreferenceTemplateNotFound)
+	}
+	return nil
+}
+
+func scanPreferenceTemplate(row interface{ Scan(...any) error }) (PreferenceTemplate, error) {
+	var t PreferenceTemplate
+	var preferences string
+	err := row.Scan(&t.ID, &t.Name, &t.Default, &preferences, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t, err
+		}
+		return t, fmt.Errorf("Database error: %v", err)
+	}
+	if err := json.Unmarshal([]byte(preferences), &t.Preferences); err != nil {
+		return t, fmt.Errorf("Failed to unmarshal template preferences: %v", err)
+	}
+	t.CreatedAt = t.CreatedAt.UTC()
+	t.UpdatedAt = t.UpdatedAt.UTC()
+	return t, nil
+}
+
+// HandlePreferenceTemplates routes GET/POST /preference-templates and
+// GET/PUT/DELETE /preference-templates/{id}.
+func (deps *HandlerDependencies) HandlePreferenceTemplates(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/preference-templates"), "/")
+	if rest == "" {
+		switch r.Method {
+		case "GET":
+			templates, err := deps.PreferenceTemplates.List()
+			if err != nil {
+				http.Error(w, "Failed to fetch preference templates: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, templates)
+		case "POST":
+			deps.HandleSavePreferenceTemplate(w, r, PreferenceTemplate{})
+		default:
+			writeMethodNotAllowed(w)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(rest)
+	if err != nil {
+		http.Error(w, "Invalid preference template ID", http.StatusBadRequest)
+		return
+	}
+	template, err := deps.PreferenceTemplates.Get(id)
+	if err != nil {
+		writePreferenceTemplateError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, template)
+	case "PUT":
+		deps.HandleSavePreferenceTemplate(w, r, template)
+	case "DELETE":
+		if err := deps.PreferenceTemplates.Delete(id); err != nil {
+			writePreferenceTemplateError(w, err)
+			return
+		}
+		deps.Audit.Record(r, "preference_template.delete", "preference_template", id, template, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// HandleSavePreferenceTemplate creates or, when existing has an ID, replaces
+// a template from {"name", "default", "preferences"}, where preferences is
+// a document from GET /preferences/{id}/export.
+func (deps *HandlerDependencies) HandleSavePreferenceTemplate(w http.ResponseWriter, r *http.Request, existing PreferenceTemplate) {
+	var body struct {
+		Name        string             `json:"name"`
+		Default     bool               `json:"default"`
+		Preferences PreferenceDocument `json:"preferences"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		http.Error(w, "Invalid preference template: name is required", http.StatusBadRequest)
+		return
+	}
+	if err := body.Preferences.validate(); err != nil {
+		http.Error(w, "Invalid preference template: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t := existing
+	t.Name = body.Name
+	t.Default = body.Default
+	t.Preferences = body.Preferences
+	t, err := deps.PreferenceTemplates.Save(t)
+	if err != nil {
+		writePreferenceTemplateError(w, err)
+		return
+	}
+
+	if existing.ID != 0 {
+		deps.Audit.Record(r, "preference_template.update", "preference_template", t.ID, existing, t)
+		writeJSON(w, t)
+		return
+	}
+	deps.Audit.Record(r, "preference_template.create", "preference_template", t.ID, nil, t)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+func writePreferenceTemplateError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPreferenceTemplateNotFound) {
+		http.Error(w, "Preference template not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPreferenceDocumentApplyTo(t *testing.T) {
+	current := UserPreference{ID: 7, Username: "alice", Version: 3, SortOrder: "name", HiddenDevices: []string{"b", "c"}, Icon: []byte("old")}
+
+	tests := []struct {
+		name, mode string
+		doc        PreferenceDocument
+		want       UserPreference
+	}{
+		{"merge adds hidden devices and takes what is set", importMerge,
+			PreferenceDocument{SortOrder: "status", HiddenDevices: []string{"a", "c"}, Icon: []byte("new")},
+			UserPreference{ID: 7, Username: "alice", Version: 3, SortOrder: "status", HiddenDevices: []string{"a", "b", "c"}, Icon: []byte("new")}},
+		{"merge keeps what the document leaves empty", importMerge,
+			PreferenceDocument{},
+			UserPreference{ID: 7, Username: "alice", Version: 3, SortOrder: "name", HiddenDevices: []string{"b", "c"}, Icon: []byte("old")}},
+		{"replace takes every setting", importReplace,
+			PreferenceDocument{SortOrder: "status", HiddenDevices: []string{"d", "a", "d"}},
+			UserPreference{ID: 7, Username: "alice", Version: 3, SortOrder: "status", HiddenDevices: []string{"a", "d"}}},
+		{"replace with an empty document clears the settings", importReplace,
+			PreferenceDocument{},
+			UserPreference{ID: 7, Username: "alice", Version: 3, HiddenDevices: []string{}}},
+	}
+	for _, tt := range tests {
+		if got := tt.doc.applyTo(current, tt.mode); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func newPreferenceTemplateTestDeps(t *testing.T) *HandlerDependencies {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "templates.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	deps := &HandlerDependencies{Store: newMemoryStore()}
+	if deps.Audit, err = newAuditLog(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.PreferenceTemplates, err = newPreferenceTemplateStore(db); err != nil {
+		t.Fatal(err)
+	}
+	return deps
+}
+
+func TestImportPreference(t *testing.T) {
+	deps := newPreferenceTemplateTestDeps(t)
+	pref, err := deps.Store.CreatePreference(UserPreference{Username: "alice", SortOrder: "name", HiddenDevices: []string{"b"}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/preferences/" + strconv.Itoa(pref.ID) + "/import"
+	doc := `{"format": "` + preferenceDocumentFormat + `", "sortOrder": "status", "hiddenDevices": ["a"]}`
+
+	tests := []struct {
+		name, query, ifMatch, body string
+		status                     int
+		sortOrder, hidden          string
+		version                    int
+	}{
+		{"without If-Match", "", "", doc, http.StatusPreconditionRequired, "name", "b", 1},
+		{"with a stale tag", "", `"2"`, doc, http.StatusPreconditionFailed, "name", "b", 1},
+		{"of another format", "", "*", `{"format": "other.v1"}`, http.StatusBadRequest, "name", "b", 1},
+		{"with an unknown mode", "?mode=overwrite", "*", doc, http.StatusBadRequest, "name", "b", 1},
+		{"merged", "", `"1"`, doc, http.StatusOK, "status", "a,b", 2},
+		{"replaced", "?mode=replace", "*", `{"hiddenDevices": ["c"]}`, http.StatusOK, "", "c", 3},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", path+tt.query, strings.NewReader(tt.body))
+		if tt.ifMatch != "" {
+			r.Header.Set("If-Match", tt.ifMatch)
+		}
+		w := httptest.NewRecorder()
+		deps.HandleImportPreference(w, r)
+		if w.Code != tt.status {
+			t.Errorf("import %s: %d %s, want %d", tt.name, w.Code, w.Body, tt.status)
+		}
+		if tt.status == http.StatusOK && w.Header().Get("ETag") != preferenceETag(UserPreference{Version: tt.version}) {
+			t.Errorf("import %s: ETag %q, want version %d", tt.name, w.Header().Get("ETag"), tt.version)
+		}
+
+		stored, err := deps.Store.GetPreference(pref.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.SortOrder != tt.sortOrder || strings.Join(stored.HiddenDevices, ",") != tt.hidden || stored.Version != tt.version {
+			t.Errorf("after import %s: version %d sorted by %q hiding %v, want version %d sorted by %q hiding %s",
+				tt.name, stored.Version, stored.SortOrder, stored.HiddenDevices, tt.version, tt.sortOrder, tt.hidden)
+		}
+	}
+
+	imports := 0
+	if err := deps.Audit.Query(auditFilter{Action: "preference.import"}, func(AuditEvent) error { imports++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if imports != 2 {
+		t.Errorf("%d imports audited, want 2", imports)
+	}
+}
+
+func TestProvisionUserAppliesTheDefaultTemplate(t *testing.T) {
+	deps := newPreferenceTemplateTestDeps(t)
+
+	// Without a default template new users start empty.
+	pref, err := deps.provisionUser("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pref.ID == 0 || pref.SortOrder != "" || len(pref.HiddenDevices) != 0 {
+		t.Errorf("provisioned %+v without a template, want empty preferences", pref)
+	}
+
+	for _, template := range []PreferenceTemplate{
+		{Name: "Old default", Default: true, Preferences: PreferenceDocument{SortOrder: "name"}},
+		{Name: "Dispatch", Default: true, Preferences: PreferenceDocument{SortOrder: "status", HiddenDevices: []string{"dev-2", "dev-1"}}},
+		{Name: "Not default", Preferences: PreferenceDocument{SortOrder: "speed"}},
+	} {
+		if _, err := deps.PreferenceTemplates.Save(template); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pref, err = deps.provisionUser("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pref.Username != "second" || pref.SortOrder != "status" || strings.Join(pref.HiddenDevices, ",") != "dev-1,dev-2" {
+		t.Errorf("provisioned %+v, want the latest default template applied", pref)
+	}
+
+	// Existing users keep their preferences.
+	again, err := deps.provisionUser("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID == pref.ID || again.SortOrder != "" || again.Version != 1 {
+		t.Errorf("provisioning an existing user returned %+v", again)
+	}
+
+	revisions, err := deps.Store.ListRevisions(pref.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].Actor != "oidc" || revisions[0].Snapshot.SortOrder != "status" {
+		t.Errorf("revisions %+v, want one by oidc with the template applied", revisions)
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Privacy zone modes, also used to mark masked positions in responses.
+const (
+	privacyCentroid = "centroid"
+	privacyHidden   = "hidden"
+)
+
+var errPrivacyZoneNotFound = errors.New("privacy zone not found")
+
+// PrivacyZone masks the positions of one device, or of whichever device a
+// driver was assigned to at the time, inside Polygon: they are moved to the
+// zone's centroid or hidden.
+type PrivacyZone struct {
+	ID             int        `json:"id"`
+	OrganizationID int        `json:"organization_id,omitempty"`
+	Name           string     `json:"name"`
+	DeviceID       string     `json:"device_id,omitempty"`
+	DriverID       int        `json:"driver_id,omitempty"`
+	Mode           string     `json:"mode"`
+	Polygon        []Position `json:"polygon"`
+	Centroid       Position   `json:"centroid"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+func (z PrivacyZone) validate() error {
+	switch {
+	case strings.TrimSpace(z.Name) == "":
+		return fmt.Errorf("name is required")
+	case (z.DeviceID == "") == (z.DriverID == 0):
+		return fmt.Errorf("exactly one of device_id and driver_id is required")
+	case z.Mode != privacyCentroid && z.Mode != privacyHidden:
+		return fmt.Errorf("mode must be centroid or hidden")
+	case len(z.Polygon) < 3:
+		return fmt.Errorf("polygon needs at least 3 points")
+	}
+	for _, p := range z.Polygon {
+		if !validLatitude(p.Latitude) || !validLongitude(p.Longitude) {
+			return fmt.Errorf("polygon points must be valid positions")
+		}
+	}
+	return nil
+}
+
+// Contains reports whether p is inside the polygon, by ray casting with
+// longitude as x and latitude as y. Zones are small enough for that.
+func (z PrivacyZone) Contains(p Position) bool {
+	inside := false
+	for i, j := 0, len(z.Polygon)-1; i < len(z.Polygon); j, i = i, i+1 {
+		a, b := z.Polygon[i], z.Polygon[j]
+		if (a.Latitude > p.Latitude) != (b.Latitude > p.Latitude) &&
+			p.Longitude < (b.Longitude-a.Longitude)*(p.Latitude-a.Latitude)/(b.Latitude-a.Latitude)+a.Longitude {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// polygonCentroid returns the area centroid of a polygon, or the mean of
+// its points when it has no area.
+func polygonCentroid(polygon []Position) Position {
+	var area, lat, lng float64
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[j], polygon[i]
+		cross := a.Longitude*b.Latitude - b.Longitude*a.Latitude
+		area += cross
+		lng += (a.Longitude + b.Longitude) * cross
+		lat += (a.Latitude + b.Latitude) * cross
+	}
+	if math.Abs(area) < 1e-12 {
+		var mean Position
+		for _, p := range polygon {
+			mean.Latitude += p.Latitude / float64(len(polygon))
+			mean.Longitude += p.Longitude / float64(len(polygon))
+		}
+		return mean
+	}
+	return Position{Latitude: lat / (3 * area), Longitude: lng / (3 * area)}
+}
+
+// privacyZones keeps the privacy_zones table and masks positions with it.
+// Every zone applies to every response, whichever organization created it;
+// the organization only decides who may see and delete the zone.
+//
+// Positions are stored unmasked, so zones also cover history recorded
+// before they were drawn. Masking happens where handlers get positions
+// from: the device list pipeline (mask), the position log, state
+// timelines and the UpstreamClient calls returning device details, points
+// and trips.
+type privacyZones struct {
+	db      *sql.DB
+	drivers *driverStore
+
+	mu    sync.RWMutex
+	zones []PrivacyZone
+}
+
+// newPrivacyZones loads the zones; drivers tells who drove a device when,
+// for driver zones.
+func newPrivacyZones(db *sql.DB, drivers *driverStore) (*privacyZones, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS privacy_zones (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            organization_id INTEGER,
+            name TEXT NOT NULL,
+            device_id TEXT,
+            driver_id INTEGER REFERENCES drivers(id),
+            mode TEXT NOT NULL,
+            polygon TEXT NOT NULL, -- JSON array of positions
+            created_at DATETIME NOT NULL
+        );
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	z := &privacyZones{db: db, drivers: drivers}
+	if err := z.reload(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+const privacyZoneColumns = "id, organization_id, name, device_id, driver_id, mode, polygon, created_at"
+
+func (z *privacyZones) reload() error {
+	rows, err := z.db.Query("SELECT " + privacyZoneColumns + " FROM privacy_zones ORDER BY name, id")
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	zones := []PrivacyZone{}
+	for rows.Next() {
+		zone, err := scanPrivacyZone(rows)
+		if err != nil {
+			return err
+		}
+		zones = append(zones, zone)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+
+	z.mu.Lock()
+	z.zones = zones
+	z.mu.Unlock()
+	return nil
+}
+
+// List returns the zones of an organization, or every zone for 0.
+func (z *privacyZones) List(organizationID int) []PrivacyZone {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	zones := []PrivacyZone{}
+	for _, zone := range z.zones {
+		if organizationID == 0 || zone.OrganizationID == organizationID {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+func (z *privacyZones) Get(id int) (PrivacyZone, error) {
+	zone, err := scanPrivacyZone(z.db.QueryRow("SELECT "+privacyZoneColumns+" FROM privacy_zones WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return zone, fmt.Errorf("No privacy zone found for ID %d: %w", id, errPrivacyZoneNotFound)
+	}
+	return zone, err
+}
+
+func (z *privacyZones) Create(zone PrivacyZone) (PrivacyZone, error) {
+	zone.CreatedAt = time.Now().UTC()
+	zone.Centroid = polygonCentroid(zone.Polygon)
+	polygon, err := json.Marshal(zone.Polygon)
+	if err != nil {
+		return zone, err
+	}
+	var organizationID, deviceID, driverID any
+	if zone.OrganizationID != 0 {
+		organizationID = zone.OrganizationID
+	}
+	if zone.DeviceID != "" {
+		deviceID = zone.DeviceID
+	}
+	if zone.DriverID != 0 {
+		driverID = zone.DriverID
+	}
+	result, err := z.db.Exec(
+		"INSERT INTO privacy_zones(organization_id, name, device_id, driver_id, mode, polygon, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		organizationID, zone.Name, deviceID, driverID, zone.Mode, string(polygon), zone.CreatedAt)
+	if err != nil {
+		return zone, fmt.Errorf("Database error: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return zone, err
+	}
+	zone.ID = int(id)
+	return zone, z.reload()
+}
+
+func (z *privacyZones) Delete(id int) error {
+	result, err := z.db.Exec("DELETE FROM privacy_zones WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No privacy zone found for ID %d: %w", id, errPrivacyZoneNotFound)
+	}
+	return z.reload()
+}
+
+func scanPrivacyZone(row interface{ Scan(...any) error }) (PrivacyZone, error) {
+	var zone PrivacyZone
+	var organizationID sql.NullInt64
+	var deviceID sql.NullString
+	var driverID sql.NullInt64
+	var polygon string
+	err := row.Scan(&zone.ID, &organizationID, &zone.Name, &deviceID, &driverID, &zone.Mode, &polygon, &zone.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return zone, err
+		}
+		return zone, fmt.Errorf("Database error: %v", err)
+	}
+	if err := json.Unmarshal([]byte(polygon), &zone.Polygon); err != nil {
+		return zone, fmt.Errorf("Database error: %v", err)
+	}
+	zone.OrganizationID = int(organizationID.Int64)
+	zone.DeviceID, zone.DriverID = deviceID.String, int(driverID.Int64)
+	zone.Centroid = polygonCentroid(zone.Polygon)
+	zone.CreatedAt = zone.CreatedAt.UTC()
+	return zone, nil
+}
+
+// zonesAt returns the zones that apply to a device at t: its own, and
+// those of the driver assigned to it then.
+func (z *privacyZones) zonesAt(deviceID string, t time.Time) []PrivacyZone {
+	if z == nil {
+		return nil
+	}
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var zones []PrivacyZone
+	driverID, driving, looked := 0, false, false
+	for _, zone := range z.zones {
+		if zone.DeviceID != "" {
+			if zone.DeviceID != deviceID {
+				continue
+			}
+		} else {
+			if !looked {
+				driverID, driving = z.drivers.DriverAt(deviceID, t)
+				looked = true
+			}
+			if !driving || zone.DriverID != driverID {
+				continue
+			}
+		}
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+// maskPosition applies zones to p, returning the position to show and how
+// it was masked, or "" when it wasn't. Hiding wins over a centroid.
+func maskPosition(zones []PrivacyZone, p Position) (Position, string) {
+	masked, mode := p, ""
+	for _, zone := range zones {
+		if !zone.Contains(p) {
+			continue
+		}
+		if zone.Mode == privacyHidden {
+			return Position{}, privacyHidden
+		}
+		if mode == "" {
+			masked, mode = zone.Centroid, privacyCentroid
+		}
+	}
+	return masked, mode
+}
+
+// maskDevice masks the latest position of a device. A hidden device keeps
+// its place in the list with a zero position.
+func (z *privacyZones) maskDevice(d *Device) {
+	position, mode := maskPosition(z.zonesAt(d.ID, time.Now().UTC()), d.Position)
+	if mode != "" {
+		d.Position, d.Privacy = position, mode
+		d.Address = ""
+	}
+}
+
+// maskPoints masks a device's location history, leaving out hidden points.
+func (z *privacyZones) maskPoints(deviceID string, points []DevicePoint) []DevicePoint {
+	masked := points[:0]
+	for _, p := range points {
+		position, mode := maskPosition(z.zonesAt(deviceID, p.Time), Position{Latitude: p.Latitude, Longitude: p.Longitude})
+		if mode == privacyHidden {
+			continue
+		}
+		if mode != "" {
+			p.Latitude, p.Longitude, p.Privacy = position.Latitude, position.Longitude, mode
+			p.Address = ""
+		}
+		masked = append(masked, p)
+	}
+	return masked
+}
+
+// maskTrack masks stored positions, leaving out hidden ones.
+func (z *privacyZones) maskTrack(deviceID string, track []StoredPosition) []StoredPosition {
+	masked := track[:0]
+	for _, p := range track {
+		position, mode := maskPosition(z.zonesAt(deviceID, p.RecordedAt), p.Position)
+		if mode == privacyHidden {
+			continue
+		}
+		p.Position = position
+		masked = append(masked, p)
+	}
+	return masked
+}
+
+// maskTransitions masks where a device entered its states. A hidden
+// position becomes zero, so the timeline stays complete.
+func (z *privacyZones) maskTransitions(deviceID string, timeline []DeviceStateTransition) {
+	for i, tr := range timeline {
+		if position, mode := maskPosition(z.zonesAt(deviceID, tr.StartedAt), tr.Position); mode != "" {
+			timeline[i].Position, timeline[i].Privacy = position, mode
+		}
+	}
+}
+
+// maskTrip masks the ends of a trip. A hidden end gets a zero position.
+func (z *privacyZones) maskTrip(t *Trip) {
+	ends := []struct {
+		position *Position
+		at       time.Time
+	}{{&t.StartPosition, t.StartTime}, {&t.EndPosition, t.EndTime}}
+	for _, end := range ends {
+		position, mode := maskPosition(z.zonesAt(t.DeviceID, end.at), *end.position)
+		if mode == "" {
+			continue
+		}
+		*end.position = position
+		if t.Privacy != privacyHidden {
+			t.Privacy = mode
+		}
+	}
+}
+
+// mask wraps a device source so that everything reading devices from it
+// gets masked positions.
+func (z *privacyZones) mask(source DeviceSource) DeviceSource {
+	return &privacyMaskedSource{source: source, zones: z}
+}
+
+type privacyMaskedSource struct {
+	source DeviceSource
+	zones  *privacyZones
+}
+
+func (s *privacyMaskedSource) FetchData(ctx context.Context) (ApiResponse, error) {
+	data, err := s.source.FetchData(ctx)
+	if err != nil {
+		return data, err
+	}
+	// The source may share its slice with others, such as the state
+	// tracker's cache, so mask a copy.
+	devices := make([]Device, len(data.Devices))
+	copy(devices, data.Devices)
+	for i := range devices {
+		s.zones.maskDevice(&devices[i])
+	}
+	data.Devices = devices
+	return data, nil
+}
+
+// HandlePrivacyZones routes GET/POST /privacy-zones and GET/DELETE
+// /privacy-zones/{id}. Members of an organization only see its zones.
+func (deps *HandlerDependencies) HandlePrivacyZones(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	organizationID := 0
+	if p := principalFromContext(r.Context()); p != nil {
+		organizationID = p.OrganizationID
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/privacy-zones"), "/")
+	if rest == "" {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, deps.Privacy.List(organizationID))
+		case "POST":
+			deps.HandleCreatePrivacyZone(w, r, organizationID)
+		default:
+			writeMethodNotAllowed(w)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(rest)
+	if err != nil {
+		http.Error(w, "Invalid privacy zone ID", http.StatusBadRequest)
+		return
+	}
+	zone, err := deps.Privacy.Get(id)
+	if err == nil && organizationID != 0 && zone.OrganizationID != organizationID {
+		err = fmt.Errorf("No privacy zone found for ID %d: %w", id, errPrivacyZoneNotFound)
+	}
+	if err != nil {
+		writePrivacyZoneError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, zone)
+	case "DELETE":
+		if err := deps.Privacy.Delete(id); err != nil {
+			writePrivacyZoneError(w, err)
+			return
+		}
+		deps.Audit.Record(r, "privacy_zone.delete", "privacy_zone", id, zone, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// HandleCreatePrivacyZone creates a zone from {"name", "device_id" or
+// "driver_id", "mode", "polygon"}.
+func (deps *HandlerDependencies) HandleCreatePrivacyZone(w http.ResponseWriter, r *http.Request, organizationID int) {
+	var zone PrivacyZone
+	if err := json.NewDecoder(r.Body).Decode(&zone); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := zone.validate(); err != nil {
+		http.Error(w, "Invalid privacy zone: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Zones mask their device for everyone, so they may only be drawn for
+	// the organization's own devices.
+	if zone.DeviceID != "" && !deps.DeviceOrganizations.allows(organizationID, zone.DeviceID) {
+		http.Error(w, "Invalid privacy zone: unknown device_id", http.StatusBadRequest)
+		return
+	}
+	if zone.DriverID != 0 {
+		driver, err := deps.Drivers.Get(zone.DriverID)
+		if err == nil && organizationID != 0 && driver.OrganizationID != organizationID {
+			err = errDriverNotFound
+		}
+		if errors.Is(err, errDriverNotFound) {
+			http.Error(w, "Invalid privacy zone: unknown driver_id", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch driver: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	zone.OrganizationID = organizationID
+
+	zone, err := deps.Privacy.Create(zone)
+	if err != nil {
+		http.Error(w, "Failed to create privacy zone: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deps.Audit.Record(r, "privacy_zone.create", "privacy_zone", zone.ID, nil, zone)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(zone)
+}
+
+func writePrivacyZoneError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPrivacyZoneNotFound) {
+		http.Error(w, "Privacy zone not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// staticDevices is a DeviceSource with a fixed device list.
+type staticDevices []Device
+
+func (s staticDevices) FetchData(ctx context.Context) (ApiResponse, error) {
+	return ApiResponse{Devices: s, Total: len(s)}, nil
+}
+
+// newPrivacyTestDeps wires devices through the position log, privacy zones
+// and the spatial index as main does.
+func newPrivacyTestDeps(t *testing.T, devices ...Device) *HandlerDependencies {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "privacy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	deps := &HandlerDependencies{Store: newMemoryStore()}
+	if deps.Organizations, err = newOrganizationStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Audit, err = newAuditLog(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Teams, err = newTeamStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.PreferenceLayers, err = newPreferenceLayerStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Drivers, err = newDriverStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Privacy, err = newPrivacyZones(db, deps.Drivers); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Positions, err = newPositionLogFromEnv(db, staticDevices(devices), deps.Privacy); err != nil {
+		t.Fatal(err)
+	}
+	if deps.DeviceIndex, err = newDeviceIndexFromEnv(deps.Privacy.mask(deps.Positions)); err != nil {
+		t.Fatal(err)
+	}
+	deps.Devices = deps.DeviceIndex
+	return deps
+}
+
+// squareZone is a zone around (10, 10) with its centroid there.
+func squareZone(t *testing.T, deps *HandlerDependencies, organizationID int, deviceID, mode string) PrivacyZone {
+	zone, err := deps.Privacy.Create(PrivacyZone{
+		OrganizationID: organizationID,
+		Name:           deviceID + " home",
+		DeviceID:       deviceID,
+		Mode:           mode,
+		Polygon:        []Position{{Latitude: 9, Longitude: 9}, {Latitude: 9, Longitude: 11}, {Latitude: 11, Longitude: 11}, {Latitude: 11, Longitude: 9}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zone
+}
+
+// A zone masks its device for everyone; its organization only decides who
+// manages it.
+func TestPrivacyZonesApplyToEveryViewer(t *testing.T) {
+	home := Position{Latitude: 10.9, Longitude: 10.9}
+	devices := staticDevices{{ID: "a", Position: home}, {ID: "b", Position: home}}
+	deps := newPrivacyTestDeps(t, devices...)
+	deps.Access.Enforce = true
+
+	organizations := map[string]int{}
+	preferences := map[string]int{}
+	for _, username := range []string{"alice", "bob"} {
+		pref, err := deps.Store.CreatePreference(UserPreference{Username: username}, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := deps.Organizations.Create(username+"'s fleet", username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		organizations[username], preferences[username] = o.ID, pref.ID
+	}
+	zone := squareZone(t, deps, organizations["alice"], "a", privacyCentroid)
+
+	request := func(username string, policy accessPolicy, handler http.HandlerFunc, method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("X-Username", username)
+		w := httptest.NewRecorder()
+		deps.authorize(policy, handler)(w, r)
+		return w
+	}
+
+	for _, username := range []string{"alice", "bob"} {
+		w := request(username, policyDevices, deps.Handler, "GET", fmt.Sprintf("/?id=%d", preferences[username]))
+		var data ApiResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+			t.Fatalf("%s: %d %s", username, w.Code, w.Body)
+		}
+		shown := map[string]Device{}
+		for _, d := range data.Devices {
+			shown[d.ID] = d
+		}
+		if a := shown["a"]; a.Privacy != privacyCentroid || a.Position != (Position{Latitude: 10, Longitude: 10}) {
+			t.Errorf("%s sees device a at %+v (%q), want the zone's centroid", username, a.Position, a.Privacy)
+		}
+		if b := shown["b"]; b.Privacy != "" || b.Position != home {
+			t.Errorf("%s sees device b at %+v (%q), want it unmasked", username, b.Position, b.Privacy)
+		}
+	}
+	if devices[0].Privacy != "" {
+		t.Error("masking changed the source's device list")
+	}
+
+	if w := request("bob", policyPrivacyZones, deps.HandlePrivacyZones, "GET", "/privacy-zones"); strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("bob lists %s, want no zones", w.Body)
+	}
+	path := fmt.Sprintf("/privacy-zones/%d", zone.ID)
+	if w := request("bob", policyPrivacyZones, deps.HandlePrivacyZones, "DELETE", path); w.Code != http.StatusNotFound {
+		t.Errorf("bob deleting alice's zone: %d, want 404", w.Code)
+	}
+	if w := request("alice", policyPrivacyZones, deps.HandlePrivacyZones, "DELETE", path); w.Code != http.StatusNoContent {
+		t.Errorf("alice deleting her zone: %d, want 204", w.Code)
+	}
+}
+
+func TestPositionLogMasksTracksButNotAggregates(t *testing.T) {
+	deps := newPrivacyTestDeps(t)
+	squareZone(t, deps, 0, "a", privacyHidden)
+
+	now := time.Now().UTC()
+	for i, p := range []Position{{Latitude: 10, Longitude: 10}, {Latitude: 10.5, Longitude: 10.5}, {Latitude: 12, Longitude: 12}} {
+		if _, err := deps.Positions.db.Exec("INSERT INTO device_positions(device_id, recorded_at, lat, lng) VALUES ('a', ?, ?, ?)",
+			now.Add(time.Duration(i-3)*time.Minute), p.Latitude, p.Longitude); err != nil {
+			t.Fatal(err)
+		}
+	}
+	from := now.Add(-time.Hour)
+
+	outside := Position{Latitude: 12, Longitude: 12}
+	track, err := deps.Positions.Track("a", from, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(track) != 1 || track[0].Position != outside {
+		t.Errorf("Track returned %+v, want only the position outside the zone", track)
+	}
+	masked, err := deps.Positions.Between(from, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(masked["a"]) != 1 || masked["a"][0].Position != outside {
+		t.Errorf("Between returned %+v, want only the position outside the zone", masked["a"])
+	}
+
+	// Aggregation such as stats rollups reads the whole track.
+	raw, err := deps.Positions.BetweenUnmasked(from, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw["a"]) != 3 {
+		t.Errorf("BetweenUnmasked returned %d positions, want all 3", len(raw["a"]))
+	}
+}
+
+func TestNearestDevicesSearchesMaskedDevicesWhereShown(t *testing.T) {
+	for _, mode := range []string{privacyCentroid, privacyHidden} {
+		t.Run(mode, func(t *testing.T) {
+			deps := newPrivacyTestDeps(t,
+				Device{ID: "a", Position: Position{Latitude: 10.9, Longitude: 10.9}},
+				Device{ID: "b", Position: Position{Latitude: 10.5, Longitude: 10.5}},
+			)
+			squareZone(t, deps, 0, "a", mode)
+
+			w := httptest.NewRecorder()
+			deps.HandleNearestDevices(w, httptest.NewRequest("GET", "/devices/nearest?id=0&lat=10&lng=10&k=2", nil))
+			var devices []NearbyDevice
+			if err := json.Unmarshal(w.Body.Bytes(), &devices); err != nil {
+				t.Fatalf("%d %s", w.Code, w.Body)
+			}
+
+			var ids []string
+			for _, d := range devices {
+				ids = append(ids, d.ID)
+			}
+			switch {
+			case mode == privacyHidden && (len(ids) != 1 || ids[0] != "b"):
+				t.Errorf("nearest devices %v, want only b", ids)
+			case mode == privacyCentroid && (len(ids) != 2 || ids[0] != "a" || devices[0].DistanceMeters != 0):
+				t.Errorf("nearest devices %v, want a first at the zone's centroid", ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity kinds rate limits can be configured for.
+const (
+	limitToken = "token"
+	limitUser  = "user"
+	limitIP    = "ip"
+)
+
+// rateLimit is a token bucket: Burst requests at once, refilled at Rate
+// per second. A zero Rate means unlimited.
+type rateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// rateLimitRule applies a limit to a route, as registered with
+// http.HandleFunc or "*" for any, and an identity kind, or "" for any.
+type rateLimitRule struct {
+	Route    string
+	Identity string
+	Limit    rateLimit
+}
+
+// defaultRateLimits are kept unless RATE_LIMITS overrides the same route
+// and identity. The device list is limited more tightly since every call
+// can fan out to OneStepGPS. Address limits count every request before it
+// is authenticated, and one address may be a proxy in front of many users,
+// so they are looser.
+var defaultRateLimits = []rateLimitRule{
+	{Route: "*", Limit: rateLimit{Rate: 20, Burst: 40}},
+	{Route: "/", Limit: rateLimit{Rate: 5, Burst: 10}},
+	{Route: "*", Identity: limitIP, Limit: rateLimit{Rate: 100, Burst: 200}},
+	{Route: "/", Identity: limitIP, Limit: rateLimit{Rate: 50, Burst: 100}},
+	{Route: "/auth/", Limit: rateLimit{Rate: 1, Burst: 10}},
+}
+
+// RateLimitConfig configures the rate limiting middleware.
+type RateLimitConfig struct {
+	Rules []rateLimitRule
+
+	// Store is "memory" (the default) or "postgres", which shares buckets
+	// between instances through DATABASE_URL.
+	Store string
+
+	// IPHeader names a header holding the client address, such as
+	// X-Real-IP, set by a trusted proxy. The connection's address is used
+	// otherwise.
+	IPHeader string
+}
+
+// rateLimitConfigFromEnv reads RATE_LIMITS, a ";"-separated list of rules
+// such as "/=5/s burst 10; /reports/ ip=30/m; *=off". A rule names a route
+// and optionally an identity kind (token, user or ip), then a number of
+// requests per s, m, h or Go duration, and optionally the burst, which
+// defaults to the number of requests.
+func rateLimitConfigFromEnv() (RateLimitConfig, error) {
+	cfg := RateLimitConfig{
+		Rules:    append([]rateLimitRule(nil), defaultRateLimits...),
+		Store:    os.Getenv("RATE_LIMIT_STORE"),
+		IPHeader: os.Getenv("RATE_LIMIT_IP_HEADER"),
+	}
+	if cfg.Store == "" {
+		cfg.Store = "memory"
+	}
+	if cfg.Store != "memory" && cfg.Store != "postgres" {
+		return cfg, fmt.Errorf("unknown RATE_LIMIT_STORE %q", cfg.Store)
+	}
+
+	for _, text := range strings.Split(os.Getenv("RATE_LIMITS"), ";") {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		rule, err := parseRateLimitRule(text)
+		if err != nil {
+			return cfg, fmt.Errorf("Invalid RATE_LIMITS rule %q: %v", strings.TrimSpace(text), err)
+		}
+		replaced := false
+		for i, existing := range cfg.Rules {
+			if existing.Route == rule.Route && existing.Identity == rule.Identity {
+				cfg.Rules[i], replaced = rule, true
+			}
+		}
+		if !replaced {
+			cfg.Rules = append(cfg.Rules, rule)
+		}
+	}
+	return cfg, nil
+}
+
+func parseRateLimitRule(text string) (rateLimitRule, error) {
+	var rule rateLimitRule
+	target, limit, ok := strings.Cut(text, "=")
+	if !ok {
+		return rule, fmt.Errorf("expected route=limit")
+	}
+
+	fields := strings.Fields(target)
+	switch {
+	case len(fields) == 1:
+	case len(fields) == 2 && (fields[1] == limitToken || fields[1] == limitUser || fields[1] == limitIP):
+		rule.Identity = fields[1]
+	default:
+		return rule, fmt.Errorf("expected a route and optionally token, user or ip")
+	}
+	rule.Route = fields[0]
+
+	fields = strings.Fields(limit)
+	if len(fields) == 1 && fields[0] == "off" {
+		return rule, nil
+	}
+	if len(fields) != 1 && (len(fields) != 3 || fields[1] != "burst") {
+		return rule, fmt.Errorf("expected requests/period, optionally followed by burst n")
+	}
+
+	count, period, ok := strings.Cut(fields[0], "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return rule, fmt.Errorf("expected a positive number of requests per period")
+	}
+	var d time.Duration
+	switch period {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	default:
+		if d, err = time.ParseDuration(period); err != nil || d <= 0 {
+			return rule, fmt.Errorf("invalid period %q", period)
+		}
+	}
+	rule.Limit = rateLimit{Rate: float64(n) / d.Seconds(), Burst: n}
+
+	if len(fields) == 3 {
+		burst, err := strconv.Atoi(fields[2])
+		if err != nil || burst <= 0 {
+			return rule, fmt.Errorf("invalid burst %q", fields[2])
+		}
+		rule.Limit.Burst = burst
+	}
+	return rule, nil
+}
+
+// limitFor picks the most specific rule for a route and identity kind.
+func (cfg RateLimitConfig) limitFor(route, identity string) rateLimit {
+	best, bestScore := rateLimit{}, -1
+	for _, rule := range cfg.Rules {
+		score := 0
+		switch rule.Route {
+		case route:
+			score += 2
+		case "*":
+		default:
+			continue
+		}
+		switch rule.Identity {
+		case identity:
+			score++
+		case "":
+		default:
+			continue
+		}
+		if score > bestScore {
+			best, bestScore = rule.Limit, score
+		}
+	}
+	return best
+}
+
+// rateDecision is the outcome of taking a token from a bucket.
+type rateDecision struct {
+	Allowed   bool
+	Remaining int
+	// Reset is how long until the bucket is full again, RetryAfter how
+	// long until the next request would be allowed.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// takeToken refills a bucket holding tokens as of updated and takes one
+// token from it if it can. It returns the decision and the new level.
+func takeToken(limit rateLimit, tokens float64, updated, now time.Time) (rateDecision, float64) {
+	burst := float64(limit.Burst)
+	if elapsed := now.Sub(updated).Seconds(); elapsed > 0 {
+		tokens = math.Min(burst, tokens+elapsed*limit.Rate)
+	}
+
+	var d rateDecision
+	if tokens >= 1 {
+		tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+	d.Remaining = int(tokens)
+	d.Reset = time.Duration((burst - tokens) / limit.Rate * float64(time.Second))
+	return d, tokens
+}
+
+// rateLimitStore keeps token buckets by key.
+type rateLimitStore interface {
+	Take(key string, limit rateLimit) (rateDecision, error)
+}
+
+// memoryRateLimitStore keeps buckets in this process.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   rateLimit
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*memoryBucket{}, lastSweep: time.Now()}
+}
+
+func (s *memoryRateLimitStore) Take(key string, limit rateLimit) (rateDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		// Full buckets carry no state worth keeping.
+		for k, b := range s.buckets {
+			if _, tokens := takeToken(b.limit, b.tokens, b.updated, now); tokens+1 >= float64(b.limit.Burst) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.limit = limit
+	d, tokens := takeToken(limit, b.tokens, b.updated, now)
+	b.tokens, b.updated = tokens, now
+	return d, nil
+}
+
+// rateLimiter is the rate limiting middleware.
+type rateLimiter struct {
+	cfg   RateLimitConfig
+	store rateLimitStore
+}
+
+func newRateLimiter(cfg RateLimitConfig) (*rateLimiter, error) {
+	l := &rateLimiter{cfg: cfg}
+	switch cfg.Store {
+	case "postgres":
+		dsn := os.Getenv("DATABASE_URL")
+		if dsn == "" {
+			return nil, fmt.Errorf("DATABASE_URL must be set when RATE_LIMIT_STORE=postgres")
+		}
+		store, err := openPostgresRateLimitStore(dsn)
+		if err != nil {
+			return nil, err
+		}
+		l.store = store
+	default:
+		l.store = newMemoryRateLimitStore()
+	}
+	return l, nil
+}
+
+// clientIP returns the client address, from IPHeader when configured.
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	ip := ""
+	if l.cfg.IPHeader != "" {
+		ip = strings.TrimSpace(strings.Split(r.Header.Get(l.cfg.IPHeader), ",")[0])
+	}
+	if ip == "" {
+		ip = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ip = host
+		}
+	}
+	return ip
+}
+
+// limitAddress wraps the handler of route with the limit for the client
+// address. It goes in front of authorize, so requests that fail
+// authentication or authorization are counted too.
+func (l *rateLimiter) limitAddress(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" || l.allow(w, route, limitIP, "ip:"+l.clientIP(r)) {
+			next(w, r)
+		}
+	}
+}
+
+// limitIdentity wraps the handler of route with the limit for the API
+// token or user authorize found. Anonymous requests, let through while
+// access control is not enforced, are only limited by address.
+func (l *rateLimiter) limitIdentity(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := principalFromContext(r.Context())
+		if r.Method == "OPTIONS" || p == nil {
+			next(w, r)
+			return
+		}
+
+		kind, key := limitUser, "user:"+p.Username
+		if p.TokenID != 0 {
+			kind, key = limitToken, "token:"+strconv.Itoa(p.TokenID)
+		}
+		if l.allow(w, route, kind, key) {
+			next(w, r)
+		}
+	}
+}
+
+// allow takes a token from the bucket of key for route and sets the
+// RateLimit headers. When the bucket is empty it answers 429 and returns
+// false. When the store fails, requests are let through.
+func (l *rateLimiter) allow(w http.ResponseWriter, route, kind, key string) bool {
+	limit := l.cfg.limitFor(route, kind)
+	if limit.Rate <= 0 {
+		return true
+	}
+
+	d, err := l.store.Take(route+" "+key, limit)
+	if err != nil {
+		log.Printf("Rate limiting unavailable: %v", err)
+		return true
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(d.Reset.Seconds()))))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, int(math.Ceil(float64(limit.Burst)/limit.Rate))))
+	if !d.Allowed {
+		setCORSHeaders(w)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.RetryAfter.Seconds()))))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// postgresRateLimitStore shares token buckets between backend instances.
+// Each Take locks the bucket's row for the length of a short transaction.
+type postgresRateLimitStore struct {
+	db *sql.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func openPostgresRateLimitStore(dsn string) (*postgresRateLimitStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to connect to database: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+            key TEXT PRIMARY KEY,
+            tokens DOUBLE PRECISION NOT NULL,
+            updated_at TIMESTAMPTZ NOT NULL
+        )`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	return &postgresRateLimitStore{db: db, lastSweep: time.Now()}, nil
+}
+
+func (s *postgresRateLimitStore) Take(key string, limit rateLimit) (rateDecision, error) {
+	s.sweep()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return rateDecision{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(`INSERT INTO rate_limit_buckets(key, tokens, updated_at) VALUES ($1, $2, $3)
+        ON CONFLICT (key) DO NOTHING`, key, float64(limit.Burst), now)
+	if err != nil {
+		return rateDecision{}, err
+	}
+
+	var tokens float64
+	var updated time.Time
+	err = tx.QueryRow("SELECT tokens, updated_at FROM rate_limit_buckets WHERE key = $1 FOR UPDATE", key).Scan(&tokens, &updated)
+	if err != nil {
+		return rateDecision{}, err
+	}
+	d, tokens := takeToken(limit, tokens, updated, now)
+	if _, err := tx.Exec("UPDATE rate_limit_buckets SET tokens = $1, updated_at = $2 WHERE key = $3", tokens, now, key); err != nil {
+		return rateDecision{}, err
+	}
+	return d, tx.Commit()
+}
+
+// sweep deletes buckets that have been idle for an hour, at most once a
+// minute per instance. Only limits slower than a burst per hour notice.
+func (s *postgresRateLimitStore) sweep() {
+	s.mu.Lock()
+	due := time.Since(s.lastSweep) > time.Minute
+	if due {
+		s.lastSweep = time.Now()
+	}
+	s.mu.Unlock()
+
+	if due {
+		if _, err := s.db.Exec("DELETE FROM rate_limit_buckets WHERE updated_at < $1", time.Now().UTC().Add(-time.Hour)); err != nil {
+			log.Printf("Failed to delete idle rate limit buckets: %v", err)
+		}
+	}
+}
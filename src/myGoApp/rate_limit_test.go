@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newRateLimitTestRoute wraps an OK handler the way main registers routes,
+// with access control enforced and alice as the only user.
+func newRateLimitTestRoute(t *testing.T, rules []rateLimitRule) http.HandlerFunc {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "limits.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	deps := &HandlerDependencies{Store: newMemoryStore(), Access: accessConfig{Enforce: true, AdminUsernames: []string{"alice"}}}
+	if deps.Organizations, err = newOrganizationStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deps.Store.CreatePreference(UserPreference{Username: "alice"}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	limiter, err := newRateLimiter(RateLimitConfig{Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	return limiter.limitAddress("/", deps.authorize(policyIdentified, limiter.limitIdentity("/", ok)))
+}
+
+func rateLimitTestRequest(handler http.HandlerFunc, addr, username string) int {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = addr + ":1234"
+	if username != "" {
+		r.Header.Set("X-Username", username)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+func TestRateLimitCountsRejectedRequests(t *testing.T) {
+	handler := newRateLimitTestRoute(t, []rateLimitRule{
+		{Route: "*", Identity: limitIP, Limit: rateLimit{Rate: 0.001, Burst: 3}},
+	})
+
+	for i, want := range []int{401, 401, 401, 429} {
+		if code := rateLimitTestRequest(handler, "10.0.0.1", "mallory"); code != want {
+			t.Errorf("request %d answered %d, want %d", i, code, want)
+		}
+	}
+	// Anonymous callers are refused by authorize and limited the same way.
+	if code := rateLimitTestRequest(handler, "10.0.0.1", ""); code != http.StatusTooManyRequests {
+		t.Errorf("anonymous request answered %d, want 429", code)
+	}
+	// Other addresses have their own bucket.
+	if code := rateLimitTestRequest(handler, "10.0.0.2", "alice"); code != http.StatusOK {
+		t.Errorf("request from another address answered %d, want 200", code)
+	}
+}
+
+func TestRateLimitAppliesIdentityLimitAfterAuthorization(t *testing.T) {
+	handler := newRateLimitTestRoute(t, []rateLimitRule{
+		{Route: "*", Identity: limitIP, Limit: rateLimit{Rate: 0.001, Burst: 100}},
+		{Route: "*", Identity: limitUser, Limit: rateLimit{Rate: 0.001, Burst: 2}},
+	})
+
+	// alice's own limit follows her between addresses.
+	for i, want := range []int{200, 200, 429} {
+		addr := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}[i]
+		if code := rateLimitTestRequest(handler, addr, "alice"); code != want {
+			t.Errorf("request %d answered %d, want %d", i, code, want)
+		}
+	}
+	// Callers refused by authorize never reach the identity limit, and
+	// don't use up alice's.
+	if code := rateLimitTestRequest(handler, "10.0.0.1", "mallory"); code != http.StatusUnauthorized {
+		t.Errorf("unknown user answered %d, want 401", code)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream modes selected by UPSTREAM_MODE.
+const (
+	upstreamLive   = "live"
+	upstreamRecord = "record"
+	upstreamReplay = "replay"
+
+	// upstreamSimulate serves the device list from an in-process
+	// Simulator; the other endpoints still go to OneStepGPS.
+	upstreamSimulate = "simulate"
+)
+
+// fixture is one recorded OneStepGPS response, stored as
+// <dir>/<key>/<seq>.json. A body that isn't JSON is stored as a JSON
+// string, marked by BodyText.
+type fixture struct {
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Query      string          `json:"query"`
+	Status     int             `json:"status"`
+	Header     http.Header     `json:"header"`
+	Body       json.RawMessage `json:"body"`
+	BodyText   bool            `json:"bodyText,omitempty"`
+	RecordedAt time.Time       `json:"recordedAt"`
+}
+
+// fixtureKey identifies requests that should share fixtures. The API key and
+// the dt_* time range parameters are left out so recordings stay valid for
+// later runs and never contain the secret.
+func fixtureKey(req *http.Request) (string, string) {
+	query := url.Values{}
+	for name, values := range req.URL.Query() {
+		if name == "api-key" || strings.HasPrefix(name, "dt_") {
+			continue
+		}
+		query[name] = values
+	}
+	encoded := query.Encode()
+
+	slug := strings.Trim(strings.NewReplacer("/", "_", ".", "_").Replace(req.URL.Path), "_")
+	sum := sha1.Sum([]byte(req.Method + " " + req.URL.Path + "?" + encoded))
+	return slug + "-" + hex.EncodeToString(sum[:4]), encoded
+}
+
+// newUpstreamTransport returns the transport for UPSTREAM_MODE: nil for live
+// traffic, a recorder or a replayer over UPSTREAM_FIXTURES_DIR otherwise.
+// UPSTREAM_REPLAY chooses between "loop" (cycle through recordings) and
+// "timeshift" (follow the recorded timing, moving timestamps to the present).
+func newUpstreamTransport(mode string) (http.RoundTripper, error) {
+	dir := os.Getenv("UPSTREAM_FIXTURES_DIR")
+	if dir == "" {
+		dir = "./fixtures"
+	}
+
+	switch mode {
+	case "", upstreamLive, upstreamSimulate:
+		return nil, nil
+	case upstreamRecord:
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("Failed to create fixtures directory: %v", err)
+		}
+		return &recordingTransport{dir: dir, next: http.DefaultTransport, seq: map[string]int{}}, nil
+	case upstreamReplay:
+		replayMode := os.Getenv("UPSTREAM_REPLAY")
+		if replayMode == "" {
+			replayMode = "loop"
+		}
+		if replayMode != "loop" && replayMode != "timeshift" {
+			return nil, fmt.Errorf("Invalid UPSTREAM_REPLAY: %q", replayMode)
+		}
+		return loadReplayTransport(dir, replayMode == "timeshift")
+	default:
+		return nil, fmt.Errorf("Invalid UPSTREAM_MODE: %q", mode)
+	}
+}
+
+// recordingTransport passes requests through to OneStepGPS and saves every
+// response as a fixture.
+type recordingTransport struct {
+	dir  string
+	next http.RoundTripper
+
+	mu  sync.Mutex
+	seq map[string]int
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := t.save(req, resp, body); err != nil {
+		log.Printf("Failed to record fixture: %v", err)
+	}
+	return resp, nil
+}
+
+func (t *recordingTransport) save(req *http.Request, resp *http.Response, body []byte) error {
+	key, query := fixtureKey(req)
+	keyDir := filepath.Join(t.dir, key)
+
+	t.mu.Lock()
+	seq, ok := t.seq[key]
+	if !ok {
+		// Continue after fixtures left by an earlier recording session.
+		existing, _ := filepath.Glob(filepath.Join(keyDir, "*.json"))
+		seq = len(existing)
+	}
+	t.seq[key] = seq + 1
+	t.mu.Unlock()
+
+	text := !json.Valid(body)
+	if text {
+		quoted, _ := json.Marshal(string(body))
+		body = quoted
+	}
+	data, err := json.MarshalIndent(fixture{
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Query:      query,
+		Status:     resp.StatusCode,
+		Header:     http.Header{"Content-Type": resp.Header.Values("Content-Type")},
+		Body:       body,
+		BodyText:   text,
+		RecordedAt: time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(keyDir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(keyDir, fmt.Sprintf("%06d.json", seq)), data, 0o644)
+}
+
+// replayTransport serves recorded fixtures instead of calling OneStepGPS.
+type replayTransport struct {
+	fixtures  map[string][]fixture
+	timeshift bool
+	started   time.Time
+
+	// firstRecorded and lastRecorded bound the recording session, which
+	// timeshift mode plays back in a loop.
+	firstRecorded time.Time
+	lastRecorded  time.Time
+
+	mu   sync.Mutex
+	next map[string]int
+}
+
+func loadReplayTransport(dir string, timeshift bool) (*replayTransport, error) {
+	t := &replayTransport{
+		fixtures:  map[string][]fixture{},
+		timeshift: timeshift,
+		started:   time.Now(),
+		next:      map[string]int{},
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var f fixture
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("Invalid fixture %s: %v", path, err)
+		}
+		key := filepath.Base(filepath.Dir(path))
+		t.fixtures[key] = append(t.fixtures[key], f)
+		if t.firstRecorded.IsZero() || f.RecordedAt.Before(t.firstRecorded) {
+			t.firstRecorded = f.RecordedAt
+		}
+		if f.RecordedAt.After(t.lastRecorded) {
+			t.lastRecorded = f.RecordedAt
+		}
+	}
+	if len(t.fixtures) == 0 {
+		return nil, fmt.Errorf("No fixtures found in %s", dir)
+	}
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, _ := fixtureKey(req)
+	recorded := t.fixtures[key]
+	if len(recorded) == 0 {
+		log.Printf("No fixture recorded for %s %s", req.Method, req.URL.Path)
+		return replayResponse(req, http.StatusNotFound, http.Header{}, []byte(`{"error":"no fixture recorded"}`)), nil
+	}
+
+	f, offset := t.pick(key, recorded)
+	body := []byte(f.Body)
+	var asString string
+	if f.BodyText && json.Unmarshal(body, &asString) == nil {
+		body = []byte(asString)
+	} else if t.timeshift {
+		body = shiftTimestamps(body, offset)
+	}
+	return replayResponse(req, f.Status, f.Header.Clone(), body), nil
+}
+
+// pick chooses the fixture to serve and the offset to shift its timestamps
+// by. Loop mode cycles through recordings in order; timeshift mode serves the
+// recording whose offset into the session matches the time elapsed since
+// replay started, wrapping around at the end of the session.
+func (t *replayTransport) pick(key string, recorded []fixture) (fixture, time.Duration) {
+	if !t.timeshift {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		i := t.next[key] % len(recorded)
+		t.next[key] = i + 1
+		return recorded[i], 0
+	}
+
+	span := t.lastRecorded.Sub(t.firstRecorded) + time.Second
+	elapsed := time.Since(t.started)
+	loops := elapsed / span
+	elapsed %= span
+
+	chosen := recorded[0]
+	for _, f := range recorded {
+		if f.RecordedAt.Sub(t.firstRecorded) > elapsed {
+			break
+		}
+		chosen = f
+	}
+	return chosen, t.started.Sub(t.firstRecorded) + loops*span
+}
+
+func replayResponse(req *http.Request, status int, header http.Header, body []byte) *http.Response {
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// shiftTimestamps moves every RFC 3339 timestamp in a JSON document by
+// offset, so replayed positions look current.
+func shiftTimestamps(body []byte, offset time.Duration) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return body
+	}
+	shifted, err := json.Marshal(shiftValue(doc, offset))
+	if err != nil {
+		return body
+	}
+	return shifted
+}
+
+func shiftValue(v any, offset time.Duration) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			v[k] = shiftValue(child, offset)
+		}
+		return v
+	case []any:
+		for i, child := range v {
+			v[i] = shiftValue(child, offset)
+		}
+		return v
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t.Add(offset).Format(time.RFC3339Nano)
+		}
+		return v
+	default:
+		return v
+	}
+}
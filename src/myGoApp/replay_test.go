@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// get sends a GET through transport and returns the response body.
+func get(t *testing.T, transport http.RoundTripper, target string) string {
+	t.Helper()
+	resp, err := (&http.Client{Transport: transport}).Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestRecordAndReplayFixtures(t *testing.T) {
+	var mu sync.Mutex
+	devicePages := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/api/public/device":
+			mu.Lock()
+			devicePages++
+			n := devicePages
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			if n == 1 {
+				w.Write([]byte(`{"result_list": [{"device_id": "first"}]}`))
+			} else {
+				w.Write([]byte(`{"result_list": [{"device_id": "second"}]}`))
+			}
+		case "/text":
+			w.Write([]byte("upstream is down"))
+		case "/string":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`"quoted"`))
+		}
+	}))
+	dir := t.TempDir()
+	recorder := &recordingTransport{dir: dir, next: http.DefaultTransport, seq: map[string]int{}}
+
+	// The API key and time range differ between requests that share
+	// fixtures.
+	get(t, recorder, server.URL+"/v3/api/public/device?api-key=secret-key&dt_from=2024-03-01T00:00:00Z&latest_point=true")
+	get(t, recorder, server.URL+"/v3/api/public/device?api-key=other-key&dt_from=2024-03-02T00:00:00Z&latest_point=true")
+	get(t, recorder, server.URL+"/text")
+	get(t, recorder, server.URL+"/string")
+	server.Close()
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 4 {
+		t.Fatalf("recorded %v, want 4 fixtures", paths)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "key") {
+			t.Errorf("fixture %s contains the API key:\n%s", path, data)
+		}
+	}
+	deviceFixtures, _ := filepath.Glob(filepath.Join(dir, "v3_api_public_device-*", "*.json"))
+	if len(deviceFixtures) != 2 {
+		t.Errorf("device list fixtures %v, want both pages under one key", deviceFixtures)
+	}
+
+	replay, err := loadReplayTransport(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server is gone: everything comes from the fixtures, and loop
+	// mode wraps around after the last one.
+	target := "http://upstream.invalid/v3/api/public/device?api-key=replay-key&dt_from=2025-01-01T00:00:00Z&latest_point=true"
+	for i, want := range []string{"first", "second", "first"} {
+		if body := get(t, replay, target); !strings.Contains(body, want) {
+			t.Errorf("replay %d served %s, want %s", i, body, want)
+		}
+	}
+	if body := get(t, replay, "http://upstream.invalid/text"); body != "upstream is down" {
+		t.Errorf("replayed text body %q", body)
+	}
+	if body := get(t, replay, "http://upstream.invalid/string"); body != `"quoted"` {
+		t.Errorf("replayed JSON string body %q, want it still quoted", body)
+	}
+	resp, err := (&http.Client{Transport: replay}).Get("http://upstream.invalid/never-recorded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("request without a fixture answered %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestTimeshiftReplayMovesTimestampsToThePresent(t *testing.T) {
+	dir := t.TempDir()
+	recordedAt := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	data, err := json.Marshal(fixture{
+		Method:     "GET",
+		Path:       "/v3/api/public/device",
+		Status:     http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       json.RawMessage(`{"result_list": [{"device_id": "truck", "dt_tracker": "2024-03-01T07:59:00Z", "display_name": "2024"}]}`),
+		RecordedAt: recordedAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := fixtureKey(httptest.NewRequest("GET", "/v3/api/public/device", nil))
+	if err := os.MkdirAll(filepath.Join(dir, key), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, key, "000000.json"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := loadReplayTransport(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Devices []struct {
+			Tracker string `json:"dt_tracker"`
+			Name    string `json:"display_name"`
+		} `json:"result_list"`
+	}
+	body := get(t, replay, "http://upstream.invalid/v3/api/public/device")
+	if err := json.Unmarshal([]byte(body), &resp); err != nil || len(resp.Devices) != 1 {
+		t.Fatalf("replayed %s (%v)", body, err)
+	}
+	tracked, err := time.Parse(time.RFC3339Nano, resp.Devices[0].Tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The position was a minute old when it was recorded.
+	if want := replay.started.Add(-time.Minute); !tracked.Equal(want) {
+		t.Errorf("dt_tracker shifted to %v, want %v", tracked, want)
+	}
+	if resp.Devices[0].Name != "2024" {
+		t.Errorf("display_name %q, want strings that aren't timestamps untouched", resp.Devices[0].Name)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// FleetReport summarizes device activity over a period.
+type FleetReport struct {
+	Title       string          `json:"title"`
+	From        time.Time       `json:"from"`
+	To          time.Time       `json:"to"`
+	GeneratedAt time.Time       `json:"generated_at"`
+	Devices     []DeviceSummary `json:"devices"`
+	Visits      []GeofenceVisit `json:"geofence_visits"`
+}
+
+// DeviceSummary is one device's line in a FleetReport. Active hours are the
+// time spent moving or idling.
+type DeviceSummary struct {
+	DeviceID       string  `json:"device_id"`
+	Name           string  `json:"display_name"`
+	DistanceKm     float64 `json:"distance_km"`
+	ActiveHours    float64 `json:"active_hours"`
+	GeofenceVisits int     `json:"geofence_visits"`
+}
+
+// GeofenceVisit is a device staying inside a geofence. ExitedAt is nil when
+// the device was still inside at the end of the period.
+type GeofenceVisit struct {
+	DeviceID  string     `json:"device_id"`
+	Geofence  string     `json:"geofence"`
+	EnteredAt time.Time  `json:"entered_at"`
+	ExitedAt  *time.Time `json:"exited_at,omitempty"`
+}
+
+// Report formats.
+const (
+	reportCSV  = "csv"
+	reportHTML = "html"
+	reportPDF  = "pdf"
+)
+
+func validReportFormat(format string) bool {
+	return format == reportCSV || format == reportHTML || format == reportPDF
+}
+
+// reportContentType returns the MIME type and file extension of a format.
+func reportContentType(format string) (string, string) {
+	switch format {
+	case reportHTML:
+		return "text/html; charset=utf-8", "html"
+	case reportPDF:
+		return "application/pdf", "pdf"
+	default:
+		return "text/csv; charset=utf-8", "csv"
+	}
+}
+
+func renderReport(report FleetReport, format string) ([]byte, error) {
+	switch format {
+	case reportCSV:
+		return renderReportCSV(report)
+	case reportHTML:
+		return renderReportHTML(report)
+	case reportPDF:
+		return renderReportPDF(report), nil
+	default:
+		return nil, fmt.Errorf("unknown report format %q", format)
+	}
+}
+
+// renderReportCSV writes the device summary followed, after a blank line,
+// by the geofence visits.
+func renderReportCSV(report FleetReport) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	w.Write([]string{"device_id", "display_name", "distance_km", "active_hours", "geofence_visits"})
+	for _, d := range report.Devices {
+		w.Write([]string{
+			d.DeviceID,
+			d.Name,
+			strconv.FormatFloat(d.DistanceKm, 'f', 2, 64),
+			strconv.FormatFloat(d.ActiveHours, 'f', 2, 64),
+			strconv.Itoa(d.GeofenceVisits),
+		})
+	}
+	w.Write(nil)
+	w.Write([]string{"device_id", "geofence", "entered_at", "exited_at"})
+	for _, v := range report.Visits {
+		exited := ""
+		if v.ExitedAt != nil {
+			exited = v.ExitedAt.Format(time.RFC3339)
+		}
+		w.Write([]string{v.DeviceID, v.Geofence, v.EnteredAt.Format(time.RFC3339), exited})
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+var reportHTMLTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04 MST") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+td.num { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{time .From}} &ndash; {{time .To}}</p>
+<table>
+<tr><th>Device</th><th>Distance (km)</th><th>Active hours</th><th>Geofence visits</th></tr>
+{{- range .Devices}}
+<tr><td>{{.Name}}</td><td class="num">{{printf "%.2f" .DistanceKm}}</td><td class="num">{{printf "%.2f" .ActiveHours}}</td><td class="num">{{.GeofenceVisits}}</td></tr>
+{{- end}}
+</table>
+{{- if .Visits}}
+<h2>Geofence visits</h2>
+<table>
+<tr><th>Device</th><th>Geofence</th><th>Entered</th><th>Exited</th></tr>
+{{- range .Visits}}
+<tr><td>{{.DeviceID}}</td><td>{{.Geofence}}</td><td>{{time .EnteredAt}}</td><td>{{if .ExitedAt}}{{time .ExitedAt}}{{end}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+<p><small>Generated {{time .GeneratedAt}}</small></p>
+</body>
+</html>
+`))
+
+func renderReportHTML(report FleetReport) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := reportHTMLTemplate.Execute(&buf, report); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// reportTextLines lays the report out as fixed-width text, as used by the
+// PDF renderer.
+func reportTextLines(report FleetReport) []string {
+	var buf bytes.Buffer
+	buf.WriteString(report.Title + "\n")
+	fmt.Fprintf(&buf, "%s - %s\n\n", report.From.Format("2006-01-02 15:04 MST"), report.To.Format("2006-01-02 15:04 MST"))
+
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Device\tDistance (km)\tActive hours\tGeofence visits\t")
+	for _, d := range report.Devices {
+		fmt.Fprintf(tw, "%s\t%.2f\t%.2f\t%d\t\n", d.Name, d.DistanceKm, d.ActiveHours, d.GeofenceVisits)
+	}
+	tw.Flush()
+
+	if len(report.Visits) > 0 {
+		buf.WriteString("\nGeofence visits\n\n")
+		tw = tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "Device\tGeofence\tEntered\tExited")
+		for _, v := range report.Visits {
+			exited := ""
+			if v.ExitedAt != nil {
+				exited = v.ExitedAt.Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", v.DeviceID, v.Geofence, v.EnteredAt.Format("2006-01-02 15:04"), exited)
+		}
+		tw.Flush()
+	}
+	fmt.Fprintf(&buf, "\nGenerated %s\n", report.GeneratedAt.Format("2006-01-02 15:04 MST"))
+
+	return strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+}
+
+// renderReportPDF writes the text layout of the report as a minimal PDF
+// using the built-in Courier font, so no PDF library is needed.
+func renderReportPDF(report FleetReport) []byte {
+	const (
+		linesPerPage = 64
+		fontSize     = 9
+		leading      = 11
+	)
+
+	lines := reportTextLines(report)
+	var pages [][]string
+	for len(lines) > 0 {
+		n := linesPerPage
+		if n > len(lines) {
+			n = len(lines)
+		}
+		pages = append(pages, lines[:n])
+		lines = lines[n:]
+	}
+
+	// Objects 1-3 are the catalog, page tree and font; each page then
+	// takes a page object and a content stream.
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+	)
+	for i, page := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL 36 756 Td\n", fontSize, leading)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", pdfEscape(line))
+		}
+		content.WriteString("ET")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// pdfEscape quotes s for a PDF string literal. The standard fonts only
+// cover Latin-1, so other characters are replaced.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// sortReport orders devices by name and visits by time.
+func sortReport(report *FleetReport) {
+	sort.Slice(report.Devices, func(i, j int) bool {
+		a, b := report.Devices[i], report.Devices[j]
+		return deviceBefore(Device{ID: a.DeviceID, Name: a.Name}, Device{ID: b.DeviceID, Name: b.Name})
+	})
+	sort.Slice(report.Visits, func(i, j int) bool {
+		return report.Visits[i].EnteredAt.Before(report.Visits[j].EnteredAt)
+	})
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errReportScheduleNotFound = errors.New("report schedule not found")
+
+// Report delivery methods.
+const (
+	deliverEmail     = "email"
+	deliverDirectory = "directory"
+)
+
+// ReportSchedule makes a user's fleet report run on a cron schedule. Each run
+// covers the period since the previous scheduled time.
+type ReportSchedule struct {
+	ID         int        `json:"id"`
+	Username   string     `json:"username"`
+	Name       string     `json:"name"`
+	Cron       string     `json:"cron"`
+	Timezone   string     `json:"timezone"`
+	Format     string     `json:"format"`
+	Delivery   string     `json:"delivery"`
+	Recipients []string   `json:"recipients,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastRunAt  *time.Time `json:"last_run_at,omitempty"`
+	NextRunAt  *time.Time `json:"next_run_at,omitempty"`
+}
+
+// ReportRun is one execution of a schedule, kept as run history.
+type ReportRun struct {
+	ID          int        `json:"id"`
+	ScheduleID  int        `json:"schedule_id"`
+	PeriodFrom  time.Time  `json:"period_from"`
+	PeriodTo    time.Time  `json:"period_to"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	DeliveredTo string     `json:"delivered_to,omitempty"`
+}
+
+// validate checks s and fills in defaults, returning its parsed cron
+// expression and time zone.
+func (s *ReportSchedule) validate() (cronSchedule, *time.Location, error) {
+	if s.Timezone == "" {
+		s.Timezone = "UTC"
+	}
+	if s.Format == "" {
+		s.Format = reportCSV
+	}
+
+	if strings.TrimSpace(s.Name) == "" {
+		return cronSchedule{}, nil, fmt.Errorf("name is required")
+	}
+	cron, err := parseCron(s.Cron)
+	if err != nil {
+		return cron, nil, fmt.Errorf("invalid cron: %v", err)
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return cron, nil, fmt.Errorf("invalid timezone: %v", err)
+	}
+	if !validReportFormat(s.Format) {
+		return cron, nil, fmt.Errorf("format must be csv, html or pdf")
+	}
+	switch s.Delivery {
+	case deliverDirectory:
+	case deliverEmail:
+		if len(s.Recipients) == 0 {
+			return cron, nil, fmt.Errorf("email delivery needs recipients")
+		}
+		for _, r := range s.Recipients {
+			if _, err := mail.ParseAddress(r); err != nil {
+				return cron, nil, fmt.Errorf("invalid recipient %q", r)
+			}
+		}
+	default:
+		return cron, nil, fmt.Errorf("delivery must be email or directory")
+	}
+	return cron, loc, nil
+}
+
+// nextRun returns the first scheduled time after the last run, or after
+// the schedule was created.
+func (s ReportSchedule) nextRun(cron cronSchedule, loc *time.Location) time.Time {
+	base := s.CreatedAt
+	if s.LastRunAt != nil {
+		base = *s.LastRunAt
+	}
+	return cron.Next(base.In(loc))
+}
+
+// ReportDeliveryConfig configures where reports go: SMTP for email
+// delivery, a directory for file delivery.
+type ReportDeliveryConfig struct {
+	SMTPAddr     string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+	Directory    string
+	PollInterval time.Duration
+}
+
+// reportDeliveryConfigFromEnv reads SMTP_ADDR (host:port), SMTP_FROM,
+// SMTP_USERNAME, SMTP_PASSWORD, REPORTS_DIR (default ./reports) and
+// REPORT_SCHEDULER_INTERVAL (default 30s).
+func reportDeliveryConfigFromEnv() (ReportDeliveryConfig, error) {
+	cfg := ReportDeliveryConfig{
+		SMTPAddr:     os.Getenv("SMTP_ADDR"),
+		SMTPFrom:     os.Getenv("SMTP_FROM"),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		Directory:    os.Getenv("REPORTS_DIR"),
+		PollInterval: 30 * time.Second,
+	}
+	if cfg.Directory == "" {
+		cfg.Directory = "./reports"
+	}
+	if cfg.SMTPFrom == "" {
+		cfg.SMTPFrom = "reports@localhost"
+	}
+	if v := os.Getenv("REPORT_SCHEDULER_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("Invalid REPORT_SCHEDULER_INTERVAL: %q", v)
+		}
+		cfg.PollInterval = d
+	}
+	return cfg, nil
+}
+
+// reportScheduler stores report schedules and their run history and runs
+// schedules when they are due.
+type reportScheduler struct {
+	db   *sql.DB
+	deps *HandlerDependencies
+	cfg  ReportDeliveryConfig
+}
+
+func newReportScheduler(db *sql.DB, deps *HandlerDependencies, cfg ReportDeliveryConfig) (*reportScheduler, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS report_schedules (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            username TEXT NOT NULL,
+            name TEXT NOT NULL,
+            cron TEXT NOT NULL,
+            timezone TEXT NOT NULL,
+            format TEXT NOT NULL,
+            delivery TEXT NOT NULL,
+            recipients TEXT NOT NULL DEFAULT '[]',
+            created_at DATETIME NOT NULL,
+            last_run_at DATETIME
+        );
+        CREATE TABLE IF NOT EXISTS report_runs (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            schedule_id INTEGER NOT NULL REFERENCES report_schedules(id) ON DELETE CASCADE,
+            period_from DATETIME NOT NULL,
+            period_to DATETIME NOT NULL,
+            started_at DATETIME NOT NULL,
+            finished_at DATETIME,
+            status TEXT NOT NULL,
+            error TEXT NOT NULL DEFAULT '',
+            delivered_to TEXT NOT NULL DEFAULT ''
+        );
+        CREATE INDEX IF NOT EXISTS idx_report_runs_schedule ON report_runs(schedule_id, started_at);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	return &reportScheduler{db: db, deps: deps, cfg: cfg}, nil
+}
+
+const reportScheduleColumns = "id, username, name, cron, timezone, format, delivery, recipients, created_at, last_run_at"
+
+func scanReportSchedule(row interface{ Scan(...any) error }) (ReportSchedule, error) {
+	var s ReportSchedule
+	var recipients string
+	var lastRunAt sql.NullTime
+	err := row.Scan(&s.ID, &s.Username, &s.Name, &s.Cron, &s.Timezone, &s.Format, &s.Delivery, &recipients, &s.CreatedAt, &lastRunAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return s, err
+		}
+		return s, fmt.Errorf("Database error: %v", err)
+	}
+	if err := json.Unmarshal([]byte(recipients), &s.Recipients); err != nil {
+		return s, fmt.Errorf("Failed to unmarshal recipients of schedule %d: %v", s.ID, err)
+	}
+	s.CreatedAt = s.CreatedAt.UTC()
+	if lastRunAt.Valid {
+		t := lastRunAt.Time.UTC()
+		s.LastRunAt = &t
+	}
+	if cron, err := parseCron(s.Cron); err == nil {
+		if loc, err := time.LoadLocation(s.Timezone); err == nil {
+			next := s.nextRun(cron, loc).UTC()
+			s.NextRunAt = &next
+		}
+	}
+	return s, nil
+}
+
+// List returns the schedules of username, or all schedules when it is empty.
+func (rs *reportScheduler) List(username string) ([]ReportSchedule, error) {
+	query := "SELECT " + reportScheduleColumns + " FROM report_schedules"
+	args := []any{}
+	if username != "" {
+		query += " WHERE username = ?"
+		args = append(args, username)
+	}
+	rows, err := rs.db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	schedules := []ReportSchedule{}
+	for rows.Next() {
+		s, err := scanReportSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return schedules, nil
+}
+
+func (rs *reportScheduler) Get(id int) (ReportSchedule, error) {
+	s, err := scanReportSchedule(rs.db.QueryRow("SELECT "+reportScheduleColumns+" FROM report_schedules WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return s, fmt.Errorf("No report schedule found for ID %d: %w", id, errReportScheduleNotFound)
+	}
+	return s, err
+}
+
+func (rs *reportScheduler) Create(s ReportSchedule) (ReportSchedule, error) {
+	if _, _, err := s.validate(); err != nil {
+		return s, err
+	}
+	recipients, err := json.Marshal(s.Recipients)
+	if err != nil {
+		return s, err
+	}
+
+	s.CreatedAt = time.Now().UTC()
+	result, err := rs.db.Exec(`
+        INSERT INTO report_schedules(username, name, cron, timezone, format, delivery, recipients, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Username, s.Name, s.Cron, s.Timezone, s.Format, s.Delivery, string(recipients), s.CreatedAt)
+	if err != nil {
+		return s, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return s, err
+	}
+	return rs.Get(int(id))
+}
+
+func (rs *reportScheduler) Delete(id int) error {
+	tx, err := rs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM report_runs WHERE schedule_id = ?", id); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM report_schedules WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No report schedule found for ID %d: %w", id, errReportScheduleNotFound)
+	}
+	return tx.Commit()
+}
+
+func (rs *reportScheduler) Runs(scheduleID int) ([]ReportRun, error) {
+	rows, err := rs.db.Query(`
+        SELECT id, schedule_id, period_from, period_to, started_at, finished_at, status, error, delivered_to
+        FROM report_runs
+        WHERE schedule_id = ?
+        ORDER BY started_at DESC, id DESC`, scheduleID)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	runs := []ReportRun{}
+	for rows.Next() {
+		var run ReportRun
+		var finishedAt sql.NullTime
+		err := rows.Scan(&run.ID, &run.ScheduleID, &run.PeriodFrom, &run.PeriodTo, &run.StartedAt, &finishedAt, &run.Status, &run.Error, &run.DeliveredTo)
+		if err != nil {
+			return nil, fmt.Errorf("Database error: %v", err)
+		}
+		run.PeriodFrom, run.PeriodTo, run.StartedAt = run.PeriodFrom.UTC(), run.PeriodTo.UTC(), run.StartedAt.UTC()
+		if finishedAt.Valid {
+			t := finishedAt.Time.UTC()
+			run.FinishedAt = &t
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return runs, nil
+}
+
+// Run generates and delivers the report of s for [from, to), recording the
+// run in the history. The returned run reflects the outcome; err is only set
+// when the run could not be recorded.
+func (rs *reportScheduler) Run(ctx context.Context, s ReportSchedule, from, to time.Time) (ReportRun, error) {
+	run := ReportRun{
+		ScheduleID: s.ID,
+		PeriodFrom: from.UTC(),
+		PeriodTo:   to.UTC(),
+		StartedAt:  time.Now().UTC(),
+		Status:     "running",
+	}
+	result, err := rs.db.Exec(`
+        INSERT INTO report_runs(schedule_id, period_from, period_to, started_at, status)
+        VALUES (?, ?, ?, ?, ?)`, run.ScheduleID, run.PeriodFrom, run.PeriodTo, run.StartedAt, run.Status)
+	if err != nil {
+		return run, fmt.Errorf("Failed to record report run: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return run, err
+	}
+	run.ID = int(id)
+
+	run.DeliveredTo, err = rs.generate(ctx, s, from, to)
+	finished := time.Now().UTC()
+	run.FinishedAt = &finished
+	run.Status = "succeeded"
+	if err != nil {
+		run.Status = "failed"
+		run.Error = err.Error()
+		log.Printf("Report schedule %d failed: %v", s.ID, err)
+	}
+
+	_, err = rs.db.Exec(`
+        UPDATE report_runs SET finished_at = ?, status = ?, error = ?, delivered_to = ?
+        WHERE id = ?`, finished, run.Status, run.Error, run.DeliveredTo, run.ID)
+	if err != nil {
+		return run, fmt.Errorf("Failed to record report run: %v", err)
+	}
+	return run, nil
+}
+
+// generate builds, renders and delivers one report, returning where it went.
+func (rs *reportScheduler) generate(ctx context.Context, s ReportSchedule, from, to time.Time) (string, error) {
+	pref, err := rs.deps.Store.GetPreferenceByUsername(s.Username)
+	if err != nil {
+		return "", err
+	}
+	report, err := rs.deps.buildFleetReport(ctx, s.Name, rs.deps.effectivePreference(pref), from, to)
+	if err != nil {
+		return "", err
+	}
+	body, err := renderReport(report, s.Format)
+	if err != nil {
+		return "", err
+	}
+
+	contentType, ext := reportContentType(s.Format)
+	filename := fmt.Sprintf("%d-%s-%s.%s", s.ID, reportSlug(s.Name), to.UTC().Format("20060102-1504"), ext)
+	if s.Delivery == deliverEmail {
+		return strings.Join(s.Recipients, ", "), rs.sendEmail(s, report, filename, contentType, body)
+	}
+	return rs.writeFile(s, filename, body)
+}
+
+var reportSlugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+func reportSlug(name string) string {
+	slug := strings.Trim(reportSlugPattern.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if slug == "" {
+		slug = "report"
+	}
+	return slug
+}
+
+func (rs *reportScheduler) writeFile(s ReportSchedule, filename string, body []byte) (string, error) {
+	dir := filepath.Join(rs.cfg.Directory, reportSlug(s.Username))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("Failed to create report directory: %v", err)
+	}
+	path := filepath.Join(dir, filename)
+	if err := os.WriteFile(path, body, 0o644); err != nil {
+		return "", fmt.Errorf("Failed to write report: %v", err)
+	}
+	return path, nil
+}
+
+// sendEmail mails the report as an attachment through SMTP_ADDR.
+func (rs *reportScheduler) sendEmail(s ReportSchedule, report FleetReport, filename, contentType string, body []byte) error {
+	if rs.cfg.SMTPAddr == "" {
+		return fmt.Errorf("SMTP_ADDR is not configured")
+	}
+
+	const boundary = "fleet-report-boundary"
+	subject := fmt.Sprintf("%s: %s - %s", report.Title, report.From.Format("2006-01-02 15:04"), report.To.Format("2006-01-02 15:04"))
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", rs.cfg.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.Recipients, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+
+	fmt.Fprintf(&msg, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", boundary)
+	fmt.Fprintf(&msg, "%s for %d devices is attached.\r\n\r\n", report.Title, len(report.Devices))
+
+	fmt.Fprintf(&msg, "--%s\r\nContent-Type: %s\r\nContent-Transfer-Encoding: base64\r\n", boundary, contentType)
+	fmt.Fprintf(&msg, "Content-Disposition: attachment; filename=%q\r\n\r\n", filename)
+	encoded := base64.StdEncoding.EncodeToString(body)
+	for len(encoded) > 76 {
+		msg.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	msg.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+
+	var auth smtp.Auth
+	if rs.cfg.SMTPUsername != "" {
+		host, _, _ := strings.Cut(rs.cfg.SMTPAddr, ":")
+		auth = smtp.PlainAuth("", rs.cfg.SMTPUsername, rs.cfg.SMTPPassword, host)
+	}
+	// Recipients may carry display names; the envelope takes bare addresses.
+	envelope := make([]string, 0, len(s.Recipients))
+	for _, r := range s.Recipients {
+		addr, err := mail.ParseAddress(r)
+		if err != nil {
+			return fmt.Errorf("Invalid recipient %q: %v", r, err)
+		}
+		envelope = append(envelope, addr.Address)
+	}
+	if err := smtp.SendMail(rs.cfg.SMTPAddr, auth, rs.cfg.SMTPFrom, envelope, msg.Bytes()); err != nil {
+		return fmt.Errorf("Failed to send report email: %v", err)
+	}
+	return nil
+}
+
+// runDue runs every schedule whose next time has passed. A schedule that
+// missed several times (e.g. while the backend was down) runs once, for the
+// most recent period.
+func (rs *reportScheduler) runDue(ctx context.Context) {
+	schedules, err := rs.List("")
+	if err != nil {
+		log.Printf("Failed to load report schedules: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, s := range schedules {
+		cron, loc, err := s.validate()
+		if err != nil {
+			log.Printf("Skipping invalid report schedule %d: %v", s.ID, err)
+			continue
+		}
+		fire := s.nextRun(cron, loc)
+		if fire.IsZero() || fire.After(now) {
+			continue
+		}
+		for next := cron.Next(fire); !next.IsZero() && !next.After(now); next = cron.Next(fire) {
+			fire = next
+		}
+
+		// The period runs back to the previous scheduled time; without one
+		// it is as long as the gap to the following run.
+		from := fire.Add(-cron.Next(fire).Sub(fire))
+		if s.LastRunAt != nil && s.LastRunAt.After(from) {
+			from = *s.LastRunAt
+		}
+
+		if _, err := rs.db.Exec("UPDATE report_schedules SET last_run_at = ? WHERE id = ?", fire.UTC(), s.ID); err != nil {
+			log.Printf("Failed to update report schedule %d: %v", s.ID, err)
+			continue
+		}
+		if _, err := rs.Run(ctx, s, from, fire); err != nil {
+			log.Printf("Report schedule %d: %v", s.ID, err)
+		}
+	}
+}
+
+// loop checks for due schedules every PollInterval until ctx is done.
+func (rs *reportScheduler) loop(ctx context.Context) {
+	ticker := time.NewTicker(rs.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rs.runDue(ctx)
+		}
+	}
+}
+
+// HandleReportSchedules routes /reports/schedules[/{id}[/runs|/run]].
+func (deps *HandlerDependencies) HandleReportSchedules(w http.ResponseWriter, r *http.Request, rest []string) {
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if len(rest) == 0 {
+		switch r.Method {
+		case "GET":
+			// Members of an organization only list their own schedules
+			// unless they ask for someone else's.
+			username := r.URL.Query().Get("username")
+			if p := principalFromContext(r.Context()); username == "" && p != nil && p.OrganizationID != 0 {
+				username = p.Username
+			}
+			schedules, err := deps.Reports.List(username)
+			if err != nil {
+				http.Error(w, "Failed to fetch report schedules: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, schedules)
+		case "POST":
+			deps.HandleCreateReportSchedule(w, r)
+		default:
+			writeMethodNotAllowed(w)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(rest[0])
+	if err != nil {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return
+	}
+	schedule, err := deps.Reports.Get(id)
+	if err != nil {
+		if errors.Is(err, errReportScheduleNotFound) {
+			http.Error(w, "Report schedule not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch report schedule: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	switch {
+	case len(rest) == 1 && r.Method == "GET":
+		writeJSON(w, schedule)
+	case len(rest) == 1 && r.Method == "DELETE":
+		if err := deps.Reports.Delete(id); err != nil {
+			http.Error(w, "Failed to delete report schedule: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deps.Audit.Record(r, "report_schedule.delete", "report_schedule", id, schedule, nil)
+		w.WriteHeader(http.StatusNoContent)
+	case len(rest) == 2 && rest[1] == "runs" && r.Method == "GET":
+		runs, err := deps.Reports.Runs(id)
+		if err != nil {
+			http.Error(w, "Failed to fetch report runs: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, runs)
+	case len(rest) == 2 && rest[1] == "run" && r.Method == "POST":
+		// Run now for ?from=&to=, by default the last 24 hours.
+		from, to, err := parseTimeRange(r.URL.Query(), defaultHistoryWindow)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		run, err := deps.Reports.Run(r.Context(), schedule, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deps.Audit.Record(r, "report_schedule.run", "report_schedule", id, nil, run)
+		writeJSON(w, run)
+	case len(rest) <= 2:
+		writeMethodNotAllowed(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (deps *HandlerDependencies) HandleCreateReportSchedule(w http.ResponseWriter, r *http.Request) {
+	var s ReportSchedule
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !deps.authorizeRequest(w, r, func(p *Principal) error { return deps.checkManagesUser(p, s.Username) }) {
+		return
+	}
+	if _, err := deps.Store.GetPreferenceByUsername(s.Username); err != nil {
+		if errors.Is(err, errPreferenceNotFound) {
+			http.Error(w, "Unknown username", http.StatusBadRequest)
+		} else {
+			http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		}
+		return
+	}
+	if _, _, err := s.validate(); err != nil {
+		http.Error(w, "Invalid report schedule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s, err := deps.Reports.Create(s)
+	if err != nil {
+		http.Error(w, "Failed to create report schedule: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deps.Audit.Record(r, "report_schedule.create", "report_schedule", s.ID, nil, s)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
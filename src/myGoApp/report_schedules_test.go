@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpMessage is one message accepted by smtpSink.
+type smtpMessage struct {
+	From       string
+	Recipients []string
+	Data       []byte
+}
+
+// smtpSink is a minimal SMTP server that accepts every message, enough for
+// net/smtp.SendMail without STARTTLS or AUTH.
+type smtpSink struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &smtpSink{listener: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	return sink
+}
+
+func (s *smtpSink) Addr() string { return s.listener.Addr().String() }
+
+func (s *smtpSink) Messages() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.messages...)
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 sink ESMTP")
+	var msg smtpMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 sink")
+		case "MAIL":
+			msg = smtpMessage{From: smtpPath(line)}
+			reply("250 OK")
+		case "RCPT":
+			msg.Recipients = append(msg.Recipients, smtpPath(line))
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data bytes.Buffer
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			msg.Data = data.Bytes()
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// smtpPath returns the address between the angle brackets of a MAIL or
+// RCPT command.
+func smtpPath(line string) string {
+	_, rest, _ := strings.Cut(line, "<")
+	path, _, _ := strings.Cut(rest, ">")
+	return path
+}
+
+func TestReportEmailDelivery(t *testing.T) {
+	sink := newSMTPSink(t)
+	rs := &reportScheduler{cfg: ReportDeliveryConfig{SMTPAddr: sink.Addr(), SMTPFrom: "reports@example.com"}}
+
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	report := FleetReport{
+		Title:       "Morning fleet",
+		From:        from,
+		To:          from.Add(24 * time.Hour),
+		GeneratedAt: from.Add(24 * time.Hour),
+		Devices:     []DeviceSummary{{DeviceID: "dev-1", Name: "Truck 1"}},
+	}
+	body, err := renderReport(report, reportCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule := ReportSchedule{ID: 7, Name: "Morning fleet", Recipients: []string{"ops@example.com", "Lead <lead@example.com>"}}
+	contentType, _ := reportContentType(reportCSV)
+
+	if err := rs.sendEmail(schedule, report, "7-morning-fleet.csv", contentType, body); err != nil {
+		t.Fatalf("sendEmail: %v", err)
+	}
+
+	messages := sink.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("sink received %d messages, want 1", len(messages))
+	}
+	got := messages[0]
+	if got.From != "reports@example.com" {
+		t.Errorf("envelope sender %q", got.From)
+	}
+	if want := []string{"ops@example.com", "lead@example.com"}; strings.Join(got.Recipients, ",") != strings.Join(want, ",") {
+		t.Errorf("envelope recipients %v, want %v", got.Recipients, want)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(got.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to := msg.Header.Get("To"); !strings.Contains(to, "ops@example.com") || !strings.Contains(to, "lead@example.com") {
+		t.Errorf("To header %q", to)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || !strings.HasPrefix(subject, "Morning fleet: 2024-03-01") {
+		t.Errorf("subject %q (%v)", subject, err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("content type %q (%v)", mediaType, err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	var attachment []byte
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		if part.FileName() != "7-morning-fleet.csv" || part.Header.Get("Content-Type") != contentType {
+			t.Errorf("attachment %q of type %q", part.FileName(), part.Header.Get("Content-Type"))
+		}
+		// multipart.Reader decodes quoted-printable only; undo the base64.
+		encoded, _ := io.ReadAll(part)
+		attachment, err = base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(attachment, body) {
+		t.Errorf("attachment %q, want the rendered report %q", attachment, body)
+	}
+}
+
+func TestReportEmailWithoutSMTP(t *testing.T) {
+	rs := &reportScheduler{}
+	if err := rs.sendEmail(ReportSchedule{Recipients: []string{"ops@example.com"}}, FleetReport{}, "r.csv", "text/csv", nil); err == nil {
+		t.Error("sendEmail succeeded without SMTP_ADDR")
+	}
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetentionInterval  = time.Hour
+	defaultRetentionBatchSize = 500
+	// retentionBatchPause is how long the purge job waits between batches,
+	// so that position writes and requests get the database in between.
+	retentionBatchPause = 50 * time.Millisecond
+)
+
+var errRetentionPolicyNotFound = errors.New("retention policy not found")
+
+// RetentionPolicy says how long position history is kept. Positions older
+// than DownsampleAfterDays are thinned to one per DownsampleIntervalSeconds, and
+// positions older than DeleteAfterDays are deleted; zero disables either.
+// A policy with DeviceIDs covers that group of devices, one without is the
+// default for every device not in a group. A policy with an OrganizationID
+// only covers the devices assigned to that organization; one without is
+// set by deployment admins and covers every device.
+type RetentionPolicy struct {
+	ID                        int       `json:"id"`
+	OrganizationID            int       `json:"organization_id,omitempty"`
+	Name                      string    `json:"name"`
+	DeviceIDs                 []string  `json:"device_ids"`
+	DownsampleAfterDays       int       `json:"downsample_after_days,omitempty"`
+	DownsampleIntervalSeconds int       `json:"downsample_interval_seconds,omitempty"`
+	DeleteAfterDays           int       `json:"delete_after_days,omitempty"`
+	CreatedAt                 time.Time `json:"created_at"`
+	UpdatedAt                 time.Time `json:"updated_at"`
+}
+
+func (p RetentionPolicy) validate() error {
+	switch {
+	case strings.TrimSpace(p.Name) == "":
+		return fmt.Errorf("name is required")
+	case p.DownsampleAfterDays < 0 || p.DeleteAfterDays < 0:
+		return fmt.Errorf("days must not be negative")
+	case p.DownsampleAfterDays == 0 && p.DeleteAfterDays == 0:
+		return fmt.Errorf("downsample_after_days or delete_after_days is required")
+	case p.DownsampleAfterDays > 0 && p.DownsampleIntervalSeconds < 60:
+		return fmt.Errorf("downsample_interval_seconds of at least 60 is required to downsample")
+	case p.DownsampleAfterDays > 0 && p.DeleteAfterDays > 0 && p.DownsampleAfterDays >= p.DeleteAfterDays:
+		return fmt.Errorf("downsample_after_days must be less than delete_after_days")
+	}
+	for _, id := range p.DeviceIDs {
+		if strings.TrimSpace(id) == "" {
+			return fmt.Errorf("device_ids must not be empty strings")
+		}
+	}
+	return nil
+}
+
+// retentionRule is what applies to one device once its policies are
+// combined. Zero times mean nothing is cut off.
+type retentionRule struct {
+	PolicyIDs        []int
+	DownsampleBefore time.Time
+	Interval         time.Duration
+	DeleteBefore     time.Time
+}
+
+// DeviceRetention is one device's line in a purge or dry-run report.
+type DeviceRetention struct {
+	DeviceID         string     `json:"device_id"`
+	PolicyIDs        []int      `json:"policy_ids"`
+	DeleteBefore     *time.Time `json:"delete_before,omitempty"`
+	Deleted          int        `json:"deleted"`
+	DownsampleBefore *time.Time `json:"downsample_before,omitempty"`
+	Downsampled      int        `json:"downsampled"`
+}
+
+// RetentionReport lists what a purge removed, or for a dry run would remove.
+type RetentionReport struct {
+	DryRun           bool              `json:"dry_run"`
+	StartedAt        time.Time         `json:"started_at"`
+	FinishedAt       time.Time         `json:"finished_at"`
+	Devices          []DeviceRetention `json:"devices"`
+	TotalDeleted     int               `json:"total_deleted"`
+	TotalDownsampled int               `json:"total_downsampled"`
+}
+
+// retentionManager keeps retention_policies and purges device_positions to
+// match them in the background.
+type retentionManager struct {
+	db        *sql.DB
+	devices   *deviceOrganizations
+	interval  time.Duration
+	batchSize int
+	now       func() time.Time
+
+	// purgeMu keeps purges from overlapping. downsampledUntil remembers
+	// how far each device has been thinned, so later runs start there
+	// instead of rescanning all of its history.
+	purgeMu          sync.Mutex
+	downsampledUntil map[string]time.Time
+}
+
+// newRetentionManagerFromEnv reads RETENTION_INTERVAL, how often the purge
+// runs (default 1h), and RETENTION_BATCH_SIZE, how many rows each short
+// transaction deletes (default 500). devices says which organization's
+// policies cover a device.
+func newRetentionManagerFromEnv(db *sql.DB, devices *deviceOrganizations) (*retentionManager, error) {
+	m := &retentionManager{
+		db:               db,
+		devices:          devices,
+		interval:         defaultRetentionInterval,
+		batchSize:        defaultRetentionBatchSize,
+		now:              time.Now,
+		downsampledUntil: map[string]time.Time{},
+	}
+	if v := os.Getenv("RETENTION_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid RETENTION_INTERVAL: %q", v)
+		}
+		m.interval = d
+	}
+	if v := os.Getenv("RETENTION_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("Invalid RETENTION_BATCH_SIZE: %q", v)
+		}
+		m.batchSize = n
+	}
+
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS retention_policies (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            organization_id INTEGER,
+            name TEXT NOT NULL,
+            device_ids TEXT NOT NULL, -- JSON array
+            downsample_after_days INTEGER NOT NULL,
+            downsample_interval_seconds INTEGER NOT NULL,
+            delete_after_days INTEGER NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL
+        );
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	return m, nil
+}
+
+const retentionPolicyColumns = `id, organization_id, name, device_ids, downsample_after_days,
+    downsample_interval_seconds, delete_after_days, created_at, updated_at`
+
+// List returns the policies of an organization, or every policy for 0.
+func (m *retentionManager) List(organizationID int) ([]RetentionPolicy, error) {
+	query := "SELECT " + retentionPolicyColumns + " FROM retention_policies"
+	var args []any
+	if organizationID != 0 {
+		query += " WHERE organization_id = ?"
+		args = append(args, organizationID)
+	}
+	rows, err := m.db.Query(query+" ORDER BY name, id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	policies := []RetentionPolicy{}
+	for rows.Next() {
+		p, err := scanRetentionPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return policies, nil
+}
+
+func (m *retentionManager) Get(id int) (RetentionPolicy, error) {
+	p, err := scanRetentionPolicy(m.db.QueryRow("SELECT "+retentionPolicyColumns+" FROM retention_policies WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return p, fmt.Errorf("No retention policy found for ID %d: %w", id, errRetentionPolicyNotFound)
+	}
+	return p, err
+}
+
+func (m *retentionManager) Create(p RetentionPolicy) (RetentionPolicy, error) {
+	p.CreatedAt = time.Now().UTC()
+	p.UpdatedAt = p.CreatedAt
+	deviceIDs, err := json.Marshal(p.DeviceIDs)
+	if err != nil {
+		return p, err
+	}
+	var organizationID any
+	if p.OrganizationID != 0 {
+		organizationID = p.OrganizationID
+	}
+	result, err := m.db.Exec(`
+        INSERT INTO retention_policies(organization_id, name, device_ids, downsample_after_days,
+            downsample_interval_seconds, delete_after_days, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		organizationID, p.Name, string(deviceIDs), p.DownsampleAfterDays,
+		p.DownsampleIntervalSeconds, p.DeleteAfterDays, p.CreatedAt, p.UpdatedAt)
+	if err != nil {
+		return p, fmt.Errorf("Database error: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return p, err
+	}
+	p.ID = int(id)
+	return p, nil
+}
+
+// Update replaces the settings of an existing policy, keeping its ID,
+// organization and creation time.
+func (m *retentionManager) Update(p RetentionPolicy) (RetentionPolicy, error) {
+	p.UpdatedAt = time.Now().UTC()
+	deviceIDs, err := json.Marshal(p.DeviceIDs)
+	if err != nil {
+		return p, err
+	}
+	result, err := m.db.Exec(`
+        UPDATE retention_policies SET name = ?, device_ids = ?, downsample_after_days = ?,
+            downsample_interval_seconds = ?, delete_after_days = ?, updated_at = ?
+        WHERE id = ?`,
+		p.Name, string(deviceIDs), p.DownsampleAfterDays,
+		p.DownsampleIntervalSeconds, p.DeleteAfterDays, p.UpdatedAt, p.ID)
+	if err != nil {
+		return p, fmt.Errorf("Database error: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return p, fmt.Errorf("No retention policy found for ID %d: %w", p.ID, errRetentionPolicyNotFound)
+	}
+	return m.Get(p.ID)
+}
+
+func (m *retentionManager) Delete(id int) error {
+	result, err := m.db.Exec("DELETE FROM retention_policies WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No retention policy found for ID %d: %w", id, errRetentionPolicyNotFound)
+	}
+	return nil
+}
+
+func scanRetentionPolicy(row interface{ Scan(...any) error }) (RetentionPolicy, error) {
+	var p RetentionPolicy
+	var organizationID sql.NullInt64
+	var deviceIDs string
+	err := row.Scan(&p.ID, &organizationID, &p.Name, &deviceIDs, &p.DownsampleAfterDays,
+		&p.DownsampleIntervalSeconds, &p.DeleteAfterDays, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return p, err
+		}
+		return p, fmt.Errorf("Database error: %v", err)
+	}
+	if err := json.Unmarshal([]byte(deviceIDs), &p.DeviceIDs); err != nil {
+		return p, fmt.Errorf("Database error: %v", err)
+	}
+	if p.DeviceIDs == nil {
+		p.DeviceIDs = []string{}
+	}
+	p.OrganizationID = int(organizationID.Int64)
+	p.CreatedAt, p.UpdatedAt = p.CreatedAt.UTC(), p.UpdatedAt.UTC()
+	return p, nil
+}
+
+// rulesFor combines the policies into a rule per device. A policy only
+// covers the devices of its organization, as organizationOf tells, or every
+// device if it has none. A device in any group it is covered by follows its
+// group policies, others follow the default policies. Where several
+// policies apply the strictest setting of each wins: privacy rules set a
+// maximum, never a minimum, on how long history is kept.
+func rulesFor(policies []RetentionPolicy, deviceIDs []string, organizationOf func(deviceID string) int, now time.Time) map[string]retentionRule {
+	covers := func(p RetentionPolicy, deviceID string) bool {
+		return p.OrganizationID == 0 || p.OrganizationID == organizationOf(deviceID)
+	}
+
+	rules := map[string]retentionRule{}
+	for _, id := range deviceIDs {
+		var grouped, defaults []RetentionPolicy
+		for _, p := range policies {
+			switch {
+			case !covers(p, id):
+			case len(p.DeviceIDs) == 0:
+				defaults = append(defaults, p)
+			case contains(p.DeviceIDs, id):
+				grouped = append(grouped, p)
+			}
+		}
+		applicable := grouped
+		if len(applicable) == 0 {
+			applicable = defaults
+		}
+		if len(applicable) == 0 {
+			continue
+		}
+
+		var rule retentionRule
+		for _, p := range applicable {
+			rule.PolicyIDs = append(rule.PolicyIDs, p.ID)
+			if p.DeleteAfterDays > 0 {
+				cutoff := now.AddDate(0, 0, -p.DeleteAfterDays)
+				if cutoff.After(rule.DeleteBefore) {
+					rule.DeleteBefore = cutoff
+				}
+			}
+			if p.DownsampleAfterDays > 0 {
+				cutoff := now.AddDate(0, 0, -p.DownsampleAfterDays)
+				if cutoff.After(rule.DownsampleBefore) {
+					rule.DownsampleBefore = cutoff
+				}
+				if interval := time.Duration(p.DownsampleIntervalSeconds) * time.Second; interval > rule.Interval {
+					rule.Interval = interval
+				}
+			}
+		}
+		if !rule.DownsampleBefore.After(rule.DeleteBefore) {
+			// Everything that would be thinned is deleted anyway.
+			rule.DownsampleBefore, rule.Interval = time.Time{}, 0
+		}
+		rules[id] = rule
+	}
+	return rules
+}
+
+// Purge applies the policies to device_positions. With dryRun it only
+// counts what would be removed. A non-zero organizationID limits the purge
+// to that organization's devices.
+func (m *retentionManager) Purge(ctx context.Context, organizationID int, dryRun bool) (RetentionReport, error) {
+	m.purgeMu.Lock()
+	defer m.purgeMu.Unlock()
+
+	now := m.now().UTC()
+	report := RetentionReport{DryRun: dryRun, StartedAt: now, Devices: []DeviceRetention{}}
+
+	policies, err := m.List(0)
+	if err != nil {
+		return report, err
+	}
+	deviceIDs, err := m.deviceIDs()
+	if err != nil {
+		return report, err
+	}
+
+	rules := rulesFor(policies, deviceIDs, m.devices.owner, now)
+	for _, id := range deviceIDs {
+		rule, ok := rules[id]
+		if !ok || !m.devices.allows(organizationID, id) {
+			continue
+		}
+		line := DeviceRetention{DeviceID: id, PolicyIDs: rule.PolicyIDs}
+		if !rule.DeleteBefore.IsZero() {
+			cutoff := rule.DeleteBefore
+			line.DeleteBefore = &cutoff
+			if line.Deleted, err = m.deleteBefore(ctx, id, cutoff, dryRun); err != nil {
+				return report, err
+			}
+		}
+		if !rule.DownsampleBefore.IsZero() {
+			cutoff := rule.DownsampleBefore
+			line.DownsampleBefore = &cutoff
+			if line.Downsampled, err = m.downsample(ctx, id, rule, dryRun); err != nil {
+				return report, err
+			}
+		}
+		report.Devices = append(report.Devices, line)
+		report.TotalDeleted += line.Deleted
+		report.TotalDownsampled += line.Downsampled
+	}
+	report.FinishedAt = m.now().UTC()
+	return report, nil
+}
+
+func (m *retentionManager) deviceIDs() ([]string, error) {
+	rows, err := m.db.Query("SELECT DISTINCT device_id FROM device_positions ORDER BY device_id")
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("Database error: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return ids, nil
+}
+
+// deleteBefore deletes a device's positions recorded before cutoff, a
+// batch per statement so the write lock is only held briefly each time.
+func (m *retentionManager) deleteBefore(ctx context.Context, deviceID string, cutoff time.Time, dryRun bool) (int, error) {
+	if dryRun {
+		var n int
+		err := m.db.QueryRow("SELECT COUNT(*) FROM device_positions WHERE device_id = ? AND recorded_at < ?", deviceID, cutoff).Scan(&n)
+		if err != nil {
+			return 0, fmt.Errorf("Database error: %v", err)
+		}
+		return n, nil
+	}
+
+	deleted := 0
+	for {
+		result, err := m.db.ExecContext(ctx, `
+            DELETE FROM device_positions WHERE id IN (
+                SELECT id FROM device_positions WHERE device_id = ? AND recorded_at < ? LIMIT ?)`,
+			deviceID, cutoff, m.batchSize)
+		if err != nil {
+			return deleted, fmt.Errorf("Database error: %v", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, fmt.Errorf("Database error: %v", err)
+		}
+		deleted += int(n)
+		if int(n) < m.batchSize {
+			return deleted, nil
+		}
+		if err := pause(ctx, retentionBatchPause); err != nil {
+			return deleted, err
+		}
+	}
+}
+
+// downsample keeps the first of a device's positions in each interval
+// between the delete and downsample cutoffs, reading and deleting a batch
+// at a time.
+func (m *retentionManager) downsample(ctx context.Context, deviceID string, rule retentionRule, dryRun bool) (int, error) {
+	start := rule.DeleteBefore
+	if until := m.downsampledUntil[deviceID]; until.After(start) {
+		// Step back to the start of its interval, to know whether the
+		// first position after it is the first in its interval.
+		start = until.Truncate(rule.Interval)
+	}
+
+	removed := 0
+	var lastAt time.Time
+	lastID := 0
+	var lastBucket time.Time
+	for {
+		rows, err := m.db.QueryContext(ctx, `
+            SELECT id, recorded_at FROM device_positions
+            WHERE device_id = ? AND recorded_at >= ? AND recorded_at < ?
+                AND (recorded_at > ? OR (recorded_at = ? AND id > ?))
+            ORDER BY recorded_at, id LIMIT ?`,
+			deviceID, start, rule.DownsampleBefore, lastAt, lastAt, lastID, m.batchSize)
+		if err != nil {
+			return removed, fmt.Errorf("Database error: %v", err)
+		}
+		var thin []int
+		n := 0
+		for rows.Next() {
+			var id int
+			var at time.Time
+			if err := rows.Scan(&id, &at); err != nil {
+				rows.Close()
+				return removed, fmt.Errorf("Database error: %v", err)
+			}
+			n++
+			lastAt, lastID = at, id
+			bucket := at.UTC().Truncate(rule.Interval)
+			if bucket.Equal(lastBucket) {
+				thin = append(thin, id)
+			}
+			lastBucket = bucket
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return removed, fmt.Errorf("Database error: %v", err)
+		}
+
+		if len(thin) > 0 && !dryRun {
+			if err := m.deleteIDs(ctx, thin); err != nil {
+				return removed, err
+			}
+		}
+		removed += len(thin)
+		if n < m.batchSize {
+			break
+		}
+		if !dryRun {
+			if err := pause(ctx, retentionBatchPause); err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	if !dryRun {
+		m.downsampledUntil[deviceID] = rule.DownsampleBefore
+	}
+	return removed, nil
+}
+
+func (m *retentionManager) deleteIDs(ctx context.Context, ids []int) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("DELETE FROM device_positions WHERE id = ?")
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, id := range ids {
+		if _, err := stmt.Exec(id); err != nil {
+			return fmt.Errorf("Database error: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	return nil
+}
+
+func pause(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func (m *retentionManager) loop(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		report, err := m.Purge(ctx, 0, false)
+		if err != nil {
+			log.Printf("Failed to purge position history: %v", err)
+		} else if report.TotalDeleted > 0 || report.TotalDownsampled > 0 {
+			log.Printf("Purged position history: %d deleted, %d downsampled", report.TotalDeleted, report.TotalDownsampled)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// HandleRetention routes GET/POST /retention, GET/PUT/DELETE
+// /retention/{id} and GET /retention/dry-run, which reports what the next
+// purge would remove without removing it. Owners only see and change the
+// policies of their organization, which cover its devices; deployment
+// admins set the policies that cover every device.
+func (deps *HandlerDependencies) HandleRetention(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	organizationID := 0
+	if p := principalFromContext(r.Context()); p != nil && !p.DeploymentAdmin {
+		organizationID = p.OrganizationID
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/retention"), "/")
+	switch {
+	case rest == "" && r.Method == "GET":
+		policies, err := deps.Retention.List(organizationID)
+		if err != nil {
+			http.Error(w, "Failed to fetch retention policies: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, policies)
+		return
+	case rest == "" && r.Method == "POST":
+		deps.HandleCreateRetentionPolicy(w, r, organizationID)
+		return
+	case rest == "dry-run" && r.Method == "GET":
+		report, err := deps.Retention.Purge(r.Context(), organizationID, true)
+		if err != nil {
+			http.Error(w, "Failed to compute retention report: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, report)
+		return
+	case rest == "" || rest == "dry-run":
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	id, err := strconv.Atoi(rest)
+	if err != nil {
+		http.Error(w, "Invalid retention policy ID", http.StatusBadRequest)
+		return
+	}
+	policy, err := deps.Retention.Get(id)
+	if err == nil && organizationID != 0 && policy.OrganizationID != organizationID {
+		err = fmt.Errorf("No retention policy found for ID %d: %w", id, errRetentionPolicyNotFound)
+	}
+	if err != nil {
+		writeRetentionError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, policy)
+	case "PUT":
+		var body RetentionPolicy
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.DeviceIDs == nil {
+			body.DeviceIDs = []string{}
+		}
+		if err := body.validate(); err != nil {
+			http.Error(w, "Invalid retention policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !deps.DeviceOrganizations.allowsAll(policy.OrganizationID, body.DeviceIDs) {
+			http.Error(w, "Invalid retention policy: unknown device_id", http.StatusBadRequest)
+			return
+		}
+		body.ID = id
+		updated, err := deps.Retention.Update(body)
+		if err != nil {
+			writeRetentionError(w, err)
+			return
+		}
+		deps.Audit.Record(r, "retention_policy.update", "retention_policy", id, policy, updated)
+		writeJSON(w, updated)
+	case "DELETE":
+		if err := deps.Retention.Delete(id); err != nil {
+			writeRetentionError(w, err)
+			return
+		}
+		deps.Audit.Record(r, "retention_policy.delete", "retention_policy", id, policy, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// HandleCreateRetentionPolicy creates a policy for an organization, or for
+// the whole deployment with 0, from {"name", "device_ids",
+// "downsample_after_days", "downsample_interval_seconds",
+// "delete_after_days"}.
+func (deps *HandlerDependencies) HandleCreateRetentionPolicy(w http.ResponseWriter, r *http.Request, organizationID int) {
+	var p RetentionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.DeviceIDs == nil {
+		p.DeviceIDs = []string{}
+	}
+	if err := p.validate(); err != nil {
+		http.Error(w, "Invalid retention policy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !deps.DeviceOrganizations.allowsAll(organizationID, p.DeviceIDs) {
+		http.Error(w, "Invalid retention policy: unknown device_id", http.StatusBadRequest)
+		return
+	}
+	p.OrganizationID = organizationID
+
+	p, err := deps.Retention.Create(p)
+	if err != nil {
+		http.Error(w, "Failed to create retention policy: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deps.Audit.Record(r, "retention_policy.create", "retention_policy", p.ID, nil, p)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+func writeRetentionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errRetentionPolicyNotFound) {
+		http.Error(w, "Retention policy not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
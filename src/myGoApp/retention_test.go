@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionPoliciesCoverTheirOrganizationsDevices(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "retention.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	deps := &HandlerDependencies{Store: newMemoryStore(), Access: accessConfig{Enforce: true, AdminUsernames: []string{"root"}}}
+	if deps.Organizations, err = newOrganizationStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.DeviceOrganizations, err = newDeviceOrganizations(db); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Retention, err = newRetentionManagerFromEnv(db, deps.DeviceOrganizations); err != nil {
+		t.Fatal(err)
+	}
+	if deps.Audit, err = newAuditLog(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE device_positions (id INTEGER PRIMARY KEY AUTOINCREMENT, device_id TEXT, recorded_at DATETIME, lat REAL, lng REAL)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"root", "alice", "bob"} {
+		if _, err := deps.Store.CreatePreference(UserPreference{Username: username}, "root"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acme, err := deps.Organizations.Create("Acme", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobco, err := deps.Organizations.Create("Bobco", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each organization has a device with a year of history.
+	old := time.Now().UTC().AddDate(-1, 0, 0)
+	for deviceID, organizationID := range map[string]int{"alice-van": acme.ID, "bob-truck": bobco.ID} {
+		if _, err := deps.DeviceOrganizations.Assign(organizationID, deviceID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO device_positions(device_id, recorded_at, lat, lng) VALUES (?, ?, 1, 1)", deviceID, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	positions := func(deviceID string) int {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM device_positions WHERE device_id = ?", deviceID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	handler := deps.authorize(policyRetention, deps.HandleRetention)
+	request := func(username, method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-Username", username)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	// alice's policy only covers Acme's devices.
+	wipe := `{"name": "wipe", "delete_after_days": 1}`
+	if w := request("alice", "POST", "/retention", `{"name": "theirs", "device_ids": ["bob-truck"], "delete_after_days": 1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("organization owner creating a policy for another organization's device answered %d, want 400", w.Code)
+	}
+	w := request("alice", "POST", "/retention", wipe)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("organization owner creating a policy answered %d %s, want 201", w.Code, w.Body)
+	}
+	var policy RetentionPolicy
+	if err := json.Unmarshal(w.Body.Bytes(), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if policy.OrganizationID != acme.ID {
+		t.Errorf("policy belongs to organization %d, want %d", policy.OrganizationID, acme.ID)
+	}
+
+	w = request("alice", "GET", "/retention/dry-run", "")
+	var report RetentionReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if len(report.Devices) != 1 || report.Devices[0].DeviceID != "alice-van" || report.TotalDeleted != 1 {
+		t.Errorf("organization owner's dry run reports %+v, want only alice-van", report)
+	}
+
+	if _, err := deps.Retention.Purge(context.Background(), 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := positions("alice-van"); n != 0 {
+		t.Errorf("alice's history has %d positions after the purge, want 0", n)
+	}
+	if n := positions("bob-truck"); n != 1 {
+		t.Fatalf("bob's history has %d positions after alice's policy, want 1", n)
+	}
+
+	// bob neither sees nor changes alice's policy.
+	path := "/retention/" + strconv.Itoa(policy.ID)
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		if w := request("bob", method, path, wipe); w.Code != http.StatusNotFound {
+			t.Errorf("%s of another organization's policy answered %d, want 404", method, w.Code)
+		}
+	}
+	if w := request("bob", "GET", "/retention", ""); strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("bob lists %s, want no policies", w.Body)
+	}
+
+	// A deployment admin sets retention for every device.
+	if w := request("root", "POST", "/retention", wipe); w.Code != http.StatusCreated {
+		t.Fatalf("deployment admin creating a policy answered %d, want 201", w.Code)
+	}
+	if w := request("root", "GET", "/retention", ""); !strings.Contains(w.Body.String(), `"organization_id":`+strconv.Itoa(acme.ID)) {
+		t.Errorf("deployment admin lists %s, want every policy", w.Body)
+	}
+	report, err = deps.Retention.Purge(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TotalDeleted != 1 || positions("bob-truck") != 0 {
+		t.Errorf("purge deleted %d positions, want bob's 1", report.TotalDeleted)
+	}
+}
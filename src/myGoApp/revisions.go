@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// diffPreferences describes what changed between two versions of a user
+// preference. A zero before value yields the diff of a newly created one.
+func diffPreferences(before, after UserPreference) PreferenceDiff {
+	var diff PreferenceDiff
+
+	if before.SortOrder != after.SortOrder {
+		diff.SortOrder = &StringChange{From: before.SortOrder, To: after.SortOrder}
+	}
+	for _, id := range after.HiddenDevices {
+		if !contains(before.HiddenDevices, id) {
+			diff.HiddenDevicesAdded = append(diff.HiddenDevicesAdded, id)
+		}
+	}
+	for _, id := range before.HiddenDevices {
+		if !contains(after.HiddenDevices, id) {
+			diff.HiddenDevicesRemoved = append(diff.HiddenDevicesRemoved, id)
+		}
+	}
+	diff.IconChanged = !bytes.Equal(before.Icon, after.Icon)
+
+	return diff
+}
+
+// actorFromRequest identifies who is making a change for the revision log.
+func actorFromRequest(r *http.Request) string {
+	if p := principalFromContext(r.Context()); p != nil {
+		return p.Username
+	}
+	if username := strings.TrimSpace(r.Header.Get("X-Username")); username != "" {
+		return username
+	}
+	return "anonymous"
+}
+
+// HandlePreferences routes the /preferences/{id}/... family of endpoints.
+func (deps *HandlerDependencies) HandlePreferences(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/preferences/"), "/"), "/")
+
+	switch {
+	case len(parts) == 1:
+		deps.HandleGetUserPreference(w, r)
+	case len(parts) == 2 && parts[1] == "hidden-devices":
+		deps.HandleUpdateHiddenDevices(w, r)
+	case len(parts) == 2 && parts[1] == "revisions":
+		deps.HandleListPreferenceRevisions(w, r)
+	case len(parts) == 2 && parts[1] == "effective":
+		deps.HandleEffectivePreference(w, r)
+	case len(parts) == 2 && parts[1] == "shown-devices":
+		deps.HandleShownDevices(w, r)
+	case len(parts) == 2 && parts[1] == "export":
+		deps.HandleExportPreference(w, r)
+	case len(parts) == 2 && parts[1] == "import":
+		deps.HandleImportPreference(w, r)
+	case len(parts) == 4 && parts[1] == "revisions" && parts[3] == "restore":
+		deps.HandleRestorePreferenceRevision(w, r)
+	default:
+		setCORSHeaders(w)
+		http.NotFound(w, r)
+	}
+}
+
+func (deps *HandlerDependencies) HandleListPreferenceRevisions(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	userID, err := getUserIDFromURL(strings.TrimSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/revisions"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := deps.Store.GetPreference(userID); err != nil {
+		if errors.Is(err, errPreferenceNotFound) {
+			http.Error(w, "Preferences not found for the given ID", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	revisions, err := deps.Store.ListRevisions(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch preference revisions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(revisions)
+	if err != nil {
+		http.Error(w, "Failed to convert preference revisions to JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// HandleRestorePreferenceRevision rolls a preference back to the state it had
+// after the given revision. The restore is itself recorded as a new revision,
+// so it can be undone the same way.
+func (deps *HandlerDependencies) HandleRestorePreferenceRevision(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"error": "Method not allowed"}`))
+		return
+	}
+
+	userID, revision, err := getRevisionFromURL(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rev, err := deps.Store.GetRevision(userID, revision)
+	if err != nil {
+		if errors.Is(err, errRevisionNotFound) {
+			http.Error(w, "Revision not found for the given preference", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch preference revision: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	pref := rev.Snapshot
+	pref.ID = userID
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+	pref.Version = version
+
+	pref, err = deps.Store.UpdatePreference(pref, actorFromRequest(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, errPreferenceNotFound):
+			http.Error(w, "Preferences not found for the given ID", http.StatusNotFound)
+		case errors.Is(err, errVersionConflict):
+			http.Error(w, "Preference has been modified", http.StatusPreconditionFailed)
+		default:
+			http.Error(w, "Failed to restore user preferences: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	deps.auditPreferenceChange(r, "preference.restore", pref)
+
+	w.Header().Set("ETag", preferenceETag(pref))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf(`{"message": "Preference restored to revision %d", "revision": %d}`, revision, pref.Version)))
+}
+
+func getRevisionFromURL(path string) (int, int, error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/preferences/"), "/"), "/")
+	if len(parts) != 4 {
+		return 0, 0, fmt.Errorf("Invalid URL format")
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid user ID format: %v", err)
+	}
+	revision, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid revision format: %v", err)
+	}
+	return id, revision, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiKeyCheckInterval = 10 * time.Second
+	redactedSecret      = "[REDACTED]"
+)
+
+// apiKeySource supplies the OneStepGPS API key. The key comes from
+// ONESTEPGPS_API_KEY_FILE (e.g. a mounted secret) when set, otherwise from
+// ONESTEPGPS_API_KEY. A file-backed key is re-read when the file changes, so
+// the key can be rotated without restarting the backend.
+type apiKeySource struct {
+	mu        sync.Mutex
+	path      string
+	key       string
+	modTime   time.Time
+	checkedAt time.Time
+
+	// retired holds keys that were rotated out; they are still redacted
+	// since they may appear in in-flight errors.
+	retired []string
+}
+
+// newAPIKeySourceFromEnv loads the API key. When optional is set (replaying
+// recorded traffic) a missing key is not an error.
+func newAPIKeySourceFromEnv(optional bool) (*apiKeySource, error) {
+	if path := os.Getenv("ONESTEPGPS_API_KEY_FILE"); path != "" {
+		s := &apiKeySource{path: path}
+		if err := s.Reload(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	key := strings.TrimSpace(os.Getenv("ONESTEPGPS_API_KEY"))
+	if key == "" && !optional {
+		return nil, fmt.Errorf("ONESTEPGPS_API_KEY or ONESTEPGPS_API_KEY_FILE must be set")
+	}
+	return &apiKeySource{key: key}, nil
+}
+
+// Key returns the current API key, picking up a rotated key file at most
+// every apiKeyCheckInterval.
+func (s *apiKeySource) Key() (string, error) {
+	s.mu.Lock()
+	due := s.path != "" && time.Since(s.checkedAt) >= apiKeyCheckInterval
+	s.mu.Unlock()
+
+	if due {
+		if err := s.reloadIfChanged(); err != nil {
+			return "", err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.key, nil
+}
+
+// Reload re-reads the key file unconditionally, e.g. on SIGHUP.
+func (s *apiKeySource) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read API key file: %v", err)
+	}
+	return s.load(info.ModTime())
+}
+
+func (s *apiKeySource) reloadIfChanged() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		// Keep serving the last good key while a secret mount is being
+		// swapped out underneath us.
+		s.mu.Lock()
+		s.checkedAt = time.Now()
+		hasKey := s.key != ""
+		s.mu.Unlock()
+		if hasKey {
+			return nil
+		}
+		return fmt.Errorf("Failed to read API key file: %v", err)
+	}
+
+	s.mu.Lock()
+	changed := !info.ModTime().Equal(s.modTime)
+	s.checkedAt = time.Now()
+	s.mu.Unlock()
+
+	if !changed {
+		return nil
+	}
+	return s.load(info.ModTime())
+}
+
+func (s *apiKeySource) load(modTime time.Time) error {
+	contents, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read API key file: %v", err)
+	}
+	key := strings.TrimSpace(string(contents))
+	if key == "" {
+		return fmt.Errorf("API key file %s is empty", s.path)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key != "" && s.key != key {
+		s.retired = append(s.retired, s.key)
+	}
+	s.key = key
+	s.modTime = modTime
+	s.checkedAt = time.Now()
+	return nil
+}
+
+// Redact replaces every current or retired API key in text.
+func (s *apiKeySource) Redact(text string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range append([]string{s.key}, s.retired...) {
+		if key == "" {
+			continue
+		}
+		text = strings.ReplaceAll(text, key, redactedSecret)
+		if escaped := url.QueryEscape(key); escaped != key {
+			text = strings.ReplaceAll(text, escaped, redactedSecret)
+		}
+	}
+	return text
+}
+
+// redactedError hides secrets in the message of err. Unwrapping it yields
+// redacted copies of the errors err wraps, so errors.Is and errors.As keep
+// working without handing out a *url.Error that still holds the key.
+type redactedError struct {
+	err  error
+	msg  string
+	keys *apiKeySource
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.keys.redactError(errors.Unwrap(e.err)) }
+
+func (s *apiKeySource) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := s.Redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		return &url.Error{Op: urlErr.Op, URL: s.Redact(urlErr.URL), Err: s.redactError(urlErr.Err)}
+	}
+	return &redactedError{err: err, msg: msg, keys: s}
+}
+
+// redactingWriter scrubs API keys from everything written through it; main
+// installs it as the output of the standard logger.
+type redactingWriter struct {
+	w    io.Writer
+	keys *apiKeySource
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, rw.keys.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
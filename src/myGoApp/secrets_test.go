@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedactErrorRedactsWrappedErrors(t *testing.T) {
+	keys := &apiKeySource{key: "s3cret/key"}
+	original := fmt.Errorf("error making http request: %w", &url.Error{
+		Op:  "Get",
+		URL: "https://upstream.test/v1?api-key=" + url.QueryEscape("s3cret/key"),
+		Err: context.DeadlineExceeded,
+	})
+
+	err := keys.redactError(original)
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if strings.Contains(e.Error(), "s3cret") {
+			t.Errorf("%T in the chain leaks the key: %v", e, e)
+		}
+	}
+
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		t.Fatal("redacted error no longer wraps a *url.Error")
+	}
+	if strings.Contains(urlErr.URL, "s3cret") {
+		t.Errorf("unwrapped URL %q leaks the key", urlErr.URL)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || !isTimeout(err) {
+		t.Errorf("redacted error %v is no longer a timeout", err)
+	}
+}
+
+func TestRedactErrorLeavesCleanErrors(t *testing.T) {
+	keys := &apiKeySource{key: "s3cret"}
+	original := errors.New("connection refused")
+	if err := keys.redactError(original); err != original {
+		t.Errorf("redactError wrapped an error with nothing to redact: %#v", err)
+	}
+}
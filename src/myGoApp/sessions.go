@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	sessionCookie     = "session"
+	defaultSessionTTL = 12 * time.Hour
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// sessionStore keeps browser login sessions. Like API tokens, only the
+// SHA-256 of a session secret is stored.
+type sessionStore struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+func newSessionStore(db *sql.DB, ttl time.Duration) (*sessionStore, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS sessions (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            hash TEXT UNIQUE NOT NULL,
+            username TEXT NOT NULL,
+            created_at DATETIME NOT NULL,
+            expires_at DATETIME NOT NULL
+        );
+        CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	return &sessionStore{db: db, ttl: ttl}, nil
+}
+
+// Create starts a session for username and returns its secret. Expired
+// sessions are cleared out on the way.
+func (s *sessionStore) Create(username string) (string, time.Time, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now().UTC()
+	expires := now.Add(s.ttl)
+
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE expires_at < ?", now); err != nil {
+		return "", time.Time{}, fmt.Errorf("Database error: %v", err)
+	}
+	_, err := s.db.Exec("INSERT INTO sessions(hash, username, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		hashSecret(secret), username, now, expires)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Database error: %v", err)
+	}
+	return secret, expires, nil
+}
+
+// Username returns who an unexpired session belongs to.
+func (s *sessionStore) Username(secret string) (string, error) {
+	var username string
+	err := s.db.QueryRow("SELECT username FROM sessions WHERE hash = ? AND expires_at > ?",
+		hashSecret(secret), time.Now().UTC()).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", errSessionNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("Database error: %v", err)
+	}
+	return username, nil
+}
+
+func (s *sessionStore) Delete(secret string) error {
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE hash = ?", hashSecret(secret)); err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	return nil
+}
+
+// principalForSession authenticates the session cookie of r. A missing,
+// unknown or expired session yields no principal rather than an error, so
+// a stale cookie doesn't lock out other ways of identifying.
+func (deps *HandlerDependencies) principalForSession(r *http.Request) (*Principal, error) {
+	if deps.Sessions == nil {
+		return nil, nil
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+	username, err := deps.Sessions.Username(cookie.Value)
+	if err != nil {
+		if errors.Is(err, errSessionNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return deps.principalForUsername(username)
+}
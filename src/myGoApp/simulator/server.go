@@ -0,0 +1,72 @@
+package simulator
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Handler serves the fleet through the OneStepGPS endpoints the backend
+// uses, so ONESTEPGPS_BASE_URL can point at it. Any API key is accepted.
+func (s *Simulator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/api/public/device", s.handleDeviceList)
+	mux.HandleFunc("/v3/api/public/device/", s.handleDevice)
+	mux.HandleFunc("/v3/api/public/device-point", s.handleDevicePoints)
+	mux.HandleFunc("/v3/api/public/driver", handleEmptyPage)
+	mux.HandleFunc("/v3/api/public/report/trip", handleEmptyPage)
+	return mux
+}
+
+// page is the envelope of OneStepGPS list endpoints.
+type page[T any] struct {
+	Results []T `json:"result_list"`
+	Total   int `json:"total"`
+}
+
+func (s *Simulator) handleDeviceList(w http.ResponseWriter, r *http.Request) {
+	devices := s.Devices()
+	writeJSON(w, page[Device]{Results: devices, Total: len(devices)})
+}
+
+func (s *Simulator) handleDevice(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v3/api/public/device/")
+	device, ok := s.Device(id)
+	if !ok {
+		http.Error(w, `{"error":"device not found"}`, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, device)
+}
+
+func (s *Simulator) handleDevicePoints(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := time.Parse(time.RFC3339, query.Get("dt_tracker_from"))
+	if err != nil {
+		from = time.Time{}
+	}
+	to, err := time.Parse(time.RFC3339, query.Get("dt_tracker_to"))
+	if err != nil {
+		to = time.Now()
+	}
+	points := s.Points(query.Get("device_id"), from, to)
+	writeJSON(w, page[Point]{Results: points, Total: len(points)})
+}
+
+// handleEmptyPage answers list endpoints the simulator has no data for.
+func handleEmptyPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"result_list":[]}`))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to convert data to JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,524 @@
+// Package simulator generates a synthetic fleet that drives along random or
+// scripted routes, for demos and load tests without a OneStepGPS account.
+package simulator
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyLimit bounds the location history kept per simulated device,
+// sampled every historyInterval.
+const (
+	historyLimit    = 500
+	historyInterval = 30 * time.Second
+)
+
+// Catching up advances the fleet in steps of stepDuration, lengthened so
+// no catch-up takes more than maxCatchUpSteps; after a long idle spell the
+// fleet moves in coarser steps instead of replaying every few seconds.
+const (
+	stepDuration    = 5 * time.Second
+	maxCatchUpSteps = 720
+)
+
+const earthRadiusMeters = 6371000.0
+
+// Position is a coordinate, encoded as OneStepGPS encodes it.
+type Position struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lng"`
+}
+
+// Device is a simulated vehicle in the shape of a OneStepGPS device.
+type Device struct {
+	ID           string    `json:"device_id"`
+	Name         string    `json:"display_name"`
+	Position     Position  `json:"latest_device_point"`
+	IsActive     string    `json:"active_state"`
+	Make         string    `json:"make"`
+	Model        string    `json:"model"`
+	VIN          string    `json:"vin"`
+	LicensePlate string    `json:"license_plate"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Point is one sample of a simulated device's location history.
+type Point struct {
+	DeviceID  string    `json:"device_id"`
+	Time      time.Time `json:"dt_tracker"`
+	Latitude  float64   `json:"lat"`
+	Longitude float64   `json:"lng"`
+	Altitude  float64   `json:"altitude"`
+	Heading   float64   `json:"angle"`
+	SpeedKph  float64   `json:"speed"`
+}
+
+// Config describes a synthetic fleet.
+type Config struct {
+	Devices  int
+	SpeedKph float64
+
+	// Devices stop for roughly StopDuration about every StopEvery of
+	// driving; InactiveRatio of those stops turn into the device going
+	// offline for InactiveDuration instead.
+	StopEvery        time.Duration
+	StopDuration     time.Duration
+	InactiveRatio    float64
+	InactiveDuration time.Duration
+
+	// Routes are scripted routes (e.g. from GPX files) that devices are
+	// assigned to in turn. Without routes every device drives between
+	// random waypoints within RadiusMeters of Center.
+	Routes       [][]Position
+	Center       Position
+	RadiusMeters float64
+
+	Seed int64
+}
+
+// DefaultConfig is ten vehicles driving around Fresno.
+func DefaultConfig() Config {
+	return Config{
+		Devices:          10,
+		SpeedKph:         50,
+		StopEvery:        10 * time.Minute,
+		StopDuration:     2 * time.Minute,
+		InactiveRatio:    0.1,
+		InactiveDuration: 15 * time.Minute,
+		Center:           Position{Latitude: 36.7378, Longitude: -119.7871},
+		RadiusMeters:     5000,
+		Seed:             time.Now().UnixNano(),
+	}
+}
+
+// ConfigFromEnv overrides the defaults with SIM_DEVICES,
+// SIM_SPEED_KPH, SIM_STOP_EVERY, SIM_STOP_DURATION, SIM_INACTIVE_RATIO,
+// SIM_INACTIVE_DURATION, SIM_CENTER ("lat,lng"), SIM_RADIUS (meters), SIM_SEED
+// and SIM_GPX (comma-separated GPX files).
+func ConfigFromEnv() (Config, error) {
+	cfg := DefaultConfig()
+
+	if v := os.Getenv("SIM_DEVICES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("Invalid SIM_DEVICES: %q", v)
+		}
+		cfg.Devices = n
+	}
+	floats := map[string]*float64{
+		"SIM_SPEED_KPH":      &cfg.SpeedKph,
+		"SIM_INACTIVE_RATIO": &cfg.InactiveRatio,
+		"SIM_RADIUS":         &cfg.RadiusMeters,
+	}
+	for name, target := range floats {
+		if v := os.Getenv(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 {
+				return cfg, fmt.Errorf("Invalid %s: %q", name, v)
+			}
+			*target = f
+		}
+	}
+	if cfg.InactiveRatio > 1 {
+		return cfg, fmt.Errorf("Invalid SIM_INACTIVE_RATIO: must be between 0 and 1")
+	}
+	durations := map[string]*time.Duration{
+		"SIM_STOP_EVERY":        &cfg.StopEvery,
+		"SIM_STOP_DURATION":     &cfg.StopDuration,
+		"SIM_INACTIVE_DURATION": &cfg.InactiveDuration,
+	}
+	for name, target := range durations {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return cfg, fmt.Errorf("Invalid %s: %v", name, err)
+			}
+			*target = d
+		}
+	}
+	if v := os.Getenv("SIM_CENTER"); v != "" {
+		parts := strings.Split(v, ",")
+		if len(parts) != 2 {
+			return cfg, fmt.Errorf("Invalid SIM_CENTER: must be lat,lng")
+		}
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		lng, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+			return cfg, fmt.Errorf("Invalid SIM_CENTER: %q", v)
+		}
+		cfg.Center = Position{Latitude: lat, Longitude: lng}
+	}
+	if v := os.Getenv("SIM_SEED"); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("Invalid SIM_SEED: %q", v)
+		}
+		cfg.Seed = seed
+	}
+	if v := os.Getenv("SIM_GPX"); v != "" {
+		for _, path := range strings.Split(v, ",") {
+			routes, err := loadGPXRoutes(strings.TrimSpace(path))
+			if err != nil {
+				return cfg, err
+			}
+			cfg.Routes = append(cfg.Routes, routes...)
+		}
+	}
+	return cfg, nil
+}
+
+// gpxDocument is the subset of GPX 1.1 the simulator reads: tracks and
+// routes, each becoming one route.
+type gpxDocument struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+	Routes []struct {
+		Points []gpxPoint `xml:"rtept"`
+	} `xml:"rte"`
+}
+
+type gpxPoint struct {
+	Lat float64 `xml:"lat,attr"`
+	Lon float64 `xml:"lon,attr"`
+}
+
+func loadGPXRoutes(path string) ([][]Position, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open GPX file: %v", err)
+	}
+	defer f.Close()
+
+	var doc gpxDocument
+	if err := xml.NewDecoder(f).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("Invalid GPX file %s: %v", path, err)
+	}
+
+	var routes [][]Position
+	addRoute := func(points []gpxPoint) {
+		route := make([]Position, 0, len(points))
+		for _, p := range points {
+			pos := Position{Latitude: p.Lat, Longitude: p.Lon}
+			if len(route) > 0 && route[len(route)-1] == pos {
+				continue
+			}
+			route = append(route, pos)
+		}
+		if len(route) >= 2 {
+			routes = append(routes, route)
+		}
+	}
+	for _, trk := range doc.Tracks {
+		var points []gpxPoint
+		for _, seg := range trk.Segments {
+			points = append(points, seg.Points...)
+		}
+		addRoute(points)
+	}
+	for _, rte := range doc.Routes {
+		addRoute(rte.Points)
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("GPX file %s has no track or route with at least two points", path)
+	}
+	return routes, nil
+}
+
+// Simulator moves a synthetic fleet along its routes. Time advances lazily:
+// every read catches the fleet up to the current time.
+type Simulator struct {
+	cfg Config
+	now func() time.Time
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	devices []*simDevice
+	updated time.Time
+}
+
+type simDevice struct {
+	detail Device
+
+	route    []Position
+	loop     bool
+	target   int // index of the waypoint being driven to
+	speedKph float64
+	heading  float64
+
+	// untilStop is the driving time left before the next stop; while
+	// stopped, resumeAt is when the device drives on.
+	untilStop time.Duration
+	resumeAt  time.Time
+	inactive  bool
+
+	history []Point
+}
+
+// New starts a fleet described by cfg at the current time.
+func New(cfg Config) *Simulator {
+	s := &Simulator{
+		cfg: cfg,
+		now: time.Now,
+		rng: rand.New(rand.NewSource(cfg.Seed)),
+	}
+	s.updated = s.now()
+
+	makes := []string{"Ford", "Chevrolet", "Ram", "Toyota", "Freightliner"}
+	for i := 0; i < cfg.Devices; i++ {
+		d := &simDevice{
+			detail: Device{
+				ID:           fmt.Sprintf("sim-%04d", i+1),
+				Name:         fmt.Sprintf("Sim Vehicle %d", i+1),
+				IsActive:     "active",
+				Make:         makes[i%len(makes)],
+				Model:        "Simulated",
+				VIN:          fmt.Sprintf("SIM%014d", i+1),
+				LicensePlate: fmt.Sprintf("SIM-%04d", i+1),
+				CreatedAt:    s.updated.UTC(),
+			},
+			// Vary speeds by ±20% so the fleet spreads out.
+			speedKph:  cfg.SpeedKph * (0.8 + 0.4*s.rng.Float64()),
+			untilStop: s.jitter(cfg.StopEvery),
+		}
+		if len(cfg.Routes) > 0 {
+			d.route = cfg.Routes[i%len(cfg.Routes)]
+			d.loop = haversineMeters(d.route[0], d.route[len(d.route)-1]) < 50
+		} else {
+			d.route = []Position{s.randomWaypoint(), s.randomWaypoint()}
+		}
+		d.detail.Position = d.route[0]
+		d.target = 1
+		d.heading = bearingDegrees(d.route[0], d.route[1])
+		d.record(s.updated)
+		s.devices = append(s.devices, d)
+	}
+	return s
+}
+
+// Devices returns every simulated device as of now.
+func (s *Simulator) Devices() []Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	devices := make([]Device, 0, len(s.devices))
+	for _, d := range s.devices {
+		devices = append(devices, d.detail)
+	}
+	return devices
+}
+
+// Device returns one simulated device, or false when there is none.
+func (s *Simulator) Device(id string) (Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	for _, d := range s.devices {
+		if d.detail.ID == id {
+			return d.detail, true
+		}
+	}
+	return Device{}, false
+}
+
+// Points returns the recorded history of a device between from and to.
+func (s *Simulator) Points(id string, from, to time.Time) []Point {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	points := []Point{}
+	for _, d := range s.devices {
+		if d.detail.ID != id {
+			continue
+		}
+		for _, p := range d.history {
+			if !p.Time.Before(from) && !p.Time.After(to) {
+				points = append(points, p)
+			}
+		}
+	}
+	return points
+}
+
+// advance moves every device forward to the current time in short steps, so
+// stops and waypoints are handled in order. It runs under s.mu, so the
+// number of steps is capped at maxCatchUpSteps however long the fleet sat
+// unread.
+func (s *Simulator) advance() {
+	now := s.now()
+	step := stepDuration
+	if gap := now.Sub(s.updated); gap > stepDuration*maxCatchUpSteps {
+		step = gap / maxCatchUpSteps
+	}
+	for s.updated.Before(now) {
+		dt := now.Sub(s.updated)
+		if dt > step {
+			dt = step
+		}
+		s.updated = s.updated.Add(dt)
+		for _, d := range s.devices {
+			s.step(d, s.updated, dt)
+		}
+	}
+}
+
+func (s *Simulator) step(d *simDevice, at time.Time, dt time.Duration) {
+	if !d.resumeAt.IsZero() {
+		if at.Before(d.resumeAt) {
+			return
+		}
+		d.resumeAt = time.Time{}
+		d.inactive = false
+		d.detail.IsActive = "active"
+		d.untilStop = s.jitter(s.cfg.StopEvery)
+	}
+
+	// Bound the legs per step so degenerate routes cannot spin forever.
+	remaining := d.speedKph / 3.6 * dt.Seconds()
+	for legs := 0; remaining > 0 && legs <= len(d.route); legs++ {
+		target := d.route[d.target]
+		dist := haversineMeters(d.detail.Position, target)
+		if dist > remaining {
+			d.detail.Position = interpolatePosition(d.detail.Position, target, remaining/dist)
+			break
+		}
+		remaining -= dist
+		d.detail.Position = target
+		s.nextWaypoint(d)
+		d.heading = bearingDegrees(d.detail.Position, d.route[d.target])
+	}
+
+	d.untilStop -= dt
+	if s.cfg.StopEvery > 0 && d.untilStop <= 0 {
+		if s.rng.Float64() < s.cfg.InactiveRatio {
+			d.inactive = true
+			d.detail.IsActive = "inactive"
+			d.resumeAt = at.Add(s.jitter(s.cfg.InactiveDuration))
+		} else {
+			d.resumeAt = at.Add(s.jitter(s.cfg.StopDuration))
+		}
+	}
+	d.record(at)
+}
+
+// nextWaypoint picks the waypoint after the one just reached: scripted
+// routes loop when closed and otherwise drive back the way they came;
+// random routes get a fresh random waypoint.
+func (s *Simulator) nextWaypoint(d *simDevice) {
+	if len(s.cfg.Routes) == 0 {
+		d.route = []Position{d.detail.Position, s.randomWaypoint()}
+		d.target = 1
+		return
+	}
+
+	d.target++
+	if d.target < len(d.route) {
+		return
+	}
+	if d.loop {
+		d.target = 1
+		return
+	}
+	reversed := make([]Position, len(d.route))
+	for i, p := range d.route {
+		reversed[len(d.route)-1-i] = p
+	}
+	d.route = reversed
+	d.target = 1
+}
+
+func (s *Simulator) randomWaypoint() Position {
+	distance := s.cfg.RadiusMeters * math.Sqrt(s.rng.Float64())
+	bearing := 360 * s.rng.Float64()
+	return destinationPosition(s.cfg.Center, bearing, distance)
+}
+
+// jitter returns d varied by ±50%.
+func (s *Simulator) jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (0.5 + s.rng.Float64()))
+}
+
+func (d *simDevice) record(at time.Time) {
+	speed := d.speedKph
+	if !d.resumeAt.IsZero() {
+		speed = 0
+	}
+	if d.inactive {
+		// Offline devices stop reporting.
+		return
+	}
+	if n := len(d.history); n > 0 && at.Sub(d.history[n-1].Time) < historyInterval {
+		return
+	}
+	d.history = append(d.history, Point{
+		DeviceID:  d.detail.ID,
+		Time:      at.UTC(),
+		Latitude:  d.detail.Position.Latitude,
+		Longitude: d.detail.Position.Longitude,
+		Heading:   d.heading,
+		SpeedKph:  speed,
+	})
+	if len(d.history) > historyLimit {
+		d.history = d.history[len(d.history)-historyLimit:]
+	}
+}
+
+// haversineMeters returns the great-circle distance between two positions.
+func haversineMeters(a, b Position) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := (b.Latitude - a.Latitude) * math.Pi / 180
+	dLng := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// interpolatePosition returns the point fraction of the way from a to b.
+// Simulated legs are short, so a linear interpolation is close enough.
+func interpolatePosition(a, b Position, fraction float64) Position {
+	return Position{
+		Latitude:  a.Latitude + (b.Latitude-a.Latitude)*fraction,
+		Longitude: a.Longitude + (b.Longitude-a.Longitude)*fraction,
+	}
+}
+
+// bearingDegrees returns the initial compass bearing from a to b.
+func bearingDegrees(a, b Position) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLng := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	y := math.Sin(dLng) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLng)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// destinationPosition returns the point distance meters from origin along
+// bearing degrees.
+func destinationPosition(origin Position, bearing, distance float64) Position {
+	lat1 := origin.Latitude * math.Pi / 180
+	lng1 := origin.Longitude * math.Pi / 180
+	theta := bearing * math.Pi / 180
+	delta := distance / earthRadiusMeters
+
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(delta) + math.Cos(lat1)*math.Sin(delta)*math.Cos(theta))
+	lng2 := lng1 + math.Atan2(math.Sin(theta)*math.Sin(delta)*math.Cos(lat1), math.Cos(delta)-math.Sin(lat1)*math.Sin(lat2))
+	return Position{
+		Latitude:  lat2 * 180 / math.Pi,
+		Longitude: math.Mod(lng2*180/math.Pi+540, 360) - 180,
+	}
+}
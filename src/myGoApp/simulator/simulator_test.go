@@ -0,0 +1,127 @@
+package simulator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestSimulator returns a simulator whose clock only moves when the test
+// moves it.
+func newTestSimulator(cfg Config) (*Simulator, *time.Time) {
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cfg.Seed = 1
+	sim := New(cfg)
+	sim.now = func() time.Time { return clock }
+	sim.updated = clock
+	for _, d := range sim.devices {
+		d.history = nil
+		d.record(clock)
+	}
+	return sim, &clock
+}
+
+func TestCatchUpIsBounded(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Devices = 50
+	sim, clock := newTestSimulator(cfg)
+	start := sim.Devices()
+
+	*clock = clock.Add(30 * 24 * time.Hour)
+	began := time.Now()
+	devices := sim.Devices()
+	if elapsed := time.Since(began); elapsed > 2*time.Second {
+		t.Errorf("catching up 30 days took %v", elapsed)
+	}
+	if !sim.updated.Equal(*clock) {
+		t.Errorf("caught up to %v, want %v", sim.updated, *clock)
+	}
+
+	moved := 0
+	for i := range devices {
+		if devices[i].Position != start[i].Position {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("no device moved while catching up")
+	}
+}
+
+func TestShortGapsUseFullResolution(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Devices = 1
+	cfg.StopEvery = 0
+	sim, clock := newTestSimulator(cfg)
+
+	*clock = clock.Add(10 * time.Minute)
+	points := sim.Points("sim-0001", time.Time{}, *clock)
+	// One sample at the start and one every historyInterval after it.
+	if want := int(10*time.Minute/historyInterval) + 1; len(points) != want {
+		t.Errorf("%d history points, want %d", len(points), want)
+	}
+}
+
+func TestScriptedRouteReversesAtTheEnd(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Devices = 1
+	cfg.StopEvery = 0
+	cfg.SpeedKph = 50
+	cfg.Routes = [][]Position{{{Latitude: 0, Longitude: 0}, {Latitude: 0, Longitude: 0.01}}}
+	sim, clock := newTestSimulator(cfg)
+
+	// The route is about 1.1km; two minutes at 50kph ±20% is 1.3-2km, past
+	// the end but not back to the start.
+	*clock = clock.Add(2 * time.Minute)
+	device, ok := sim.Device("sim-0001")
+	if !ok {
+		t.Fatal("sim-0001 not found")
+	}
+	d := sim.devices[0]
+	if d.route[0] != cfg.Routes[0][1] {
+		t.Errorf("route starts at %v, want the reversed route", d.route[0])
+	}
+	if device.Position.Longitude <= 0 || device.Position.Longitude >= 0.01 {
+		t.Errorf("position %v is off the route", device.Position)
+	}
+}
+
+func TestHandlerServesOneStepGPSShapes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Devices = 2
+	sim, _ := newTestSimulator(cfg)
+	server := httptest.NewServer(sim.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v3/api/public/device?latest_point=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Results []struct {
+			ID       string `json:"device_id"`
+			Position struct {
+				Lat float64 `json:"lat"`
+			} `json:"latest_device_point"`
+		} `json:"result_list"`
+		Total int `json:"total"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 2 || len(list.Results) != 2 || list.Results[0].ID != "sim-0001" || list.Results[0].Position.Lat == 0 {
+		t.Errorf("device list %+v", list)
+	}
+
+	resp, err = http.Get(server.URL + "/v3/api/public/device/sim-9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown device answered %d, want 404", resp.StatusCode)
+	}
+}
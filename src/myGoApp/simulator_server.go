@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+
+	"myGoApp/simulator"
+)
+
+// runSimulatorServer serves a simulated fleet through the OneStepGPS
+// endpoints the backend uses, so ONESTEPGPS_BASE_URL can point at it. It
+// listens on SIM_ADDR (default :9090).
+func runSimulatorServer() {
+	cfg, err := simulator.ConfigFromEnv()
+	if err != nil {
+		panic(err.Error())
+	}
+	sim := simulator.New(cfg)
+
+	addr := os.Getenv("SIM_ADDR")
+	if addr == "" {
+		addr = ":9090"
+	}
+
+	log.Printf("Simulating %d devices on %s", cfg.Devices, addr)
+	panic(http.ListenAndServe(addr, sim.Handler()))
+}
+
+// simulatedFleet serves the device list from an in-process simulator.
+type simulatedFleet struct {
+	sim *simulator.Simulator
+}
+
+func (f simulatedFleet) FetchData(ctx context.Context) (ApiResponse, error) {
+	devices := f.sim.Devices()
+	response := ApiResponse{Devices: make([]Device, 0, len(devices)), Total: len(devices)}
+	for _, d := range devices {
+		response.Devices = append(response.Devices, Device{
+			ID:       d.ID,
+			Name:     d.Name,
+			Position: Position(d.Position),
+			IsActive: d.IsActive,
+		})
+	}
+	return response, nil
+}
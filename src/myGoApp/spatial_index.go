@@ -0,0 +1,260 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// spatialIndex is a static k-d tree over positions. Positions are stored as
+// points on the unit sphere, where straight-line distance grows with
+// great-circle distance, so searches are exact everywhere, including near
+// the poles and across the antimeridian.
+type spatialIndex[T any] struct {
+	nodes []spatialNode[T]
+}
+
+type spatialNode[T any] struct {
+	point    [3]float64
+	position Position
+	item     T
+}
+
+// newSpatialIndex builds an index over items, located by position.
+func newSpatialIndex[T any](items []T, position func(T) Position) *spatialIndex[T] {
+	nodes := make([]spatialNode[T], len(items))
+	for i, item := range items {
+		pos := position(item)
+		nodes[i] = spatialNode[T]{point: unitVector(pos), position: pos, item: item}
+	}
+	buildSpatialTree(nodes, 0)
+	return &spatialIndex[T]{nodes: nodes}
+}
+
+// buildSpatialTree arranges nodes in place so that the median along axis is
+// the root of each subslice, with smaller values to its left.
+func buildSpatialTree[T any](nodes []spatialNode[T], axis int) {
+	if len(nodes) <= 1 {
+		return
+	}
+	mid := len(nodes) / 2
+	selectNth(nodes, mid, axis)
+	next := (axis + 1) % 3
+	buildSpatialTree(nodes[:mid], next)
+	buildSpatialTree(nodes[mid+1:], next)
+}
+
+// selectNth partially orders nodes along axis so that nodes[n] holds the
+// value it would have if sorted, with no larger values before it and no
+// smaller ones after it.
+func selectNth[T any](nodes []spatialNode[T], n, axis int) {
+	lo, hi := 0, len(nodes)-1
+	for lo < hi {
+		// Partition around the median of three to avoid quadratic
+		// behaviour on already ordered input.
+		mid := lo + (hi-lo)/2
+		if nodes[mid].point[axis] < nodes[lo].point[axis] {
+			nodes[mid], nodes[lo] = nodes[lo], nodes[mid]
+		}
+		if nodes[hi].point[axis] < nodes[lo].point[axis] {
+			nodes[hi], nodes[lo] = nodes[lo], nodes[hi]
+		}
+		if nodes[hi].point[axis] < nodes[mid].point[axis] {
+			nodes[hi], nodes[mid] = nodes[mid], nodes[hi]
+		}
+		pivot := nodes[mid].point[axis]
+
+		i, j := lo, hi
+		for i <= j {
+			for nodes[i].point[axis] < pivot {
+				i++
+			}
+			for nodes[j].point[axis] > pivot {
+				j--
+			}
+			if i <= j {
+				nodes[i], nodes[j] = nodes[j], nodes[i]
+				i++
+				j--
+			}
+		}
+		switch {
+		case n <= j:
+			hi = j
+		case n >= i:
+			lo = i
+		default:
+			return
+		}
+	}
+}
+
+func (idx *spatialIndex[T]) Len() int {
+	return len(idx.nodes)
+}
+
+// spatialMatch is a search result with its distance from the query point.
+type spatialMatch[T any] struct {
+	Item           T
+	DistanceMeters float64
+}
+
+// Nearest returns the item closest to pos and its distance in meters, or
+// false when the index is empty.
+func (idx *spatialIndex[T]) Nearest(pos Position) (T, float64, bool) {
+	matches := idx.KNearest(pos, 1, nil)
+	if len(matches) == 0 {
+		var zero T
+		return zero, 0, false
+	}
+	return matches[0].Item, matches[0].DistanceMeters, true
+}
+
+// KNearest returns up to k items closest to pos, nearest first. Items for
+// which keep returns false are skipped; a nil keep keeps everything.
+func (idx *spatialIndex[T]) KNearest(pos Position, k int, keep func(T) bool) []spatialMatch[T] {
+	if k <= 0 {
+		return nil
+	}
+
+	target := unitVector(pos)
+	// best holds node indexes ordered by chord distance, at most k long.
+	type candidate struct {
+		node int
+		dist float64
+	}
+	best := make([]candidate, 0, k)
+	worst := func() float64 {
+		if len(best) < k {
+			return math.Inf(1)
+		}
+		return best[len(best)-1].dist
+	}
+
+	var search func(lo, hi, axis int)
+	search = func(lo, hi, axis int) {
+		if lo >= hi {
+			return
+		}
+		mid := lo + (hi-lo)/2
+		node := &idx.nodes[mid]
+		if d := chordSquared(node.point, target); d < worst() && (keep == nil || keep(node.item)) {
+			i := sort.Search(len(best), func(i int) bool { return best[i].dist > d })
+			if len(best) < k {
+				best = append(best, candidate{})
+			}
+			copy(best[i+1:], best[i:])
+			best[i] = candidate{node: mid, dist: d}
+		}
+
+		delta := target[axis] - node.point[axis]
+		near, far := [2]int{lo, mid}, [2]int{mid + 1, hi}
+		if delta > 0 {
+			near, far = far, near
+		}
+		next := (axis + 1) % 3
+		search(near[0], near[1], next)
+		if delta*delta < worst() {
+			search(far[0], far[1], next)
+		}
+	}
+	search(0, len(idx.nodes), 0)
+
+	matches := make([]spatialMatch[T], len(best))
+	for i, c := range best {
+		node := idx.nodes[c.node]
+		matches[i] = spatialMatch[T]{Item: node.item, DistanceMeters: haversineMeters(pos, node.position)}
+	}
+	return matches
+}
+
+// Within returns the items inside box for which keep returns true (all of
+// them when keep is nil).
+func (idx *spatialIndex[T]) Within(box BoundingBox, keep func(T) bool) []T {
+	items := []T{}
+	for _, part := range box.splitAtAntimeridian() {
+		lower, upper := part.unitBounds()
+		var search func(lo, hi, axis int)
+		search = func(lo, hi, axis int) {
+			if lo >= hi {
+				return
+			}
+			mid := lo + (hi-lo)/2
+			node := &idx.nodes[mid]
+			if part.Contains(node.position) && (keep == nil || keep(node.item)) {
+				items = append(items, node.item)
+			}
+			next := (axis + 1) % 3
+			if lower[axis] <= node.point[axis] {
+				search(lo, mid, next)
+			}
+			if upper[axis] >= node.point[axis] {
+				search(mid+1, hi, next)
+			}
+		}
+		search(0, len(idx.nodes), 0)
+	}
+	return items
+}
+
+// splitAtAntimeridian returns box as one or two boxes that do not cross
+// the antimeridian.
+func (b BoundingBox) splitAtAntimeridian() []BoundingBox {
+	if b.MinLng <= b.MaxLng {
+		return []BoundingBox{b}
+	}
+	east, west := b, b
+	east.MaxLng = 180
+	west.MinLng = -180
+	return []BoundingBox{east, west}
+}
+
+// unitBounds returns the smallest axis-aligned box around the part of the
+// unit sphere covered by b, which must not cross the antimeridian. Each
+// coordinate is a product of a function of latitude and one of longitude,
+// so its extremes lie at the box edges or where those functions peak.
+func (b BoundingBox) unitBounds() (lower, upper [3]float64) {
+	lats := []float64{b.MinLat, b.MaxLat}
+	if b.MinLat < 0 && b.MaxLat > 0 {
+		lats = append(lats, 0)
+	}
+	lngs := []float64{b.MinLng, b.MaxLng}
+	for _, lng := range []float64{-90, 0, 90} {
+		if b.MinLng < lng && b.MaxLng > lng {
+			lngs = append(lngs, lng)
+		}
+	}
+
+	lower = [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+	upper = [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for _, lat := range lats {
+		for _, lng := range lngs {
+			p := unitVector(Position{Latitude: lat, Longitude: lng})
+			for axis := range p {
+				lower[axis] = math.Min(lower[axis], p[axis])
+				upper[axis] = math.Max(upper[axis], p[axis])
+			}
+		}
+	}
+	// Allow for rounding so points on the edge are not pruned.
+	for axis := range lower {
+		lower[axis] -= 1e-12
+		upper[axis] += 1e-12
+	}
+	return lower, upper
+}
+
+// unitVector maps a position to its point on the unit sphere.
+func unitVector(pos Position) [3]float64 {
+	lat := pos.Latitude * math.Pi / 180
+	lng := pos.Longitude * math.Pi / 180
+	return [3]float64{
+		math.Cos(lat) * math.Cos(lng),
+		math.Cos(lat) * math.Sin(lng),
+		math.Sin(lat),
+	}
+}
+
+func chordSquared(a, b [3]float64) float64 {
+	dx, dy, dz := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dx*dx + dy*dy + dz*dz
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// benchmarkFleetSizes are the fleets the spatial index benchmarks run
+// against, spread over the continental US.
+var benchmarkFleetSizes = []int{10000, 50000, 100000}
+
+func randomFleet(size int) []Device {
+	rng := rand.New(rand.NewSource(int64(size)))
+	devices := make([]Device, size)
+	for i := range devices {
+		devices[i] = Device{
+			ID:       fmt.Sprintf("bench-%d", i),
+			Name:     fmt.Sprintf("Bench Vehicle %d", i),
+			IsActive: "active",
+			Position: Position{
+				Latitude:  25 + 24*rng.Float64(),
+				Longitude: -125 + 58*rng.Float64(),
+			},
+		}
+	}
+	return devices
+}
+
+func devicePosition(d Device) Position { return d.Position }
+
+// hideEveryTenth returns a keep function hiding every tenth device, as a
+// caller's preference would.
+func hideEveryTenth(devices []Device) func(Device) bool {
+	hidden := UserPreference{}
+	for i := 0; i < len(devices); i += 10 {
+		hidden.HiddenDevices = append(hidden.HiddenDevices, devices[i].ID)
+	}
+	return visibleDevice(hidden)
+}
+
+// nearestByScan is the brute-force baseline the index is checked and
+// measured against.
+func nearestByScan(devices []Device, pos Position, k int, keep func(Device) bool) []Device {
+	best := make([]Device, 0, k+1)
+	dists := make([]float64, 0, k+1)
+	for _, d := range devices {
+		if !keep(d) {
+			continue
+		}
+		dist := haversineMeters(pos, d.Position)
+		if len(best) == k && dist >= dists[k-1] {
+			continue
+		}
+		i := len(best)
+		for i > 0 && dists[i-1] > dist {
+			i--
+		}
+		best = append(best[:i], append([]Device{d}, best[i:]...)...)
+		dists = append(dists[:i], append([]float64{dist}, dists[i:]...)...)
+		if len(best) > k {
+			best, dists = best[:k], dists[:k]
+		}
+	}
+	return best
+}
+
+func TestSpatialIndexMatchesLinearScan(t *testing.T) {
+	devices := randomFleet(2000)
+	index := newSpatialIndex(devices, devicePosition)
+	keep := hideEveryTenth(devices)
+
+	for i := 0; i < 50; i++ {
+		pos := devices[i*37%len(devices)].Position
+		pos.Latitude += 0.5
+		got := index.KNearest(pos, 10, keep)
+		want := nearestByScan(devices, pos, 10, keep)
+		if len(got) != len(want) {
+			t.Fatalf("query %d: %d matches, want %d", i, len(got), len(want))
+		}
+		for j := range want {
+			if got[j].Item.ID != want[j].ID {
+				t.Errorf("query %d match %d = %s, want %s", i, j, got[j].Item.ID, want[j].ID)
+			}
+		}
+	}
+
+	box := BoundingBox{MinLng: -100, MinLat: 30, MaxLng: -98, MaxLat: 32}
+	count := 0
+	for _, d := range devices {
+		if keep(d) && box.Contains(d.Position) {
+			count++
+		}
+	}
+	if got := index.Within(box, keep); len(got) != count {
+		t.Errorf("Within found %d devices, want %d", len(got), count)
+	}
+}
+
+func BenchmarkSpatialIndexBuild(b *testing.B) {
+	for _, size := range benchmarkFleetSizes {
+		devices := randomFleet(size)
+		b.Run(fmt.Sprintf("devices=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				newSpatialIndex(devices, devicePosition)
+			}
+		})
+	}
+}
+
+func BenchmarkSpatialIndexNearest(b *testing.B) {
+	for _, size := range benchmarkFleetSizes {
+		devices := randomFleet(size)
+		index := newSpatialIndex(devices, devicePosition)
+		keep := hideEveryTenth(devices)
+		b.Run(fmt.Sprintf("devices=%d/k=10", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				index.KNearest(devices[i%size].Position, 10, keep)
+			}
+		})
+		b.Run(fmt.Sprintf("devices=%d/k=10/linear-scan", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				nearestByScan(devices, devices[i%size].Position, 10, keep)
+			}
+		})
+	}
+}
+
+func BenchmarkSpatialIndexWithin(b *testing.B) {
+	for _, size := range benchmarkFleetSizes {
+		devices := randomFleet(size)
+		index := newSpatialIndex(devices, devicePosition)
+		keep := hideEveryTenth(devices)
+		b.Run(fmt.Sprintf("devices=%d/1x1-degree", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p := devices[i%size].Position
+				index.Within(BoundingBox{MinLng: p.Longitude, MinLat: p.Latitude, MaxLng: p.Longitude + 1, MaxLat: p.Latitude + 1}, keep)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Legs shorter than jitterMeters are GPS noise around a stationary
+	// device; legs faster than maxPlausibleKph are position glitches.
+	jitterMeters    = 20
+	maxPlausibleKph = 300
+
+	defaultStatsRollupInterval = 10 * time.Minute
+	maxStatsRangeDays          = 366
+	metersPerMile              = 1609.344
+	statsDayLayout             = "2006-01-02"
+)
+
+// filteredDistanceMeters measures the distance travelled along a track.
+// Distance only accrues once the device has moved jitterMeters away from the
+// last counted position, and positions that would need an implausible speed
+// to reach are dropped.
+func filteredDistanceMeters(track []StoredPosition) float64 {
+	if len(track) == 0 {
+		return 0
+	}
+
+	var total float64
+	anchor := track[0]
+	for _, p := range track[1:] {
+		d := haversineMeters(anchor.Position, p.Position)
+		if d < jitterMeters {
+			continue
+		}
+		if hours := p.RecordedAt.Sub(anchor.RecordedAt).Hours(); hours > 0 && d/1000/hours > maxPlausibleKph {
+			continue
+		}
+		total += d
+		anchor = p
+	}
+	return total
+}
+
+// statsRollup maintains device_daily_stats, the distance each device
+// travelled per UTC day, so mileage survives the purge of raw positions.
+type statsRollup struct {
+	db        *sql.DB
+	positions *positionLog
+	interval  time.Duration
+}
+
+// newStatsRollupFromEnv creates the rollup table; STATS_ROLLUP_INTERVAL sets
+// how often it is brought up to date (default 10m).
+func newStatsRollupFromEnv(db *sql.DB, positions *positionLog) (*statsRollup, error) {
+	interval := defaultStatsRollupInterval
+	if v := os.Getenv("STATS_ROLLUP_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid STATS_ROLLUP_INTERVAL: %q", v)
+		}
+		interval = d
+	}
+
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS device_daily_stats (
+            device_id TEXT NOT NULL,
+            day TEXT NOT NULL, -- UTC date, YYYY-MM-DD
+            distance_meters REAL NOT NULL,
+            positions INTEGER NOT NULL,
+            updated_at DATETIME NOT NULL,
+            PRIMARY KEY (device_id, day)
+        );
+        CREATE INDEX IF NOT EXISTS idx_device_daily_stats_day ON device_daily_stats(day);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	return &statsRollup{db: db, positions: positions, interval: interval}, nil
+}
+
+// update recomputes every day from the latest rolled-up day (which may have
+// been partial) through today. On an empty table it starts from the oldest
+// stored position.
+func (s *statsRollup) update() error {
+	var start sql.NullString
+	if err := s.db.QueryRow("SELECT MAX(day) FROM device_daily_stats").Scan(&start); err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+
+	var day time.Time
+	if start.Valid {
+		parsed, err := time.Parse(statsDayLayout, start.String)
+		if err != nil {
+			return fmt.Errorf("Invalid day %q in device_daily_stats", start.String)
+		}
+		day = parsed
+	} else {
+		// MIN loses the column's DATETIME type, so the driver returns the
+		// stored text, which starts with the UTC date.
+		var oldest sql.NullString
+		if err := s.db.QueryRow("SELECT MIN(recorded_at) FROM device_positions").Scan(&oldest); err != nil {
+			return fmt.Errorf("Database error: %v", err)
+		}
+		if !oldest.Valid {
+			return nil
+		}
+		parsed, err := time.Parse(statsDayLayout, oldest.String[:min(len(oldest.String), len(statsDayLayout))])
+		if err != nil {
+			return fmt.Errorf("Invalid recorded_at %q in device_positions", oldest.String)
+		}
+		day = parsed
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for ; !day.After(today); day = day.AddDate(0, 0, 1) {
+		if err := s.rollUpDay(day); err != nil {
+			return fmt.Errorf("Failed to roll up %s: %v", day.Format(statsDayLayout), err)
+		}
+	}
+	return nil
+}
+
+// rollUpDay replaces the stats of one UTC day. The leg from a device's last
+// position of the previous hour into the day counts towards the day.
+func (s *statsRollup) rollUpDay(day time.Time) error {
+	tracks, err := s.positions.BetweenUnmasked(day.Add(-time.Hour), day.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	key := day.Format(statsDayLayout)
+	if _, err := tx.Exec("DELETE FROM device_daily_stats WHERE day = ?", key); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for deviceID, track := range tracks {
+		// Keep only the last position before the day as the starting point.
+		first := 0
+		for first+1 < len(track) && track[first+1].RecordedAt.Before(day) {
+			first++
+		}
+		track = track[first:]
+		inDay := len(track)
+		if track[0].RecordedAt.Before(day) {
+			inDay--
+		}
+		if inDay == 0 {
+			continue
+		}
+
+		_, err := tx.Exec(`
+            INSERT INTO device_daily_stats(device_id, day, distance_meters, positions, updated_at)
+            VALUES (?, ?, ?, ?, ?)`, deviceID, key, filteredDistanceMeters(track), inDay, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// loop brings the rollups up to date now and then every interval until ctx
+// is done.
+func (s *statsRollup) loop(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.update(); err != nil {
+			log.Printf("Failed to update distance statistics: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DistanceStat is the distance travelled by one device, on one day or in one
+// week, depending on how the query is grouped.
+type DistanceStat struct {
+	DeviceID      string  `json:"device_id,omitempty"`
+	Day           string  `json:"day,omitempty"`
+	Week          string  `json:"week,omitempty"`
+	DistanceKm    float64 `json:"distance_km"`
+	DistanceMiles float64 `json:"distance_miles"`
+}
+
+// DistanceStats answers GET /stats/distance.
+type DistanceStats struct {
+	From       string         `json:"from"`
+	To         string         `json:"to"`
+	GroupBy    string         `json:"group_by"`
+	Results    []DistanceStat `json:"results"`
+	TotalKm    float64        `json:"total_km"`
+	TotalMiles float64        `json:"total_miles"`
+}
+
+// Distance sums device_daily_stats over the days from..to (inclusive) for
+// the devices keep accepts, grouped by "device", "day" or "week" (ISO weeks,
+// labelled by their Monday).
+func (s *statsRollup) Distance(from, to time.Time, groupBy string, keep func(deviceID string) bool) (DistanceStats, error) {
+	stats := DistanceStats{
+		From:    from.Format(statsDayLayout),
+		To:      to.Format(statsDayLayout),
+		GroupBy: groupBy,
+		Results: []DistanceStat{},
+	}
+
+	rows, err := s.db.Query(`
+        SELECT device_id, day, distance_meters
+        FROM device_daily_stats
+        WHERE day >= ? AND day <= ?`, stats.From, stats.To)
+	if err != nil {
+		return stats, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	totals := map[string]float64{}
+	var total float64
+	for rows.Next() {
+		var deviceID, day string
+		var meters float64
+		if err := rows.Scan(&deviceID, &day, &meters); err != nil {
+			return stats, fmt.Errorf("Database error: %v", err)
+		}
+		if !keep(deviceID) {
+			continue
+		}
+
+		group := deviceID
+		switch groupBy {
+		case "day":
+			group = day
+		case "week":
+			t, err := time.Parse(statsDayLayout, day)
+			if err != nil {
+				return stats, fmt.Errorf("Invalid day %q in device_daily_stats", day)
+			}
+			// Weeks start on Monday.
+			group = t.AddDate(0, 0, -(int(t.Weekday())+6)%7).Format(statsDayLayout)
+		}
+		totals[group] += meters
+		total += meters
+	}
+	if err := rows.Err(); err != nil {
+		return stats, fmt.Errorf("Database error: %v", err)
+	}
+
+	for group, meters := range totals {
+		stat := DistanceStat{DistanceKm: meters / 1000, DistanceMiles: meters / metersPerMile}
+		switch groupBy {
+		case "day":
+			stat.Day = group
+		case "week":
+			stat.Week = group
+		default:
+			stat.DeviceID = group
+		}
+		stats.Results = append(stats.Results, stat)
+	}
+	sort.Slice(stats.Results, func(i, j int) bool {
+		a, b := stats.Results[i], stats.Results[j]
+		return a.DeviceID+a.Day+a.Week < b.DeviceID+b.Day+b.Week
+	})
+	stats.TotalKm = total / 1000
+	stats.TotalMiles = total / metersPerMile
+	return stats, nil
+}
+
+// HandleStats routes /stats/distance.
+func (deps *HandlerDependencies) HandleStats(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/stats/"), "/") {
+	case "distance":
+		deps.HandleDistanceStats(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// HandleDistanceStats returns the distance travelled by the devices the user
+// can see between ?from= and ?to= (dates, inclusive; default the last 7
+// days), grouped by ?group_by=device|day|week (default device).
+func (deps *HandlerDependencies) HandleDistanceStats(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	groupBy := values.Get("group_by")
+	if groupBy == "" {
+		groupBy = "device"
+	}
+	if groupBy != "device" && groupBy != "day" && groupBy != "week" {
+		http.Error(w, "group_by must be device, day or week", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if v := values.Get("to"); v != "" {
+		t, err := parseStatsDay(v)
+		if err != nil {
+			http.Error(w, "Invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -6)
+	if v := values.Get("from"); v != "" {
+		t, err := parseStatsDay(v)
+		if err != nil {
+			http.Error(w, "Invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if from.After(to) {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) >= maxStatsRangeDays*24*time.Hour {
+		http.Error(w, fmt.Sprintf("Time range must not exceed %d days", maxStatsRangeDays), http.StatusBadRequest)
+		return
+	}
+
+	pref, ok := deps.preferenceForDeviceRequest(w, r)
+	if !ok {
+		return
+	}
+
+	stats, err := deps.Stats.Distance(from, to, groupBy, func(deviceID string) bool {
+		return !contains(pref.HiddenDevices, deviceID) && deps.DeviceOrganizations.visible(r.Context(), deviceID)
+	})
+	if err != nil {
+		http.Error(w, "Failed to fetch distance statistics: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+// parseStatsDay accepts a date (YYYY-MM-DD) or an RFC 3339 timestamp, and
+// returns the UTC day it falls on.
+func parseStatsDay(value string) (time.Time, error) {
+	if t, err := time.Parse(statsDayLayout, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be YYYY-MM-DD or RFC 3339")
+	}
+	return t.UTC().Truncate(24 * time.Hour), nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilteredDistanceMeters(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int, lat float64) StoredPosition {
+		return StoredPosition{RecordedAt: start.Add(time.Duration(minutes) * time.Minute), Position: Position{Latitude: lat}}
+	}
+	leg := func(from, to float64) float64 {
+		return haversineMeters(Position{Latitude: from}, Position{Latitude: to})
+	}
+
+	tests := []struct {
+		name  string
+		track []StoredPosition
+		want  float64
+	}{
+		{"no positions", nil, 0},
+		{"one position", []StoredPosition{at(0, 0)}, 0},
+		// 0.0001° of latitude is about 11m.
+		{"jitter around a parked device", []StoredPosition{at(0, 0), at(1, 0.0001), at(2, -0.0001), at(3, 0.00015)}, 0},
+		{"drift adds up from the last counted position", []StoredPosition{at(0, 0), at(1, 0.0001), at(2, 0.0002)}, leg(0, 0.0002)},
+		{"a glitch needing an implausible speed is dropped", []StoredPosition{at(0, 0), at(1, 1), at(10, 0.01)}, leg(0, 0.01)},
+		{"travel at a plausible speed", []StoredPosition{at(0, 0), at(60, 1), at(120, 2)}, leg(0, 1) + leg(1, 2)},
+	}
+	for _, tt := range tests {
+		if got := filteredDistanceMeters(tt.track); math.Abs(got-tt.want) > 0.01 {
+			t.Errorf("%s: %.2fm, want %.2fm", tt.name, got, tt.want)
+		}
+	}
+}
+
+func newTestStatsRollup(t *testing.T) *statsRollup {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "stats.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	positions, err := newPositionLogFromEnv(db, staticDevices{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := newStatsRollupFromEnv(db, positions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestRollUpDayCountsTheLegAcrossMidnight(t *testing.T) {
+	s := newTestStatsRollup(t)
+	day := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	for _, p := range []StoredPosition{
+		{DeviceID: "truck", RecordedAt: day.Add(-30 * time.Minute), Position: Position{Latitude: 0}},
+		{DeviceID: "truck", RecordedAt: day.Add(30 * time.Minute), Position: Position{Latitude: 0.01}},
+		{DeviceID: "truck", RecordedAt: day.Add(2 * time.Hour), Position: Position{Latitude: 0.02}},
+		// Only moved the evening before.
+		{DeviceID: "parked", RecordedAt: day.Add(-20 * time.Minute), Position: Position{Latitude: 1}},
+		{DeviceID: "parked", RecordedAt: day.Add(-10 * time.Minute), Position: Position{Latitude: 1.01}},
+	} {
+		if _, err := s.db.Exec("INSERT INTO device_positions(device_id, recorded_at, lat, lng) VALUES (?, ?, ?, 0)",
+			p.DeviceID, p.RecordedAt, p.Position.Latitude); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, d := range []time.Time{day.AddDate(0, 0, -1), day} {
+		if err := s.rollUpDay(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := s.db.Query("SELECT device_id, day, distance_meters, positions FROM device_daily_stats ORDER BY day, device_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	type stat struct {
+		deviceID, day string
+		meters        float64
+		positions     int
+	}
+	var got []stat
+	for rows.Next() {
+		var s stat
+		if err := rows.Scan(&s.deviceID, &s.day, &s.meters, &s.positions); err != nil {
+			t.Fatal(err)
+		}
+		s.meters = math.Round(s.meters)
+		got = append(got, s)
+	}
+	leg := math.Round(haversineMeters(Position{}, Position{Latitude: 0.01}))
+	want := []stat{
+		{"parked", "2024-03-01", leg, 2},
+		{"truck", "2024-03-01", 0, 1},
+		// The leg from 23:30 into the day counts towards it, without the
+		// position before midnight being counted again.
+		{"truck", "2024-03-02", 2 * leg, 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("daily stats %+v, want %+v", got, want)
+	}
+}
+
+func TestDistanceGroupsByWeek(t *testing.T) {
+	s := newTestStatsRollup(t)
+	for _, row := range []struct {
+		deviceID, day string
+		meters        float64
+	}{
+		{"a", "2024-03-03", 1000}, // Sunday
+		{"a", "2024-03-04", 2000}, // Monday
+		{"b", "2024-03-10", 500},  // Sunday
+		{"b", "2024-03-11", 4000}, // Monday
+		{"hidden", "2024-03-04", 8000},
+		{"a", "2024-03-12", 16000}, // after the range
+	} {
+		if _, err := s.db.Exec("INSERT INTO device_daily_stats(device_id, day, distance_meters, positions, updated_at) VALUES (?, ?, ?, 1, ?)",
+			row.deviceID, row.day, row.meters, time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)
+	keep := func(deviceID string) bool { return deviceID != "hidden" }
+	stats, err := s.Distance(from, to, "week", keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DistanceStat{
+		{Week: "2024-02-26", DistanceKm: 1, DistanceMiles: 1000 / metersPerMile},
+		{Week: "2024-03-04", DistanceKm: 2.5, DistanceMiles: 2500 / metersPerMile},
+		{Week: "2024-03-11", DistanceKm: 4, DistanceMiles: 4000 / metersPerMile},
+	}
+	if !reflect.DeepEqual(stats.Results, want) {
+		t.Errorf("weekly distance %+v, want %+v", stats.Results, want)
+	}
+	if stats.TotalKm != 7.5 {
+		t.Errorf("total %vkm, want 7.5km", stats.TotalKm)
+	}
+
+	stats, err = s.Distance(from, to, "device", keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Results) != 2 || stats.Results[0].DeviceID != "a" || stats.Results[0].DistanceKm != 3 || stats.Results[1].DistanceKm != 4.5 {
+		t.Errorf("distance by device %+v, want a 3km and b 4.5km", stats.Results)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+var (
+	errPreferenceNotFound = errors.New("user preference not found")
+	errVersionConflict    = errors.New("user preference has been modified")
+	errRevisionNotFound   = errors.New("preference revision not found")
+	errUsernameTaken      = errors.New("username is already taken")
+)
+
+// PreferenceStore persists user preferences together with their revision
+// history. Implementations must return errors wrapping the sentinels above so
+// handlers can map them to HTTP status codes regardless of the backend.
+type PreferenceStore interface {
+	GetPreference(id int) (UserPreference, error)
+	GetPreferenceByUsername(username string) (UserPreference, error)
+
+	// CreatePreference inserts pref as version 1 and records its first
+	// revision.
+	CreatePreference(pref UserPreference, actor string) (UserPreference, error)
+
+	// UpdatePreference stores pref and returns it with its new version and
+	// timestamps. When pref.Version is non-zero the update only succeeds if
+	// the stored version still matches it. Every successful update is
+	// recorded as a revision attributed to actor.
+	UpdatePreference(pref UserPreference, actor string) (UserPreference, error)
+
+	// UpdateHiddenDevices applies change to the hidden devices of a
+	// preference atomically, with the same versioning and revision
+	// semantics as UpdatePreference.
+	UpdateHiddenDevices(id int, change HiddenDevicesChange, expectedVersion int, actor string) (UserPreference, error)
+
+	// ListRevisions returns the revisions of a preference, newest first.
+	ListRevisions(preferenceID int) ([]PreferenceRevision, error)
+	GetRevision(preferenceID, revision int) (PreferenceRevision, error)
+
+	Close() error
+}
+
+// openPreferenceStore selects the storage backend from the environment.
+// PREFERENCE_STORE may be "sqlite" (the default), "postgres" or "memory";
+// the SQLite backend shares the application database db.
+func openPreferenceStore(db *sql.DB) (PreferenceStore, error) {
+	switch backend := os.Getenv("PREFERENCE_STORE"); backend {
+	case "", "sqlite":
+		return newSQLiteStore(db)
+	case "postgres":
+		dsn := os.Getenv("DATABASE_URL")
+		if dsn == "" {
+			return nil, fmt.Errorf("DATABASE_URL must be set when PREFERENCE_STORE=postgres")
+		}
+		return openPostgresStore(dsn)
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown PREFERENCE_STORE %q", backend)
+	}
+}
+
+// applyHiddenDevicesChange returns the hidden device set that results from
+// applying change to current. ShowAll is applied first, so a change can
+// reset the set and hide a fresh selection in one step.
+func applyHiddenDevicesChange(current []string, change HiddenDevicesChange) []string {
+	hidden := map[string]bool{}
+	if !change.ShowAll {
+		for _, id := range current {
+			hidden[id] = true
+		}
+	}
+	for _, id := range change.Remove {
+		delete(hidden, id)
+	}
+	for _, id := range change.Add {
+		hidden[id] = true
+	}
+
+	result := make([]string, 0, len(hidden))
+	for id := range hidden {
+		result = append(result, id)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// normalizeHiddenDevices sorts and de-duplicates device IDs the way the
+// stores return them.
+func normalizeHiddenDevices(ids []string) []string {
+	return applyHiddenDevicesChange(ids, HiddenDevicesChange{})
+}
+
+// encodeRevision serializes the snapshot and diff columns of the revision
+// that takes a preference from before to after.
+func encodeRevision(before, after UserPreference) (snapshot, diff string, err error) {
+	snapshotJSON, err := json.Marshal(after)
+	if err != nil {
+		return "", "", err
+	}
+	diffJSON, err := json.Marshal(diffPreferences(before, after))
+	if err != nil {
+		return "", "", err
+	}
+	return string(snapshotJSON), string(diffJSON), nil
+}
+
+func scanPreferenceRevision(row interface{ Scan(...any) error }) (PreferenceRevision, error) {
+	var rev PreferenceRevision
+	var snapshot, diff string
+
+	if err := row.Scan(&rev.PreferenceID, &rev.Revision, &rev.Actor, &snapshot, &diff, &rev.CreatedAt); err != nil {
+		return rev, err
+	}
+	if err := json.Unmarshal([]byte(snapshot), &rev.Snapshot); err != nil {
+		return rev, fmt.Errorf("Failed to unmarshal revision snapshot: %v", err)
+	}
+	if err := json.Unmarshal([]byte(diff), &rev.Diff); err != nil {
+		return rev, fmt.Errorf("Failed to unmarshal revision diff: %v", err)
+	}
+	return rev, nil
+}
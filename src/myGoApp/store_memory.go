@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is a PreferenceStore kept entirely in process memory. It is
+// meant for tests and local development; nothing survives a restart.
+type memoryStore struct {
+	mu        sync.Mutex
+	nextID    int
+	prefs     map[int]UserPreference
+	revisions map[int][]PreferenceRevision
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		nextID:    1,
+		prefs:     make(map[int]UserPreference),
+		revisions: make(map[int][]PreferenceRevision),
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) GetPreference(id int) (UserPreference, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pref, ok := s.prefs[id]
+	if !ok {
+		return UserPreference{}, fmt.Errorf("No user preference found for ID %d: %w", id, errPreferenceNotFound)
+	}
+	return copyPreference(pref), nil
+}
+
+func (s *memoryStore) GetPreferenceByUsername(username string) (UserPreference, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pref := range s.prefs {
+		if pref.Username == username {
+			return copyPreference(pref), nil
+		}
+	}
+	return UserPreference{}, fmt.Errorf("No user preference found for username %s: %w", username, errPreferenceNotFound)
+}
+
+func (s *memoryStore) CreatePreference(pref UserPreference, actor string) (UserPreference, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.prefs {
+		if existing.Username == pref.Username {
+			return pref, fmt.Errorf("username %s: %w", pref.Username, errUsernameTaken)
+		}
+	}
+
+	now := time.Now().UTC()
+	pref = copyPreference(pref)
+	pref.ID = s.nextID
+	pref.HiddenDevices = normalizeHiddenDevices(pref.HiddenDevices)
+	pref.Version = 1
+	pref.CreatedAt = now
+	pref.UpdatedAt = now
+	s.nextID++
+
+	s.prefs[pref.ID] = pref
+	s.appendRevision(UserPreference{}, pref, actor)
+	return copyPreference(pref), nil
+}
+
+func (s *memoryStore) UpdatePreference(pref UserPreference, actor string) (UserPreference, error) {
+	return s.update(pref.ID, pref.Version, actor, func(previous UserPreference) UserPreference {
+		return copyPreference(pref)
+	})
+}
+
+func (s *memoryStore) UpdateHiddenDevices(id int, change HiddenDevicesChange, expectedVersion int, actor string) (UserPreference, error) {
+	return s.update(id, expectedVersion, actor, func(previous UserPreference) UserPreference {
+		previous.HiddenDevices = applyHiddenDevicesChange(previous.HiddenDevices, change)
+		return previous
+	})
+}
+
+func (s *memoryStore) update(id, expectedVersion int, actor string, mutate func(previous UserPreference) UserPreference) (UserPreference, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, ok := s.prefs[id]
+	if !ok {
+		return UserPreference{}, fmt.Errorf("No user preference found for ID %d: %w", id, errPreferenceNotFound)
+	}
+	if expectedVersion != 0 && expectedVersion != previous.Version {
+		return previous, errVersionConflict
+	}
+
+	pref := mutate(copyPreference(previous))
+	pref.ID = previous.ID
+	pref.HiddenDevices = normalizeHiddenDevices(pref.HiddenDevices)
+	pref.Username = previous.Username
+	pref.Version = previous.Version + 1
+	pref.CreatedAt = previous.CreatedAt
+	pref.UpdatedAt = time.Now().UTC()
+
+	s.prefs[pref.ID] = pref
+	s.appendRevision(previous, pref, actor)
+	return copyPreference(pref), nil
+}
+
+func (s *memoryStore) ListRevisions(preferenceID int) ([]PreferenceRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revisions := make([]PreferenceRevision, 0, len(s.revisions[preferenceID]))
+	for _, rev := range s.revisions[preferenceID] {
+		rev.Snapshot = copyPreference(rev.Snapshot)
+		revisions = append(revisions, rev)
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision > revisions[j].Revision
+	})
+	return revisions, nil
+}
+
+func (s *memoryStore) GetRevision(preferenceID, revision int) (PreferenceRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rev := range s.revisions[preferenceID] {
+		if rev.Revision == revision {
+			rev.Snapshot = copyPreference(rev.Snapshot)
+			return rev, nil
+		}
+	}
+	return PreferenceRevision{}, fmt.Errorf("No revision %d found for preference %d: %w", revision, preferenceID, errRevisionNotFound)
+}
+
+// appendRevision must be called with s.mu held.
+func (s *memoryStore) appendRevision(before, after UserPreference, actor string) {
+	s.revisions[after.ID] = append(s.revisions[after.ID], PreferenceRevision{
+		PreferenceID: after.ID,
+		Revision:     after.Version,
+		Actor:        actor,
+		Snapshot:     copyPreference(after),
+		Diff:         diffPreferences(before, after),
+		CreatedAt:    after.UpdatedAt,
+	})
+}
+
+// copyPreference returns pref with its slices cloned so callers cannot alias
+// the store's internal state.
+func copyPreference(pref UserPreference) UserPreference {
+	if pref.HiddenDevices != nil {
+		pref.HiddenDevices = append([]string{}, pref.HiddenDevices...)
+	}
+	if pref.Icon != nil {
+		pref.Icon = append([]byte(nil), pref.Icon...)
+	}
+	return pref
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresStore is the PreferenceStore backed by a PostgreSQL server, for
+// deployments that run more than one backend instance.
+type postgresStore struct {
+	db *sql.DB
+}
+
+func openPostgresStore(dsn string) (*postgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to connect to database: %v", err)
+	}
+
+	s := &postgresStore{db: db}
+	if err := s.createTables(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *postgresStore) createTables() error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS user_preferences (
+            id SERIAL PRIMARY KEY,
+            username TEXT UNIQUE NOT NULL,
+            sort_order TEXT NOT NULL DEFAULT '',
+            hidden_devices TEXT, -- legacy JSON array, migrated to hidden_devices
+            icon BYTEA,
+            version INTEGER NOT NULL DEFAULT 1,
+            created_at TIMESTAMPTZ NOT NULL,
+            updated_at TIMESTAMPTZ NOT NULL
+        )`,
+		`CREATE TABLE IF NOT EXISTS preference_revisions (
+            id SERIAL PRIMARY KEY,
+            preference_id INTEGER NOT NULL REFERENCES user_preferences(id),
+            revision INTEGER NOT NULL,
+            actor TEXT NOT NULL,
+            snapshot TEXT NOT NULL,
+            diff TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL,
+            UNIQUE (preference_id, revision)
+        )`,
+		`CREATE TABLE IF NOT EXISTS hidden_devices (
+            preference_id INTEGER NOT NULL REFERENCES user_preferences(id),
+            device_id TEXT NOT NULL,
+            PRIMARY KEY (preference_id, device_id)
+        )`,
+		// Hidden devices used to be stored as a JSON array on the
+		// preference row; move any such rows into hidden_devices.
+		`INSERT INTO hidden_devices(preference_id, device_id)
+        SELECT id, json_array_elements_text(hidden_devices::json)
+        FROM user_preferences
+        WHERE hidden_devices IS NOT NULL AND hidden_devices <> ''
+        ON CONFLICT DO NOTHING`,
+		`UPDATE user_preferences SET hidden_devices = NULL WHERE hidden_devices IS NOT NULL`,
+	}
+	for _, stmt := range statements {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("Failed to create tables: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *postgresStore) GetPreference(id int) (UserPreference, error) {
+	return s.getPreference(s.db, id, "")
+}
+
+func (s *postgresStore) GetPreferenceByUsername(username string) (UserPreference, error) {
+	pref, err := s.scanPreference(s.db, s.db.QueryRow(`
+        SELECT id, username, sort_order, icon, version, created_at, updated_at
+        FROM user_preferences
+        WHERE username = $1`, username))
+	if err == sql.ErrNoRows {
+		return pref, fmt.Errorf("No user preference found for username %s: %w", username, errPreferenceNotFound)
+	}
+	return pref, err
+}
+
+// getPreference loads a preference by ID; lock may be "FOR UPDATE" when
+// called inside an update transaction.
+func (s *postgresStore) getPreference(q queryer, id int, lock string) (UserPreference, error) {
+	pref, err := s.scanPreference(q, q.QueryRow(`
+        SELECT id, username, sort_order, icon, version, created_at, updated_at
+        FROM user_preferences
+        WHERE id = $1 `+lock, id))
+	if err == sql.ErrNoRows {
+		return pref, fmt.Errorf("No user preference found for ID %d: %w", id, errPreferenceNotFound)
+	}
+	return pref, err
+}
+
+func (s *postgresStore) scanPreference(q queryer, row *sql.Row) (UserPreference, error) {
+	var pref UserPreference
+
+	err := row.Scan(&pref.ID, &pref.Username, &pref.SortOrder, &pref.Icon, &pref.Version, &pref.CreatedAt, &pref.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return pref, err
+		}
+		return pref, fmt.Errorf("Database error: %v", err)
+	}
+	pref.CreatedAt = pref.CreatedAt.UTC()
+	pref.UpdatedAt = pref.UpdatedAt.UTC()
+
+	rows, err := q.Query("SELECT device_id FROM hidden_devices WHERE preference_id = $1 ORDER BY device_id", pref.ID)
+	if err != nil {
+		return pref, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	pref.HiddenDevices = []string{}
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			return pref, fmt.Errorf("Database error: %v", err)
+		}
+		pref.HiddenDevices = append(pref.HiddenDevices, deviceID)
+	}
+	if err := rows.Err(); err != nil {
+		return pref, fmt.Errorf("Database error: %v", err)
+	}
+	return pref, nil
+}
+
+func (s *postgresStore) replaceHiddenDevices(tx *sql.Tx, preferenceID int, hiddenDevices []string) error {
+	if _, err := tx.Exec("DELETE FROM hidden_devices WHERE preference_id = $1", preferenceID); err != nil {
+		return err
+	}
+	if len(hiddenDevices) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+        INSERT INTO hidden_devices(preference_id, device_id)
+        SELECT $1, unnest($2::text[])
+        ON CONFLICT DO NOTHING`, preferenceID, pq.Array(hiddenDevices))
+	return err
+}
+
+func (s *postgresStore) CreatePreference(pref UserPreference, actor string) (UserPreference, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return pref, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	err = tx.QueryRow(`
+        INSERT INTO user_preferences(username, sort_order, icon, version, created_at, updated_at)
+        VALUES ($1, $2, $3, 1, $4, $4)
+        RETURNING id`, pref.Username, pref.SortOrder, pref.Icon, now).Scan(&pref.ID)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return pref, fmt.Errorf("username %s: %w", pref.Username, errUsernameTaken)
+		}
+		return pref, err
+	}
+
+	pref.HiddenDevices = normalizeHiddenDevices(pref.HiddenDevices)
+	pref.Version = 1
+	pref.CreatedAt = now
+	pref.UpdatedAt = now
+
+	if err := s.replaceHiddenDevices(tx, pref.ID, pref.HiddenDevices); err != nil {
+		return pref, err
+	}
+	if err := s.insertRevision(tx, UserPreference{}, pref, actor); err != nil {
+		return pref, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return pref, err
+	}
+	return pref, nil
+}
+
+func (s *postgresStore) UpdatePreference(pref UserPreference, actor string) (UserPreference, error) {
+	return s.update(pref.ID, pref.Version, actor, func(previous UserPreference) UserPreference {
+		return pref
+	})
+}
+
+func (s *postgresStore) UpdateHiddenDevices(id int, change HiddenDevicesChange, expectedVersion int, actor string) (UserPreference, error) {
+	return s.update(id, expectedVersion, actor, func(previous UserPreference) UserPreference {
+		previous.HiddenDevices = applyHiddenDevicesChange(previous.HiddenDevices, change)
+		return previous
+	})
+}
+
+// update applies mutate to the row-locked preference inside one transaction,
+// checking expectedVersion (when non-zero) and recording the revision.
+func (s *postgresStore) update(id, expectedVersion int, actor string, mutate func(previous UserPreference) UserPreference) (UserPreference, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return UserPreference{}, err
+	}
+	defer tx.Rollback()
+
+	previous, err := s.getPreference(tx, id, "FOR UPDATE")
+	if err != nil {
+		return previous, err
+	}
+	if expectedVersion != 0 && expectedVersion != previous.Version {
+		return previous, errVersionConflict
+	}
+
+	pref := mutate(copyPreference(previous))
+	pref.ID = previous.ID
+	pref.HiddenDevices = normalizeHiddenDevices(pref.HiddenDevices)
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	_, err = tx.Exec(`
+        UPDATE user_preferences
+        SET sort_order = $1, icon = $2, version = version + 1, updated_at = $3
+        WHERE id = $4`, pref.SortOrder, pref.Icon, now, pref.ID)
+	if err != nil {
+		return pref, err
+	}
+	if err := s.replaceHiddenDevices(tx, pref.ID, pref.HiddenDevices); err != nil {
+		return pref, err
+	}
+
+	pref.Username = previous.Username
+	pref.Version = previous.Version + 1
+	pref.CreatedAt = previous.CreatedAt
+	pref.UpdatedAt = now
+
+	if err := s.insertRevision(tx, previous, pref, actor); err != nil {
+		return pref, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return pref, err
+	}
+	return pref, nil
+}
+
+func (s *postgresStore) insertRevision(tx *sql.Tx, before, after UserPreference, actor string) error {
+	snapshot, diff, err := encodeRevision(before, after)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO preference_revisions(preference_id, revision, actor, snapshot, diff, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)`, after.ID, after.Version, actor, snapshot, diff, after.UpdatedAt)
+	return err
+}
+
+func (s *postgresStore) ListRevisions(preferenceID int) ([]PreferenceRevision, error) {
+	rows, err := s.db.Query(`
+        SELECT preference_id, revision, actor, snapshot, diff, created_at
+        FROM preference_revisions
+        WHERE preference_id = $1
+        ORDER BY revision DESC`, preferenceID)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	revisions := []PreferenceRevision{}
+	for rows.Next() {
+		rev, err := scanPreferenceRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return revisions, nil
+}
+
+func (s *postgresStore) GetRevision(preferenceID, revision int) (PreferenceRevision, error) {
+	rev, err := scanPreferenceRevision(s.db.QueryRow(`
+        SELECT preference_id, revision, actor, snapshot, diff, created_at
+        FROM preference_revisions
+        WHERE preference_id = $1 AND revision = $2`, preferenceID, revision))
+	if err == sql.ErrNoRows {
+		return rev, fmt.Errorf("No revision %d found for preference %d: %w", revision, preferenceID, errRevisionNotFound)
+	}
+	return rev, err
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	runPreferenceStoreConformance(t, func(t *testing.T) PreferenceStore {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "preferences.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		store, err := newSQLiteStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	runPreferenceStoreConformance(t, func(t *testing.T) PreferenceStore {
+		return newMemoryStore()
+	})
+}
+
+// TestPostgresStoreConformance runs against the server in DATABASE_URL. The
+// database is shared between runs, so every test uses fresh usernames.
+func TestPostgresStoreConformance(t *testing.T) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	runPreferenceStoreConformance(t, func(t *testing.T) PreferenceStore {
+		store, err := openPostgresStore(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+var usernameCounter atomic.Int64
+
+// uniqueUsername returns a username no earlier run has used.
+func uniqueUsername(base string) string {
+	return fmt.Sprintf("%s-%d-%d", base, time.Now().UnixNano(), usernameCounter.Add(1))
+}
+
+// runPreferenceStoreConformance checks the behaviour every PreferenceStore
+// backend must share. newStore returns an empty or shared store; tests only
+// rely on the preferences they create.
+func runPreferenceStoreConformance(t *testing.T, newStore func(t *testing.T) PreferenceStore) {
+	create := func(t *testing.T, s PreferenceStore, pref UserPreference) UserPreference {
+		t.Helper()
+		created, err := s.CreatePreference(pref, "creator")
+		if err != nil {
+			t.Fatalf("CreatePreference: %v", err)
+		}
+		return created
+	}
+
+	t.Run("CreateAndGet", func(t *testing.T) {
+		s := newStore(t)
+		username := uniqueUsername("alice")
+		created := create(t, s, UserPreference{
+			Username:      username,
+			SortOrder:     "name",
+			HiddenDevices: []string{"b", "a", "b"},
+			Icon:          []byte{1, 2, 3},
+		})
+
+		if created.ID == 0 || created.Version != 1 {
+			t.Fatalf("created ID %d version %d, want a non-zero ID and version 1", created.ID, created.Version)
+		}
+		if created.CreatedAt.IsZero() || !created.UpdatedAt.Equal(created.CreatedAt) {
+			t.Errorf("created at %v, updated at %v; want equal non-zero times", created.CreatedAt, created.UpdatedAt)
+		}
+		if want := []string{"a", "b"}; !reflect.DeepEqual(created.HiddenDevices, want) {
+			t.Errorf("hidden devices %v, want %v", created.HiddenDevices, want)
+		}
+
+		for name, get := range map[string]func() (UserPreference, error){
+			"by ID":       func() (UserPreference, error) { return s.GetPreference(created.ID) },
+			"by username": func() (UserPreference, error) { return s.GetPreferenceByUsername(username) },
+		} {
+			got, err := get()
+			if err != nil {
+				t.Fatalf("get %s: %v", name, err)
+			}
+			if got.ID != created.ID || got.Username != username || got.SortOrder != "name" || got.Version != 1 {
+				t.Errorf("get %s = %+v, want %+v", name, got, created)
+			}
+			if !reflect.DeepEqual(got.HiddenDevices, []string{"a", "b"}) || string(got.Icon) != string([]byte{1, 2, 3}) {
+				t.Errorf("get %s: hidden devices %v icon %v", name, got.HiddenDevices, got.Icon)
+			}
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.GetPreference(-1); !errors.Is(err, errPreferenceNotFound) {
+			t.Errorf("GetPreference(-1) error %v, want errPreferenceNotFound", err)
+		}
+		if _, err := s.GetPreferenceByUsername(uniqueUsername("nobody")); !errors.Is(err, errPreferenceNotFound) {
+			t.Errorf("GetPreferenceByUsername error %v, want errPreferenceNotFound", err)
+		}
+		if _, err := s.UpdatePreference(UserPreference{ID: -1}, "x"); !errors.Is(err, errPreferenceNotFound) {
+			t.Errorf("UpdatePreference error %v, want errPreferenceNotFound", err)
+		}
+		if _, err := s.UpdateHiddenDevices(-1, HiddenDevicesChange{Add: []string{"a"}}, 0, "x"); !errors.Is(err, errPreferenceNotFound) {
+			t.Errorf("UpdateHiddenDevices error %v, want errPreferenceNotFound", err)
+		}
+	})
+
+	t.Run("UsernameTaken", func(t *testing.T) {
+		s := newStore(t)
+		username := uniqueUsername("bob")
+		create(t, s, UserPreference{Username: username})
+		if _, err := s.CreatePreference(UserPreference{Username: username}, "x"); !errors.Is(err, errUsernameTaken) {
+			t.Errorf("second CreatePreference error %v, want errUsernameTaken", err)
+		}
+	})
+
+	t.Run("UpdateVersioning", func(t *testing.T) {
+		s := newStore(t)
+		username := uniqueUsername("carol")
+		pref := create(t, s, UserPreference{Username: username})
+
+		// Version 0 updates unconditionally; the username can't change.
+		updated, err := s.UpdatePreference(UserPreference{ID: pref.ID, Username: "mallory", SortOrder: "status", HiddenDevices: []string{"x"}}, "editor")
+		if err != nil {
+			t.Fatalf("UpdatePreference: %v", err)
+		}
+		if updated.Version != 2 || updated.Username != username || updated.SortOrder != "status" {
+			t.Errorf("updated = %+v, want version 2 of %s sorted by status", updated, username)
+		}
+		if !updated.CreatedAt.Equal(pref.CreatedAt) || updated.UpdatedAt.Before(pref.UpdatedAt) {
+			t.Errorf("updated timestamps %v/%v after %v/%v", updated.CreatedAt, updated.UpdatedAt, pref.CreatedAt, pref.UpdatedAt)
+		}
+
+		if _, err := s.UpdatePreference(UserPreference{ID: pref.ID, Version: 1, SortOrder: "stale"}, "editor"); !errors.Is(err, errVersionConflict) {
+			t.Errorf("stale update error %v, want errVersionConflict", err)
+		}
+		updated, err = s.UpdatePreference(UserPreference{ID: pref.ID, Version: 2, SortOrder: "name"}, "editor")
+		if err != nil || updated.Version != 3 {
+			t.Fatalf("conditional update = version %d, %v; want version 3", updated.Version, err)
+		}
+
+		got, err := s.GetPreference(pref.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != 3 || got.SortOrder != "name" || len(got.HiddenDevices) != 0 {
+			t.Errorf("stored %+v, want version 3 sorted by name with nothing hidden", got)
+		}
+	})
+
+	t.Run("UpdateHiddenDevices", func(t *testing.T) {
+		s := newStore(t)
+		pref := create(t, s, UserPreference{Username: uniqueUsername("dave"), SortOrder: "name", HiddenDevices: []string{"a", "b"}})
+
+		steps := []struct {
+			change HiddenDevicesChange
+			want   []string
+		}{
+			{HiddenDevicesChange{Add: []string{"c", "a"}}, []string{"a", "b", "c"}},
+			{HiddenDevicesChange{Remove: []string{"b", "missing"}}, []string{"a", "c"}},
+			{HiddenDevicesChange{ShowAll: true, Add: []string{"z"}}, []string{"z"}},
+			{HiddenDevicesChange{ShowAll: true}, []string{}},
+		}
+		for i, step := range steps {
+			updated, err := s.UpdateHiddenDevices(pref.ID, step.change, 0, "editor")
+			if err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+			if !reflect.DeepEqual(updated.HiddenDevices, step.want) {
+				t.Errorf("step %d: hidden devices %v, want %v", i, updated.HiddenDevices, step.want)
+			}
+			if updated.SortOrder != "name" || updated.Version != i+2 {
+				t.Errorf("step %d: sort order %q version %d", i, updated.SortOrder, updated.Version)
+			}
+		}
+
+		if _, err := s.UpdateHiddenDevices(pref.ID, HiddenDevicesChange{Add: []string{"a"}}, 1, "editor"); !errors.Is(err, errVersionConflict) {
+			t.Errorf("stale change error %v, want errVersionConflict", err)
+		}
+	})
+
+	t.Run("Revisions", func(t *testing.T) {
+		s := newStore(t)
+		pref := create(t, s, UserPreference{Username: uniqueUsername("erin"), SortOrder: "name"})
+		if _, err := s.UpdatePreference(UserPreference{ID: pref.ID, SortOrder: "status"}, "editor"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.UpdateHiddenDevices(pref.ID, HiddenDevicesChange{Add: []string{"a"}}, 0, "hider"); err != nil {
+			t.Fatal(err)
+		}
+
+		revisions, err := s.ListRevisions(pref.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revisions) != 3 {
+			t.Fatalf("%d revisions, want 3", len(revisions))
+		}
+		for i, want := range []struct {
+			revision int
+			actor    string
+		}{{3, "hider"}, {2, "editor"}, {1, "creator"}} {
+			if revisions[i].Revision != want.revision || revisions[i].Actor != want.actor || revisions[i].PreferenceID != pref.ID {
+				t.Errorf("revision %d = %d by %q, want %d by %q", i, revisions[i].Revision, revisions[i].Actor, want.revision, want.actor)
+			}
+		}
+		if diff := revisions[1].Diff; diff.SortOrder == nil || diff.SortOrder.From != "name" || diff.SortOrder.To != "status" {
+			t.Errorf("revision 2 diff %+v, want sort order name -> status", diff)
+		}
+		if diff := revisions[0].Diff; !reflect.DeepEqual(diff.HiddenDevicesAdded, []string{"a"}) || diff.SortOrder != nil {
+			t.Errorf("revision 3 diff %+v, want device a hidden", diff)
+		}
+
+		rev, err := s.GetRevision(pref.ID, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev.Snapshot.SortOrder != "status" || rev.Snapshot.Version != 2 || len(rev.Snapshot.HiddenDevices) != 0 {
+			t.Errorf("revision 2 snapshot %+v", rev.Snapshot)
+		}
+		if _, err := s.GetRevision(pref.ID, 99); !errors.Is(err, errRevisionNotFound) {
+			t.Errorf("GetRevision(99) error %v, want errRevisionNotFound", err)
+		}
+	})
+
+	t.Run("ReturnedValuesAreCopies", func(t *testing.T) {
+		s := newStore(t)
+		pref := create(t, s, UserPreference{Username: uniqueUsername("frank"), HiddenDevices: []string{"a"}})
+		pref.HiddenDevices[0] = "changed"
+
+		got, err := s.GetPreference(pref.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.HiddenDevices, []string{"a"}) {
+			t.Errorf("hidden devices %v after changing a returned preference", got.HiddenDevices)
+		}
+	})
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errTeamNotFound       = errors.New("team not found")
+	errTeamMemberNotFound = errors.New("team member not found")
+)
+
+// Team groups members of an organization that share preferences. Each user
+// is on at most one team.
+type Team struct {
+	ID             int       `json:"id"`
+	OrganizationID int       `json:"organization_id"`
+	Name           string    `json:"name"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type TeamMember struct {
+	TeamID    int       `json:"team_id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type teamStore struct {
+	db *sql.DB
+}
+
+func newTeamStore(db *sql.DB) (*teamStore, error) {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS teams (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            organization_id INTEGER NOT NULL REFERENCES organizations(id),
+            name TEXT NOT NULL,
+            created_at DATETIME NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS team_members (
+            username TEXT PRIMARY KEY,
+            team_id INTEGER NOT NULL REFERENCES teams(id),
+            created_at DATETIME NOT NULL
+        );
+        CREATE INDEX IF NOT EXISTS idx_team_members_team ON team_members(team_id);
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tables: %v", err)
+	}
+	return &teamStore{db: db}, nil
+}
+
+// List returns the teams of an organization, or every team for 0.
+func (s *teamStore) List(organizationID int) ([]Team, error) {
+	query := "SELECT id, organization_id, name, created_at FROM teams"
+	var args []any
+	if organizationID != 0 {
+		query += " WHERE organization_id = ?"
+		args = append(args, organizationID)
+	}
+	rows, err := s.db.Query(query+" ORDER BY name, id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	teams := []Team{}
+	for rows.Next() {
+		t, err := scanTeam(rows)
+		if err != nil {
+			return nil, err
+		}
+		teams = append(teams, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return teams, nil
+}
+
+func (s *teamStore) Get(id int) (Team, error) {
+	t, err := scanTeam(s.db.QueryRow("SELECT id, organization_id, name, created_at FROM teams WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return t, fmt.Errorf("No team found for ID %d: %w", id, errTeamNotFound)
+	}
+	return t, err
+}
+
+func (s *teamStore) Create(t Team) (Team, error) {
+	t.CreatedAt = time.Now().UTC()
+	result, err := s.db.Exec("INSERT INTO teams(organization_id, name, created_at) VALUES (?, ?, ?)",
+		t.OrganizationID, t.Name, t.CreatedAt)
+	if err != nil {
+		return t, fmt.Errorf("Database error: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return t, err
+	}
+	t.ID = int(id)
+	return t, nil
+}
+
+// Delete removes a team and its memberships.
+func (s *teamStore) Delete(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM team_members WHERE team_id = ?", id); err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	result, err := tx.Exec("DELETE FROM teams WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("No team found for ID %d: %w", id, errTeamNotFound)
+	}
+	return tx.Commit()
+}
+
+func (s *teamStore) Members(teamID int) ([]TeamMember, error) {
+	rows, err := s.db.Query(
+		"SELECT team_id, username, created_at FROM team_members WHERE team_id = ? ORDER BY username", teamID)
+	if err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	defer rows.Close()
+
+	members := []TeamMember{}
+	for rows.Next() {
+		var m TeamMember
+		if err := rows.Scan(&m.TeamID, &m.Username, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("Database error: %v", err)
+		}
+		m.CreatedAt = m.CreatedAt.UTC()
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Database error: %v", err)
+	}
+	return members, nil
+}
+
+// TeamOf returns the team username is on.
+func (s *teamStore) TeamOf(username string) (Team, error) {
+	t, err := scanTeam(s.db.QueryRow(`
+        SELECT t.id, t.organization_id, t.name, t.created_at
+        FROM team_members m JOIN teams t ON t.id = m.team_id
+        WHERE m.username = ?`, username))
+	if err == sql.ErrNoRows {
+		return t, fmt.Errorf("%q is not on a team: %w", username, errTeamMemberNotFound)
+	}
+	return t, err
+}
+
+// SetMember puts username on a team, moving them off the team they were
+// on.
+func (s *teamStore) SetMember(teamID int, username string) (TeamMember, error) {
+	m := TeamMember{TeamID: teamID, Username: username, CreatedAt: time.Now().UTC()}
+	_, err := s.db.Exec(`
+        INSERT INTO team_members(username, team_id, created_at) VALUES (?, ?, ?)
+        ON CONFLICT(username) DO UPDATE SET team_id = excluded.team_id, created_at = excluded.created_at`,
+		username, teamID, m.CreatedAt)
+	if err != nil {
+		return m, fmt.Errorf("Database error: %v", err)
+	}
+	return m, nil
+}
+
+func (s *teamStore) RemoveMember(teamID int, username string) error {
+	result, err := s.db.Exec("DELETE FROM team_members WHERE team_id = ? AND username = ?", teamID, username)
+	if err != nil {
+		return fmt.Errorf("Database error: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%q is not on team %d: %w", username, teamID, errTeamMemberNotFound)
+	}
+	return nil
+}
+
+func scanTeam(row interface{ Scan(...any) error }) (Team, error) {
+	var t Team
+	if err := row.Scan(&t.ID, &t.OrganizationID, &t.Name, &t.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return t, err
+		}
+		return t, fmt.Errorf("Database error: %v", err)
+	}
+	t.CreatedAt = t.CreatedAt.UTC()
+	return t, nil
+}
+
+// HandleTeams routes GET/POST /teams, GET/DELETE /teams/{id}, GET
+// /teams/{id}/members, PUT/DELETE /teams/{id}/members/{username} and
+// GET/PUT /teams/{id}/preferences. Members of an organization only see its
+// teams.
+func (deps *HandlerDependencies) HandleTeams(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	organizationID := 0
+	if p := principalFromContext(r.Context()); p != nil {
+		organizationID = p.OrganizationID
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/teams"), "/"), "/")
+	if parts[0] == "" {
+		switch r.Method {
+		case "GET":
+			teams, err := deps.Teams.List(organizationID)
+			if err != nil {
+				http.Error(w, "Failed to fetch teams: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, teams)
+		case "POST":
+			deps.HandleCreateTeam(w, r, organizationID)
+		default:
+			writeMethodNotAllowed(w)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid team ID", http.StatusBadRequest)
+		return
+	}
+	team, err := deps.Teams.Get(id)
+	if err == nil && organizationID != 0 && team.OrganizationID != organizationID {
+		err = fmt.Errorf("No team found for ID %d: %w", id, errTeamNotFound)
+	}
+	if err != nil {
+		writeTeamError(w, err)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		writeJSON(w, team)
+	case len(parts) == 1 && r.Method == "DELETE":
+		if err := deps.Teams.Delete(id); err != nil {
+			writeTeamError(w, err)
+			return
+		}
+		if err := deps.PreferenceLayers.Delete(layerTeam, id); err != nil {
+			http.Error(w, "Failed to delete team preferences: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deps.Audit.Record(r, "team.delete", "team", id, team, nil)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "members" && r.Method == "GET":
+		members, err := deps.Teams.Members(id)
+		if err != nil {
+			writeTeamError(w, err)
+			return
+		}
+		writeJSON(w, members)
+	case len(parts) == 3 && parts[1] == "members":
+		username, err := url.PathUnescape(parts[2])
+		if err != nil || username == "" {
+			http.Error(w, "Invalid username", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			deps.HandleSetTeamMember(w, r, team, username)
+		case "DELETE":
+			if err := deps.Teams.RemoveMember(id, username); err != nil {
+				writeTeamError(w, err)
+				return
+			}
+			deps.Audit.Record(r, "team.member.remove", "team_member", username, TeamMember{TeamID: id, Username: username}, nil)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeMethodNotAllowed(w)
+		}
+	case len(parts) == 2 && parts[1] == "preferences":
+		deps.HandlePreferenceLayer(w, r, layerTeam, id)
+	case len(parts) <= 2:
+		writeMethodNotAllowed(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// HandleCreateTeam creates a team in the caller's organization from
+// {"name"}.
+func (deps *HandlerDependencies) HandleCreateTeam(w http.ResponseWriter, r *http.Request, organizationID int) {
+	if organizationID == 0 {
+		http.Error(w, "Teams belong to an organization; join one first", http.StatusBadRequest)
+		return
+	}
+	var t Team
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Bad request data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		http.Error(w, "Invalid team: name is required", http.StatusBadRequest)
+		return
+	}
+	t.OrganizationID = organizationID
+
+	t, err := deps.Teams.Create(t)
+	if err != nil {
+		http.Error(w, "Failed to create team: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deps.Audit.Record(r, "team.create", "team", t.ID, nil, t)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// HandleSetTeamMember puts a member of the team's organization on the team.
+func (deps *HandlerDependencies) HandleSetTeamMember(w http.ResponseWriter, r *http.Request, team Team, username string) {
+	m, err := deps.Organizations.Membership(username)
+	if err == nil && m.OrganizationID != team.OrganizationID {
+		err = errMemberNotFound
+	}
+	if err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	var before any
+	if current, err := deps.Teams.TeamOf(username); err == nil {
+		before = TeamMember{TeamID: current.ID, Username: username}
+	}
+	member, err := deps.Teams.SetMember(team.ID, username)
+	if err != nil {
+		writeTeamError(w, err)
+		return
+	}
+	deps.Audit.Record(r, "team.member.set", "team_member", username, before, member)
+	writeJSON(w, member)
+}
+
+func writeTeamError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errTeamNotFound):
+		http.Error(w, "Team not found", http.StatusNotFound)
+	case errors.Is(err, errTeamMemberNotFound):
+		http.Error(w, "Team member not found", http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultUpstreamBaseURL = "https://track.onestepgps.com"
+
+var errCircuitOpen = errors.New("OneStepGPS circuit breaker is open")
+
+// errCallTimeout is the cause of a call's context ending at CallTimeout, to
+// tell an upstream too slow to answer from a caller that went away.
+var errCallTimeout = fmt.Errorf("OneStepGPS call timed out: %w", context.DeadlineExceeded)
+
+// upstreamStatusError is returned when OneStepGPS answers with a non-200
+// status after all retries.
+type upstreamStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("received non-200 response code: %d", e.StatusCode)
+}
+
+// UpstreamConfig tunes how the backend talks to OneStepGPS.
+type UpstreamConfig struct {
+	BaseURL string
+
+	// KeyTransport is "header" to send the API key as a bearer token, which
+	// keeps it out of URLs seen by proxies, or "query" to send it as the
+	// api-key query parameter for upstreams that only accept that.
+	KeyTransport string
+
+	// CallTimeout bounds a whole call including retries; AttemptTimeout
+	// bounds a single HTTP round trip.
+	CallTimeout    time.Duration
+	AttemptTimeout time.Duration
+
+	// MaxRetries is the number of extra attempts made for idempotent
+	// requests, backing off exponentially from BaseBackoff up to MaxBackoff
+	// with full jitter.
+	MaxRetries  int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// The circuit opens after BreakerThreshold consecutive failed attempts
+	// and lets a single probe through once BreakerCooldown has elapsed.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Transport replaces http.DefaultTransport, e.g. to record or replay
+	// upstream traffic.
+	Transport http.RoundTripper
+}
+
+func defaultUpstreamConfig() UpstreamConfig {
+	return UpstreamConfig{
+		BaseURL:          defaultUpstreamBaseURL,
+		KeyTransport:     "header",
+		CallTimeout:      15 * time.Second,
+		AttemptTimeout:   5 * time.Second,
+		MaxRetries:       3,
+		BaseBackoff:      200 * time.Millisecond,
+		MaxBackoff:       5 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+// upstreamConfigFromEnv overrides the defaults with ONESTEPGPS_BASE_URL,
+// ONESTEPGPS_API_KEY_TRANSPORT, ONESTEPGPS_TIMEOUT, ONESTEPGPS_ATTEMPT_TIMEOUT, ONESTEPGPS_MAX_RETRIES and
+// ONESTEPGPS_BREAKER_THRESHOLD / ONESTEPGPS_BREAKER_COOLDOWN.
+func upstreamConfigFromEnv() (UpstreamConfig, error) {
+	cfg := defaultUpstreamConfig()
+
+	if v := os.Getenv("ONESTEPGPS_BASE_URL"); v != "" {
+		cfg.BaseURL = v
+	}
+	switch v := os.Getenv("ONESTEPGPS_API_KEY_TRANSPORT"); v {
+	case "":
+	case "query", "header":
+		cfg.KeyTransport = v
+	default:
+		return cfg, fmt.Errorf("Invalid ONESTEPGPS_API_KEY_TRANSPORT: %q", v)
+	}
+	durations := map[string]*time.Duration{
+		"ONESTEPGPS_TIMEOUT":          &cfg.CallTimeout,
+		"ONESTEPGPS_ATTEMPT_TIMEOUT":  &cfg.AttemptTimeout,
+		"ONESTEPGPS_BREAKER_COOLDOWN": &cfg.BreakerCooldown,
+	}
+	for name, target := range durations {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return cfg, fmt.Errorf("Invalid %s: %v", name, err)
+			}
+			*target = d
+		}
+	}
+	ints := map[string]*int{
+		"ONESTEPGPS_MAX_RETRIES":       &cfg.MaxRetries,
+		"ONESTEPGPS_BREAKER_THRESHOLD": &cfg.BreakerThreshold,
+	}
+	for name, target := range ints {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return cfg, fmt.Errorf("Invalid %s: %q", name, v)
+			}
+			*target = n
+		}
+	}
+	return cfg, nil
+}
+
+// UpstreamClient calls the OneStepGPS public API with deadlines, retries and
+// a circuit breaker so a slow or failing upstream degrades gracefully.
+type UpstreamClient struct {
+	keys       *apiKeySource
+	cfg        UpstreamConfig
+	httpClient *http.Client
+	breaker    *circuitBreaker
+
+	// privacy masks the positions returned by the device detail, point and
+	// trip calls. FetchData is left unmasked, as the source the device
+	// list pipeline records and masks.
+	privacy *privacyZones
+}
+
+func newUpstreamClient(keys *apiKeySource, cfg UpstreamConfig) *UpstreamClient {
+	return &UpstreamClient{
+		keys:       keys,
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: cfg.AttemptTimeout, Transport: cfg.Transport},
+		breaker:    newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+	}
+}
+
+// getJSON performs an idempotent GET of path and decodes the JSON body into
+// out, retrying transient failures.
+func (c *UpstreamClient) getJSON(ctx context.Context, path string, query url.Values, out any) error {
+	if c.cfg.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, c.cfg.CallTimeout, errCallTimeout)
+		defer cancel()
+	}
+
+	target := c.cfg.BaseURL + path
+
+	var lastErr error
+	for attempt := 0; attempt <= c.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			wait := c.backoff(attempt)
+			var statusErr *upstreamStatusError
+			if errors.As(lastErr, &statusErr) && statusErr.RetryAfter > 0 {
+				wait = statusErr.RetryAfter
+			}
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+				return lastErr
+			}
+			select {
+			case <-ctx.Done():
+				return lastErr
+			case <-time.After(wait):
+			}
+		}
+
+		body, err := c.attempt(ctx, target, query)
+		if err == nil {
+			if err := json.Unmarshal(body, out); err != nil {
+				return fmt.Errorf("error unmarshalling json: %v", err)
+			}
+			return nil
+		}
+		lastErr = err
+		if !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return lastErr
+}
+
+// attempt makes a single request. The API key is looked up per attempt so a
+// rotated key takes effect immediately, and is scrubbed from any error.
+func (c *UpstreamClient) attempt(ctx context.Context, target string, query url.Values) ([]byte, error) {
+	apiKey, err := c.keys.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	for k, v := range query {
+		params[k] = v
+	}
+	if c.cfg.KeyTransport == "query" {
+		params.Set("api-key", apiKey)
+	}
+	if encoded := params.Encode(); encoded != "" {
+		target += "?" + encoded
+	}
+
+	record, err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	// A call its caller abandoned says nothing about the upstream, so it
+	// gives its slot back without counting as a success or failure.
+	done := func(success bool) {
+		if ctx.Err() != nil && context.Cause(ctx) != errCallTimeout {
+			c.breaker.release()
+			return
+		}
+		record(success)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		done(false)
+		return nil, c.keys.redactError(fmt.Errorf("error creating http request: %w", err))
+	}
+	if c.cfg.KeyTransport == "header" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		done(false)
+		return nil, c.keys.redactError(fmt.Errorf("error making http request: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		// Server errors and throttling both count against the breaker, so
+		// a rate-limited upstream gets a cooldown instead of more traffic.
+		done(resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests)
+		return nil, &upstreamStatusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		done(false)
+		return nil, c.keys.redactError(fmt.Errorf("error reading response body: %w", err))
+	}
+	done(true)
+	return body, nil
+}
+
+// backoff returns the full-jitter delay before the given retry attempt.
+func (c *UpstreamClient) backoff(attempt int) time.Duration {
+	ceiling := c.cfg.BaseBackoff << (attempt - 1)
+	if ceiling <= 0 || ceiling > c.cfg.MaxBackoff {
+		ceiling = c.cfg.MaxBackoff
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// retryable reports whether a failed attempt may succeed if repeated.
+func retryable(err error) bool {
+	if errors.Is(err, errCircuitOpen) {
+		return false
+	}
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+// parseRetryAfter understands both forms of the Retry-After header.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops calls to a failing upstream for a cooldown period and
+// then lets a single probe through to decide whether to close again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may proceed. On success the caller must
+// report the outcome through the returned function.
+func (b *circuitBreaker) allow() (func(success bool), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 {
+		return func(bool) {}, nil
+	}
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return nil, errCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.probing = false
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return nil, errCircuitOpen
+		}
+		b.probing = true
+	}
+	return b.record, nil
+}
+
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.state = breakerClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+// release gives back the slot of a call whose outcome isn't recorded, so
+// that a half-open breaker admits another probe.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// retryAfter is how long until the breaker will admit a probe.
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen {
+		return 0
+	}
+	return b.cooldown - time.Since(b.openedAt)
+}
+
+// writeUpstreamError maps a failed OneStepGPS call to a response for our own
+// client: an open circuit or upstream outage is a 503, a timeout a 504.
+func (c *UpstreamClient) writeUpstreamError(w http.ResponseWriter, err error) {
+	log.Printf("OneStepGPS request failed: %v", err)
+
+	var statusErr *upstreamStatusError
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		if wait := c.breaker.retryAfter(); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		}
+		http.Error(w, "Device data is temporarily unavailable", http.StatusServiceUnavailable)
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		http.Error(w, "Timed out fetching device data", http.StatusGatewayTimeout)
+	case errors.Is(err, errTooManyPages):
+		http.Error(w, "Too much device data; narrow the time range", http.StatusBadGateway)
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound:
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests:
+		if statusErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(statusErr.RetryAfter.Seconds())+1))
+		}
+		http.Error(w, "Device data is temporarily unavailable", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Failed to fetch data", http.StatusBadGateway)
+	}
+}
+
+func isTimeout(err error) bool {
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstreamServer answers each request with the next handler in turn,
+// repeating the last one, and records when each request arrived.
+type upstreamServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	handlers []http.HandlerFunc
+	hits     []time.Time
+}
+
+func newUpstreamServer(t *testing.T, handlers ...http.HandlerFunc) *upstreamServer {
+	s := &upstreamServer{handlers: handlers}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		i := len(s.hits)
+		if i >= len(s.handlers) {
+			i = len(s.handlers) - 1
+		}
+		s.hits = append(s.hits, time.Now())
+		handler := s.handlers[i]
+		s.mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *upstreamServer) Hits() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.hits...)
+}
+
+func respondStatus(code int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(code) }
+}
+
+func respondJSON(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(body)) }
+}
+
+func testUpstreamClient(baseURL string, tune func(*UpstreamConfig)) *UpstreamClient {
+	cfg := defaultUpstreamConfig()
+	cfg.BaseURL = baseURL
+	cfg.BaseBackoff = time.Millisecond
+	cfg.MaxBackoff = 5 * time.Millisecond
+	cfg.BreakerThreshold = 0
+	if tune != nil {
+		tune(&cfg)
+	}
+	return newUpstreamClient(&apiKeySource{key: "secret-key"}, cfg)
+}
+
+func TestUpstreamRetriesServerErrors(t *testing.T) {
+	server := newUpstreamServer(t,
+		respondStatus(http.StatusInternalServerError),
+		respondStatus(http.StatusBadGateway),
+		respondJSON(`{"ok":true}`),
+	)
+	client := testUpstreamClient(server.URL, nil)
+
+	var out struct{ OK bool }
+	if err := client.getJSON(context.Background(), "/v1", nil, &out); err != nil {
+		t.Fatalf("getJSON: %v", err)
+	}
+	if !out.OK || len(server.Hits()) != 3 {
+		t.Errorf("got %+v after %d attempts, want ok after 3", out, len(server.Hits()))
+	}
+}
+
+func TestUpstreamGivesUpAfterMaxRetries(t *testing.T) {
+	server := newUpstreamServer(t, respondStatus(http.StatusServiceUnavailable))
+	client := testUpstreamClient(server.URL, func(cfg *UpstreamConfig) { cfg.MaxRetries = 2 })
+
+	err := client.getJSON(context.Background(), "/v1", nil, &struct{}{})
+	var statusErr *upstreamStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("error %v, want a 503 status error", err)
+	}
+	if n := len(server.Hits()); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+}
+
+func TestUpstreamDoesNotRetryClientErrors(t *testing.T) {
+	server := newUpstreamServer(t, respondStatus(http.StatusNotFound))
+	client := testUpstreamClient(server.URL, nil)
+
+	err := client.getJSON(context.Background(), "/v1", nil, &struct{}{})
+	var statusErr *upstreamStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("error %v, want a 404 status error", err)
+	}
+	if n := len(server.Hits()); n != 1 {
+		t.Errorf("%d attempts, want 1", n)
+	}
+}
+
+func TestUpstreamHonoursRetryAfter(t *testing.T) {
+	server := newUpstreamServer(t,
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		},
+		respondJSON(`{}`),
+	)
+	client := testUpstreamClient(server.URL, nil)
+
+	if err := client.getJSON(context.Background(), "/v1", nil, &struct{}{}); err != nil {
+		t.Fatalf("getJSON: %v", err)
+	}
+	hits := server.Hits()
+	if len(hits) != 2 {
+		t.Fatalf("%d attempts, want 2", len(hits))
+	}
+	if wait := hits[1].Sub(hits[0]); wait < 900*time.Millisecond {
+		t.Errorf("retried after %v, want the 1s Retry-After", wait)
+	}
+}
+
+func TestUpstreamRetryAfterBeyondDeadline(t *testing.T) {
+	server := newUpstreamServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	client := testUpstreamClient(server.URL, func(cfg *UpstreamConfig) { cfg.CallTimeout = time.Second })
+
+	start := time.Now()
+	err := client.getJSON(context.Background(), "/v1", nil, &struct{}{})
+	var statusErr *upstreamStatusError
+	if !errors.As(err, &statusErr) || statusErr.RetryAfter != time.Minute {
+		t.Fatalf("error %v, want the 429 with its Retry-After", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("waited %v for a retry that could not fit the deadline", elapsed)
+	}
+}
+
+func TestUpstreamCallDeadline(t *testing.T) {
+	server := newUpstreamServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	client := testUpstreamClient(server.URL, func(cfg *UpstreamConfig) {
+		cfg.AttemptTimeout = 50 * time.Millisecond
+		cfg.CallTimeout = 200 * time.Millisecond
+		cfg.MaxRetries = 100
+	})
+
+	start := time.Now()
+	err := client.getJSON(context.Background(), "/v1", nil, &struct{}{})
+	if !errors.Is(err, context.DeadlineExceeded) && !isTimeout(err) {
+		t.Fatalf("error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("call took %v, want it bounded by the 200ms call timeout", elapsed)
+	}
+	if n := len(server.Hits()); n < 2 {
+		t.Errorf("%d attempts, want timed-out attempts to be retried", n)
+	}
+
+	w := httptest.NewRecorder()
+	client.writeUpstreamError(w, err)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("mapped to %d, want 504", w.Code)
+	}
+}
+
+func TestUpstreamCircuitBreaker(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusInternalServerError
+	server := newUpstreamServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(`{}`))
+	})
+	setStatus := func(code int) {
+		mu.Lock()
+		defer mu.Unlock()
+		status = code
+	}
+	client := testUpstreamClient(server.URL, func(cfg *UpstreamConfig) {
+		cfg.MaxRetries = 0
+		cfg.BreakerThreshold = 2
+		cfg.BreakerCooldown = 50 * time.Millisecond
+	})
+	call := func() error {
+		return client.getJSON(context.Background(), "/v1", nil, &struct{}{})
+	}
+
+	// Two consecutive failures open the circuit.
+	for i := 0; i < 2; i++ {
+		if err := call(); err == nil || errors.Is(err, errCircuitOpen) {
+			t.Fatalf("call %d error %v, want the upstream failure", i, err)
+		}
+	}
+	if err := call(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("error %v, want an open circuit", err)
+	}
+	if n := len(server.Hits()); n != 2 {
+		t.Errorf("%d requests reached upstream, want 2", n)
+	}
+	w := httptest.NewRecorder()
+	client.writeUpstreamError(w, errCircuitOpen)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("open circuit mapped to %d with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// After the cooldown a failed probe reopens it straight away.
+	time.Sleep(60 * time.Millisecond)
+	if err := call(); err == nil || errors.Is(err, errCircuitOpen) {
+		t.Fatalf("probe error %v, want the upstream failure", err)
+	}
+	if err := call(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("error %v after a failed probe, want an open circuit", err)
+	}
+
+	// A successful probe closes it.
+	setStatus(http.StatusOK)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := call(); err != nil {
+			t.Fatalf("call %d after recovery: %v", i, err)
+		}
+	}
+	if n := len(server.Hits()); n != 6 {
+		t.Errorf("%d requests reached upstream, want 6", n)
+	}
+}
+
+func TestUpstreamThrottlingOpensBreaker(t *testing.T) {
+	server := newUpstreamServer(t, respondStatus(http.StatusTooManyRequests))
+	client := testUpstreamClient(server.URL, func(cfg *UpstreamConfig) {
+		cfg.MaxRetries = 0
+		cfg.BreakerThreshold = 2
+		cfg.BreakerCooldown = time.Minute
+	})
+
+	for i := 0; i < 2; i++ {
+		client.getJSON(context.Background(), "/v1", nil, &struct{}{})
+	}
+	if err := client.getJSON(context.Background(), "/v1", nil, &struct{}{}); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("error %v after repeated 429s, want an open circuit", err)
+	}
+}
+
+func TestHalfOpenBreakerAdmitsOneProbe(t *testing.T) {
+	b := newCircuitBreaker(1, time.Millisecond)
+	done, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done(false)
+	time.Sleep(5 * time.Millisecond)
+
+	probe, err := b.allow()
+	if err != nil {
+		t.Fatalf("probe refused: %v", err)
+	}
+	if _, err := b.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("second call while probing: %v, want an open circuit", err)
+	}
+	probe(true)
+	if _, err := b.allow(); err != nil {
+		t.Errorf("call after a successful probe: %v", err)
+	}
+}
+
+func TestCancelledCallsDoNotCountAgainstBreaker(t *testing.T) {
+	hang := func(w http.ResponseWriter, r *http.Request) { <-r.Context().Done() }
+	server := newUpstreamServer(t, hang, hang, respondStatus(http.StatusInternalServerError), hang, respondJSON(`{}`))
+	client := testUpstreamClient(server.URL, func(cfg *UpstreamConfig) {
+		cfg.MaxRetries = 0
+		cfg.BreakerThreshold = 1
+		cfg.BreakerCooldown = 20 * time.Millisecond
+	})
+	cancelled := func() error {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		return client.getJSON(ctx, "/v1", nil, &struct{}{})
+	}
+
+	// Callers that go away leave the breaker closed.
+	for i := 0; i < 2; i++ {
+		if err := cancelled(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("call %d error %v, want it cancelled", i, err)
+		}
+	}
+	if err := client.getJSON(context.Background(), "/v1", nil, &struct{}{}); err == nil || errors.Is(err, errCircuitOpen) {
+		t.Fatalf("error %v after cancelled calls, want the upstream failure", err)
+	}
+
+	// A cancelled probe hands the half-open breaker to the next call.
+	time.Sleep(30 * time.Millisecond)
+	if err := cancelled(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("probe error %v, want it cancelled", err)
+	}
+	if err := client.getJSON(context.Background(), "/v1", nil, &struct{}{}); err != nil {
+		t.Fatalf("call after a cancelled probe: %v", err)
+	}
+	if n := len(server.Hits()); n != 5 {
+		t.Errorf("%d requests reached upstream, want 5", n)
+	}
+}
+
+func TestCallTimeoutsCountAgainstBreaker(t *testing.T) {
+	server := newUpstreamServer(t, func(w http.ResponseWriter, r *http.Request) { <-r.Context().Done() })
+	client := testUpstreamClient(server.URL, func(cfg *UpstreamConfig) {
+		cfg.MaxRetries = 0
+		cfg.CallTimeout = 20 * time.Millisecond
+		cfg.BreakerThreshold = 1
+		cfg.BreakerCooldown = time.Minute
+	})
+	if err := client.getJSON(context.Background(), "/v1", nil, &struct{}{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v, want a timeout", err)
+	}
+	if err := client.getJSON(context.Background(), "/v1", nil, &struct{}{}); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("error %v after a timed-out call, want an open circuit", err)
+	}
+}
+
+func TestPaginationStopsAtPageLimit(t *testing.T) {
+	server := newUpstreamServer(t, respondJSON(`{"result_list": [{}], "next_cursor": "more"}`))
+	client := testUpstreamClient(server.URL, nil)
+
+	drivers, err := client.FetchDrivers(context.Background())
+	if !errors.Is(err, errTooManyPages) {
+		t.Fatalf("got %d drivers and error %v, want errTooManyPages", len(drivers), err)
+	}
+	if n := len(server.Hits()); n != maxUpstreamPages {
+		t.Errorf("%d pages requested, want %d", n, maxUpstreamPages)
+	}
+	w := httptest.NewRecorder()
+	client.writeUpstreamError(w, err)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("mapped to %d, want 502", w.Code)
+	}
+}
+
+func TestUpstreamSendsKeyInHeaderByDefault(t *testing.T) {
+	var gotAuth, gotQuery string
+	server := newUpstreamServer(t, func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotQuery = r.URL.RawQuery
+		w.Write([]byte(`{}`))
+	})
+	client := testUpstreamClient(server.URL, nil)
+
+	if err := client.getJSON(context.Background(), "/v1", url.Values{"lat_lng": {"1"}}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if gotAuth != "Bearer secret-key" || gotQuery != "lat_lng=1" {
+		t.Errorf("Authorization %q query %q, want the key in the header only", gotAuth, gotQuery)
+	}
+}